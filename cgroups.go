@@ -2,6 +2,7 @@ package cgroups
 
 import (
 	"errors"
+	"fmt"
 )
 
 var (
@@ -21,8 +22,42 @@ var (
 	// manage devices.
 	DevicesSetV1 func(path string, r *Resources) error
 	DevicesSetV2 func(path string, r *Resources) error
+
+	// DevicesUnlinkV2 is a function to look up the BPF link of the cgroup
+	// v2 device filter (see [Resources.DevicesLink]) while the cgroup is
+	// still there, which returns the function to remove it (once the
+	// cgroup has no processes, or is removed). Like DevicesSetV2, it is nil
+	// unless the devices package is imported.
+	DevicesUnlinkV2 func(path string, r *Resources) (func() error, error)
 )
 
+// SetError is returned by [Manager.Set] when one of the steps of applying
+// the resources fails. Before returning it, the manager tries to roll back
+// the changes made by the preceding steps (and the failed step itself).
+type SetError struct {
+	// Step is the name of the step that failed, usually a controller name.
+	Step string
+	// Err is the error returned by the failed step.
+	Err error
+	// RollbackErr is the error from restoring the previous values,
+	// or nil if the rollback succeeded.
+	RollbackErr error
+}
+
+func (e *SetError) Error() string {
+	if e.RollbackErr != nil {
+		return fmt.Sprintf("unable to set %s: %v (rollback failed: %v)", e.Step, e.Err, e.RollbackErr)
+	}
+	return fmt.Sprintf("unable to set %s: %v (rolled back)", e.Step, e.Err)
+}
+
+func (e *SetError) Unwrap() error { return e.Err }
+
+// RolledBack reports whether the previous values were successfully restored.
+func (e *SetError) RolledBack() bool {
+	return e.RollbackErr == nil
+}
+
 type Manager interface {
 	// Apply creates a cgroup, if not yet created, and adds a process
 	// with the specified pid into that cgroup.  A special value of -1
@@ -60,6 +95,9 @@ type Manager interface {
 	// Set sets cgroup resources parameters/limits. If the argument is nil,
 	// the resources specified during Manager creation (or the previous call
 	// to Set) are used.
+	//
+	// If any of the parameters can not be set, the ones already changed
+	// are reverted to their previous values, and a [*SetError] is returned.
 	Set(r *Resources) error
 
 	// GetPaths returns cgroup path(s) to save in a state file in order to
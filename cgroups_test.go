@@ -1,6 +1,7 @@
 package cgroups
 
 import (
+	"reflect"
 	"testing"
 )
 
@@ -19,3 +20,46 @@ func TestParseCgroups(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestResourcesClone(t *testing.T) {
+	limit := int64(10)
+	handles := uint32(5)
+	r := &Resources{
+		PidsLimit:                  &limit,
+		BlkioWeightDevice:          []*WeightDevice{NewWeightDevice(8, 0, 100, 0)},
+		Rdma:                       map[string]LinuxRdma{"mlx5_0": {HcaHandles: &handles}},
+		Unified:                    map[string]string{"memory.high": "max"},
+		HugetlbLimit:               []*HugepageLimit{{Pagesize: "2MB", Limit: 1}},
+		MemoryReservation:          1024,
+		NetPrioIfpriomap:           []*IfPrioMap{{Interface: "eth0", Priority: 1}},
+		BlkioThrottleReadBpsDevice: []*ThrottleDevice{NewThrottleDevice(8, 0, 1)},
+		IP:                         &IPPolicy{Accounting: true, AddressDeny: []string{"any"}},
+		ManagedOOM:                 &ManagedOOM{Swap: ManagedOOMKill},
+	}
+	c := r.Clone()
+	if !reflect.DeepEqual(r, c) {
+		t.Fatalf("clone differs: %+v vs %+v", r, c)
+	}
+
+	// Modify the clone; the original must not change.
+	*c.PidsLimit = 20
+	c.BlkioWeightDevice[0].Weight = 200
+	*c.Rdma["mlx5_0"].HcaHandles = 6
+	c.Unified["memory.high"] = "100"
+	c.HugetlbLimit[0].Limit = 2
+	c.NetPrioIfpriomap[0].Priority = 2
+	c.BlkioThrottleReadBpsDevice[0].Rate = 2
+	c.IP.AddressDeny[0] = "localhost"
+	c.ManagedOOM.Swap = ManagedOOMAuto
+	if *r.PidsLimit != 10 || r.BlkioWeightDevice[0].Weight != 100 ||
+		*r.Rdma["mlx5_0"].HcaHandles != 5 || r.Unified["memory.high"] != "max" ||
+		r.HugetlbLimit[0].Limit != 1 || r.NetPrioIfpriomap[0].Priority != 1 ||
+		r.BlkioThrottleReadBpsDevice[0].Rate != 1 || r.IP.AddressDeny[0] != "any" ||
+		r.ManagedOOM.Swap != ManagedOOMKill {
+		t.Fatalf("original modified via clone: %+v", r)
+	}
+
+	if (*Resources)(nil).Clone() != nil {
+		t.Fatal("expected nil clone of nil")
+	}
+}
@@ -1,6 +1,9 @@
 package cgroups
 
 import (
+	"maps"
+	"slices"
+
 	systemdDbus "github.com/coreos/go-systemd/v22/dbus"
 	devices "github.com/opencontainers/cgroups/devices/config"
 )
@@ -28,6 +31,13 @@ type Cgroup struct {
 	// ScopePrefix describes prefix for the scope name.
 	ScopePrefix string `json:"scope_prefix,omitzero"`
 
+	// UnitName, if set, is the full name of the systemd unit, such as
+	// "foo.scope" or "foo-bar.slice", used instead of the one made of
+	// ScopePrefix and Name. Its suffix chooses the unit type, which is
+	// either a scope or a slice. Ignored unless systemd is used for
+	// managing cgroups.
+	UnitName string `json:"unit_name,omitzero"`
+
 	// Resources contains various cgroups settings to apply.
 	*Resources
 
@@ -39,6 +49,26 @@ type Cgroup struct {
 	// Ignored unless systemd is used for managing cgroups.
 	SystemdProps []systemdDbus.Property `json:"-"`
 
+	// DelegateSubgroup, if set, is the name of the sub-cgroup of the
+	// systemd unit the processes are put in, so that the unit cgroup
+	// itself can be managed by them (see DelegateSubgroup= in
+	// systemd.resource-control(5)). Only supported by the systemd
+	// cgroup v2 manager, for scopes.
+	DelegateSubgroup string `json:"delegate_subgroup,omitzero"`
+
+	// DelegateControllers, if set, are the controllers delegated to
+	// the systemd unit, rather than all of them (see Delegate= in
+	// systemd.resource-control(5)). Only supported by the systemd
+	// managers, for scopes.
+	DelegateControllers []string `json:"delegate_controllers,omitzero"`
+
+	// ParentManagedOOM, if set, are the systemd-oomd settings of the
+	// parent slice of the systemd unit (Parent, or the default slice; for
+	// a slice, the one implied by its name), which are set when the unit
+	// is started. As the parent slice may be shared, they affect its other
+	// units as well. Only supported by the systemd managers.
+	ParentManagedOOM *ManagedOOM `json:"parent_managed_oom,omitzero"`
+
 	// Rootless tells if rootless cgroups should be used.
 	Rootless bool `json:"Rootless,omitzero"`
 
@@ -54,6 +84,14 @@ type Resources struct {
 	// Devices is the set of access rules for devices in the container.
 	Devices []*devices.Rule `json:"devices,omitzero"`
 
+	// DevicesAudit, if set, enables the auditing of the device accesses
+	// denied by Devices (cgroup v2 only).
+	DevicesAudit *devices.Audit `json:"devices_audit,omitzero"`
+
+	// DevicesLink, if set, makes the device filter attached via a BPF
+	// link (cgroup v2 only).
+	DevicesLink *devices.Link `json:"devices_link,omitzero"`
+
 	// Memory limit (in bytes).
 	Memory int64 `json:"memory,omitzero"`
 
@@ -127,19 +165,64 @@ type Resources struct {
 	MemorySwappiness *uint64 `json:"memory_swappiness,omitzero"`
 
 	// Set priority of network traffic for container.
+	// On cgroup v2, it is set by an eBPF program for the egress packets,
+	// and the interfaces are looked up in the network namespace of the
+	// processes in the cgroup (so, until there are some, it is ignored
+	// with a warning). If the program can't be attached for lack of
+	// privileges, or when rootless, both it and NetClsClassid are ignored
+	// with a warning.
 	NetPrioIfpriomap []*IfPrioMap `json:"net_prio_ifpriomap,omitzero"`
 
 	// Set class identifier for container's network packets.
+	// On cgroup v2, it is set as the priority of the egress packets
+	// (see NetPrioIfpriomap), which classful qdiscs use as the class.
 	NetClsClassid uint32 `json:"net_cls_classid_u,omitzero"`
 
 	// Rdma resource restriction configuration.
 	Rdma map[string]LinuxRdma `json:"rdma,omitzero"`
 
+	// PerfEvents enables counting the software perf events of the cgroup
+	// (see [PerfEventStats]).
+	//
+	// The counters are perf event fds held in the memory of the process
+	// which called Set, rather than any state of the cgroup: the counts
+	// are only available to the managers of that process, and counting
+	// stops (and the counts are lost) when it exits. So it is only useful
+	// for a long-running process which both sets the resources and reads
+	// the statistics; if Set is called by a short-lived process (such as
+	// a runtime CLI), nothing is counted past its exit.
+	//
+	// Each cgroup takes 5 fds per online CPU, up to a limit (see
+	// [github.com/opencontainers/cgroups/fscommon.MaxPerfEventFds]), and
+	// the CPUs brought online after Set are not counted.
+	PerfEvents bool `json:"perf_events,omitzero"`
+
 	// Used on cgroups v2:
 
 	// CpuWeight sets a proportional bandwidth limit.
 	CpuWeight uint64 `json:"cpu_weight,omitzero"`
 
+	// Maximum number of descendant cgroups (cgroup.max.descendants);
+	// set < `0' to disable limit. `nil` means "keep current limit".
+	MaxDescendants *int64 `json:"max_descendants,omitzero"`
+
+	// Maximum depth of the descendant cgroups tree (cgroup.max.depth);
+	// set < `0' to disable limit. `nil` means "keep current limit".
+	MaxDepth *int64 `json:"max_depth,omitzero"`
+
+	// IP is the IP traffic accounting and access control policy, which
+	// is only supported by the systemd cgroup managers.
+	IP *IPPolicy `json:"ip,omitzero"`
+
+	// ManagedOOM are the systemd-oomd settings of the cgroup, which are
+	// only supported by the systemd cgroup managers.
+	ManagedOOM *ManagedOOM `json:"managed_oom,omitzero"`
+
+	// NetworkAccounting enables the accounting of the network traffic of
+	// the cgroup, by the eBPF programs attached to it (see [Stats.NetworkStats]).
+	// Only supported by the cgroup v2 managers.
+	NetworkAccounting bool `json:"network_accounting,omitzero"`
+
 	// Unified is cgroupv2-only key-value map.
 	Unified map[string]string `json:"unified,omitzero"`
 
@@ -166,4 +249,147 @@ type Resources struct {
 	// if the new memory limits (Memory and MemorySwap) being set are lower
 	// than the current memory usage, and reject if so.
 	MemoryCheckBeforeUpdate bool `json:"memory_check_before_update,omitzero"`
+
+	// SkipUnchanged is a flag for cgroup managers to only apply the
+	// settings which differ from the ones applied by the previous
+	// successful call to Set on the same manager, skipping unchanged
+	// controllers, systemd unit properties, and device rules. It is
+	// useful when Set is called periodically with mostly identical
+	// resources.
+	//
+	// Note the live cgroup values are not consulted, so the settings
+	// changed behind the manager's back are not re-applied.
+	SkipUnchanged bool `json:"-"`
+}
+
+// IPPolicy configures the IP traffic accounting and access control for
+// a cgroup, which is implemented by systemd using eBPF programs (see
+// systemd.resource-control(5)). The lists replace the ones set before.
+type IPPolicy struct {
+	// Accounting enables the IP traffic accounting (IPAccounting),
+	// which makes the IP statistics available (see [IPStats], which are
+	// only collected if the [IP] controller is asked for).
+	Accounting bool `json:"accounting,omitzero"`
+
+	// AddressAllow and AddressDeny are the lists of IP addresses or
+	// prefixes (such as "10.0.0.0/8" or "::1") which the traffic is
+	// allowed to or denied from (IPAddressAllow and IPAddressDeny).
+	// The symbolic names "any", "localhost", "link-local" and
+	// "multicast" are also accepted.
+	AddressAllow []string `json:"address_allow,omitzero"`
+	AddressDeny  []string `json:"address_deny,omitzero"`
+
+	// IngressFilterPath and EgressFilterPath are the paths of pinned
+	// BPF_PROG_TYPE_CGROUP_SKB programs filtering the incoming and the
+	// outgoing traffic (IPIngressFilterPath and IPEgressFilterPath).
+	IngressFilterPath []string `json:"ingress_filter_path,omitzero"`
+	EgressFilterPath  []string `json:"egress_filter_path,omitzero"`
+}
+
+// ManagedOOMMode is the action systemd-oomd takes on a cgroup exceeding its
+// limits.
+type ManagedOOMMode string
+
+const (
+	// ManagedOOMAuto means systemd-oomd does not take action (unless
+	// configured to on a parent cgroup).
+	ManagedOOMAuto ManagedOOMMode = "auto"
+	// ManagedOOMKill means systemd-oomd kills the descendant cgroup
+	// with the most memory reclaim or swap usage.
+	ManagedOOMKill ManagedOOMMode = "kill"
+)
+
+// ManagedOOMPreference is how systemd-oomd considers a cgroup when choosing
+// the one to kill.
+type ManagedOOMPreference string
+
+const (
+	ManagedOOMPreferenceNone  ManagedOOMPreference = "none"
+	ManagedOOMPreferenceAvoid ManagedOOMPreference = "avoid"
+	ManagedOOMPreferenceOmit  ManagedOOMPreference = "omit"
+)
+
+// ManagedOOM configures the killing of cgroups by systemd-oomd, based on
+// the memory pressure and swap usage (see ManagedOOMSwap and the related
+// settings in systemd.resource-control(5)). The zero values are not set.
+type ManagedOOM struct {
+	// Swap is the action taken when the swap usage is above the
+	// systemd-oomd limit (ManagedOOMSwap).
+	Swap ManagedOOMMode `json:"swap,omitzero"`
+
+	// MemoryPressure is the action taken when the memory pressure is
+	// above MemoryPressureLimit (ManagedOOMMemoryPressure).
+	MemoryPressure ManagedOOMMode `json:"memory_pressure,omitzero"`
+
+	// MemoryPressureLimit is the memory pressure limit, as a fraction
+	// in the [0, 1] range, with a precision of 0.0001
+	// (ManagedOOMMemoryPressureLimit). 0 means the systemd-oomd default.
+	MemoryPressureLimit float64 `json:"memory_pressure_limit,omitzero"`
+
+	// Preference is how the cgroup is considered when choosing the one
+	// to kill (ManagedOOMPreference).
+	Preference ManagedOOMPreference `json:"preference,omitzero"`
+}
+
+// Clone returns a deep copy of r.
+func (r *Resources) Clone() *Resources {
+	if r == nil {
+		return nil
+	}
+	c := *r
+	c.Devices = cloneSlice(r.Devices)
+	c.DevicesAudit = clonePtr(r.DevicesAudit)
+	c.DevicesLink = clonePtr(r.DevicesLink)
+	c.CpuBurst = clonePtr(r.CpuBurst)
+	c.CPUIdle = clonePtr(r.CPUIdle)
+	c.PidsLimit = clonePtr(r.PidsLimit)
+	c.MaxDescendants = clonePtr(r.MaxDescendants)
+	c.MaxDepth = clonePtr(r.MaxDepth)
+	c.BlkioWeightDevice = cloneSlice(r.BlkioWeightDevice)
+	c.BlkioThrottleReadBpsDevice = cloneSlice(r.BlkioThrottleReadBpsDevice)
+	c.BlkioThrottleWriteBpsDevice = cloneSlice(r.BlkioThrottleWriteBpsDevice)
+	c.BlkioThrottleReadIOPSDevice = cloneSlice(r.BlkioThrottleReadIOPSDevice)
+	c.BlkioThrottleWriteIOPSDevice = cloneSlice(r.BlkioThrottleWriteIOPSDevice)
+	c.HugetlbLimit = cloneSlice(r.HugetlbLimit)
+	c.MemorySwappiness = clonePtr(r.MemorySwappiness)
+	c.NetPrioIfpriomap = cloneSlice(r.NetPrioIfpriomap)
+	if r.Rdma != nil {
+		c.Rdma = make(map[string]LinuxRdma, len(r.Rdma))
+		for k, v := range r.Rdma {
+			c.Rdma[k] = LinuxRdma{
+				HcaHandles: clonePtr(v.HcaHandles),
+				HcaObjects: clonePtr(v.HcaObjects),
+			}
+		}
+	}
+	if r.IP != nil {
+		ip := *r.IP
+		ip.AddressAllow = slices.Clone(r.IP.AddressAllow)
+		ip.AddressDeny = slices.Clone(r.IP.AddressDeny)
+		ip.IngressFilterPath = slices.Clone(r.IP.IngressFilterPath)
+		ip.EgressFilterPath = slices.Clone(r.IP.EgressFilterPath)
+		c.IP = &ip
+	}
+	c.ManagedOOM = clonePtr(r.ManagedOOM)
+	c.Unified = maps.Clone(r.Unified)
+	return &c
+}
+
+func clonePtr[T any](p *T) *T {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
+
+func cloneSlice[T any](s []*T) []*T {
+	if s == nil {
+		return nil
+	}
+	c := make([]*T, len(s))
+	for i := range s {
+		c[i] = clonePtr(s[i])
+	}
+	return c
 }
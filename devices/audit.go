@@ -0,0 +1,229 @@
+package devices
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	devices "github.com/opencontainers/cgroups/devices/config"
+	"github.com/opencontainers/cgroups/internal/bpf"
+)
+
+// auditRingBufSize is the size of the audit ring buffer data area. It must
+// be a power of 2, and a multiple of the page size.
+const auditRingBufSize = 256 * 1024
+
+// auditEvent is a record sent to the ring buffer by the device filter in
+// the audit mode (see program.auditBlock).
+type auditEvent struct {
+	devType  uint32 // BPF_DEVCG_DEV_*
+	access   uint32 // BPF_DEVCG_ACC_*
+	major    uint32
+	minor    uint32
+	pidTgid  uint64
+	cgroupID uint64
+}
+
+// AuditEvent is a device access denied by a device filter in the audit
+// mode (or, in the log-only mode, the one which would have been denied).
+type AuditEvent struct {
+	Type         devices.Type
+	Major, Minor uint32
+	Access       devices.Permissions
+	// Pid is the process (thread group) ID, in the initial PID namespace.
+	Pid int
+	// CgroupID is the ID (inode number) of the process cgroup.
+	CgroupID uint64
+}
+
+func (e *auditEvent) toAuditEvent() *AuditEvent {
+	ev := &AuditEvent{
+		Type:     devices.CharDevice,
+		Major:    e.major,
+		Minor:    e.minor,
+		Pid:      int(e.pidTgid >> 32),
+		CgroupID: e.cgroupID,
+	}
+	if e.devType == unix.BPF_DEVCG_DEV_BLOCK {
+		ev.Type = devices.BlockDevice
+	}
+	var perms []byte
+	for _, acc := range []struct {
+		bit  uint32
+		perm byte
+	}{
+		{unix.BPF_DEVCG_ACC_READ, 'r'},
+		{unix.BPF_DEVCG_ACC_WRITE, 'w'},
+		{unix.BPF_DEVCG_ACC_MKNOD, 'm'},
+	} {
+		if e.access&acc.bit != 0 {
+			perms = append(perms, acc.perm)
+		}
+	}
+	ev.Access = devices.Permissions(perms)
+	return ev
+}
+
+// openAuditRingBuf returns the fd of the audit ring buffer pinned at path,
+// creating and pinning it first if it does not exist.
+func openAuditRingBuf(path string) (int, error) {
+	fd, err := bpf.ObjGet(path)
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return fd, err
+	}
+	fd, err = bpfRingBufCreate(auditRingBufSize)
+	if err != nil {
+		return -1, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	if err := bpf.ObjPin(fd, path); err != nil {
+		unix.Close(fd)
+		// Lost the race with someone else creating it.
+		if errors.Is(err, os.ErrExist) {
+			return bpf.ObjGet(path)
+		}
+		return -1, err
+	}
+	return fd, nil
+}
+
+// AuditReader reads the denied device accesses from an audit ring buffer
+// (see [devices.Audit]).
+type AuditReader struct {
+	mu sync.Mutex
+	fd int
+	// wakeFd is an eventfd used to interrupt a blocked Read on Close.
+	wakeFd   int
+	closed   atomic.Bool
+	consumer []byte // consumer position page
+	producer []byte // producer position page, followed by the data (mapped twice)
+	mask     uint64
+}
+
+// NewAuditReader opens the audit ring buffer pinned at path.
+func NewAuditReader(path string) (*AuditReader, error) {
+	fd, err := bpf.ObjGet(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newAuditReader(fd)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return r, nil
+}
+
+func newAuditReader(fd int) (*AuditReader, error) {
+	pageSize := os.Getpagesize()
+	consumer, err := unix.Mmap(fd, 0, pageSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("can't mmap audit ring buffer: %w", err)
+	}
+	// The data area is mapped twice, so that the records wrapping
+	// around the end of the buffer can be read contiguously.
+	producer, err := unix.Mmap(fd, int64(pageSize), pageSize+2*auditRingBufSize, unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		_ = unix.Munmap(consumer)
+		return nil, fmt.Errorf("can't mmap audit ring buffer: %w", err)
+	}
+	wakeFd, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		_ = unix.Munmap(consumer)
+		_ = unix.Munmap(producer)
+		return nil, os.NewSyscallError("eventfd", err)
+	}
+	return &AuditReader{
+		fd:       fd,
+		wakeFd:   wakeFd,
+		consumer: consumer,
+		producer: producer,
+		mask:     auditRingBufSize - 1,
+	}, nil
+}
+
+// Ring buffer record header flags (BPF_RINGBUF_*_BIT).
+const (
+	ringBufBusyBit    = 1 << 31
+	ringBufDiscardBit = 1 << 30
+	ringBufHeaderSize = 8
+)
+
+// Read returns the next denied device access, waiting for one if there
+// are none. It returns [os.ErrClosed] once the reader is closed.
+func (r *AuditReader) Read() (*AuditEvent, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for {
+		if r.closed.Load() {
+			return nil, os.ErrClosed
+		}
+		if ev := r.next(); ev != nil {
+			return ev, nil
+		}
+		fds := []unix.PollFd{
+			{Fd: int32(r.fd), Events: unix.POLLIN},
+			{Fd: int32(r.wakeFd), Events: unix.POLLIN},
+		}
+		if _, err := unix.Poll(fds, -1); err != nil && !errors.Is(err, unix.EINTR) {
+			return nil, os.NewSyscallError("poll", err)
+		}
+	}
+}
+
+// next returns the next event from the ring buffer, or nil if there are none.
+func (r *AuditReader) next() *AuditEvent {
+	consPos := (*uint64)(unsafe.Pointer(&r.consumer[0]))
+	prodPos := (*uint64)(unsafe.Pointer(&r.producer[0]))
+	data := r.producer[os.Getpagesize():]
+	for {
+		cons := atomic.LoadUint64(consPos)
+		if cons >= atomic.LoadUint64(prodPos) {
+			return nil
+		}
+		off := cons & r.mask
+		header := atomic.LoadUint32((*uint32)(unsafe.Pointer(&data[off])))
+		if header&ringBufBusyBit != 0 {
+			// The record is not committed yet.
+			return nil
+		}
+		size := uint64(header &^ (ringBufBusyBit | ringBufDiscardBit))
+		var ev *AuditEvent
+		if header&ringBufDiscardBit == 0 && size == uint64(unsafe.Sizeof(auditEvent{})) {
+			raw := *(*auditEvent)(unsafe.Pointer(&data[off+ringBufHeaderSize]))
+			ev = raw.toAuditEvent()
+		}
+		// Records are 8-byte aligned.
+		atomic.StoreUint64(consPos, cons+(size+ringBufHeaderSize+7)&^7)
+		if ev != nil {
+			return ev
+		}
+	}
+}
+
+// Close closes the reader, interrupting any blocked Read.
+func (r *AuditReader) Close() error {
+	if r.closed.Swap(true) {
+		return nil
+	}
+	// Wake up the blocked Read, if any, and wait for it to return.
+	buf := [8]byte{1}
+	_, _ = unix.Write(r.wakeFd, buf[:])
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return errors.Join(
+		unix.Munmap(r.consumer),
+		unix.Munmap(r.producer),
+		unix.Close(r.wakeFd),
+		unix.Close(r.fd),
+	)
+}
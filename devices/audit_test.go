@@ -0,0 +1,82 @@
+package devices
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	devices "github.com/opencontainers/cgroups/devices/config"
+	"github.com/opencontainers/cgroups/internal/bpf"
+)
+
+func TestAuditedDeviceFilter(t *testing.T) {
+	fd, err := bpfRingBufCreate(auditRingBufSize)
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) || errors.Is(err, unix.EINVAL) {
+			t.Skipf("unable to create BPF ring buffer: %v", err)
+		}
+		t.Fatal(err)
+	}
+	r, err := newAuditReader(fd)
+	if err != nil {
+		unix.Close(fd)
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	rules := []*devices.Rule{
+		{Type: devices.CharDevice, Major: 1, Minor: 3, Permissions: "rwm", Allow: true},
+	}
+	for _, logOnly := range []bool{false, true} {
+		insts, license, err := auditedDeviceFilter(rules, &auditConfig{ringBufFd: fd, logOnly: logOnly})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Check the device filter program is accepted by the verifier.
+		progFd, err := bpfProgLoad(insts, license)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unix.Close(progFd)
+
+		// Run it as a raw tracepoint program (see NewVerifyingEvaluator).
+		progFd, err = bpf.ProgLoad(unix.BPF_PROG_TYPE_RAW_TRACEPOINT, FilterName, insts, license)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := &Evaluator{progFd: progFd}
+		allowed, err := e.runFilter(devices.CharDevice, 1, 3, "rw")
+		if err != nil {
+			e.Close()
+			if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EINVAL) {
+				t.Skipf("BPF_PROG_TEST_RUN is not supported: %v", err)
+			}
+			t.Fatal(err)
+		}
+		if !allowed {
+			t.Errorf("expected c 1:3 rw to be allowed")
+		}
+		allowed, err = e.runFilter(devices.BlockDevice, 8, 1, "rm")
+		e.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != logOnly {
+			t.Errorf("log only %v: expected b 8:1 rm to be allowed=%v", logOnly, logOnly)
+		}
+
+		ev, err := r.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := AuditEvent{Type: devices.BlockDevice, Major: 8, Minor: 1, Access: "rm", Pid: ev.Pid, CgroupID: ev.CgroupID}
+		if *ev != want {
+			t.Errorf("expected %+v, got %+v", want, *ev)
+		}
+		if ev.Pid != os.Getpid() {
+			t.Errorf("expected pid %d, got %d", os.Getpid(), ev.Pid)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package config
+
+// Audit configures the auditing of the denied device accesses, which is
+// only supported on cgroup v2.
+type Audit struct {
+	// Pin is the path (in a bpffs) of the BPF ring buffer which the
+	// denied accesses are sent to. It is created if it does not exist,
+	// and can be shared between cgroups.
+	Pin string `json:"pin"`
+
+	// LogOnly makes the device filter allow the accesses which would be
+	// denied, only recording them. It is useful to roll out a tighter
+	// device policy safely.
+	LogOnly bool `json:"log_only,omitzero"`
+}
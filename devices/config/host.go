@@ -0,0 +1,246 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrNotADevice denotes that a file is not a valid device node.
+var ErrNotADevice = errors.New("not a device node")
+
+// DeviceFromPath returns the device for the host device node at path,
+// with the given permissions.
+//
+// If path is a symlink (such as /dev/disk/by-id/* or /dev/dri/by-path/*),
+// it is resolved, and the device is the one it points to, but its Path
+// is left as is. The resolved path is then opened without following any
+// symlink (see [openNoSymlinks]), so that neither the node nor any of its
+// parent directories can be swapped for a symlink in the meantime.
+func DeviceFromPath(path string, permissions Permissions) (*Device, error) {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := openNoSymlinks(target)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fd)
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return nil, &os.PathError{Op: "fstat", Path: target, Err: err}
+	}
+
+	var devType Type
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFBLK:
+		devType = BlockDevice
+	case unix.S_IFCHR:
+		devType = CharDevice
+	case unix.S_IFIFO:
+		devType = FifoDevice
+	default:
+		return nil, ErrNotADevice
+	}
+	devNumber := uint64(st.Rdev) //nolint:unconvert // Rdev is uint32 on e.g. MIPS.
+	return &Device{
+		Rule: Rule{
+			Type:        devType,
+			Major:       int64(unix.Major(devNumber)),
+			Minor:       int64(unix.Minor(devNumber)),
+			Permissions: permissions,
+		},
+		Path:     path,
+		FileMode: os.FileMode(st.Mode &^ unix.S_IFMT),
+		Uid:      st.Uid,
+		Gid:      st.Gid,
+	}, nil
+}
+
+// openNoSymlinks opens path with O_PATH, failing (with ELOOP) if any of
+// its components is a symlink. It uses openat2 with RESOLVE_NO_SYMLINKS,
+// falling back to O_NOFOLLOW, which only checks the last component, on
+// kernels older than 5.6.
+func openNoSymlinks(path string) (int, error) {
+	fd, err := unix.Openat2(unix.AT_FDCWD, path, &unix.OpenHow{
+		Flags:   unix.O_PATH | unix.O_NOFOLLOW | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_NO_SYMLINKS | unix.RESOLVE_NO_MAGICLINKS,
+	})
+	if err == nil {
+		return fd, nil
+	}
+	if err != unix.ENOSYS {
+		return -1, &os.PathError{Op: "openat2", Path: path, Err: err}
+	}
+	fd, err = unix.Open(path, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return fd, nil
+}
+
+// DeviceFilter reports whether a device found by GetDevices is to be
+// included in the result.
+type DeviceFilter func(*Device) bool
+
+// ByType returns a DeviceFilter which includes the devices of the given
+// types only.
+func ByType(types ...Type) DeviceFilter {
+	return func(d *Device) bool {
+		for _, t := range types {
+			if d.Type == t {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ByMajor returns a DeviceFilter which includes the devices with the
+// given major numbers only.
+func ByMajor(majors ...int64) DeviceFilter {
+	return func(d *Device) bool {
+		for _, m := range majors {
+			if d.Major == m {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ByName returns a DeviceFilter which includes the devices whose base
+// name matches one of the [filepath.Match] patterns only.
+func ByName(patterns ...string) DeviceFilter {
+	return func(d *Device) bool {
+		name := filepath.Base(d.Path)
+		for _, p := range patterns {
+			if ok, _ := filepath.Match(p, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// HostDevices returns all the device nodes under /dev on the host, with
+// the "rwm" permissions.
+func HostDevices() ([]*Device, error) {
+	return GetDevices("/dev")
+}
+
+// GetDevices recursively traverses dir (for example, /dev/dri or /dev/vfio)
+// and returns all the device nodes found in it, with the "rwm" permissions,
+// for which all the filters return true.
+//
+// Symlinks are not followed, so that every device is only returned once,
+// and the directories which are not supposed to hold host devices (such as
+// /dev/pts and /dev/shm), as well as /dev/console, are skipped.
+func GetDevices(dir string, filters ...DeviceFilter) ([]*Device, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var out []*Device
+next:
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		switch {
+		case e.IsDir():
+			switch e.Name() {
+			// ".lxc" & ".lxd-mounts" + ".udev" added to address
+			// https://github.com/lxc/lxd/issues/2825
+			// https://github.com/opencontainers/runc/issues/2865
+			case "pts", "shm", "fd", "mqueue", ".lxc", ".lxd-mounts", ".udev":
+				continue
+			}
+			sub, err := GetDevices(path, filters...)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, sub...)
+			continue
+		case e.Type()&os.ModeSymlink != 0, e.Name() == "console":
+			continue
+		}
+		dev, err := DeviceFromPath(path, "rwm")
+		if err != nil {
+			if errors.Is(err, ErrNotADevice) || errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		for _, f := range filters {
+			if !f(dev) {
+				continue next
+			}
+		}
+		out = append(out, dev)
+	}
+	return out, nil
+}
+
+// AllowRules returns the set of allow rules which give access to devs.
+//
+// The rules of the devices with the same type and numbers are merged (with
+// the union of their permissions), and the ones covered by a rule with a
+// wildcard type, major or minor number are omitted. FIFOs are skipped, as
+// the devices cgroup does not control access to them. Otherwise, the rules
+// are in the order of devs.
+func AllowRules(devs []*Device) []*Rule {
+	var rules []*Rule
+	idx := make(map[Rule]int)
+	for _, d := range devs {
+		if !d.Type.CanCgroup() || d.Permissions.IsEmpty() {
+			continue
+		}
+		key := Rule{Type: d.Type, Major: d.Major, Minor: d.Minor}
+		if d.Type == WildcardDevice {
+			key.Major, key.Minor = Wildcard, Wildcard
+		}
+		if i, ok := idx[key]; ok {
+			rules[i].Permissions = rules[i].Permissions.Union(d.Permissions)
+			continue
+		}
+		idx[key] = len(rules)
+		r := key
+		// Union normalizes the permissions to the "rwm" order.
+		r.Permissions = d.Permissions.Union("")
+		r.Allow = true
+		rules = append(rules, &r)
+	}
+
+	out := make([]*Rule, 0, len(rules))
+	for i, r := range rules {
+		covered := false
+		for j, o := range rules {
+			if i != j && o.covers(r) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// covers reports whether the rule r matches all the accesses matched by o.
+func (r *Rule) covers(o *Rule) bool {
+	if r.Type != WildcardDevice {
+		if r.Type != o.Type {
+			return false
+		}
+		if r.Major != Wildcard && r.Major != o.Major {
+			return false
+		}
+		if r.Minor != Wildcard && r.Minor != o.Minor {
+			return false
+		}
+	}
+	return o.Permissions.Difference(r.Permissions).IsEmpty()
+}
@@ -0,0 +1,103 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestDeviceFromPath(t *testing.T) {
+	dev, err := DeviceFromPath("/dev/null", "rwm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dev.Type != CharDevice || dev.Major != 1 || dev.Minor != 3 || dev.Path != "/dev/null" {
+		t.Errorf("unexpected device: %+v", dev)
+	}
+
+	// A symlink resolves to the device it points to.
+	link := filepath.Join(t.TempDir(), "null")
+	if err := os.Symlink("/dev/null", link); err != nil {
+		t.Fatal(err)
+	}
+	ldev, err := DeviceFromPath(link, "rwm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ldev.Path != link || ldev.Rule != dev.Rule {
+		t.Errorf("unexpected device for a symlink: %+v", ldev)
+	}
+
+	if _, err := DeviceFromPath(t.TempDir(), "rwm"); !errors.Is(err, ErrNotADevice) {
+		t.Errorf("expected ErrNotADevice for a directory, got %v", err)
+	}
+}
+
+func TestOpenNoSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	link := filepath.Join(dir, "dev")
+	if err := os.Symlink("/dev", link); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := openNoSymlinks("/dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unix.Close(fd)
+
+	// A symlink in the middle of the path is not followed either.
+	fd, err = openNoSymlinks(filepath.Join(link, "null"))
+	if err == nil {
+		unix.Close(fd)
+		t.Skip("openat2 is not available")
+	}
+	if !errors.Is(err, unix.ELOOP) {
+		t.Errorf("expected ELOOP, got %v", err)
+	}
+}
+
+func TestGetDevices(t *testing.T) {
+	devs, err := GetDevices("/dev", ByName("null", "zero"), ByType(CharDevice))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, d := range devs {
+		paths = append(paths, d.Path)
+	}
+	if !reflect.DeepEqual(paths, []string{"/dev/null", "/dev/zero"}) {
+		t.Errorf("unexpected devices: %v", paths)
+	}
+}
+
+func TestAllowRules(t *testing.T) {
+	devs := []*Device{
+		{Rule: Rule{Type: CharDevice, Major: 1, Minor: 3, Permissions: "rw"}},
+		{Rule: Rule{Type: FifoDevice, Major: 0, Minor: 0, Permissions: "rwm"}},
+		{Rule: Rule{Type: BlockDevice, Major: 8, Minor: 0, Permissions: "r"}},
+		{Rule: Rule{Type: CharDevice, Major: 1, Minor: 3, Permissions: "mr"}},
+		{Rule: Rule{Type: BlockDevice, Major: 8, Minor: 1, Permissions: "rw"}},
+		{Rule: Rule{Type: BlockDevice, Major: 8, Minor: Wildcard, Permissions: "r"}},
+		{Rule: Rule{Type: CharDevice, Major: 5, Minor: 1, Permissions: ""}},
+	}
+	expected := []*Rule{
+		{Type: CharDevice, Major: 1, Minor: 3, Permissions: "rwm", Allow: true},
+		{Type: BlockDevice, Major: 8, Minor: 1, Permissions: "rw", Allow: true},
+		{Type: BlockDevice, Major: 8, Minor: Wildcard, Permissions: "r", Allow: true},
+	}
+	if rules := AllowRules(devs); !reflect.DeepEqual(rules, expected) {
+		t.Errorf("unexpected rules:\n got %+v\nwant %+v", rules, expected)
+	}
+
+	devs = append(devs, &Device{Rule: Rule{Type: WildcardDevice, Permissions: "rwm"}})
+	expected = []*Rule{
+		{Type: WildcardDevice, Major: Wildcard, Minor: Wildcard, Permissions: "rwm", Allow: true},
+	}
+	if rules := AllowRules(devs); !reflect.DeepEqual(rules, expected) {
+		t.Errorf("unexpected rules:\n got %+v\nwant %+v", rules, expected)
+	}
+}
@@ -0,0 +1,18 @@
+package config
+
+// Link configures the device filter to be attached to the cgroup through
+// a BPF link, rather than directly, which is only supported on cgroup v2
+// (and requires Linux 5.7 or later). The program of a BPF link is replaced
+// atomically when the device rules are updated.
+type Link struct {
+	// PinDir is the directory (in a bpffs) in which the link is pinned,
+	// under a name derived from the cgroup ID, so that the device filter
+	// stays attached after the current process exits, and can be updated
+	// by any process later on.
+	//
+	// If empty, the link is held by the current process instead, and the
+	// device filter is detached once it exits (leaving the cgroup with no
+	// device filter at all), so it is only to be used by the processes
+	// which outlive the cgroup.
+	PinDir string `json:"pin_dir,omitzero"`
+}
@@ -7,13 +7,16 @@
 package devices
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"math"
 	"strconv"
+	"unsafe"
 
 	"github.com/cilium/ebpf/asm"
 	devices "github.com/opencontainers/cgroups/devices/config"
+	"github.com/opencontainers/cgroups/internal/bpf"
 	"golang.org/x/sys/unix"
 )
 
@@ -24,37 +27,37 @@ const (
 
 // deviceFilter returns eBPF device filter program and its license string.
 func deviceFilter(rules []*devices.Rule) (asm.Instructions, string, error) {
+	return auditedDeviceFilter(rules, nil)
+}
+
+// auditConfig configures a device filter to report the denied accesses.
+type auditConfig struct {
+	// ringBufFd is the fd of the BPF ring buffer the events are sent to.
+	ringBufFd int
+	// logOnly makes the program allow the accesses it would deny.
+	logOnly bool
+}
+
+// auditedDeviceFilter is like deviceFilter, but if audit is not nil, the
+// denied accesses are reported to the ring buffer as auditEvent records.
+func auditedDeviceFilter(rules []*devices.Rule, audit *auditConfig) (asm.Instructions, string, error) {
 	// Generate the minimum ruleset for the device rules we are given. While we
 	// don't care about minimum transitions in cgroupv2, using the emulator
 	// gives us a guarantee that the behaviour of devices filtering is the same
 	// as cgroupv1, including security hardenings to avoid misconfiguration
 	// (such as punching holes in wildcard rules).
-	emu := new(emulator)
-	for _, rule := range rules {
-		if err := emu.Apply(*rule); err != nil {
-			return nil, "", err
-		}
-	}
-	cleanRules, err := emu.Rules()
+	set, err := Normalize(rules)
 	if err != nil {
 		return nil, "", err
 	}
 
 	p := &program{
-		defaultAllow: emu.IsBlacklist(),
+		defaultAllow: set.DefaultAllow,
+		audit:        audit,
 	}
 	p.init()
 
-	for idx, rule := range cleanRules {
-		if rule.Type == devices.WildcardDevice {
-			// We can safely skip over wildcard entries because there should
-			// only be one (at most) at the very start to instruct cgroupv1 to
-			// go into allow-list mode. However we do double-check this here.
-			if idx != 0 || rule.Allow != emu.IsBlacklist() {
-				return nil, "", fmt.Errorf("[internal error] emulated cgroupv2 devices ruleset had bad wildcard at idx %v (%s)", idx, rule.CgroupString())
-			}
-			continue
-		}
+	for idx, rule := range set.Rules {
 		if rule.Allow == p.defaultAllow {
 			// There should be no rules which have an action equal to the
 			// default action, the emulator removes those.
@@ -71,6 +74,7 @@ type program struct {
 	insts        asm.Instructions
 	defaultAllow bool
 	blockID      int
+	audit        *auditConfig
 }
 
 func (p *program) init() {
@@ -102,9 +106,8 @@ func (p *program) init() {
 
 // appendRule rule converts an OCI rule to the relevant eBPF block and adds it
 // to the in-progress filter program. In order to operate properly, it must be
-// called with a "clean" rule list (generated by devices.Emulator.Rules() --
-// with any "a" rules removed).
-func (p *program) appendRule(rule *devices.Rule) error {
+// called with a "clean" rule list (generated by Normalize).
+func (p *program) appendRule(rule *RuleRange) error {
 	if p.blockID < 0 {
 		return errors.New("the program is finalized")
 	}
@@ -125,6 +128,11 @@ func (p *program) appendRule(rule *devices.Rule) error {
 	if rule.Minor > math.MaxUint32 {
 		return fmt.Errorf("invalid minor %d", rule.Major)
 	}
+	// The range bounds are compared as (sign-extended) 32-bit immediates.
+	isRange := rule.MinorEnd > rule.Minor
+	if isRange && (rule.Minor < 0 || rule.MinorEnd > math.MaxInt32) {
+		return fmt.Errorf("invalid minor range %d-%d", rule.Minor, rule.MinorEnd)
+	}
 	hasMajor := rule.Major >= 0 // if not specified in OCI json, major is set to -1
 	hasMinor := rule.Minor >= 0
 	bpfAccess := int32(0)
@@ -166,13 +174,19 @@ func (p *program) appendRule(rule *devices.Rule) error {
 			asm.JNE.Imm(asm.R4, int32(rule.Major), nextBlockSym),
 		)
 	}
-	if hasMinor {
+	if isRange {
+		p.insts = append(p.insts,
+			// if (R5 < minor || R5 > minorEnd) goto next
+			asm.JLT.Imm(asm.R5, int32(rule.Minor), nextBlockSym),
+			asm.JGT.Imm(asm.R5, int32(rule.MinorEnd), nextBlockSym),
+		)
+	} else if hasMinor {
 		p.insts = append(p.insts,
 			// if (R5 != minor) goto next
 			asm.JNE.Imm(asm.R5, int32(rule.Minor), nextBlockSym),
 		)
 	}
-	p.insts = append(p.insts, acceptBlock(rule.Allow)...)
+	p.insts = append(p.insts, p.acceptBlock(rule.Allow)...)
 	// set blockSym to the first instruction we added in this iteration
 	p.insts[prevBlockLastIdx+1] = p.insts[prevBlockLastIdx+1].WithSymbol(blockSym)
 	p.blockID++
@@ -180,20 +194,67 @@ func (p *program) appendRule(rule *devices.Rule) error {
 }
 
 func (p *program) finalize() asm.Instructions {
-	var v int32
-	if p.defaultAllow {
-		v = 1
-	}
 	blockSym := "block-" + strconv.Itoa(p.blockID)
-	p.insts = append(p.insts,
-		// R0 <- v
-		asm.Mov.Imm32(asm.R0, v).WithSymbol(blockSym),
-		asm.Return(),
-	)
+	if p.audit == nil {
+		var v int32
+		if p.defaultAllow {
+			v = 1
+		}
+		p.insts = append(p.insts,
+			// R0 <- v
+			asm.Mov.Imm32(asm.R0, v).WithSymbol(blockSym),
+			asm.Return(),
+		)
+	} else {
+		insts := p.acceptBlock(p.defaultAllow)
+		insts[0] = insts[0].WithSymbol(blockSym)
+		p.insts = append(p.insts, insts...)
+		p.insts = append(p.insts, p.auditBlock()...)
+	}
 	p.blockID = -1
 	return p.insts
 }
 
+// auditSym is the symbol of the block reporting the denied accesses.
+const auditSym = "audit"
+
+// acceptBlock is like acceptBlock, except that with auditing enabled,
+// the denial goes through the audit block.
+func (p *program) acceptBlock(accept bool) asm.Instructions {
+	if accept || p.audit == nil {
+		return acceptBlock(accept)
+	}
+	return asm.Instructions{asm.Ja.Label(auditSym)}
+}
+
+// auditBlock returns the instructions which send an auditEvent describing
+// the access to the ring buffer, and then deny (or, in the log-only mode,
+// allow) the access.
+func (p *program) auditBlock() asm.Instructions {
+	// The registers R1-R5 are clobbered by the helper calls, so save
+	// the access (see init) into the event on the stack first.
+	const size = int16(unsafe.Sizeof(auditEvent{}))
+	return asm.Instructions{
+		asm.StoreMem(asm.RFP, -size, asm.R2, asm.Word).WithSymbol(auditSym),
+		asm.StoreMem(asm.RFP, -size+4, asm.R3, asm.Word),
+		asm.StoreMem(asm.RFP, -size+8, asm.R4, asm.Word),
+		asm.StoreMem(asm.RFP, -size+12, asm.R5, asm.Word),
+		asm.FnGetCurrentPidTgid.Call(),
+		asm.StoreMem(asm.RFP, -size+16, asm.R0, asm.DWord),
+		asm.FnGetCurrentCgroupId.Call(),
+		asm.StoreMem(asm.RFP, -size+24, asm.R0, asm.DWord),
+		// bpf_ringbuf_output(ringbuf, &event, sizeof(event), 0)
+		asm.LoadMapPtr(asm.R1, p.audit.ringBufFd),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, int32(-size)),
+		asm.Mov.Imm(asm.R3, int32(size)),
+		asm.Mov.Imm(asm.R4, 0),
+		asm.FnRingbufOutput.Call(),
+		acceptBlock(p.audit.logOnly)[0],
+		asm.Return(),
+	}
+}
+
 func acceptBlock(accept bool) asm.Instructions {
 	var v int32
 	if accept {
@@ -205,3 +266,182 @@ func acceptBlock(accept bool) asm.Instructions {
 		asm.Return(),
 	}
 }
+
+// errUnknownFilter is returned by decodeDeviceFilter for programs which
+// were not generated by deviceFilter.
+var errUnknownFilter = errors.New("not a device filter program generated by this package")
+
+// decodeDeviceFilter is the reverse of deviceFilter: it decodes the raw
+// instructions of a program generated by deviceFilter back into the list of
+// rules, in the order they are checked by the program, and the default
+// action (used if no rule matches). All the rules have the action opposite
+// to the default one. It returns errUnknownFilter if the program does not
+// look like the one generated by deviceFilter.
+func decodeDeviceFilter(raw []byte) ([]*RuleRange, bool, error) {
+	var insts asm.Instructions
+	if err := insts.Unmarshal(bytes.NewReader(raw), bpf.NativeEndian); err != nil {
+		return nil, false, fmt.Errorf("%w: %w", errUnknownFilter, err)
+	}
+	d := &decoder{insts: insts}
+	prologue := &program{}
+	prologue.init()
+	for _, want := range prologue.insts {
+		if !d.next(want) {
+			return nil, false, errUnknownFilter
+		}
+	}
+	var rules []*RuleRange
+	for {
+		// The last block, with the default action.
+		if len(d.insts)-d.pos == 2 {
+			allow, ok := d.accept()
+			if !ok {
+				return nil, false, errUnknownFilter
+			}
+			for _, rule := range rules {
+				if rule.Allow == allow {
+					return nil, false, errUnknownFilter
+				}
+			}
+			return rules, allow, nil
+		}
+		rule, err := d.rule()
+		if err != nil {
+			return nil, false, err
+		}
+		rules = append(rules, rule)
+	}
+}
+
+// decoder matches instructions against the ones generated by program.
+type decoder struct {
+	insts asm.Instructions
+	pos   int
+}
+
+// next consumes the next instruction if it is the same as want,
+// ignoring the jump offset.
+func (d *decoder) next(want asm.Instruction) bool {
+	if d.pos >= len(d.insts) {
+		return false
+	}
+	ins := d.insts[d.pos]
+	if ins.OpCode != want.OpCode || ins.Dst != want.Dst || ins.Src != want.Src || ins.Constant != want.Constant ||
+		(!want.OpCode.Class().IsJump() && ins.Offset != want.Offset) {
+		return false
+	}
+	d.pos++
+	return true
+}
+
+// jumpsTo reports whether the last consumed instruction is a jump to the
+// instruction at index target.
+func (d *decoder) jumpsTo(target int) bool {
+	return d.pos+int(d.insts[d.pos-1].Offset) == target
+}
+
+// accept consumes the instructions generated by acceptBlock.
+func (d *decoder) accept() (allow, ok bool) {
+	for _, allow := range []bool{false, true} {
+		pos := d.pos
+		insts := acceptBlock(allow)
+		if d.next(insts[0]) && d.next(insts[1]) {
+			return allow, true
+		}
+		d.pos = pos
+	}
+	return false, false
+}
+
+// rule consumes the instructions generated by program.appendRule.
+func (d *decoder) rule() (*RuleRange, error) {
+	// All the jumps in a block go to the next one, which starts right
+	// after the two accept instructions, so find the end of the block
+	// by looking at the first jump.
+	if d.pos >= len(d.insts) {
+		return nil, errUnknownFilter
+	}
+	next := d.pos + 1 + int(d.insts[d.pos].Offset)
+	if next <= d.pos || next > len(d.insts) {
+		return nil, errUnknownFilter
+	}
+
+	rule := &devices.Rule{Major: devices.Wildcard, Minor: devices.Wildcard, Permissions: "rwm"}
+	bpfType := d.insts[d.pos].Constant
+	switch bpfType {
+	case int64(unix.BPF_DEVCG_DEV_CHAR):
+		rule.Type = devices.CharDevice
+	case int64(unix.BPF_DEVCG_DEV_BLOCK):
+		rule.Type = devices.BlockDevice
+	default:
+		return nil, errUnknownFilter
+	}
+	if !d.next(asm.JNE.Imm(asm.R2, int32(bpfType), "")) || !d.jumpsTo(next) {
+		return nil, errUnknownFilter
+	}
+	if d.next(asm.Mov.Reg32(asm.R1, asm.R3)) {
+		if d.pos >= len(d.insts) {
+			return nil, errUnknownFilter
+		}
+		bpfAccess := int32(d.insts[d.pos].Constant)
+		if !d.next(asm.And.Imm32(asm.R1, bpfAccess)) || !d.next(asm.JNE.Reg(asm.R1, asm.R3, "")) || !d.jumpsTo(next) {
+			return nil, errUnknownFilter
+		}
+		var perms []byte
+		for _, acc := range []struct {
+			bit  int32
+			perm byte
+		}{
+			{unix.BPF_DEVCG_ACC_READ, 'r'},
+			{unix.BPF_DEVCG_ACC_WRITE, 'w'},
+			{unix.BPF_DEVCG_ACC_MKNOD, 'm'},
+		} {
+			if bpfAccess&acc.bit != 0 {
+				perms = append(perms, acc.perm)
+				bpfAccess &^= acc.bit
+			}
+		}
+		if bpfAccess != 0 {
+			return nil, errUnknownFilter
+		}
+		rule.Permissions = devices.Permissions(perms)
+	}
+	for _, f := range []struct {
+		reg asm.Register
+		val *int64
+	}{
+		{asm.R4, &rule.Major},
+		{asm.R5, &rule.Minor},
+	} {
+		if d.pos >= len(d.insts) {
+			return nil, errUnknownFilter
+		}
+		imm := int32(d.insts[d.pos].Constant)
+		if d.next(asm.JNE.Imm(f.reg, imm, "")) {
+			if !d.jumpsTo(next) {
+				return nil, errUnknownFilter
+			}
+			*f.val = int64(uint32(imm))
+		}
+	}
+	r := &RuleRange{Rule: *rule, MinorEnd: rule.Minor}
+	if rule.Minor == devices.Wildcard && d.pos < len(d.insts) {
+		lo := int32(d.insts[d.pos].Constant)
+		if d.next(asm.JLT.Imm(asm.R5, lo, "")) {
+			if !d.jumpsTo(next) || d.pos >= len(d.insts) {
+				return nil, errUnknownFilter
+			}
+			hi := int32(d.insts[d.pos].Constant)
+			if !d.next(asm.JGT.Imm(asm.R5, hi, "")) || !d.jumpsTo(next) || lo < 0 || hi <= lo {
+				return nil, errUnknownFilter
+			}
+			r.Minor, r.MinorEnd = int64(lo), int64(hi)
+		}
+	}
+	allow, ok := d.accept()
+	if !ok || d.pos != next {
+		return nil, errUnknownFilter
+	}
+	r.Allow = allow
+	return r, nil
+}
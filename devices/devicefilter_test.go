@@ -1,10 +1,16 @@
 package devices
 
 import (
+	"bytes"
+	"errors"
+	"math"
 	"strings"
 	"testing"
 
+	"github.com/cilium/ebpf/asm"
+
 	devices "github.com/opencontainers/cgroups/devices/config"
+	"github.com/opencontainers/cgroups/internal/bpf"
 )
 
 func hash(s, comm string) string {
@@ -25,6 +31,7 @@ func testDeviceFilter(t testing.TB, devices []*devices.Rule, expectedStr string)
 		t.Fatalf("%s: %v (devices: %+v)", t.Name(), err, devices)
 	}
 	s := insts.String()
+	testDecodeDeviceFilter(t, insts)
 	if expectedStr != "" {
 		hashed := hash(s, "//")
 		expectedHashed := hash(expectedStr, "//")
@@ -171,51 +178,41 @@ block-3:
         26: MovImm32 dst: r0 imm: 1
         27: Exit
 block-4:
+// (c, 1, 7-9, rwm, true), merged into a range
         28: JNEImm dst: r2 off: -1 imm: 2 <block-5>
         29: JNEImm dst: r4 off: -1 imm: 1 <block-5>
-        30: JNEImm dst: r5 off: -1 imm: 7 <block-5>
-        31: MovImm32 dst: r0 imm: 1
-        32: Exit
+        30: JLTImm dst: r5 off: -1 imm: 7 <block-5>
+        31: JGTImm dst: r5 off: -1 imm: 9 <block-5>
+        32: MovImm32 dst: r0 imm: 1
+        33: Exit
 block-5:
-        33: JNEImm dst: r2 off: -1 imm: 2 <block-6>
-        34: JNEImm dst: r4 off: -1 imm: 1 <block-6>
-        35: JNEImm dst: r5 off: -1 imm: 8 <block-6>
-        36: MovImm32 dst: r0 imm: 1
-        37: Exit
+        34: JNEImm dst: r2 off: -1 imm: 2 <block-6>
+        35: JNEImm dst: r4 off: -1 imm: 5 <block-6>
+        36: JNEImm dst: r5 off: -1 imm: 0 <block-6>
+        37: MovImm32 dst: r0 imm: 1
+        38: Exit
 block-6:
-        38: JNEImm dst: r2 off: -1 imm: 2 <block-7>
-        39: JNEImm dst: r4 off: -1 imm: 1 <block-7>
-        40: JNEImm dst: r5 off: -1 imm: 9 <block-7>
-        41: MovImm32 dst: r0 imm: 1
-        42: Exit
+        39: JNEImm dst: r2 off: -1 imm: 2 <block-7>
+        40: JNEImm dst: r4 off: -1 imm: 5 <block-7>
+        41: JNEImm dst: r5 off: -1 imm: 2 <block-7>
+        42: MovImm32 dst: r0 imm: 1
+        43: Exit
 block-7:
-        43: JNEImm dst: r2 off: -1 imm: 2 <block-8>
-        44: JNEImm dst: r4 off: -1 imm: 5 <block-8>
-        45: JNEImm dst: r5 off: -1 imm: 0 <block-8>
-        46: MovImm32 dst: r0 imm: 1
-        47: Exit
+// tuntap (c, 10, 200, rwm, true)
+        44: JNEImm dst: r2 off: -1 imm: 2 <block-8>
+        45: JNEImm dst: r4 off: -1 imm: 10 <block-8>
+        46: JNEImm dst: r5 off: -1 imm: 200 <block-8>
+        47: MovImm32 dst: r0 imm: 1
+        48: Exit
 block-8:
-        48: JNEImm dst: r2 off: -1 imm: 2 <block-9>
-        49: JNEImm dst: r4 off: -1 imm: 5 <block-9>
-        50: JNEImm dst: r5 off: -1 imm: 2 <block-9>
+// /dev/pts (c, 136, wildcard, rwm, true)
+        49: JNEImm dst: r2 off: -1 imm: 2 <block-9>
+        50: JNEImm dst: r4 off: -1 imm: 136 <block-9>
         51: MovImm32 dst: r0 imm: 1
         52: Exit
 block-9:
-// tuntap (c, 10, 200, rwm, true)
-        53: JNEImm dst: r2 off: -1 imm: 2 <block-10>
-        54: JNEImm dst: r4 off: -1 imm: 10 <block-10>
-        55: JNEImm dst: r5 off: -1 imm: 200 <block-10>
-        56: MovImm32 dst: r0 imm: 1
-        57: Exit
-block-10:
-// /dev/pts (c, 136, wildcard, rwm, true)
-	58: JNEImm dst: r2 off: -1 imm: 2 <block-11>
-        59: JNEImm dst: r4 off: -1 imm: 136 <block-11>
-        60: MovImm32 dst: r0 imm: 1
-        61: Exit
-block-11:
-        62: MovImm32 dst: r0 imm: 0
-        63: Exit
+        53: MovImm32 dst: r0 imm: 0
+        54: Exit
 `
 	testDeviceFilter(t, devices, expected)
 }
@@ -334,3 +331,71 @@ block-1:
 `
 	testDeviceFilter(t, devices, expected)
 }
+
+// testDecodeDeviceFilter checks that the program decoded by decodeDeviceFilter
+// results in the same program when generated again.
+func testDecodeDeviceFilter(t testing.TB, insts asm.Instructions) {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	if err := insts.Marshal(buf, bpf.NativeEndian); err != nil {
+		t.Fatal(err)
+	}
+	rules, defaultAllow, err := decodeDeviceFilter(buf.Bytes())
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	p := &program{defaultAllow: defaultAllow}
+	p.init()
+	for _, rule := range rules {
+		if err := p.appendRule(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := &bytes.Buffer{}
+	decoded := p.finalize()
+	if err := decoded.Marshal(got, bpf.NativeEndian); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), buf.Bytes()) {
+		t.Fatalf("decoded program differs:\n%s\nexpected:\n%s", decoded, insts)
+	}
+}
+
+func TestDecodeDeviceFilter_Unknown(t *testing.T) {
+	buf := &bytes.Buffer{}
+	insts := asm.Instructions{
+		asm.Mov.Imm32(asm.R0, 1),
+		asm.Return(),
+	}
+	if err := insts.Marshal(buf, bpf.NativeEndian); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := decodeDeviceFilter(buf.Bytes()); !errors.Is(err, errUnknownFilter) {
+		t.Fatalf("expected errUnknownFilter, got %v", err)
+	}
+}
+
+func TestDecodeDeviceFilter_LargeRange(t *testing.T) {
+	// A program may match a range of minor numbers as large as it likes,
+	// which is decoded as is.
+	rule := &RuleRange{
+		Rule:     devices.Rule{Type: devices.CharDevice, Major: 1, Minor: 0, Permissions: "rwm", Allow: true},
+		MinorEnd: math.MaxInt32,
+	}
+	p := &program{}
+	p.init()
+	if err := p.appendRule(rule); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := p.finalize().Marshal(buf, bpf.NativeEndian); err != nil {
+		t.Fatal(err)
+	}
+	rules, _, err := decodeDeviceFilter(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 || *rules[0] != *rule {
+		t.Fatalf("expected %+v, got %+v", rule, rules)
+	}
+}
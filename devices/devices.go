@@ -12,5 +12,6 @@ import (
 func init() {
 	cgroups.DevicesSetV1 = setV1
 	cgroups.DevicesSetV2 = setV2
+	cgroups.DevicesUnlinkV2 = unlinkV2
 	systemd.GenerateDeviceProps = systemdProperties
 }
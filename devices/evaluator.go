@@ -0,0 +1,175 @@
+package devices
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	devices "github.com/opencontainers/cgroups/devices/config"
+	"github.com/opencontainers/cgroups/internal/bpf"
+)
+
+// Evaluator answers whether a device access is allowed by a list of device
+// rules, without applying the rules to any cgroup. It is useful to test
+// device policies.
+type Evaluator struct {
+	emu *emulator
+	// progFd is the fd of the eBPF device filter program, used in the
+	// verification mode, or -1.
+	progFd int
+}
+
+// NewEvaluator returns an Evaluator for the rules, which are applied in
+// order (like the ones in [cgroups.Resources.Devices]).
+func NewEvaluator(rules []*devices.Rule) (*Evaluator, error) {
+	emu := new(emulator)
+	for _, rule := range rules {
+		if err := emu.Apply(*rule); err != nil {
+			return nil, err
+		}
+	}
+	return &Evaluator{emu: emu, progFd: -1}, nil
+}
+
+// NewVerifyingEvaluator is like NewEvaluator, but it also loads the eBPF
+// program which would be used to apply the rules on cgroup v2, and checks
+// that it agrees with the emulator on every call to Allowed, by running
+// it with BPF_PROG_TEST_RUN. This requires the privileges to load eBPF
+// programs (CAP_BPF and CAP_PERFMON, or CAP_SYS_ADMIN), and Linux 5.10+.
+//
+// The kernel does not support BPF_PROG_TEST_RUN for device filter programs,
+// so the program is loaded as a raw tracepoint program instead, which has a
+// compatible context (read-only memory, containing struct bpf_cgroup_dev_ctx
+// in this case).
+//
+// Note that in the deny-list mode, the eBPF program only denies the access
+// which is fully covered by one of the rules, while cgroup v1 denies any
+// access which overlaps with a rule, so the two may disagree for accesses
+// consisting of more than one access type.
+//
+// Close must be called to release the program.
+func NewVerifyingEvaluator(rules []*devices.Rule) (*Evaluator, error) {
+	e, err := NewEvaluator(rules)
+	if err != nil {
+		return nil, err
+	}
+	insts, license, err := deviceFilter(rules)
+	if err != nil {
+		return nil, err
+	}
+	e.progFd, err = bpf.ProgLoad(unix.BPF_PROG_TYPE_RAW_TRACEPOINT, FilterName, insts, license)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call BPF_PROG_LOAD: %w", err)
+	}
+	return e, nil
+}
+
+// Close releases the resources used by e.
+func (e *Evaluator) Close() error {
+	if e.progFd == -1 {
+		return nil
+	}
+	err := unix.Close(e.progFd)
+	e.progFd = -1
+	return err
+}
+
+// Allowed reports whether the access (any combination of 'r', 'w', and
+// 'm') to the device with the given type (either [devices.CharDevice] or
+// [devices.BlockDevice]), major, and minor numbers is allowed, following
+// the semantics of cgroup v1 devices controller.
+//
+// In the verification mode (see NewVerifyingEvaluator), an error is also
+// returned if the eBPF device filter gives a different answer.
+func (e *Evaluator) Allowed(typ devices.Type, major, minor uint32, access devices.Permissions) (bool, error) {
+	if typ != devices.CharDevice && typ != devices.BlockDevice {
+		return false, fmt.Errorf("invalid device type %q", string(typ))
+	}
+	if access.IsEmpty() || strings.Trim(string(access), "rwm") != "" {
+		return false, fmt.Errorf("invalid device access %q", string(access))
+	}
+	allowed := e.emu.allows(typ, int64(major), int64(minor), access)
+	if e.progFd == -1 {
+		return allowed, nil
+	}
+	bpfAllowed, err := e.runFilter(typ, major, minor, access)
+	if err != nil {
+		return false, err
+	}
+	if bpfAllowed != allowed {
+		return allowed, &MismatchError{
+			Rule:         devices.Rule{Type: typ, Major: int64(major), Minor: int64(minor), Permissions: access},
+			Emulator:     allowed,
+			DeviceFilter: bpfAllowed,
+		}
+	}
+	return allowed, nil
+}
+
+// MismatchError is returned by [Evaluator.Allowed] in the verification
+// mode if the emulator and the eBPF device filter disagree.
+type MismatchError struct {
+	// Rule describes the access (Allow is not used).
+	Rule devices.Rule
+	// Emulator and DeviceFilter are the answers of the emulator
+	// and the eBPF device filter.
+	Emulator, DeviceFilter bool
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("device access %s %d:%d %s: emulator allowed=%v, eBPF device filter allowed=%v",
+		string(e.Rule.Type), e.Rule.Major, e.Rule.Minor, e.Rule.Permissions, e.Emulator, e.DeviceFilter)
+}
+
+// runFilter runs the loaded eBPF device filter program.
+func (e *Evaluator) runFilter(typ devices.Type, major, minor uint32, access devices.Permissions) (bool, error) {
+	bpfType := uint32(unix.BPF_DEVCG_DEV_CHAR)
+	if typ == devices.BlockDevice {
+		bpfType = unix.BPF_DEVCG_DEV_BLOCK
+	}
+	var bpfAccess uint32
+	for _, r := range access {
+		switch r {
+		case 'r':
+			bpfAccess |= unix.BPF_DEVCG_ACC_READ
+		case 'w':
+			bpfAccess |= unix.BPF_DEVCG_ACC_WRITE
+		case 'm':
+			bpfAccess |= unix.BPF_DEVCG_ACC_MKNOD
+		}
+	}
+	// struct bpf_cgroup_dev_ctx, padded to a multiple of 8 bytes.
+	ctx := make([]byte, 16)
+	bpf.NativeEndian.PutUint32(ctx[0:], bpfType|bpfAccess<<16)
+	bpf.NativeEndian.PutUint32(ctx[4:], major)
+	bpf.NativeEndian.PutUint32(ctx[8:], minor)
+	ret, err := bpf.ProgTestRun(e.progFd, ctx)
+	if err != nil {
+		return false, err
+	}
+	return ret == 1, nil
+}
+
+// allows reports whether the access to the device is allowed, the same way
+// the cgroup v1 devices controller does it (see devcgroup_legacy_check_permission
+// in the kernel).
+func (e *emulator) allows(node devices.Type, major, minor int64, access devices.Permissions) bool {
+	for meta, perms := range e.rules {
+		if meta.node != node ||
+			(meta.major != devices.Wildcard && meta.major != major) ||
+			(meta.minor != devices.Wildcard && meta.minor != minor) {
+			continue
+		}
+		if e.defaultAllow {
+			// The access must not match any exception, even partially.
+			if !perms.Intersection(access).IsEmpty() {
+				return false
+			}
+		} else if access.Difference(perms).IsEmpty() {
+			// The access must completely match an exception.
+			return true
+		}
+	}
+	return e.defaultAllow
+}
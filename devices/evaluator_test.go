@@ -0,0 +1,150 @@
+package devices
+
+import (
+	"errors"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/cilium/ebpf/asm"
+	"golang.org/x/sys/unix"
+
+	devices "github.com/opencontainers/cgroups/devices/config"
+	"github.com/opencontainers/cgroups/internal/bpf"
+)
+
+func TestEvaluator(t *testing.T) {
+	rules := []*devices.Rule{
+		// Allow-list mode.
+		{Type: devices.WildcardDevice, Major: devices.Wildcard, Minor: devices.Wildcard, Permissions: "rwm", Allow: false},
+		{Type: devices.CharDevice, Major: 1, Minor: 3, Permissions: "rwm", Allow: true},
+		{Type: devices.CharDevice, Major: devices.Wildcard, Minor: devices.Wildcard, Permissions: "m", Allow: true},
+		{Type: devices.CharDevice, Major: 10, Minor: 229, Permissions: "rw", Allow: true},
+	}
+	testCases := []struct {
+		typ          devices.Type
+		major, minor uint32
+		access       devices.Permissions
+		allowed      bool
+	}{
+		{devices.CharDevice, 1, 3, "rw", true},
+		{devices.CharDevice, 1, 3, "wr", true},
+		{devices.CharDevice, 1, 5, "r", false},
+		{devices.CharDevice, 1, 5, "m", true},
+		{devices.BlockDevice, 1, 5, "m", false},
+		{devices.CharDevice, 10, 229, "rw", true},
+		// The access has to fully match a single rule.
+		{devices.CharDevice, 10, 229, "rwm", false},
+	}
+
+	e, err := NewEvaluator(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range testCases {
+		allowed, err := e.Allowed(tc.typ, tc.major, tc.minor, tc.access)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != tc.allowed {
+			t.Errorf("%c %d:%d %s: expected allowed=%v, got %v", tc.typ, tc.major, tc.minor, tc.access, tc.allowed, allowed)
+		}
+	}
+
+	if _, err := e.Allowed(devices.WildcardDevice, 1, 3, "r"); err == nil {
+		t.Error("expected an error for a wildcard device type")
+	}
+	if _, err := e.Allowed(devices.CharDevice, 1, 3, "x"); err == nil {
+		t.Error("expected an error for an invalid access")
+	}
+}
+
+// requireVerifyingEvaluator skips the test unless the eBPF programs used
+// by NewVerifyingEvaluator can be loaded (which requires privileges and
+// a recent enough kernel).
+func requireVerifyingEvaluator(t *testing.T) {
+	t.Helper()
+	insts := asm.Instructions{asm.Mov.Imm32(asm.R0, 0), asm.Return()}
+	fd, err := bpf.ProgLoad(unix.BPF_PROG_TYPE_RAW_TRACEPOINT, FilterName, insts, "Apache")
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) || errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOSYS) {
+			t.Skipf("unable to load eBPF programs: %v", err)
+		}
+		t.Fatal(err)
+	}
+	unix.Close(fd)
+}
+
+func TestVerifyingEvaluator(t *testing.T) {
+	requireVerifyingEvaluator(t)
+	rng := rand.New(rand.NewSource(1))
+	perms := []devices.Permissions{"r", "w", "m", "rw", "rm", "wm", "rwm"}
+	randRule := func() *devices.Rule {
+		rule := &devices.Rule{
+			Type:        []devices.Type{devices.CharDevice, devices.BlockDevice}[rng.Intn(2)],
+			Major:       int64(rng.Intn(3)),
+			Minor:       int64(rng.Intn(3)),
+			Permissions: perms[rng.Intn(len(perms))],
+		}
+		if rng.Intn(4) == 0 {
+			rule.Major = devices.Wildcard
+		}
+		if rng.Intn(4) == 0 {
+			rule.Minor = devices.Wildcard
+		}
+		return rule
+	}
+
+	for i := range 100 {
+		// Alternate between the allow-list and the deny-list modes.
+		denyList := i%2 == 1
+		rules := []*devices.Rule{{
+			Type:        devices.WildcardDevice,
+			Major:       devices.Wildcard,
+			Minor:       devices.Wildcard,
+			Permissions: "rwm",
+			Allow:       denyList,
+		}}
+		for range rng.Intn(8) {
+			rule := randRule()
+			rule.Allow = !denyList
+			rules = append(rules, rule)
+		}
+		if _, err := NewEvaluator(rules); err != nil {
+			// The emulator rejects some rule sets (see emulator.rmRule).
+			continue
+		}
+		// Any other error is a failure to load the device filter.
+		e, err := NewVerifyingEvaluator(rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, typ := range []devices.Type{devices.CharDevice, devices.BlockDevice} {
+			for major := range uint32(4) {
+				for minor := range uint32(4) {
+					for _, access := range perms {
+						// In the deny-list mode, the eBPF program only denies
+						// the access fully covered by a rule, while cgroup v1
+						// denies any overlapping access, so only the single
+						// access types are compared.
+						if denyList && len(access) > 1 {
+							continue
+						}
+						if _, err := e.Allowed(typ, major, minor, access); err != nil {
+							e.Close()
+							if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EINVAL) {
+								t.Skipf("BPF_PROG_TEST_RUN is not supported: %v", err)
+							}
+							var list []string
+							for _, rule := range rules {
+								list = append(list, rule.CgroupString())
+							}
+							t.Fatalf("rules %q: %v", list, err)
+						}
+					}
+				}
+			}
+		}
+		e.Close()
+	}
+}
@@ -0,0 +1,240 @@
+package devices
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/opencontainers/cgroups"
+	"github.com/opencontainers/cgroups/internal/bpf"
+)
+
+// heldLinks are the fds of the device filter links which are not pinned,
+// by cgroup ID. They are kept open until the link is removed (see
+// unlinkV2), as closing the last fd of a link detaches its program. The
+// mutex also serializes the updates of the pinned links by this process.
+var heldLinks = struct {
+	sync.Mutex
+	fds map[uint64]int
+}{fds: make(map[uint64]int)}
+
+// cgroupID returns the ID of the cgroup v2 dirFd, which is its inode number.
+func cgroupID(dirFd int) (uint64, error) {
+	var st unix.Stat_t
+	if err := unix.Fstat(dirFd, &st); err != nil {
+		return 0, os.NewSyscallError("fstat", err)
+	}
+	return st.Ino, nil
+}
+
+// linkPinPath returns the path the device filter link of the cgroup with
+// the given ID is pinned at.
+func linkPinPath(pinDir string, id uint64) string {
+	return filepath.Join(pinDir, "devices-"+strconv.FormatUint(id, 10))
+}
+
+// linkCgroupDeviceFilter attaches progFd to the cgroup dirFd through a BPF
+// link, which is pinned in pinDir (unless it is empty, in which case the
+// link fd is held by this process).
+//
+// If the cgroup already has such a link, its program is replaced, which is
+// atomic. Otherwise, a new link is created, and all the device filters
+// attached to the cgroup before are detached once it is in place, like
+// loadAttachCgroupDeviceFilter does.
+func linkCgroupDeviceFilter(progFd, dirFd int, pinDir string) error {
+	id, err := cgroupID(dirFd)
+	if err != nil {
+		return err
+	}
+
+	heldLinks.Lock()
+	defer heldLinks.Unlock()
+
+	// Update the existing link, if any.
+	linkFd, pinned := -1, pinDir != ""
+	if pinned {
+		linkFd, err = bpf.ObjGet(linkPinPath(pinDir, id))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	} else if fd, ok := heldLinks.fds[id]; ok {
+		linkFd = fd
+	}
+	if linkFd != -1 {
+		err := bpf.LinkUpdate(linkFd, progFd)
+		if pinned {
+			unix.Close(linkFd)
+		}
+		if err == nil {
+			return nil
+		}
+		// ENOLINK means the link is defunct, i.e. its cgroup has been
+		// removed, or it has been detached (see detachLinkedFilter).
+		// Replace it.
+		if !errors.Is(err, unix.ENOLINK) {
+			return fmt.Errorf("failed to call BPF_LINK_UPDATE: %w", err)
+		}
+		if err := removeLink(pinDir, id); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	// Get the list of existing programs.
+	oldFds, err := findAttachedCgroupDeviceFilters(dirFd)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, fd := range oldFds {
+			unix.Close(fd)
+		}
+	}()
+
+	linkFd, err = bpf.LinkCreate(dirFd, progFd, unix.BPF_CGROUP_DEVICE)
+	if err != nil {
+		return fmt.Errorf("failed to call BPF_LINK_CREATE: %w", err)
+	}
+	if pinned {
+		// Until it is pinned, the link is only held by linkFd, so
+		// closing it on error detaches the program (while the old
+		// ones are still there).
+		err := bpf.ObjPin(linkFd, linkPinPath(pinDir, id))
+		unix.Close(linkFd)
+		if err != nil {
+			return err
+		}
+	} else {
+		heldLinks.fds[id] = linkFd
+	}
+
+	return detachOldFilters(dirFd, id, oldFds)
+}
+
+// detachOldFilters detaches the device filters oldFds from the cgroup dirFd
+// with the given ID, once the new one is attached.
+func detachOldFilters(dirFd int, id uint64, oldFds []int) error {
+	for _, oldFd := range oldFds {
+		err := bpf.ProgDetach(dirFd, oldFd, unix.BPF_CGROUP_DEVICE)
+		if errors.Is(err, unix.ENOENT) {
+			// The program is attached through a BPF link.
+			if err := detachLinkedFilter(id, oldFd); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to call BPF_PROG_DETACH (BPF_CGROUP_DEVICE) on old filter program: %w", err)
+		}
+	}
+	return nil
+}
+
+// detachLinkedFilter detaches the device filter progFd, which is attached
+// to the cgroup with the given ID through a BPF link, and so can't be
+// detached with BPF_PROG_DETACH. The link is looked up among all the BPF
+// links, and detached with BPF_LINK_DETACH, which works even if it is
+// pinned (the defunct link is then replaced, or removed, later on). The
+// links of the programs other than ours are left alone.
+//
+// It requires Linux 5.9 or later. The caller holds heldLinks.
+func detachLinkedFilter(id uint64, progFd int) error {
+	info, _, err := bpf.ProgGetInfo(progFd)
+	if err != nil {
+		return err
+	}
+	if info.NameString() != FilterName {
+		logrus.Debugf("not detaching a device filter (prog_id=%d) attached through another BPF link", info.ID)
+		return nil
+	}
+	var linkID uint32
+	for {
+		linkID, err = bpf.LinkGetNextID(linkID)
+		if errors.Is(err, unix.ENOENT) {
+			// The link is gone already.
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to find the BPF link of device filter (prog_id=%d): %w", info.ID, err)
+		}
+		linkFd, err := bpf.LinkGetFdByID(linkID)
+		if errors.Is(err, unix.ENOENT) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		linkInfo, err := bpf.LinkGetInfo(linkFd)
+		if err == nil && linkInfo.Type == unix.BPF_LINK_TYPE_CGROUP && linkInfo.CgroupID == id &&
+			linkInfo.AttachType == unix.BPF_CGROUP_DEVICE && linkInfo.ProgID == info.ID {
+			err = bpf.LinkDetach(linkFd)
+			unix.Close(linkFd)
+			if err != nil {
+				return fmt.Errorf("failed to call BPF_LINK_DETACH: %w", err)
+			}
+			// Release the link, if it is held by this process.
+			if fd, ok := heldLinks.fds[id]; ok {
+				if held, err := bpf.LinkGetInfo(fd); err == nil && held.ID == linkID {
+					delete(heldLinks.fds, id)
+					unix.Close(fd)
+				}
+			}
+			return nil
+		}
+		unix.Close(linkFd)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// removeLink unpins or closes the device filter link of the cgroup with the
+// given ID, depending on whether pinDir is set. Once the cgroup is removed,
+// that is the only way to release the link, together with its program.
+// The caller holds heldLinks.
+func removeLink(pinDir string, id uint64) error {
+	if pinDir != "" {
+		return os.Remove(linkPinPath(pinDir, id))
+	}
+	if fd, ok := heldLinks.fds[id]; ok {
+		delete(heldLinks.fds, id)
+		return unix.Close(fd)
+	}
+	return nil
+}
+
+// unlinkV2 returns the function which removes the device filter link of
+// the cgroup v2 dirPath, if any, which is created by setV2 when
+// r.DevicesLink is set. As the link is looked up by the cgroup ID, unlinkV2
+// is to be called while the cgroup is still there, but the function it
+// returns can be called once the cgroup is removed (so that the device
+// filter stays attached as long as the cgroup has processes).
+func unlinkV2(dirPath string, r *cgroups.Resources) (func() error, error) {
+	if r.DevicesLink == nil {
+		return func() error { return nil }, nil
+	}
+	dirFd, err := unix.Open(dirPath, unix.O_DIRECTORY|unix.O_RDONLY|unix.O_CLOEXEC, 0o600)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: dirPath, Err: err}
+	}
+	id, err := cgroupID(dirFd)
+	unix.Close(dirFd)
+	if err != nil {
+		return nil, err
+	}
+
+	pinDir := r.DevicesLink.PinDir
+	return func() error {
+		heldLinks.Lock()
+		defer heldLinks.Unlock()
+		if err := removeLink(pinDir, id); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,192 @@
+package devices
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/opencontainers/cgroups"
+	devices "github.com/opencontainers/cgroups/devices/config"
+)
+
+// testCgroup2 creates a temporary cgroup v2 cgroup, skipping the test if
+// it is not possible.
+func testCgroup2(t *testing.T) string {
+	t.Helper()
+	for _, root := range []string{"/sys/fs/cgroup", "/sys/fs/cgroup/unified"} {
+		var st unix.Statfs_t
+		if err := unix.Statfs(root, &st); err != nil || st.Type != unix.CGROUP2_SUPER_MAGIC {
+			continue
+		}
+		path, err := os.MkdirTemp(root, "devices-test-")
+		if err != nil {
+			t.Skipf("unable to create a cgroup: %v", err)
+		}
+		t.Cleanup(func() { _ = os.Remove(path) })
+		return path
+	}
+	t.Skip("cgroup v2 is not mounted")
+	return ""
+}
+
+// mountBpffs mounts a bpffs in a temporary directory, skipping the test if
+// it is not possible.
+func mountBpffs(t *testing.T) string {
+	t.Helper()
+	bpffs := t.TempDir()
+	if err := unix.Mount("bpf", bpffs, "bpf", 0, ""); err != nil {
+		t.Skipf("unable to mount bpffs: %v", err)
+	}
+	t.Cleanup(func() { _ = unix.Unmount(bpffs, unix.MNT_DETACH) })
+	return bpffs
+}
+
+// setLinked is setV2, skipping the test if BPF links are not supported.
+func setLinked(t *testing.T, path string, r *cgroups.Resources) {
+	t.Helper()
+	if err := setV2(path, r); err != nil {
+		if errors.Is(err, unix.EINVAL) || errors.Is(err, os.ErrPermission) {
+			t.Skipf("unable to attach a device filter through a BPF link: %v", err)
+		}
+		t.Fatal(err)
+	}
+}
+
+// getFilter returns the only filter attached to path, which is ours.
+func getFilter(t *testing.T, path string) *Filter {
+	t.Helper()
+	filters, err := GetFilters(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filters) != 1 {
+		t.Fatalf("expected 1 filter, got %d", len(filters))
+	}
+	if f := filters[0]; f.Name != FilterName || !f.Known {
+		t.Fatalf("expected a filter named %q, got %+v", FilterName, f)
+	}
+	return filters[0]
+}
+
+func TestDevicesLink(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	bpffs := mountBpffs(t)
+
+	ruleSets := [][]*devices.Rule{
+		{{Type: devices.CharDevice, Major: 1, Minor: 3, Permissions: "rwm", Allow: true}},
+		{{Type: devices.BlockDevice, Major: 8, Minor: devices.Wildcard, Permissions: "r", Allow: true}},
+	}
+	for _, pinDir := range []string{"", bpffs} {
+		path := testCgroup2(t)
+		r := &cgroups.Resources{DevicesLink: &devices.Link{PinDir: pinDir}}
+		var prevID uint32
+		for _, rules := range ruleSets {
+			r.Devices = rules
+			setLinked(t, path, r)
+			f := getFilter(t, path)
+			expected := make([]*RuleRange, 0, len(rules))
+			for _, rule := range rules {
+				expected = append(expected, &RuleRange{Rule: *rule, MinorEnd: rule.Minor})
+			}
+			if !reflect.DeepEqual(f.Rules, expected) {
+				t.Errorf("pinDir %q: unexpected filter rules: %+v", pinDir, f.Rules)
+			}
+			if f.ID == prevID {
+				t.Errorf("pinDir %q: filter program was not replaced", pinDir)
+			}
+			prevID = f.ID
+		}
+		if m, _ := filepath.Glob(filepath.Join(bpffs, "devices-*")); len(m) != min(len(pinDir), 1) {
+			t.Errorf("pinDir %q: unexpected pinned links %v", pinDir, m)
+		}
+
+		unlink, err := unlinkV2(path, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The link is only removed once asked for.
+		getFilter(t, path)
+		if err := unlink(); err != nil {
+			t.Fatal(err)
+		}
+		filters, err := GetFilters(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(filters) != 0 {
+			t.Errorf("pinDir %q: expected no filters after unlinking, got %d", pinDir, len(filters))
+		}
+		if m, _ := filepath.Glob(filepath.Join(bpffs, "devices-*")); len(m) != 0 {
+			t.Errorf("pinDir %q: expected no pinned links after unlinking, got %v", pinDir, m)
+		}
+	}
+}
+
+func TestDevicesLinkRemovedCgroup(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	bpffs := mountBpffs(t)
+	path := testCgroup2(t)
+	r := &cgroups.Resources{
+		Devices:     []*devices.Rule{{Type: devices.CharDevice, Major: 1, Minor: 3, Permissions: "rwm", Allow: true}},
+		DevicesLink: &devices.Link{PinDir: bpffs},
+	}
+	setLinked(t, path, r)
+
+	// The link is looked up while the cgroup is there, and removed after
+	// it is gone (as the systemd manager does).
+	unlink, err := unlinkV2(path, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := unlink(); err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := filepath.Glob(filepath.Join(bpffs, "devices-*")); len(m) != 0 {
+		t.Errorf("expected no pinned links after unlinking, got %v", m)
+	}
+}
+
+func TestDevicesLinkSwitch(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	bpffs := mountBpffs(t)
+	path := testCgroup2(t)
+	rules := []*devices.Rule{{Type: devices.CharDevice, Major: 1, Minor: 3, Permissions: "rwm", Allow: true}}
+	linked := &cgroups.Resources{Devices: rules, DevicesLink: &devices.Link{PinDir: bpffs}}
+	setLinked(t, path, linked)
+	prev := getFilter(t, path)
+
+	// A Set without a link detaches the linked filter through its link.
+	if err := setV2(path, &cgroups.Resources{Devices: rules}); err != nil {
+		t.Fatal(err)
+	}
+	f := getFilter(t, path)
+	if f.ID == prev.ID {
+		t.Error("expected the linked filter to be replaced")
+	}
+
+	// And the other way round, replacing the defunct link.
+	setLinked(t, path, linked)
+	if f := getFilter(t, path); f.ID == prev.ID {
+		t.Error("expected the filter to be replaced")
+	}
+	unlink, err := unlinkV2(path, linked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unlink(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,179 @@
+package devices
+
+import (
+	"fmt"
+
+	devices "github.com/opencontainers/cgroups/devices/config"
+)
+
+// LintKind is the kind of a problem with a device rule found by [Lint].
+type LintKind int
+
+const (
+	// Shadowed means the rule has no effect, as the devices and
+	// permissions it matches are already given the same action by an
+	// earlier rule (such as a wildcard rule).
+	Shadowed LintKind = iota + 1
+	// NoOp means the rule has no effect, as it has no permissions, or
+	// nothing it matches was given the opposite action before, or its
+	// effect is discarded by a later rule for all devices ("a").
+	NoOp
+	// Conflicting means the rule reverts (a part of) the effect of an
+	// earlier rule, or it can't be applied at all, as it would punch a
+	// hole in an earlier wildcard rule (see [Normalize]).
+	Conflicting
+)
+
+func (k LintKind) String() string {
+	switch k {
+	case Shadowed:
+		return "shadowed"
+	case NoOp:
+		return "no-op"
+	case Conflicting:
+		return "conflicting"
+	default:
+		return fmt.Sprintf("LintKind(%d)", int(k))
+	}
+}
+
+// LintIssue is a problem with a device rule found by [Lint].
+type LintIssue struct {
+	Kind LintKind
+	// Index is the index of the rule.
+	Index int
+	// Rule is the rule.
+	Rule *devices.Rule
+	// Other is the index of the other rule involved, i.e. the one which
+	// shadows the rule, the later one discarding its effect, or the one
+	// it conflicts with. It is -1 if there is no such rule.
+	Other int
+}
+
+func (i LintIssue) String() string {
+	s := fmt.Sprintf("rule %d (%s) is %s", i.Index, i.Rule.CgroupString(), i.Kind)
+	if i.Other >= 0 {
+		switch i.Kind {
+		case Shadowed:
+			s += fmt.Sprintf(" by rule %d", i.Other)
+		case NoOp:
+			s += fmt.Sprintf(" (discarded by rule %d)", i.Other)
+		case Conflicting:
+			s += fmt.Sprintf(" with rule %d", i.Other)
+		}
+	}
+	return s
+}
+
+// Lint finds the device rules which are redundant or conflicting, when
+// applied in order with the cgroup v1 semantics (as with [Normalize]).
+// The issues are sorted by rule index, with at most one issue per rule.
+func Lint(rules []*devices.Rule) []LintIssue {
+	l := &linter{
+		emu:   new(emulator),
+		owner: make(map[deviceMeta]int),
+	}
+	for i, rule := range rules {
+		l.apply(i, rule)
+	}
+	// Issues for the discarded rules are found out of order.
+	issues := make([]LintIssue, 0, len(l.issues))
+	for i, rule := range rules {
+		if issue, ok := l.issues[i]; ok {
+			issue.Index, issue.Rule = i, rule
+			issues = append(issues, issue)
+		}
+	}
+	return issues
+}
+
+type linter struct {
+	emu *emulator
+	// owner is the index of the last rule which changed an entry of emu.
+	owner map[deviceMeta]int
+	// effective are the indices of the rules applied since the last
+	// rule for all devices (including it), which had an effect.
+	effective []int
+	issues    map[int]LintIssue
+}
+
+func (l *linter) report(i int, kind LintKind, other int) {
+	if l.issues == nil {
+		l.issues = make(map[int]LintIssue)
+	}
+	l.issues[i] = LintIssue{Kind: kind, Other: other}
+}
+
+func (l *linter) apply(i int, rule *devices.Rule) {
+	if !rule.Type.CanCgroup() {
+		return
+	}
+	if rule.Type == devices.WildcardDevice {
+		// All the rules since the last reset are discarded.
+		for _, j := range l.effective {
+			l.report(j, NoOp, i)
+		}
+		_ = l.emu.Apply(*rule)
+		clear(l.owner)
+		l.effective = []int{i}
+		return
+	}
+	if rule.Permissions.IsEmpty() || !rule.Permissions.IsValid() {
+		l.report(i, NoOp, -1)
+		return
+	}
+
+	r := deviceRule{
+		meta:  deviceMeta{node: rule.Type, major: rule.Major, minor: rule.Minor},
+		perms: rule.Permissions,
+	}
+	if rule.Allow != l.emu.defaultAllow {
+		// The rule adds an exception, which may be covered by an
+		// existing one.
+		other := -1
+		for meta, perms := range l.emu.rules {
+			if (deviceRule{meta: meta, perms: perms}).covers(r) {
+				if j := l.owner[meta]; other == -1 || j < other {
+					other = j
+				}
+			}
+		}
+		if other != -1 {
+			l.report(i, Shadowed, other)
+			return
+		}
+		_ = l.emu.Apply(*rule)
+		l.owner[r.meta] = i
+		l.effective = append(l.effective, i)
+		return
+	}
+
+	// The rule removes (a part of) an exception.
+	before := l.emu.rules[r.meta]
+	if err := l.emu.Apply(*rule); err != nil {
+		// It would punch a hole in a wildcard exception.
+		other := -1
+		for _, meta := range []deviceMeta{
+			{node: r.meta.node, major: devices.Wildcard, minor: r.meta.minor},
+			{node: r.meta.node, major: r.meta.major, minor: devices.Wildcard},
+			{node: r.meta.node, major: devices.Wildcard, minor: devices.Wildcard},
+		} {
+			if j, ok := l.owner[meta]; ok && meta != r.meta && !l.emu.rules[meta].Intersection(r.perms).IsEmpty() {
+				other = j
+				break
+			}
+		}
+		l.report(i, Conflicting, other)
+		return
+	}
+	if before.Intersection(r.perms).IsEmpty() {
+		l.report(i, NoOp, -1)
+		return
+	}
+	j := l.owner[r.meta]
+	if _, ok := l.emu.rules[r.meta]; !ok {
+		delete(l.owner, r.meta)
+	}
+	l.report(i, Conflicting, j)
+	l.effective = append(l.effective, i)
+}
@@ -0,0 +1,58 @@
+package devices
+
+import (
+	"testing"
+
+	devices "github.com/opencontainers/cgroups/devices/config"
+)
+
+func TestLint(t *testing.T) {
+	rules := []*devices.Rule{
+		{Type: devices.WildcardDevice, Major: devices.Wildcard, Minor: devices.Wildcard, Permissions: "rwm", Allow: false},
+		{Type: devices.CharDevice, Major: devices.Wildcard, Minor: devices.Wildcard, Permissions: "m", Allow: true},
+		{Type: devices.CharDevice, Major: 1, Minor: 3, Permissions: "m", Allow: true},
+		{Type: devices.CharDevice, Major: 1, Minor: 3, Permissions: "rw", Allow: true},
+		{Type: devices.CharDevice, Major: 1, Minor: 3, Permissions: "w", Allow: false},
+		{Type: devices.CharDevice, Major: 5, Minor: 0, Permissions: "r", Allow: false},
+		{Type: devices.CharDevice, Major: 2, Minor: 2, Permissions: "m", Allow: false},
+		{Type: devices.BlockDevice, Major: 8, Minor: 0, Permissions: "", Allow: true},
+		{Type: devices.BlockDevice, Major: 8, Minor: 1, Permissions: "r", Allow: true},
+	}
+	expected := []string{
+		"rule 2 (c 1:3 m) is shadowed by rule 1",
+		"rule 4 (c 1:3 w) is conflicting with rule 3",
+		"rule 5 (c 5:0 r) is no-op",
+		"rule 6 (c 2:2 m) is conflicting with rule 1",
+		"rule 7 (b 8:0 ) is no-op",
+	}
+	checkLint(t, rules, expected)
+
+	// A rule for all devices discards the earlier rules.
+	rules = append(rules, &devices.Rule{Type: devices.WildcardDevice, Major: devices.Wildcard, Minor: devices.Wildcard, Permissions: "rwm", Allow: true})
+	expected = []string{
+		"rule 0 (a *:* rwm) is no-op (discarded by rule 9)",
+		"rule 1 (c *:* m) is no-op (discarded by rule 9)",
+		"rule 2 (c 1:3 m) is shadowed by rule 1",
+		"rule 3 (c 1:3 rw) is no-op (discarded by rule 9)",
+		"rule 4 (c 1:3 w) is no-op (discarded by rule 9)",
+		"rule 5 (c 5:0 r) is no-op",
+		"rule 6 (c 2:2 m) is conflicting with rule 1",
+		"rule 7 (b 8:0 ) is no-op",
+		"rule 8 (b 8:1 r) is no-op (discarded by rule 9)",
+	}
+	checkLint(t, rules, expected)
+}
+
+func checkLint(t *testing.T, rules []*devices.Rule, expected []string) {
+	t.Helper()
+	issues := Lint(rules)
+	if len(issues) != len(expected) {
+		t.Errorf("expected %d issues, got %d: %v", len(expected), len(issues), issues)
+		return
+	}
+	for i, issue := range issues {
+		if s := issue.String(); s != expected[i] {
+			t.Errorf("issue %d: expected %q, got %q", i, expected[i], s)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package devices
+
+import (
+	"math"
+
+	devices "github.com/opencontainers/cgroups/devices/config"
+)
+
+// RuleRange is a device rule matching a range of minor numbers.
+type RuleRange struct {
+	devices.Rule
+	// MinorEnd is the last minor number matched by the rule (so the rule
+	// matches the minor numbers from Minor to MinorEnd). It is equal to
+	// Minor if the rule matches a single minor number, or any of them.
+	MinorEnd int64
+}
+
+// RuleSet is the normalized form of a list of device rules.
+type RuleSet struct {
+	// DefaultAllow is the action for the devices not matching any rule.
+	DefaultAllow bool
+	// Rules are the exceptions to DefaultAllow, i.e. all of them have the
+	// opposite action, so their order does not matter. They are sorted by
+	// major number, minor number, and type.
+	Rules []*RuleRange
+}
+
+// Normalize returns the minimal rule set equivalent to rules, applied in
+// order with the cgroup v1 semantics (starting in the deny-all mode). It
+// is the rule set compiled into the cgroup v2 device filter.
+//
+// Normalization collapses the rules for the same devices into one with the
+// union of their permissions, drops the rules which are covered by other
+// (wildcard) rules, and merges the rules for adjacent minor numbers (with
+// the same type, major number and permissions) into ranges.
+//
+// Like with cgroup v1, the rules which would punch a hole in an earlier
+// wildcard rule are rejected (see also [Lint]).
+func Normalize(rules []*devices.Rule) (*RuleSet, error) {
+	emu := new(emulator)
+	for _, rule := range rules {
+		if err := emu.Apply(*rule); err != nil {
+			return nil, err
+		}
+	}
+	return emu.normalize(), nil
+}
+
+func (e *emulator) normalize() *RuleSet {
+	entries := e.rules.orderedEntries()
+	s := &RuleSet{DefaultAllow: e.defaultAllow}
+	// Ranges which can still be extended, by (type, major, permissions).
+	type rangeKey struct {
+		node  devices.Type
+		major int64
+		perms devices.Permissions
+	}
+	open := make(map[rangeKey]*RuleRange)
+	for i, entry := range entries {
+		covered := false
+		for j, o := range entries {
+			if i != j && o.covers(entry) {
+				covered = true
+				break
+			}
+		}
+		if covered {
+			continue
+		}
+		meta := entry.meta
+		key := rangeKey{node: meta.node, major: meta.major, perms: entry.perms}
+		if r := open[key]; r != nil && meta.major != devices.Wildcard && meta.minor != devices.Wildcard &&
+			r.MinorEnd+1 == meta.minor && meta.minor <= math.MaxInt32 {
+			r.MinorEnd = meta.minor
+			continue
+		}
+		r := &RuleRange{
+			Rule: devices.Rule{
+				Type:        meta.node,
+				Major:       meta.major,
+				Minor:       meta.minor,
+				Permissions: entry.perms,
+				Allow:       !e.defaultAllow,
+			},
+			MinorEnd: meta.minor,
+		}
+		if meta.minor != devices.Wildcard {
+			open[key] = r
+		}
+		s.Rules = append(s.Rules, r)
+	}
+	return s
+}
+
+// covers reports whether r matches every access matched by o.
+func (r deviceRule) covers(o deviceRule) bool {
+	return r.meta.node == o.meta.node &&
+		(r.meta.major == devices.Wildcard || r.meta.major == o.meta.major) &&
+		(r.meta.minor == devices.Wildcard || r.meta.minor == o.meta.minor) &&
+		o.perms.Difference(r.perms).IsEmpty()
+}
+
+// DeviceRules returns the list of rules equivalent to s, which is a rule
+// for all devices with the DefaultAllow action, followed by the rules of
+// s, with the ranges split into individual rules.
+func (s *RuleSet) DeviceRules() []*devices.Rule {
+	rules := []*devices.Rule{{
+		Type:        devices.WildcardDevice,
+		Major:       devices.Wildcard,
+		Minor:       devices.Wildcard,
+		Permissions: "rwm",
+		Allow:       s.DefaultAllow,
+	}}
+	for _, r := range s.Rules {
+		rules = append(rules, r.split()...)
+	}
+	return rules
+}
+
+// split returns the individual rules matched by r.
+func (r *RuleRange) split() []*devices.Rule {
+	rules := []*devices.Rule{}
+	for minor := r.Minor; ; minor++ {
+		rule := r.Rule
+		rule.Minor = minor
+		rules = append(rules, &rule)
+		if minor >= r.MinorEnd {
+			return rules
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package devices
+
+import (
+	"reflect"
+	"testing"
+
+	devices "github.com/opencontainers/cgroups/devices/config"
+)
+
+func TestNormalize(t *testing.T) {
+	rules := []*devices.Rule{
+		{Type: devices.CharDevice, Major: 1, Minor: 3, Permissions: "r", Allow: true},
+		{Type: devices.CharDevice, Major: 1, Minor: 3, Permissions: "w", Allow: true},
+		{Type: devices.CharDevice, Major: 1, Minor: 5, Permissions: "wr", Allow: true},
+		{Type: devices.CharDevice, Major: 1, Minor: 4, Permissions: "rw", Allow: true},
+		{Type: devices.CharDevice, Major: 1, Minor: 6, Permissions: "r", Allow: true},
+		{Type: devices.BlockDevice, Major: 1, Minor: 7, Permissions: "rw", Allow: true},
+		{Type: devices.CharDevice, Major: devices.Wildcard, Minor: devices.Wildcard, Permissions: "m", Allow: true},
+		{Type: devices.CharDevice, Major: 10, Minor: 200, Permissions: "m", Allow: true},
+	}
+	set, err := Normalize(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng := func(typ devices.Type, major, minor, minorEnd int64, perms devices.Permissions) *RuleRange {
+		return &RuleRange{
+			Rule:     devices.Rule{Type: typ, Major: major, Minor: minor, Permissions: perms, Allow: true},
+			MinorEnd: minorEnd,
+		}
+	}
+	expected := &RuleSet{
+		Rules: []*RuleRange{
+			rng(devices.CharDevice, devices.Wildcard, devices.Wildcard, devices.Wildcard, "m"),
+			rng(devices.CharDevice, 1, 3, 5, "rw"),
+			rng(devices.CharDevice, 1, 6, 6, "r"),
+			rng(devices.BlockDevice, 1, 7, 7, "rw"),
+		},
+	}
+	if !reflect.DeepEqual(set, expected) {
+		t.Errorf("unexpected rule set:\n got %+v\nwant %+v", set.Rules, expected.Rules)
+	}
+
+	// The normalized rules are equivalent to the original ones.
+	expand := set.DeviceRules()
+	if len(expand) != 7 {
+		t.Fatalf("expected 7 rules, got %d", len(expand))
+	}
+	again, err := Normalize(expand)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(again, set) {
+		t.Errorf("normalizing the expanded rules gives a different rule set:\n got %+v\nwant %+v", again.Rules, set.Rules)
+	}
+}
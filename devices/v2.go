@@ -1,13 +1,16 @@
 package devices
 
 import (
+	"encoding/hex"
 	"fmt"
+	"os"
 
 	"github.com/moby/sys/userns"
 	"golang.org/x/sys/unix"
 
 	"github.com/opencontainers/cgroups"
 	devices "github.com/opencontainers/cgroups/devices/config"
+	"github.com/opencontainers/cgroups/internal/bpf"
 )
 
 func isRWM(perms devices.Permissions) bool {
@@ -55,7 +58,17 @@ func setV2(dirPath string, r *cgroups.Resources) error {
 	if r.SkipDevices {
 		return nil
 	}
-	insts, license, err := deviceFilter(r.Devices)
+	var audit *auditConfig
+	if r.DevicesAudit != nil {
+		fd, err := openAuditRingBuf(r.DevicesAudit.Pin)
+		if err != nil {
+			return fmt.Errorf("unable to open device audit ring buffer: %w", err)
+		}
+		// Once the program is loaded, it holds a reference to the map.
+		defer unix.Close(fd)
+		audit = &auditConfig{ringBufFd: fd, logOnly: r.DevicesAudit.LogOnly}
+	}
+	insts, license, err := auditedDeviceFilter(r.Devices, audit)
 	if err != nil {
 		return err
 	}
@@ -64,10 +77,81 @@ func setV2(dirPath string, r *cgroups.Resources) error {
 		return fmt.Errorf("cannot get dir FD for %s", dirPath)
 	}
 	defer unix.Close(dirFD)
-	if err := loadAttachCgroupDeviceFilter(insts, license, dirFD); err != nil {
+	if err := loadAttachCgroupDeviceFilter(insts, license, dirFD, r.DevicesLink); err != nil {
 		if !canSkipEBPFError(r) {
 			return err
 		}
 	}
 	return nil
 }
+
+// Filter describes a device filter, i.e. a BPF_CGROUP_DEVICE eBPF program,
+// attached to a cgroup v2 cgroup.
+type Filter struct {
+	// ID is the program ID.
+	ID uint32
+	// Name is the program name, which is set by some generators
+	// (this package uses [FilterName], and systemd uses "sd_devices").
+	Name string
+	// Tag is the program tag (a hash of its instructions), in hex.
+	Tag string
+	// Known is true if the program was generated by this package, in
+	// which case it is described by Rules and DefaultAllow. Otherwise,
+	// the program comes from an unknown generator, such as systemd.
+	Known bool
+	// Rules are the device rules, in the order they are checked by the
+	// program (the first matching rule decides). All the rules have
+	// the action opposite to DefaultAllow. The ranges of minor numbers
+	// are kept as they are (rather than split into a rule per minor, as
+	// [RuleSet.DeviceRules] does), as a program may well match most of
+	// the minor numbers with a single range.
+	Rules []*RuleRange
+	// DefaultAllow is the action for devices not matching any rule.
+	DefaultAllow bool
+}
+
+// GetFilters returns the device filters attached to the cgroup v2 dirPath,
+// decoding the ones generated by this package back into device rules.
+//
+// It requires the privileges to read the eBPF program instructions.
+func GetFilters(dirPath string) ([]*Filter, error) {
+	dirFd, err := unix.Open(dirPath, unix.O_DIRECTORY|unix.O_RDONLY|unix.O_CLOEXEC, 0o600)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: dirPath, Err: err}
+	}
+	defer unix.Close(dirFd)
+
+	fds, err := findAttachedCgroupDeviceFilters(dirFd)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+	}()
+
+	filters := make([]*Filter, 0, len(fds))
+	for _, fd := range fds {
+		info, insns, err := bpf.ProgGetInfo(fd)
+		if err != nil {
+			return nil, err
+		}
+		if insns == nil {
+			return nil, fmt.Errorf("instructions of device filter program (prog_id=%d) are not available", info.ID)
+		}
+		f := &Filter{
+			ID:   info.ID,
+			Name: info.NameString(),
+			Tag:  hex.EncodeToString(info.Tag[:]),
+		}
+		// Programs which can't be decoded are from unknown generators.
+		if rules, defaultAllow, err := decodeDeviceFilter(insns); err == nil {
+			f.Known = true
+			f.DefaultAllow = defaultAllow
+			f.Rules = rules
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
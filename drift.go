@@ -0,0 +1,88 @@
+package cgroups
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Drift describes a setting applied by [Manager.Set] whose current value
+// differs from the one it had right after being applied, for example
+// because it was changed by hand, or rewritten by systemd on daemon-reload.
+type Drift struct {
+	// Path is the cgroup directory, and File is the cgroup file name.
+	// Both are empty for a systemd unit property.
+	Path string `json:"path,omitzero"`
+	File string `json:"file,omitzero"`
+	// Unit is the systemd unit name, and Property is the unit property
+	// name. Both are empty for a cgroup file.
+	Unit     string `json:"unit,omitzero"`
+	Property string `json:"property,omitzero"`
+	// Expected is the applied value, and Actual is the current one.
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+	// Err, if set, is why the current value could not be read (in which
+	// case Actual is empty).
+	Err string `json:"error,omitzero"`
+}
+
+func (d Drift) String() string {
+	what := d.Path + "/" + d.File
+	if d.Property != "" {
+		what = d.Unit + " property " + d.Property
+	}
+	if d.Err != "" {
+		return fmt.Sprintf("%s: expected %q, got error: %s", what, d.Expected, d.Err)
+	}
+	return fmt.Sprintf("%s: expected %q, got %q", what, d.Expected, d.Actual)
+}
+
+// Verifier is implemented by cgroup managers that can detect, and repair,
+// the drift of the settings applied by the last successful [Manager.Set]
+// call (both in cgroupfs and, for systemd managers, in unit properties).
+type Verifier interface {
+	// Verify returns the applied settings whose current values
+	// differ from the applied ones.
+	Verify() ([]Drift, error)
+
+	// Reconcile is like Verify, but it also re-applies the drifted
+	// settings (and only those).
+	Reconcile() ([]Drift, error)
+}
+
+// contextVerifier is implemented by the Verifiers whose checks can be
+// aborted, such as the systemd managers.
+type contextVerifier interface {
+	VerifyContext(ctx context.Context) ([]Drift, error)
+	ReconcileContext(ctx context.Context) ([]Drift, error)
+}
+
+// WatchDrift calls v.Verify (or v.Reconcile, if reconcile is true) every
+// interval, and passes the results to fn, until ctx is done. If v has the
+// VerifyContext and ReconcileContext methods, they are called with ctx
+// instead. It fails if interval is not positive.
+func WatchDrift(ctx context.Context, v Verifier, interval time.Duration, reconcile bool, fn func([]Drift, error)) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid drift watch interval %v", interval)
+	}
+	check := v.Verify
+	if reconcile {
+		check = v.Reconcile
+	}
+	if cv, ok := v.(contextVerifier); ok {
+		check = func() ([]Drift, error) { return cv.VerifyContext(ctx) }
+		if reconcile {
+			check = func() ([]Drift, error) { return cv.ReconcileContext(ctx) }
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			fn(check())
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package cgroups
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type fakeVerifier struct {
+	verified, reconciled int
+}
+
+func (v *fakeVerifier) Verify() ([]Drift, error) {
+	v.verified++
+	return nil, nil
+}
+
+func (v *fakeVerifier) Reconcile() ([]Drift, error) {
+	v.reconciled++
+	return []Drift{{Path: "/sys/fs/cgroup/test", File: "pids.max", Expected: "10", Actual: "max"}}, nil
+}
+
+func TestWatchDrift(t *testing.T) {
+	v := &fakeVerifier{}
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := WatchDrift(ctx, v, time.Millisecond, true, func(drifts []Drift, err error) {
+		if err != nil || len(drifts) != 1 {
+			t.Errorf("unexpected result: %v, %v", drifts, err)
+		}
+		if calls++; calls == 3 {
+			cancel()
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.reconciled != 3 || v.verified != 0 {
+		t.Errorf("expected 3 Reconcile calls and no Verify calls, got %d and %d", v.reconciled, v.verified)
+	}
+}
+
+func TestWatchDriftInterval(t *testing.T) {
+	for _, interval := range []time.Duration{0, -time.Second} {
+		err := WatchDrift(context.Background(), &fakeVerifier{}, interval, false, func([]Drift, error) {
+			t.Error("unexpected check")
+		})
+		if err == nil {
+			t.Errorf("interval %v: expected an error", interval)
+		}
+	}
+}
+
+type fakeContextVerifier struct {
+	fakeVerifier
+	ctx context.Context
+}
+
+func (v *fakeContextVerifier) VerifyContext(ctx context.Context) ([]Drift, error) {
+	v.ctx = ctx
+	return v.Verify()
+}
+
+func (v *fakeContextVerifier) ReconcileContext(ctx context.Context) ([]Drift, error) {
+	v.ctx = ctx
+	return v.Reconcile()
+}
+
+func TestWatchDriftContext(t *testing.T) {
+	v := &fakeContextVerifier{}
+	ctx, cancel := context.WithCancel(context.Background())
+	err := WatchDrift(ctx, v, time.Millisecond, false, func([]Drift, error) {
+		cancel()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.verified == 0 || v.ctx != ctx {
+		t.Error("expected VerifyContext to be called with ctx")
+	}
+}
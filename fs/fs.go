@@ -61,6 +61,12 @@ type Manager struct {
 	mu      sync.Mutex
 	cgroups *cgroups.Cgroup
 	paths   map[string]string
+	// applied is a copy of the resources applied by the last
+	// successful Set, used for Resources.SkipUnchanged.
+	applied *cgroups.Resources
+	// expected are the contents of the files written by Set,
+	// used by Verify and Reconcile.
+	expected fscommon.AppliedFiles
 }
 
 func NewManager(cg *cgroups.Cgroup, paths map[string]string) (*Manager, error) {
@@ -174,6 +180,7 @@ func (m *Manager) AddPid(subcgroup string, pid int) (retErr error) {
 func (m *Manager) Destroy() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	_ = fscommon.SetPerfEvents(m.paths["perf_event"], false)
 	return cgroups.RemovePaths(m.paths)
 }
 
@@ -228,8 +235,15 @@ func (m *Manager) Set(r *cgroups.Resources) error {
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	// Save the values about to be changed, so that they can be
+	// restored if any of the subsystems fails.
+	var tx fscommon.Transaction
 	for _, sys := range subsystems {
+		if r.SkipUnchanged && fscommon.Unchanged(sys.Name(), m.applied, r) {
+			continue
+		}
 		path := m.paths[sys.Name()]
+		SaveState(&tx, sys.Name(), path, r)
 		if err := sys.Set(path, r); err != nil {
 			// When rootless is true, errors from the device subsystem
 			// are ignored, as it is really not expected to work.
@@ -241,11 +255,16 @@ func (m *Manager) Set(r *cgroups.Resources) error {
 			if path == "" {
 				// We never created a path for this cgroup, so we cannot set
 				// limits for it (though we have already tried at this point).
-				return fmt.Errorf("cannot set %s limit: container could not join or create cgroup", sys.Name())
+				err = errors.New("container could not join or create cgroup")
 			}
-			return err
+			return &cgroups.SetError{Step: sys.Name(), Err: err, RollbackErr: tx.Rollback()}
 		}
 	}
+	m.applied = r.Clone()
+	if m.expected == nil {
+		m.expected = make(fscommon.AppliedFiles)
+	}
+	m.expected.Record(tx.Files())
 
 	return nil
 }
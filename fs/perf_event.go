@@ -2,6 +2,7 @@ package fs
 
 import (
 	"github.com/opencontainers/cgroups"
+	"github.com/opencontainers/cgroups/fscommon"
 )
 
 type PerfEventGroup struct{}
@@ -11,19 +12,18 @@ func (s *PerfEventGroup) Name() string {
 }
 
 // ID returns the controller ID for perf_event subsystem.
-// Returns 0 as perf_event is not a cgroups.Controller.
 func (s *PerfEventGroup) ID() cgroups.Controller {
-	return 0
+	return cgroups.PerfEvent
 }
 
 func (s *PerfEventGroup) Apply(path string, _ *cgroups.Resources, pid int) error {
 	return apply(path, pid)
 }
 
-func (s *PerfEventGroup) Set(_ string, _ *cgroups.Resources) error {
-	return nil
+func (s *PerfEventGroup) Set(path string, r *cgroups.Resources) error {
+	return fscommon.SetPerfEvents(path, r.PerfEvents)
 }
 
 func (s *PerfEventGroup) GetStats(path string, stats *cgroups.Stats) error {
-	return nil
+	return fscommon.GetPerfEventStats(path, stats)
 }
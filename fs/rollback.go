@@ -0,0 +1,228 @@
+package fs
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/cgroups"
+	devices "github.com/opencontainers/cgroups/devices/config"
+	"github.com/opencontainers/cgroups/fscommon"
+)
+
+// SaveState saves the current values of the cgroup files (and other state)
+// of the given subsystem at path which are about to be modified by its Set
+// with r, so that they can be restored by tx.Rollback.
+func SaveState(tx *fscommon.Transaction, subsystem, path string, r *cgroups.Resources) {
+	if path == "" {
+		return
+	}
+	switch subsystem {
+	case "cpuset":
+		if r.CpusetCpus != "" {
+			tx.SaveFiles(path, cpusetFile(path, "cpus"))
+		}
+		if r.CpusetMems != "" {
+			tx.SaveFiles(path, cpusetFile(path, "mems"))
+		}
+	case "devices":
+		saveDevices(tx, path, r)
+	case "memory":
+		saveMemory(tx, path, r)
+	case "cpu":
+		saveCPU(tx, path, r)
+	case "pids":
+		if r.PidsLimit != nil {
+			tx.SaveFiles(path, "pids.max")
+		}
+	case "blkio":
+		saveBlkio(tx, path, r)
+	case "hugetlb":
+		for _, hugetlb := range r.HugetlbLimit {
+			prefix := "hugetlb." + hugetlb.Pagesize
+			tx.SaveFiles(path, prefix+".limit_in_bytes", prefix+".rsvd.limit_in_bytes")
+		}
+	case "net_cls":
+		if r.NetClsClassid != 0 {
+			tx.SaveFiles(path, "net_cls.classid")
+		}
+	case "net_prio":
+		if len(r.NetPrioIfpriomap) > 0 {
+			// All the interfaces are listed, so no keys can be added.
+			tx.SaveFiles(path, "net_prio.ifpriomap")
+		}
+	case "freezer":
+		if r.Freezer == cgroups.Undefined {
+			return
+		}
+		freezer := &FreezerGroup{}
+		prev, err := freezer.GetState(path)
+		if err != nil || prev == cgroups.Undefined {
+			return
+		}
+		tx.OnRollback(func() error {
+			return freezer.Set(path, &cgroups.Resources{Freezer: prev})
+		})
+	case "perf_event":
+		// The counts can't be restored once the counting is stopped,
+		// but the counting started by Set is stopped on rollback.
+		if r.PerfEvents && !fscommon.PerfEventsEnabled(path) {
+			tx.OnRollback(func() error {
+				return fscommon.SetPerfEvents(path, false)
+			})
+		}
+	case "rdma":
+		fscommon.RdmaSave(tx, path, r)
+	}
+}
+
+// saveDevices saves the current device rules, as shown by devices.list,
+// to be re-applied on rollback.
+func saveDevices(tx *fscommon.Transaction, path string, r *cgroups.Resources) {
+	if r.SkipDevices || cgroups.DevicesSetV1 == nil {
+		return
+	}
+	list, err := cgroups.ReadFile(path, "devices.list")
+	if err != nil {
+		return
+	}
+	rules, err := devicesListToRules(list)
+	if err != nil {
+		return
+	}
+	tx.OnRollback(func() error {
+		return cgroups.DevicesSetV1(path, &cgroups.Resources{Devices: rules})
+	})
+}
+
+// devicesListToRules converts the contents of devices.list to a list of
+// rules which results in the same devices cgroup state.
+func devicesListToRules(list string) ([]*devices.Rule, error) {
+	// Start with a deny-all (i.e. allow-list) mode.
+	rules := []*devices.Rule{{
+		Type:        devices.WildcardDevice,
+		Major:       devices.Wildcard,
+		Minor:       devices.Wildcard,
+		Permissions: "rwm",
+	}}
+	for line := range strings.SplitSeq(list, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		// Input: node major:minor perms.
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ' ' || r == ':'
+		})
+		if len(fields) != 4 {
+			return nil, malformedLine("", "devices.list", line)
+		}
+		rule := &devices.Rule{
+			Type:        devices.Type(fields[0][0]),
+			Permissions: devices.Permissions(fields[3]),
+			Allow:       true,
+		}
+		if rule.Type == devices.WildcardDevice {
+			// "a *:* rwm" means the cgroup is in deny-list mode,
+			// allowing everything.
+			rule.Major, rule.Minor = devices.Wildcard, devices.Wildcard
+			return []*devices.Rule{rule}, nil
+		}
+		for i, f := range []*int64{&rule.Major, &rule.Minor} {
+			if fields[i+1] == "*" {
+				*f = devices.Wildcard
+				continue
+			}
+			v, err := strconv.ParseInt(fields[i+1], 10, 64)
+			if err != nil {
+				return nil, malformedLine("", "devices.list", line)
+			}
+			*f = v
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func saveMemory(tx *fscommon.Transaction, path string, r *cgroups.Resources) {
+	if r.Memory != 0 || r.MemorySwap != 0 {
+		// The limits need to be restored in a particular order,
+		// which is what setMemoryAndSwap takes care of.
+		prev := &cgroups.Resources{}
+		if v, err := fscommon.GetCgroupParamInt(path, cgroupMemoryLimit); err == nil {
+			prev.Memory = v
+		}
+		if v, err := fscommon.GetCgroupParamInt(path, cgroupMemorySwapLimit); err == nil {
+			prev.MemorySwap = v
+		}
+		if prev.Memory != 0 || prev.MemorySwap != 0 {
+			tx.MarkModified(path, cgroupMemoryLimit)
+			if prev.MemorySwap != 0 {
+				tx.MarkModified(path, cgroupMemorySwapLimit)
+			}
+			tx.OnRollback(func() error {
+				return setMemoryAndSwap(path, prev)
+			})
+		}
+	}
+	if r.MemoryReservation != 0 {
+		tx.SaveFiles(path, "memory.soft_limit_in_bytes")
+	}
+	if r.OomKillDisable {
+		// memory.oom_control can't be written back as is.
+		if v, err := fscommon.GetValueByKey(path, "memory.oom_control", "oom_kill_disable"); err == nil {
+			tx.OnRollback(func() error {
+				return cgroups.WriteFile(path, "memory.oom_control", strconv.FormatUint(v, 10))
+			})
+		}
+	}
+	if r.MemorySwappiness != nil && int64(*r.MemorySwappiness) != -1 {
+		tx.SaveFiles(path, "memory.swappiness")
+	}
+}
+
+func saveCPU(tx *fscommon.Transaction, path string, r *cgroups.Resources) {
+	if r.CpuShares != 0 {
+		tx.SaveFiles(path, "cpu.shares")
+	}
+	if r.CPUIdle != nil {
+		tx.SaveFiles(path, "cpu.idle")
+	}
+	if r.CpuRtPeriod != 0 || r.CpuRtRuntime != 0 {
+		tx.SaveFiles(path, "cpu.rt_period_us", "cpu.rt_runtime_us")
+	}
+	if r.CpuBurst != nil {
+		tx.SaveFiles(path, "cpu.cfs_burst_us")
+	}
+	if r.CpuPeriod != 0 || r.CpuQuota != 0 {
+		tx.SaveFiles(path, "cpu.cfs_period_us", "cpu.cfs_quota_us")
+	}
+}
+
+func saveBlkio(tx *fscommon.Transaction, path string, r *cgroups.Resources) {
+	// Writing "MAJOR:MINOR 0" removes the per-device setting.
+	resetDevice := func(key string) string {
+		return key + " 0"
+	}
+	s := &BlkioGroup{}
+	s.detectWeightFilenames(path)
+	if r.BlkioWeight != 0 {
+		tx.SaveFiles(path, s.weightFilename)
+	}
+	if r.BlkioLeafWeight != 0 {
+		tx.SaveFiles(path, "blkio.leaf_weight")
+	}
+	if len(r.BlkioWeightDevice) > 0 {
+		tx.SaveKeyedFile(path, s.weightDeviceFilename, resetDevice)
+		tx.SaveKeyedFile(path, "blkio.leaf_weight_device", resetDevice)
+	}
+	for file, tds := range map[string][]*cgroups.ThrottleDevice{
+		"blkio.throttle.read_bps_device":   r.BlkioThrottleReadBpsDevice,
+		"blkio.throttle.write_bps_device":  r.BlkioThrottleWriteBpsDevice,
+		"blkio.throttle.read_iops_device":  r.BlkioThrottleReadIOPSDevice,
+		"blkio.throttle.write_iops_device": r.BlkioThrottleWriteIOPSDevice,
+	} {
+		if len(tds) > 0 {
+			tx.SaveKeyedFile(path, file, resetDevice)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package fs
+
+import (
+	"reflect"
+	"testing"
+
+	devices "github.com/opencontainers/cgroups/devices/config"
+)
+
+func TestDevicesListToRules(t *testing.T) {
+	testCases := []struct {
+		list     string
+		expected []*devices.Rule
+	}{
+		{
+			list: "a *:* rwm\n",
+			expected: []*devices.Rule{
+				{Type: devices.WildcardDevice, Major: devices.Wildcard, Minor: devices.Wildcard, Permissions: "rwm", Allow: true},
+			},
+		},
+		{
+			list: "c 1:3 rwm\nb *:* m\nc 136:* rw\n",
+			expected: []*devices.Rule{
+				{Type: devices.WildcardDevice, Major: devices.Wildcard, Minor: devices.Wildcard, Permissions: "rwm"},
+				{Type: devices.CharDevice, Major: 1, Minor: 3, Permissions: "rwm", Allow: true},
+				{Type: devices.BlockDevice, Major: devices.Wildcard, Minor: devices.Wildcard, Permissions: "m", Allow: true},
+				{Type: devices.CharDevice, Major: 136, Minor: devices.Wildcard, Permissions: "rw", Allow: true},
+			},
+		},
+		{
+			list: "",
+			expected: []*devices.Rule{
+				{Type: devices.WildcardDevice, Major: devices.Wildcard, Minor: devices.Wildcard, Permissions: "rwm"},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		rules, err := devicesListToRules(tc.list)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.list, err)
+		}
+		if !reflect.DeepEqual(rules, tc.expected) {
+			t.Errorf("%q: expected %+v, got %+v", tc.list, tc.expected, rules)
+		}
+	}
+
+	if _, err := devicesListToRules("c 1:x rwm\n"); err == nil {
+		t.Error("expected an error for a malformed line")
+	}
+}
@@ -0,0 +1,27 @@
+package fs
+
+import (
+	"github.com/opencontainers/cgroups"
+)
+
+// Walk returns the tree of cgroups rooted at path, which is a cgroup in a
+// cgroup v1 hierarchy (see [cgroups.Walk]). If opts is not nil, the
+// statistics of every cgroup are also collected, for the controllers of the
+// hierarchy which are specified by opts.
+func Walk(path string, opts *cgroups.StatsOptions) (*cgroups.Node, error) {
+	return cgroups.Walk(path, &cgroups.WalkOptions{Stats: statsFunc(opts)})
+}
+
+func statsFunc(opts *cgroups.StatsOptions) func(string, []string) (*cgroups.Stats, error) {
+	if opts == nil {
+		return nil
+	}
+	return func(path string, controllers []string) (*cgroups.Stats, error) {
+		paths := make(map[string]string, len(controllers))
+		for _, c := range controllers {
+			paths[c] = path
+		}
+		m := &Manager{cgroups: &cgroups.Cgroup{}, paths: paths}
+		return m.Stats(opts)
+	}
+}
@@ -0,0 +1,85 @@
+package fs2
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/cgroups"
+	"github.com/opencontainers/cgroups/fscommon"
+)
+
+// Core interface files, i.e. the ones prefixed with "cgroup.".
+
+func isCoreSet(r *cgroups.Resources) bool {
+	return r != nil && (r.MaxDescendants != nil || r.MaxDepth != nil)
+}
+
+func setCore(dirPath string, r *cgroups.Resources) error {
+	if !isCoreSet(r) {
+		return nil
+	}
+	for file, limit := range map[string]*int64{
+		"cgroup.max.descendants": r.MaxDescendants,
+		"cgroup.max.depth":       r.MaxDepth,
+	} {
+		if limit == nil {
+			continue
+		}
+		val := "max"
+		if *limit >= 0 {
+			val = strconv.FormatInt(*limit, 10)
+		}
+		if err := cgroups.WriteFile(dirPath, file, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func saveCore(tx *fscommon.Transaction, dirPath string, r *cgroups.Resources) {
+	if r.MaxDescendants != nil {
+		tx.SaveFiles(dirPath, "cgroup.max.descendants")
+	}
+	if r.MaxDepth != nil {
+		tx.SaveFiles(dirPath, "cgroup.max.depth")
+	}
+}
+
+func statCore(dirPath string, stats *cgroups.Stats) error {
+	f, err := cgroups.OpenFile(dirPath, "cgroup.stat", os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	st := &stats.CgroupStats
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		key, value, err := fscommon.ParseKeyValue(sc.Text())
+		if err != nil {
+			return &parseError{Path: dirPath, File: "cgroup.stat", Err: err}
+		}
+		switch {
+		case key == "nr_descendants":
+			st.NrDescendants = value
+		case key == "nr_dying_descendants":
+			st.NrDyingDescendants = value
+		case strings.HasPrefix(key, "nr_dying_subsys_"):
+			if st.NrDyingSubsys == nil {
+				st.NrDyingSubsys = make(map[string]uint64)
+			}
+			st.NrDyingSubsys[strings.TrimPrefix(key, "nr_dying_subsys_")] = value
+		case strings.HasPrefix(key, "nr_subsys_"):
+			if st.NrSubsys == nil {
+				st.NrSubsys = make(map[string]uint64)
+			}
+			st.NrSubsys[strings.TrimPrefix(key, "nr_subsys_")] = value
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return &parseError{Path: dirPath, File: "cgroup.stat", Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package fs2
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/opencontainers/cgroups"
+)
+
+const exampleCgroupStatData = `nr_descendants 3
+nr_subsys_cpu 2
+nr_subsys_memory 4
+nr_dying_descendants 1
+nr_dying_subsys_cpu 0
+nr_dying_subsys_memory 1
+`
+
+func TestStatCore(t *testing.T) {
+	// We're using a fake cgroupfs.
+	cgroups.TestMode = true
+	fakeCgroupDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(fakeCgroupDir, "cgroup.stat"), []byte(exampleCgroupStatData), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	gotStats := cgroups.NewStats()
+	if err := statCore(fakeCgroupDir, gotStats); err != nil {
+		t.Fatal(err)
+	}
+	want := cgroups.CgroupStats{
+		NrDescendants:      3,
+		NrDyingDescendants: 1,
+		NrSubsys:           map[string]uint64{"cpu": 2, "memory": 4},
+		NrDyingSubsys:      map[string]uint64{"cpu": 0, "memory": 1},
+	}
+	if !reflect.DeepEqual(gotStats.CgroupStats, want) {
+		t.Errorf("expected %+v, got %+v", want, gotStats.CgroupStats)
+	}
+}
+
+func TestSetCore(t *testing.T) {
+	// We're using a fake cgroupfs.
+	cgroups.TestMode = true
+	fakeCgroupDir := t.TempDir()
+
+	descendants, depth := int64(10), int64(-1)
+	r := &cgroups.Resources{MaxDescendants: &descendants, MaxDepth: &depth}
+	if err := setCore(fakeCgroupDir, r); err != nil {
+		t.Fatal(err)
+	}
+	for file, want := range map[string]string{
+		"cgroup.max.descendants": "10",
+		"cgroup.max.depth":       "max",
+	} {
+		got, err := cgroups.ReadFile(fakeCgroupDir, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%s: expected %q, got %q", file, want, got)
+		}
+	}
+}
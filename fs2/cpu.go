@@ -76,6 +76,25 @@ func setCPU(dirPath string, r *cgroups.Resources) error {
 	return nil
 }
 
+func saveCPU(tx *fscommon.Transaction, dirPath string, r *cgroups.Resources) {
+	if !isCPUSet(r) {
+		return
+	}
+	if r.CPUIdle != nil {
+		tx.SaveFiles(dirPath, "cpu.idle")
+	}
+	if r.CpuWeight != 0 {
+		tx.SaveFiles(dirPath, "cpu.weight")
+	}
+	// Saved in this order so that cpu.max is restored before cpu.max.burst.
+	if r.CpuBurst != nil {
+		tx.SaveFiles(dirPath, "cpu.max.burst")
+	}
+	if r.CpuQuota != 0 || r.CpuPeriod != 0 {
+		tx.SaveFiles(dirPath, "cpu.max")
+	}
+}
+
 func statCpu(dirPath string, stats *cgroups.Stats) error {
 	const file = "cpu.stat"
 	f, err := cgroups.OpenFile(dirPath, file, os.O_RDONLY)
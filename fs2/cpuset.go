@@ -2,6 +2,7 @@ package fs2
 
 import (
 	"github.com/opencontainers/cgroups"
+	"github.com/opencontainers/cgroups/fscommon"
 )
 
 func isCpusetSet(r *cgroups.Resources) bool {
@@ -25,3 +26,12 @@ func setCpuset(dirPath string, r *cgroups.Resources) error {
 	}
 	return nil
 }
+
+func saveCpuset(tx *fscommon.Transaction, dirPath string, r *cgroups.Resources) {
+	if r.CpusetCpus != "" {
+		tx.SaveFiles(dirPath, "cpuset.cpus")
+	}
+	if r.CpusetMems != "" {
+		tx.SaveFiles(dirPath, "cpuset.mems")
+	}
+}
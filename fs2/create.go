@@ -133,6 +133,12 @@ func CreateCgroupPath(path string, c *cgroups.Cgroup) (Err error) {
 				}
 			}
 		}
+		// Limit the descendants before anything can be created below.
+		if i == len(elements)-1 {
+			if err := setCore(current, c.Resources); err != nil {
+				return err
+			}
+		}
 		// enable all supported controllers
 		if i < len(elements)-1 {
 			if err := cgroups.WriteFile(current, cgStCtlFile, res); err != nil {
@@ -0,0 +1,27 @@
+package fs2
+
+import (
+	"github.com/opencontainers/cgroups"
+)
+
+var _ cgroups.Verifier = &Manager{}
+
+// Verify returns the cgroup files written by Set whose contents were
+// changed since.
+func (m *Manager) Verify() ([]cgroups.Drift, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.expected.Verify()
+}
+
+// Reconcile is like Verify, but it also writes the applied contents
+// back to the drifted files.
+func (m *Manager) Reconcile() ([]cgroups.Drift, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	drifts, err := m.expected.Verify()
+	if err != nil {
+		return nil, err
+	}
+	return drifts, m.expected.Reconcile(drifts)
+}
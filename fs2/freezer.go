@@ -11,6 +11,7 @@ import (
 	"golang.org/x/sys/unix"
 
 	"github.com/opencontainers/cgroups"
+	"github.com/opencontainers/cgroups/fscommon"
 )
 
 func setFreezer(dirPath string, state cgroups.FreezerState) error {
@@ -50,6 +51,21 @@ func setFreezer(dirPath string, state cgroups.FreezerState) error {
 	return nil
 }
 
+// saveFreezer arranges for the current freezer state to be restored on
+// rollback, if the state is about to be changed.
+func saveFreezer(tx *fscommon.Transaction, dirPath string, state cgroups.FreezerState) {
+	if state == cgroups.Undefined {
+		return
+	}
+	prev, err := getFreezer(dirPath)
+	if err != nil || prev == cgroups.Undefined {
+		return
+	}
+	tx.OnRollback(func() error {
+		return setFreezer(dirPath, prev)
+	})
+}
+
 func getFreezer(dirPath string) (cgroups.FreezerState, error) {
 	fd, err := cgroups.OpenFile(dirPath, "cgroup.freeze", unix.O_RDONLY)
 	if err != nil {
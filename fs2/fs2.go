@@ -6,6 +6,9 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
 
 	"github.com/opencontainers/cgroups"
 	"github.com/opencontainers/cgroups/fscommon"
@@ -14,12 +17,22 @@ import (
 type parseError = fscommon.ParseError
 
 type Manager struct {
+	// mu protects applied and expected, which are used by both Set,
+	// and Verify and Reconcile (that may be called concurrently,
+	// see [cgroups.WatchDrift]).
+	mu     sync.Mutex
 	config *cgroups.Cgroup
 	// dirPath is like "/sys/fs/cgroup/user.slice/user-1001.slice/session-1.scope"
 	dirPath string
 	// controllers is content of "cgroup.controllers" file.
 	// excludes pseudo-controllers ("devices" and "freezer").
 	controllers map[string]struct{}
+	// applied is a copy of the resources applied by the last
+	// successful Set, used for Resources.SkipUnchanged.
+	applied *cgroups.Resources
+	// expected are the contents of the files written by Set,
+	// used by Verify and Reconcile.
+	expected fscommon.AppliedFiles
 }
 
 // NewManager creates a manager for cgroup v2 unified hierarchy.
@@ -185,6 +198,27 @@ func (m *Manager) Stats(opts *cgroups.StatsOptions) (*cgroups.Stats, error) {
 		}
 	}
 
+	// cgroup.stat (since kernel 4.14)
+	if controllers&cgroups.Core != 0 {
+		if err := statCore(m.dirPath, st); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+
+	// network accounting (eBPF, if enabled)
+	if controllers&cgroups.Network != 0 && m.config.Resources != nil && m.config.Resources.NetworkAccounting {
+		if err := statNetworkAccounting(m.dirPath, st); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+
+	// perf_event (software events, if enabled)
+	if controllers&cgroups.PerfEvent != 0 {
+		if err := fscommon.GetPerfEventStats(m.dirPath, st); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
 	if len(errs) > 0 && !m.config.Rootless {
 		return st, fmt.Errorf("error while statting cgroup v2: %+v", errs)
 	}
@@ -203,6 +237,22 @@ func (m *Manager) Freeze(state cgroups.FreezerState) error {
 }
 
 func (m *Manager) Destroy() error {
+	if r := m.config.Resources; r != nil && r.DevicesLink != nil && cgroups.DevicesUnlinkV2 != nil {
+		// As the cgroup is empty by now, the link can be removed first.
+		unlink, err := cgroups.DevicesUnlinkV2(m.dirPath, r)
+		if err == nil {
+			err = unlink()
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			logrus.Warnf("unable to remove device filter link: %v", err)
+		}
+	}
+	if r := m.config.Resources; r != nil && r.NetworkAccounting {
+		if err := setNetworkAccounting(m.dirPath, false); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logrus.Warnf("unable to detach network accounting programs: %v", err)
+		}
+	}
+	_ = fscommon.SetPerfEvents(m.dirPath, false)
 	return cgroups.RemovePath(m.dirPath)
 }
 
@@ -217,55 +267,235 @@ func (m *Manager) Set(r *cgroups.Resources) error {
 	if err := m.getControllers(); err != nil {
 		return err
 	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Every step saves the values it is about to change, so that
+	// they can be restored if this or any later step fails.
+	var tx fscommon.Transaction
+	fail := func(step string, err error) error {
+		return &cgroups.SetError{Step: step, Err: err, RollbackErr: tx.Rollback()}
+	}
+	// With SkipUnchanged, the controllers whose settings are the same
+	// as the previously applied ones are skipped.
+	var prev *cgroups.Resources
+	if r.SkipUnchanged {
+		prev = m.applied
+	}
+	changed := func(controller string) bool {
+		return !fscommon.Unchanged(controller, prev, r)
+	}
+	// The unified resources which are no longer set are reset first,
+	// so that the settings of their (changed) controllers apply.
+	removed := removedUnified(prev, r.Unified)
+	m.saveUnified(&tx, removed)
+	if err := m.setUnified(removed); err != nil {
+		return fail("unified", err)
+	}
+	// cgroup.max.descendants and cgroup.max.depth (since kernel 4.14)
+	if changed("cgroup") {
+		saveCore(&tx, m.dirPath, r)
+		if err := setCore(m.dirPath, r); err != nil {
+			return fail("cgroup", err)
+		}
+	}
 	// pids (since kernel 4.5)
-	if err := setPids(m.dirPath, r); err != nil {
-		return err
+	if changed("pids") {
+		savePids(&tx, m.dirPath, r)
+		if err := setPids(m.dirPath, r); err != nil {
+			return fail("pids", err)
+		}
 	}
 	// memory (since kernel 4.5)
-	if err := setMemory(m.dirPath, r); err != nil {
-		return err
+	if changed("memory") {
+		saveMemory(&tx, m.dirPath, r)
+		if err := setMemory(m.dirPath, r); err != nil {
+			return fail("memory", err)
+		}
 	}
 	// io (since kernel 4.5)
-	if err := setIo(m.dirPath, r); err != nil {
-		return err
+	if changed("io") {
+		saveIo(&tx, m.dirPath, r)
+		if err := setIo(m.dirPath, r); err != nil {
+			return fail("io", err)
+		}
 	}
 	// cpu (since kernel 4.15)
-	if err := setCPU(m.dirPath, r); err != nil {
-		return err
+	if changed("cpu") {
+		saveCPU(&tx, m.dirPath, r)
+		if err := setCPU(m.dirPath, r); err != nil {
+			return fail("cpu", err)
+		}
 	}
 	// devices (since kernel 4.15, pseudo-controller)
 	//
 	// When rootless is true, errors from the device subsystem are ignored because it is really not expected to work.
 	// However, errors from other subsystems are not ignored.
 	// see @test "runc create (rootless + limits + no cgrouppath + no permission) fails with informative error"
-	if err := setDevices(m.dirPath, r); err != nil {
-		if !m.config.Rootless || errors.Is(err, cgroups.ErrDevicesUnsupported) {
-			return err
+	if changed("devices") {
+		m.saveDevices(&tx, r)
+		if err := setDevices(m.dirPath, r); err != nil {
+			if !m.config.Rootless || errors.Is(err, cgroups.ErrDevicesUnsupported) {
+				return fail("devices", err)
+			}
 		}
 	}
 	// cpuset (since kernel 5.0)
-	if err := setCpuset(m.dirPath, r); err != nil {
-		return err
+	if changed("cpuset") {
+		saveCpuset(&tx, m.dirPath, r)
+		if err := setCpuset(m.dirPath, r); err != nil {
+			return fail("cpuset", err)
+		}
 	}
 	// hugetlb (since kernel 5.6)
-	if err := setHugeTlb(m.dirPath, r); err != nil {
-		return err
+	if changed("hugetlb") {
+		saveHugeTlb(&tx, m.dirPath, r)
+		if err := setHugeTlb(m.dirPath, r); err != nil {
+			return fail("hugetlb", err)
+		}
 	}
 	// rdma (since kernel 4.11)
-	if err := fscommon.RdmaSet(m.dirPath, r); err != nil {
-		return err
+	if changed("rdma") {
+		fscommon.RdmaSave(&tx, m.dirPath, r)
+		if err := fscommon.RdmaSet(m.dirPath, r); err != nil {
+			return fail("rdma", err)
+		}
+	}
+	// net_cls and net_prio (eBPF, no controller on cgroup v2)
+	//
+	// Skipped unless these are or were set, as attaching the program
+	// requires the privileges which are not needed otherwise. Like with
+	// devices, the errors are ignored when rootless, and so are the
+	// permission errors, as these settings used to be ignored on cgroup v2.
+	if (changed("net_cls") || changed("net_prio")) && (hasNet(r) || hasNet(m.config.Resources)) {
+		m.saveNet(&tx)
+		if err := setNet(m.dirPath, r); err != nil {
+			if !m.config.Rootless && !errors.Is(err, os.ErrPermission) {
+				return fail("net", err)
+			}
+			logrus.Warnf("ignoring the net_cls and net_prio settings: %v", err)
+		}
+	}
+	// network accounting (eBPF, skipped unless it is or was enabled, as above)
+	if changed("network") && (r.NetworkAccounting || (m.config.Resources != nil && m.config.Resources.NetworkAccounting)) {
+		m.saveNetworkAccounting(&tx)
+		if err := setNetworkAccounting(m.dirPath, r.NetworkAccounting); err != nil {
+			return fail("network", err)
+		}
 	}
 	// freezer (since kernel 5.2, pseudo-controller)
+	saveFreezer(&tx, m.dirPath, r.Freezer)
 	if err := setFreezer(m.dirPath, r.Freezer); err != nil {
-		return err
+		return fail("freezer", err)
 	}
-	if err := m.setUnified(r.Unified); err != nil {
-		return err
+	unified := changedUnified(prev, r.Unified)
+	m.saveUnified(&tx, unified)
+	if err := m.setUnified(unified); err != nil {
+		return fail("unified", err)
+	}
+	// perf_event (software events, counted by this process)
+	//
+	// This is the last step, as the counts can't be restored on rollback.
+	if changed("perf_event") {
+		if err := fscommon.SetPerfEvents(m.dirPath, r.PerfEvents); err != nil {
+			return fail("perf_event", err)
+		}
 	}
 	m.config.Resources = r
+	m.applied = r.Clone()
+	if m.expected == nil {
+		m.expected = make(fscommon.AppliedFiles)
+	}
+	m.expected.Record(tx.Files())
 	return nil
 }
 
+// changedUnified returns the subset of res with values different from
+// those in prev. If prev is nil, res is returned as is.
+func changedUnified(prev *cgroups.Resources, res map[string]string) map[string]string {
+	if prev == nil || len(prev.Unified) == 0 {
+		return res
+	}
+	changed := make(map[string]string, len(res))
+	for k, v := range res {
+		if pv, ok := prev.Unified[k]; !ok || pv != v {
+			changed[k] = v
+		}
+	}
+	return changed
+}
+
+// unifiedDefaults are the default values of the unified resources, which
+// are written to reset them, in addition to those of keyedFiles, and the
+// "*.max" and "*.high" limits (which default to "max").
+var unifiedDefaults = map[string]string{
+	"cgroup.max.depth":       "max",
+	"cgroup.max.descendants": "max",
+	"cpu.idle":               "0",
+	"cpu.max.burst":          "0",
+	"cpu.weight":             "100",
+	"cpu.weight.nice":        "0",
+	"cpu.uclamp.min":         "0",
+	"cpu.uclamp.max":         "max",
+	"cpuset.cpus":            "",
+	"cpuset.mems":            "",
+	"memory.low":             "0",
+	"memory.min":             "0",
+	"memory.oom.group":       "0",
+	"memory.swap.high":       "max",
+}
+
+// removedUnified returns the unified resources set in prev but not in res,
+// along with the values resetting them to their defaults. The resources
+// with no known default are left as is. If prev is nil, nothing is
+// returned.
+func removedUnified(prev *cgroups.Resources, res map[string]string) map[string]string {
+	if prev == nil {
+		return nil
+	}
+	removed := make(map[string]string)
+	for k, v := range prev.Unified {
+		if _, ok := res[k]; ok {
+			continue
+		}
+		if reset, ok := keyedFiles[k]; ok {
+			var lines []string
+			for line := range strings.Lines(v) {
+				// Only the "KEY VALUES..." lines, not "[default] VALUE".
+				if f := strings.Fields(line); len(f) > 1 && f[0] != "default" {
+					lines = append(lines, reset(f[0]))
+				}
+			}
+			if strings.HasSuffix(k, "weight") {
+				lines = append(lines, "default 100")
+			}
+			removed[k] = strings.Join(lines, "\n")
+			continue
+		}
+		def, ok := unifiedDefaults[k]
+		if !ok && (strings.HasSuffix(k, ".max") || strings.HasSuffix(k, ".high")) {
+			def, ok = "max", true
+		}
+		if !ok {
+			logrus.Warnf("unable to reset unified resource %q: unknown default value", k)
+			continue
+		}
+		removed[k] = def
+	}
+	return removed
+}
+
+// saveDevices arranges for the previously set device rules to be
+// re-applied on rollback, as the eBPF program can not be saved as is.
+func (m *Manager) saveDevices(tx *fscommon.Transaction, r *cgroups.Resources) {
+	prev := m.config.Resources
+	if r.SkipDevices || prev == nil || prev.SkipDevices || cgroups.DevicesSetV2 == nil {
+		return
+	}
+	tx.OnRollback(func() error {
+		return setDevices(m.dirPath, prev)
+	})
+}
+
 func setDevices(dirPath string, r *cgroups.Resources) error {
 	if cgroups.DevicesSetV2 == nil {
 		if len(r.Devices) > 0 {
@@ -301,6 +531,38 @@ func (m *Manager) setUnified(res map[string]string) error {
 	return nil
 }
 
+// keyedFiles lists the files consisting of "KEY VALUES..." lines, to which
+// a new key can be added, along with a function that returns a line which
+// removes the key (i.e. resets it to its default value).
+var keyedFiles = map[string]func(key string) string{
+	"io.bfq.weight": resetDeviceWeight,
+	"io.weight":     resetDeviceWeight,
+	"io.max": func(key string) string {
+		return key + " rbps=max wbps=max riops=max wiops=max"
+	},
+	"rdma.max": func(key string) string {
+		return key + " hca_handle=max hca_object=max"
+	},
+}
+
+func resetDeviceWeight(key string) string {
+	return key + " default"
+}
+
+func (m *Manager) saveUnified(tx *fscommon.Transaction, res map[string]string) {
+	for k := range res {
+		if strings.Contains(k, "/") {
+			// Rejected by setUnified.
+			continue
+		}
+		if reset, ok := keyedFiles[k]; ok {
+			tx.SaveKeyedFile(m.dirPath, k, reset)
+		} else {
+			tx.SaveFiles(m.dirPath, k)
+		}
+	}
+}
+
 func (m *Manager) GetPaths() map[string]string {
 	paths := make(map[string]string, 1)
 	paths[""] = m.dirPath
@@ -1,8 +1,10 @@
 package fs2
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 
 	"github.com/opencontainers/cgroups"
@@ -304,3 +306,241 @@ func TestStats(t *testing.T) {
 		})
 	}
 }
+
+func TestSetRollback(t *testing.T) {
+	// We're using a fake cgroupfs.
+	cgroups.TestMode = true
+	fakeCgroupDir := t.TempDir()
+
+	for file, data := range map[string]string{
+		"cgroup.controllers": "pids memory",
+		"pids.max":           "max\n",
+		"memory.max":         "max\n",
+	} {
+		if err := os.WriteFile(filepath.Join(fakeCgroupDir, file), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err := NewManager(&cgroups.Cgroup{}, fakeCgroupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limit := int64(100)
+	err = m.Set(&cgroups.Resources{
+		PidsLimit: &limit,
+		Memory:    1 << 20,
+		Freezer:   "INVALID",
+	})
+	var setErr *cgroups.SetError
+	if !errors.As(err, &setErr) {
+		t.Fatalf("expected SetError, got %v", err)
+	}
+	if setErr.Step != "freezer" {
+		t.Errorf("expected freezer step to fail, got %q", setErr.Step)
+	}
+	if !setErr.RolledBack() {
+		t.Errorf("expected successful rollback, got %v", setErr.RollbackErr)
+	}
+
+	for _, file := range []string{"pids.max", "memory.max"} {
+		got, err := cgroups.ReadFile(fakeCgroupDir, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != "max" {
+			t.Errorf("%s: expected %q after rollback, got %q", file, "max", got)
+		}
+	}
+	if m.config.Resources != nil {
+		t.Errorf("expected resources not to be updated on failure, got %+v", m.config.Resources)
+	}
+}
+
+func TestSetSkipUnchanged(t *testing.T) {
+	// We're using a fake cgroupfs.
+	cgroups.TestMode = true
+	fakeCgroupDir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(fakeCgroupDir, "cgroup.controllers"), []byte("pids memory"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewManager(&cgroups.Cgroup{}, fakeCgroupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limit := int64(100)
+	r := &cgroups.Resources{PidsLimit: &limit, Memory: 1 << 20, SkipUnchanged: true}
+	if err := m.Set(r); err != nil {
+		t.Fatal(err)
+	}
+
+	// Change the files behind the manager's back.
+	for _, file := range []string{"pids.max", "memory.max"} {
+		if err := cgroups.WriteFile(fakeCgroupDir, file, "42"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only memory is changed, so pids.max should not be written.
+	r = r.Clone()
+	r.Memory = 2 << 20
+	if err := m.Set(r); err != nil {
+		t.Fatal(err)
+	}
+	for file, want := range map[string]string{
+		"pids.max":   "42",
+		"memory.max": "2097152",
+	} {
+		got, err := cgroups.ReadFile(fakeCgroupDir, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%s: expected %q, got %q", file, want, got)
+		}
+	}
+
+	// Without SkipUnchanged, everything is written.
+	r.SkipUnchanged = false
+	if err := m.Set(r); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := cgroups.ReadFile(fakeCgroupDir, "pids.max"); got != "100" {
+		t.Errorf("pids.max: expected %q, got %q", "100", got)
+	}
+}
+
+func TestSetSkipUnchangedRemovedUnified(t *testing.T) {
+	// We're using a fake cgroupfs.
+	cgroups.TestMode = true
+	fakeCgroupDir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(fakeCgroupDir, "cgroup.controllers"), []byte("pids memory io"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewManager(&cgroups.Cgroup{}, fakeCgroupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &cgroups.Resources{
+		Memory: 1 << 20,
+		Unified: map[string]string{
+			"memory.max": "1000000",
+			"memory.low": "1000",
+			"io.weight":  "default 200\n8:0 300",
+		},
+		SkipUnchanged: true,
+	}
+	if err := m.Set(r); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the unified resources are removed, they are reset to their
+	// defaults, unless the typed settings apply to them.
+	r = r.Clone()
+	r.Unified = nil
+	if err := m.Set(r); err != nil {
+		t.Fatal(err)
+	}
+	for file, want := range map[string]string{
+		"memory.max": "1048576",
+		"memory.low": "0",
+		"io.weight":  "8:0 default\ndefault 100",
+	} {
+		got, err := cgroups.ReadFile(fakeCgroupDir, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%s: expected %q, got %q", file, want, got)
+		}
+	}
+}
+
+func TestVerifyReconcile(t *testing.T) {
+	// We're using a fake cgroupfs.
+	cgroups.TestMode = true
+	fakeCgroupDir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(fakeCgroupDir, "cgroup.controllers"), []byte("pids memory"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewManager(&cgroups.Cgroup{}, fakeCgroupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limit := int64(100)
+	if err := m.Set(&cgroups.Resources{PidsLimit: &limit, Memory: 1 << 20}); err != nil {
+		t.Fatal(err)
+	}
+	drifts, err := m.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drifts) != 0 {
+		t.Fatalf("expected no drift, got %v", drifts)
+	}
+
+	if err := cgroups.WriteFile(fakeCgroupDir, "pids.max", "42"); err != nil {
+		t.Fatal(err)
+	}
+	drifts, err = m.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []cgroups.Drift{{Path: fakeCgroupDir, File: "pids.max", Expected: "100", Actual: "42"}}
+	if !reflect.DeepEqual(drifts, want) {
+		t.Fatalf("expected %v, got %v", want, drifts)
+	}
+	if got, _ := cgroups.ReadFile(fakeCgroupDir, "pids.max"); got != "100" {
+		t.Errorf("expected pids.max to be reconciled to 100, got %q", got)
+	}
+
+	// A file which can't be read is a drift too, and the others are
+	// still checked.
+	if err := os.Remove(filepath.Join(fakeCgroupDir, "memory.max")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cgroups.WriteFile(fakeCgroupDir, "pids.max", "42"); err != nil {
+		t.Fatal(err)
+	}
+	drifts, err = m.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drifts) != 2 || drifts[0].File != "memory.max" || drifts[0].Err == "" || drifts[1].File != "pids.max" {
+		t.Fatalf("expected memory.max (with an error) and pids.max drifts, got %v", drifts)
+	}
+}
+
+func TestVerifyConcurrentSet(t *testing.T) {
+	// We're using a fake cgroupfs.
+	cgroups.TestMode = true
+	fakeCgroupDir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(fakeCgroupDir, "cgroup.controllers"), []byte("pids"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewManager(&cgroups.Cgroup{}, fakeCgroupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 100 {
+			if _, err := m.Verify(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := range 100 {
+		limit := int64(100 + i)
+		if err := m.Set(&cgroups.Resources{PidsLimit: &limit}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
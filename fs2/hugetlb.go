@@ -40,6 +40,13 @@ func setHugeTlb(dirPath string, r *cgroups.Resources) error {
 	return nil
 }
 
+func saveHugeTlb(tx *fscommon.Transaction, dirPath string, r *cgroups.Resources) {
+	for _, hugetlb := range r.HugetlbLimit {
+		prefix := "hugetlb." + hugetlb.Pagesize
+		tx.SaveFiles(dirPath, prefix+".max", prefix+".rsvd.max")
+	}
+}
+
 func statHugeTlb(dirPath string, stats *cgroups.Stats) error {
 	hugetlbStats := cgroups.HugetlbStats{}
 	rsvd := ".rsvd"
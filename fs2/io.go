@@ -11,6 +11,7 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"github.com/opencontainers/cgroups"
+	"github.com/opencontainers/cgroups/fscommon"
 )
 
 func isIoSet(r *cgroups.Resources) bool {
@@ -97,6 +98,22 @@ func setIo(dirPath string, r *cgroups.Resources) error {
 	return nil
 }
 
+func saveIo(tx *fscommon.Transaction, dirPath string, r *cgroups.Resources) {
+	if !isIoSet(r) {
+		return
+	}
+	if r.BlkioWeight != 0 || len(r.BlkioWeightDevice) > 0 {
+		tx.SaveKeyedFile(dirPath, "io.bfq.weight", keyedFiles["io.bfq.weight"])
+		tx.SaveKeyedFile(dirPath, "io.weight", keyedFiles["io.weight"])
+	}
+	if len(r.BlkioThrottleReadBpsDevice) > 0 ||
+		len(r.BlkioThrottleWriteBpsDevice) > 0 ||
+		len(r.BlkioThrottleReadIOPSDevice) > 0 ||
+		len(r.BlkioThrottleWriteIOPSDevice) > 0 {
+		tx.SaveKeyedFile(dirPath, "io.max", keyedFiles["io.max"])
+	}
+}
+
 func readCgroup2MapFile(dirPath string, name string) (map[string][]string, error) {
 	ret := map[string][]string{}
 	f, err := cgroups.OpenFile(dirPath, name, os.O_RDONLY)
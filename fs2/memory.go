@@ -77,6 +77,12 @@ func setMemory(dirPath string, r *cgroups.Resources) error {
 	return nil
 }
 
+func saveMemory(tx *fscommon.Transaction, dirPath string, r *cgroups.Resources) {
+	if isMemorySet(r) {
+		tx.SaveFiles(dirPath, "memory.swap.max", "memory.max", "memory.low")
+	}
+}
+
 func statMemory(dirPath string, stats *cgroups.Stats) error {
 	const file = "memory.stat"
 	statsFile, err := cgroups.OpenFile(dirPath, file, os.O_RDONLY)
@@ -0,0 +1,331 @@
+package fs2
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+
+	"github.com/cilium/ebpf/asm"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/opencontainers/cgroups"
+	"github.com/opencontainers/cgroups/fscommon"
+	"github.com/opencontainers/cgroups/internal/bpf"
+)
+
+// netFilterName is the name of the egress programs which implement the
+// net_cls and net_prio settings, so that only ours are ever replaced or
+// detached (the cgroup may have others, such as the ones of systemd).
+const netFilterName = "oci_net"
+
+// Offsets of the fields of struct __sk_buff.
+const (
+	skbPriority = 32
+	skbIfindex  = 40
+)
+
+// hasNet reports whether r has any net_cls or net_prio settings.
+func hasNet(r *cgroups.Resources) bool {
+	return r != nil && (r.NetClsClassid != 0 || len(r.NetPrioIfpriomap) > 0)
+}
+
+// netProgram generates a BPF_PROG_TYPE_CGROUP_SKB program which emulates
+// net_prio and net_cls for the egress packets:
+//
+//   - for the interfaces in ifprio (by ifindex), it sets skb->priority
+//     to their priority, like net_prio does;
+//   - for the other interfaces, it sets skb->priority to classid, which
+//     is what the classful qdiscs (such as HTB) use to classify a packet
+//     when its major number is the qdisc handle.
+//
+// Like with cgroup v1, the priority is only set if the socket did not set
+// one already (with SO_PRIORITY). All the packets are let through.
+func netProgram(classid uint32, ifprio map[int]uint32) asm.Instructions {
+	const exit = "exit"
+	insts := asm.Instructions{
+		// if (skb->priority != 0) goto exit;
+		asm.LoadMem(asm.R2, asm.R1, skbPriority, asm.Word),
+		asm.JNE.Imm(asm.R2, 0, exit),
+		asm.LoadMem(asm.R3, asm.R1, skbIfindex, asm.Word),
+	}
+	// setPriority sets skb->priority to prio, and jumps to exit.
+	// Stores into the context can't have an immediate source.
+	setPriority := func(label string, prio uint32) asm.Instructions {
+		return asm.Instructions{
+			asm.Mov.Imm32(asm.R2, int32(prio)).WithSymbol(label),
+			asm.StoreMem(asm.R1, skbPriority, asm.R2, asm.Word),
+			asm.Ja.Label(exit),
+		}
+	}
+
+	var blocks asm.Instructions
+	ifindexes := make([]int, 0, len(ifprio))
+	for ifindex := range ifprio {
+		ifindexes = append(ifindexes, ifindex)
+	}
+	slices.Sort(ifindexes)
+	for _, ifindex := range ifindexes {
+		// switch (skb->ifindex) { case ifindex: ... }
+		target := exit
+		if prio := ifprio[ifindex]; prio != 0 {
+			target = "if" + strconv.Itoa(ifindex)
+			blocks = append(blocks, setPriority(target, prio)...)
+		}
+		insts = append(insts, asm.JEq.Imm(asm.R3, int32(ifindex), target))
+	}
+	// default:
+	if classid != 0 {
+		insts = append(insts, setPriority("", classid)...)
+	} else if len(blocks) > 0 {
+		insts = append(insts, asm.Ja.Label(exit))
+	}
+	insts = append(insts, blocks...)
+	return append(insts,
+		asm.Mov.Imm(asm.R0, 1).WithSymbol(exit),
+		asm.Return(),
+	)
+}
+
+// errNoNetns is returned by cgroupNetns when the cgroup has no processes.
+var errNoNetns = errors.New("no processes in the cgroup to resolve the interface names for")
+
+// netIfprio resolves the interface names of ifpriomap in the network
+// namespace of the processes in the cgroup dirPath, as the ifindexes the
+// program matches are only unique within a network namespace. It fails if
+// the processes are in different namespaces. If the cgroup has no
+// processes yet, the interface priorities are skipped with a warning (they
+// are set by the next Set which changes them).
+func netIfprio(dirPath string, ifpriomap []*cgroups.IfPrioMap) (map[int]uint32, error) {
+	ifprio := make(map[int]uint32, len(ifpriomap))
+	for _, m := range ifpriomap {
+		if m.Priority < 0 || m.Priority > math.MaxUint32 {
+			return nil, fmt.Errorf("invalid priority %d for interface %s", m.Priority, m.Interface)
+		}
+	}
+	if len(ifpriomap) == 0 {
+		return ifprio, nil
+	}
+	nsFd, err := cgroupNetns(dirPath)
+	if errors.Is(err, errNoNetns) {
+		logrus.Warnf("not setting the interface priorities of cgroup %s: %v", dirPath, err)
+		return ifprio, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to set interface priorities: %w", err)
+	}
+	defer unix.Close(nsFd)
+	err = inNetns(nsFd, func() error {
+		for _, m := range ifpriomap {
+			iface, err := net.InterfaceByName(m.Interface)
+			if err != nil {
+				return fmt.Errorf("unable to set priority for interface %s: %w", m.Interface, err)
+			}
+			ifprio[iface.Index] = uint32(m.Priority)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ifprio, nil
+}
+
+// cgroupNetns returns an fd of the network namespace of the processes in
+// the cgroup dirPath (including its descendants).
+func cgroupNetns(dirPath string) (int, error) {
+	pids, err := cgroups.GetAllPids(dirPath)
+	if err != nil {
+		return -1, err
+	}
+	nsFd := -1
+	var nsSt unix.Stat_t
+	for _, pid := range pids {
+		fd, err := unix.Open("/proc/"+strconv.Itoa(pid)+"/ns/net", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ESRCH) {
+				// The process has exited.
+				continue
+			}
+			if nsFd != -1 {
+				unix.Close(nsFd)
+			}
+			return -1, fmt.Errorf("unable to open the network namespace of pid %d: %w", pid, err)
+		}
+		var st unix.Stat_t
+		if err := unix.Fstat(fd, &st); err != nil {
+			unix.Close(fd)
+			if nsFd != -1 {
+				unix.Close(nsFd)
+			}
+			return -1, os.NewSyscallError("fstat", err)
+		}
+		if nsFd == -1 {
+			nsFd, nsSt = fd, st
+			continue
+		}
+		unix.Close(fd)
+		if st.Dev != nsSt.Dev || st.Ino != nsSt.Ino {
+			unix.Close(nsFd)
+			return -1, errors.New("the processes in the cgroup are in different network namespaces")
+		}
+	}
+	if nsFd == -1 {
+		return -1, errNoNetns
+	}
+	return nsFd, nil
+}
+
+// inNetns runs fn in the network namespace nsFd. Unless it is the current
+// one, fn is run by a dedicated OS thread, which is terminated afterwards
+// (as it is never unlocked), rather than switched back.
+func inNetns(nsFd int, fn func() error) error {
+	var st, own unix.Stat_t
+	if err := unix.Fstat(nsFd, &st); err != nil {
+		return os.NewSyscallError("fstat", err)
+	}
+	if err := unix.Stat("/proc/thread-self/ns/net", &own); err == nil && st.Dev == own.Dev && st.Ino == own.Ino {
+		return fn()
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		if err := unix.Setns(nsFd, unix.CLONE_NEWNET); err != nil {
+			errCh <- fmt.Errorf("unable to enter the network namespace of the cgroup: %w", os.NewSyscallError("setns", err))
+			return
+		}
+		errCh <- fn()
+	}()
+	return <-errCh
+}
+
+// attachTypeName returns the name of the cgroup attachType (one of the
+// ones used in this package) for the errors and logs.
+func attachTypeName(attachType uint32) string {
+	switch attachType {
+	case unix.BPF_CGROUP_INET_INGRESS:
+		return "CGROUP_INET_INGRESS"
+	case unix.BPF_CGROUP_INET_EGRESS:
+		return "CGROUP_INET_EGRESS"
+	}
+	return strconv.FormatUint(uint64(attachType), 10)
+}
+
+// findPrograms returns the fds of the programs with the given name (i.e.
+// our own ones) attached to the cgroup dirFd with the given attachType.
+func findPrograms(dirFd int, attachType uint32, name string) ([]int, error) {
+	fds, err := bpf.ProgQuery(dirFd, attachType, attachTypeName(attachType))
+	if err != nil {
+		return nil, err
+	}
+	ours := fds[:0]
+	for _, fd := range fds {
+		info, _, err := bpf.ProgGetInfo(fd)
+		if err == nil && info.NameString() == name {
+			ours = append(ours, fd)
+			continue
+		}
+		unix.Close(fd)
+		if err != nil {
+			for _, fd := range ours {
+				unix.Close(fd)
+			}
+			return nil, err
+		}
+	}
+	return ours, nil
+}
+
+// detachPrograms detaches the programs fds attached to the cgroup dirFd
+// with the given attachType.
+func detachPrograms(dirFd int, attachType uint32, fds []int) error {
+	for _, fd := range fds {
+		if err := bpf.ProgDetach(dirFd, fd, attachType); err != nil {
+			if errors.Is(err, unix.ENOENT) {
+				logrus.Debugf("program is already detached: %v", err)
+				continue
+			}
+			return fmt.Errorf("failed to call BPF_PROG_DETACH (BPF_%s) on old program: %w", attachTypeName(attachType), err)
+		}
+	}
+	return nil
+}
+
+// setNet implements the NetClsClassid and NetPrioIfpriomap settings of r
+// with an eBPF program attached to the cgroup dirPath (see netProgram),
+// replacing the one set before, if any. If there are no such settings,
+// the program is detached.
+func setNet(dirPath string, r *cgroups.Resources) error {
+	var insts asm.Instructions
+	if hasNet(r) {
+		ifprio, err := netIfprio(dirPath, r.NetPrioIfpriomap)
+		if err != nil {
+			return err
+		}
+		insts = netProgram(r.NetClsClassid, ifprio)
+	}
+
+	dirFd, err := unix.Open(dirPath, unix.O_DIRECTORY|unix.O_RDONLY|unix.O_CLOEXEC, 0o600)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: dirPath, Err: err}
+	}
+	defer unix.Close(dirFd)
+
+	oldFds, err := findPrograms(dirFd, unix.BPF_CGROUP_INET_EGRESS, netFilterName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, fd := range oldFds {
+			unix.Close(fd)
+		}
+	}()
+
+	useReplaceProg := false
+	if insts != nil {
+		raiseMemlockLimit()
+		progFd, err := bpf.ProgLoad(unix.BPF_PROG_TYPE_CGROUP_SKB, netFilterName, insts, "GPL")
+		if err != nil {
+			return fmt.Errorf("failed to call BPF_PROG_LOAD: %w", err)
+		}
+		// The cgroup attachment keeps the program alive.
+		defer unix.Close(progFd)
+
+		// The other programs may have been attached with BPF_F_ALLOW_MULTI
+		// (as systemd does), which requires us to use it as well.
+		replaceFd := -1
+		attachFlags := uint32(unix.BPF_F_ALLOW_MULTI)
+		if len(oldFds) == 1 && bpf.HaveProgReplace() {
+			useReplaceProg = true
+			replaceFd = oldFds[0]
+			attachFlags |= unix.BPF_F_REPLACE
+		}
+		if err := bpf.ProgAttach(dirFd, progFd, unix.BPF_CGROUP_INET_EGRESS, attachFlags, replaceFd); err != nil {
+			return fmt.Errorf("failed to call BPF_PROG_ATTACH: %w", err)
+		}
+	}
+	if useReplaceProg {
+		return nil
+	}
+	return detachPrograms(dirFd, unix.BPF_CGROUP_INET_EGRESS, oldFds)
+}
+
+// raiseMemlockLimit increases `ulimit -l` limit to avoid BPF_PROG_LOAD
+// and BPF_MAP_CREATE errors, like for the device filter.
+func raiseMemlockLimit() {
+	_ = unix.Setrlimit(unix.RLIMIT_MEMLOCK, &unix.Rlimit{Cur: unix.RLIM_INFINITY, Max: unix.RLIM_INFINITY})
+}
+
+// saveNet arranges for the previously set net_cls and net_prio settings
+// to be re-applied on rollback, as the eBPF program can not be saved as is.
+func (m *Manager) saveNet(tx *fscommon.Transaction) {
+	prev := m.config.Resources
+	tx.OnRollback(func() error {
+		return setNet(m.dirPath, prev)
+	})
+}
@@ -0,0 +1,191 @@
+package fs2
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/opencontainers/cgroups"
+)
+
+// testCgroup2 creates a temporary cgroup v2 cgroup, skipping the test if
+// it is not possible.
+func testCgroup2(t *testing.T) string {
+	t.Helper()
+	for _, root := range []string{"/sys/fs/cgroup", "/sys/fs/cgroup/unified"} {
+		var st unix.Statfs_t
+		if err := unix.Statfs(root, &st); err != nil || st.Type != unix.CGROUP2_SUPER_MAGIC {
+			continue
+		}
+		path, err := os.MkdirTemp(root, "fs2-test-")
+		if err != nil {
+			t.Skipf("unable to create a cgroup: %v", err)
+		}
+		t.Cleanup(func() { _ = os.Remove(path) })
+		return path
+	}
+	t.Skip("cgroup v2 is not mounted")
+	return ""
+}
+
+// startInCgroup starts cmd, and moves it to the cgroup path. It is killed
+// once the test is done.
+func startInCgroup(t *testing.T, path string, cmd *exec.Cmd) {
+	t.Helper()
+	if err := cmd.Start(); err != nil {
+		t.Skipf("unable to start %s: %v", cmd.Path, err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	if err := cgroups.WriteCgroupProc(path, cmd.Process.Pid); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNetIfprio(t *testing.T) {
+	_, err := netIfprio(t.TempDir(), []*cgroups.IfPrioMap{{Interface: "lo", Priority: -1}})
+	if err == nil {
+		t.Fatal("expected an error for a negative priority")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	path := testCgroup2(t)
+	// Without processes, the interface priorities are skipped.
+	ifprio, err := netIfprio(path, []*cgroups.IfPrioMap{{Interface: "lo", Priority: 1}})
+	if err != nil || len(ifprio) != 0 {
+		t.Fatalf("expected no interface priorities for a cgroup without processes, got %v, %v", ifprio, err)
+	}
+
+	// The interfaces are resolved in the network namespace of the
+	// processes, rather than in the current one.
+	cmd := exec.Command("unshare", "--net", "sleep", "1000")
+	startInCgroup(t, path, cmd)
+	own, _ := os.Readlink("/proc/self/ns/net")
+	for range 100 {
+		// Wait for unshare to create the new namespace.
+		ns, err := os.Readlink("/proc/" + strconv.Itoa(cmd.Process.Pid) + "/ns/net")
+		if err == nil && ns != own {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ifprio, err = netIfprio(path, []*cgroups.IfPrioMap{{Interface: "lo", Priority: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ifprio) != 1 || ifprio[1] != 1 {
+		t.Errorf("unexpected interface priorities: %v", ifprio)
+	}
+	_, err = netIfprio(path, []*cgroups.IfPrioMap{{Interface: "no-such-if0", Priority: 1}})
+	if err == nil {
+		t.Fatal("expected an error for an unknown interface")
+	}
+	// The host interfaces are not in the new namespace.
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		if iface.Name == "lo" {
+			continue
+		}
+		if _, err := netIfprio(path, []*cgroups.IfPrioMap{{Interface: iface.Name, Priority: 1}}); err == nil {
+			t.Errorf("expected an error for the host interface %s", iface.Name)
+		}
+		break
+	}
+
+	// Processes in different namespaces are rejected.
+	startInCgroup(t, path, exec.Command("sleep", "1000"))
+	if _, err := netIfprio(path, []*cgroups.IfPrioMap{{Interface: "lo", Priority: 1}}); err == nil {
+		t.Fatal("expected an error for processes in different network namespaces")
+	}
+}
+
+func TestSetNet(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	path := testCgroup2(t)
+	// The interfaces are resolved in the namespace of the processes.
+	startInCgroup(t, path, exec.Command("sleep", "1000"))
+	m, err := NewManager(&cgroups.Cgroup{Resources: &cgroups.Resources{}}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	countNetPrograms := func() int {
+		t.Helper()
+		dirFd, err := unix.Open(path, unix.O_DIRECTORY|unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer unix.Close(dirFd)
+		fds, err := findPrograms(dirFd, unix.BPF_CGROUP_INET_EGRESS, netFilterName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+		return len(fds)
+	}
+
+	for _, tc := range []struct {
+		r    *cgroups.Resources
+		want int
+	}{
+		{&cgroups.Resources{NetClsClassid: 0x100001}, 1},
+		{&cgroups.Resources{NetPrioIfpriomap: []*cgroups.IfPrioMap{{Interface: "lo", Priority: 5}}}, 1},
+		{&cgroups.Resources{
+			NetClsClassid:    0x100002,
+			NetPrioIfpriomap: []*cgroups.IfPrioMap{{Interface: "lo", Priority: 0}},
+		}, 1},
+		{&cgroups.Resources{}, 0},
+	} {
+		if err := m.Set(tc.r); err != nil {
+			if tc.want > 0 && countNetPrograms() == 0 {
+				t.Skipf("unable to attach the net program: %v", err)
+			}
+			t.Fatal(err)
+		}
+		if got := countNetPrograms(); got != tc.want {
+			t.Errorf("%+v: expected %d net programs, got %d", tc.r, tc.want, got)
+		}
+	}
+
+	// A failed Set leaves the previous program in place.
+	if err := m.Set(&cgroups.Resources{NetClsClassid: 0x100001}); err != nil {
+		t.Fatal(err)
+	}
+	err = m.Set(&cgroups.Resources{NetPrioIfpriomap: []*cgroups.IfPrioMap{{Interface: "no-such-if0", Priority: 1}}})
+	if err == nil {
+		t.Fatal("expected an error for an unknown interface")
+	}
+	if got := countNetPrograms(); got != 1 {
+		t.Errorf("expected the net program to be kept, got %d", got)
+	}
+
+	// When rootless, the errors are ignored.
+	rootless, err := NewManager(&cgroups.Cgroup{Rootless: true, Resources: &cgroups.Resources{}}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rootless.Set(&cgroups.Resources{NetPrioIfpriomap: []*cgroups.IfPrioMap{{Interface: "no-such-if0", Priority: 1}}}); err != nil {
+		t.Errorf("expected the net error to be ignored when rootless, got %v", err)
+	}
+
+	// The interface priorities of a cgroup without processes are skipped.
+	empty, err := NewManager(&cgroups.Cgroup{Resources: &cgroups.Resources{}}, testCgroup2(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := empty.Set(&cgroups.Resources{NetPrioIfpriomap: []*cgroups.IfPrioMap{{Interface: "lo", Priority: 5}}}); err != nil {
+		t.Errorf("expected Set of a cgroup without processes to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+package fs2
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/cilium/ebpf/asm"
+	"golang.org/x/sys/unix"
+
+	"github.com/opencontainers/cgroups"
+	"github.com/opencontainers/cgroups/fscommon"
+	"github.com/opencontainers/cgroups/internal/bpf"
+)
+
+// netAcctName is the name of the network accounting programs.
+const netAcctName = "oci_net_acct"
+
+// The network accounting map is an array of two elements, one for each
+// direction, which are updated by the program of that direction.
+const (
+	netAcctIngress = 0
+	netAcctEgress  = 1
+
+	// netAcctValueSize is the size of the map values, which are the
+	// number of bytes and the number of packets (both u64).
+	netAcctValueSize = 16
+)
+
+// netAcctAttachTypes are the attach types of the network accounting
+// programs, indexed by the map key.
+var netAcctAttachTypes = [...]uint32{
+	netAcctIngress: unix.BPF_CGROUP_INET_INGRESS,
+	netAcctEgress:  unix.BPF_CGROUP_INET_EGRESS,
+}
+
+// netAcctProgram generates a BPF_PROG_TYPE_CGROUP_SKB program which adds
+// every packet to the element key of the map mapFd. All the packets are
+// let through.
+func netAcctProgram(mapFd int, key int32) asm.Instructions {
+	const exit = "exit"
+	return asm.Instructions{
+		// R6 = ctx
+		asm.Mov.Reg(asm.R6, asm.R1),
+		// R0 = bpf_map_lookup_elem(map, &key)
+		asm.StoreImm(asm.RFP, -4, int64(key), asm.Word),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -4),
+		asm.LoadMapPtr(asm.R1, mapFd),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, exit),
+		// value->bytes += skb->len
+		asm.LoadMem(asm.R1, asm.R6, 0, asm.Word),
+		asm.StoreXAdd(asm.R0, asm.R1, asm.DWord),
+		// value->packets++
+		asm.Add.Imm(asm.R0, 8),
+		asm.Mov.Imm(asm.R1, 1),
+		asm.StoreXAdd(asm.R0, asm.R1, asm.DWord),
+		asm.Mov.Imm(asm.R0, 1).WithSymbol(exit),
+		asm.Return(),
+	}
+}
+
+// findNetAcctPrograms returns the fds of the network accounting programs
+// attached to the cgroup dirFd, indexed by the map key. The caller must
+// close them.
+func findNetAcctPrograms(dirFd int) (fds [len(netAcctAttachTypes)][]int, _ error) {
+	for key, attachType := range netAcctAttachTypes {
+		var err error
+		fds[key], err = findPrograms(dirFd, attachType, netAcctName)
+		if err != nil {
+			closeNetAcctPrograms(fds)
+			return fds, err
+		}
+	}
+	return fds, nil
+}
+
+func closeNetAcctPrograms(fds [len(netAcctAttachTypes)][]int) {
+	for _, fds := range fds {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+	}
+}
+
+// setNetworkAccounting attaches the network accounting programs to the
+// cgroup dirPath, together with their (new) map, if enable is true and
+// they are not attached yet, or detaches them if enable is false. The
+// counters are kept while the programs stay attached.
+func setNetworkAccounting(dirPath string, enable bool) error {
+	dirFd, err := unix.Open(dirPath, unix.O_DIRECTORY|unix.O_RDONLY|unix.O_CLOEXEC, 0o600)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: dirPath, Err: err}
+	}
+	defer unix.Close(dirFd)
+
+	oldFds, err := findNetAcctPrograms(dirFd)
+	if err != nil {
+		return err
+	}
+	defer closeNetAcctPrograms(oldFds)
+	if enable && len(oldFds[netAcctIngress]) == 1 && len(oldFds[netAcctEgress]) == 1 {
+		return nil
+	}
+	// Detach whatever is left of the programs attached before.
+	for key, attachType := range netAcctAttachTypes {
+		if err := detachPrograms(dirFd, attachType, oldFds[key]); err != nil {
+			return err
+		}
+	}
+	if !enable {
+		return nil
+	}
+
+	raiseMemlockLimit()
+	mapFd, err := bpf.MapCreate(unix.BPF_MAP_TYPE_ARRAY, 4, netAcctValueSize, uint32(len(netAcctAttachTypes)))
+	if err != nil {
+		return fmt.Errorf("failed to create network accounting map: %w", err)
+	}
+	// The programs hold references to the map.
+	defer unix.Close(mapFd)
+	for key, attachType := range netAcctAttachTypes {
+		err := attachNetAcctProgram(dirFd, mapFd, int32(key), attachType)
+		if err != nil {
+			// Do not leave the accounting half-enabled.
+			if fds, err := findNetAcctPrograms(dirFd); err == nil {
+				for key, attachType := range netAcctAttachTypes {
+					_ = detachPrograms(dirFd, attachType, fds[key])
+				}
+				closeNetAcctPrograms(fds)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func attachNetAcctProgram(dirFd, mapFd int, key int32, attachType uint32) error {
+	progFd, err := bpf.ProgLoad(unix.BPF_PROG_TYPE_CGROUP_SKB, netAcctName, netAcctProgram(mapFd, key), "GPL")
+	if err != nil {
+		return fmt.Errorf("failed to call BPF_PROG_LOAD: %w", err)
+	}
+	// The cgroup attachment keeps the program alive.
+	defer unix.Close(progFd)
+	// See the comment about BPF_F_ALLOW_MULTI in setNet.
+	if err := bpf.ProgAttach(dirFd, progFd, attachType, unix.BPF_F_ALLOW_MULTI, -1); err != nil {
+		return fmt.Errorf("failed to call BPF_PROG_ATTACH (BPF_%s): %w", attachTypeName(attachType), err)
+	}
+	return nil
+}
+
+// statNetworkAccounting reads the counters of the network accounting
+// programs attached to the cgroup dirPath.
+func statNetworkAccounting(dirPath string, stats *cgroups.Stats) error {
+	dirFd, err := unix.Open(dirPath, unix.O_DIRECTORY|unix.O_RDONLY|unix.O_CLOEXEC, 0o600)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: dirPath, Err: err}
+	}
+	defer unix.Close(dirFd)
+
+	// Both programs use the same map, so either one would do.
+	fds, err := findPrograms(dirFd, unix.BPF_CGROUP_INET_EGRESS, netAcctName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+	}()
+	if len(fds) == 0 {
+		return errors.New("network accounting programs are not attached")
+	}
+	ids, err := bpf.ProgMapIDs(fds[0])
+	if err != nil {
+		return err
+	}
+	if len(ids) != 1 {
+		return fmt.Errorf("network accounting program uses %d maps, expected 1", len(ids))
+	}
+	mapFd, err := bpf.MapGetFdByID(ids[0])
+	if err != nil {
+		return fmt.Errorf("unable to get network accounting map: %w", err)
+	}
+	defer unix.Close(mapFd)
+
+	key := make([]byte, 4)
+	value := make([]byte, netAcctValueSize)
+	for _, v := range []struct {
+		key            uint32
+		bytes, packets *uint64
+	}{
+		{netAcctIngress, &stats.NetworkStats.IngressBytes, &stats.NetworkStats.IngressPackets},
+		{netAcctEgress, &stats.NetworkStats.EgressBytes, &stats.NetworkStats.EgressPackets},
+	} {
+		bpf.NativeEndian.PutUint32(key, v.key)
+		if err := bpf.MapLookupElem(mapFd, key, value); err != nil {
+			return fmt.Errorf("unable to read network accounting map: %w", err)
+		}
+		*v.bytes = bpf.NativeEndian.Uint64(value[0:])
+		*v.packets = bpf.NativeEndian.Uint64(value[8:])
+	}
+	return nil
+}
+
+// saveNetworkAccounting arranges for the network accounting to be
+// re-enabled or disabled on rollback, as it was before.
+func (m *Manager) saveNetworkAccounting(tx *fscommon.Transaction) {
+	prev := m.config.Resources
+	tx.OnRollback(func() error {
+		return setNetworkAccounting(m.dirPath, prev != nil && prev.NetworkAccounting)
+	})
+}
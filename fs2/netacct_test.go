@@ -0,0 +1,113 @@
+package fs2
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/cgroups"
+)
+
+// dialInCgroup creates a UDP socket connected to addr, which belongs to the
+// cgroup v2 path, by temporarily moving the current process into it.
+func dialInCgroup(t *testing.T, path string, addr *net.UDPAddr) *net.UDPConn {
+	t.Helper()
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var orig string
+	for _, line := range strings.Split(string(data), "\n") {
+		if p, ok := strings.CutPrefix(line, "0::"); ok {
+			orig = filepath.Join(filepath.Dir(path), p)
+		}
+	}
+	if orig == "" {
+		t.Skip("unable to find the current cgroup v2 cgroup")
+	}
+	pid := strconv.Itoa(os.Getpid())
+	if err := cgroups.WriteFile(path, "cgroup.procs", pid); err != nil {
+		t.Skipf("unable to move the process into the cgroup: %v", err)
+	}
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err := cgroups.WriteFile(orig, "cgroup.procs", pid); err != nil {
+		t.Fatalf("unable to move the process back: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestNetworkAccounting(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	path := testCgroup2(t)
+	config := &cgroups.Cgroup{Resources: &cgroups.Resources{NetworkAccounting: true}}
+	m, err := NewManager(config, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Set(config.Resources); err != nil {
+		t.Skipf("unable to enable network accounting: %v", err)
+	}
+
+	l, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn := dialInCgroup(t, path, l.LocalAddr().(*net.UDPAddr))
+	defer conn.Close()
+
+	// Only the traffic of the socket in the cgroup is counted.
+	const payload = 100
+	if _, err := conn.Write(make([]byte, payload)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, payload)
+	_, from, err := l.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Enabling it again keeps the counters.
+	if err := m.Set(config.Resources); err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if _, err := l.WriteToUDP(buf, from); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	st, err := m.Stats(&cgroups.StatsOptions{Controllers: cgroups.Network})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The sizes of the IP packets (with the IP and UDP headers).
+	const size = payload + 20 + 8
+	want := cgroups.IPStats{
+		IngressBytes:   2 * size,
+		IngressPackets: 2,
+		EgressBytes:    size,
+		EgressPackets:  1,
+	}
+	if st.NetworkStats != want {
+		t.Errorf("expected %+v, got %+v", want, st.NetworkStats)
+	}
+
+	// Disabling it detaches the programs.
+	if err := m.Set(&cgroups.Resources{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := statNetworkAccounting(path, cgroups.NewStats()); err == nil {
+		t.Error("expected an error after disabling network accounting")
+	}
+}
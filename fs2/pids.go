@@ -37,6 +37,12 @@ func setPids(dirPath string, r *cgroups.Resources) error {
 	return nil
 }
 
+func savePids(tx *fscommon.Transaction, dirPath string, r *cgroups.Resources) {
+	if isPidsSet(r) {
+		tx.SaveFiles(dirPath, "pids.max")
+	}
+}
+
 func statPidsFromCgroupProcs(dirPath string, stats *cgroups.Stats) error {
 	// if the controller is not enabled, let's read PIDS from cgroups.procs
 	// (or threads if cgroup.threads is enabled)
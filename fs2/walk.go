@@ -0,0 +1,22 @@
+package fs2
+
+import (
+	"github.com/opencontainers/cgroups"
+)
+
+// Walk returns the tree of cgroups rooted at the cgroup v2 path (see
+// [cgroups.Walk]). If opts is not nil, the statistics of every cgroup are
+// also collected, for the controllers specified by opts.
+func Walk(path string, opts *cgroups.StatsOptions) (*cgroups.Node, error) {
+	return cgroups.Walk(path, &cgroups.WalkOptions{Stats: statsFunc(opts)})
+}
+
+func statsFunc(opts *cgroups.StatsOptions) func(string, []string) (*cgroups.Stats, error) {
+	if opts == nil {
+		return nil
+	}
+	return func(path string, _ []string) (*cgroups.Stats, error) {
+		m := &Manager{config: &cgroups.Cgroup{}, dirPath: path}
+		return m.Stats(opts)
+	}
+}
@@ -0,0 +1,99 @@
+package fscommon
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/opencontainers/cgroups"
+)
+
+// Unchanged reports whether the settings of the given controller in r are
+// the same as in prev, so that setting them again can be skipped (see
+// [cgroups.Resources.SkipUnchanged]). It returns false if prev is nil, or
+// if the controller is not known. Both cgroup v1 subsystem names and
+// cgroup v2 controller names are accepted.
+//
+// Note the freezer is never considered unchanged, since its state can also
+// be changed by Manager.Freeze.
+func Unchanged(controller string, prev, r *cgroups.Resources) bool {
+	if prev == nil || r == nil {
+		return false
+	}
+	if !unifiedUnchanged(controller, prev.Unified, r.Unified) {
+		return false
+	}
+	switch controller {
+	case "cpu":
+		return prev.CpuShares == r.CpuShares &&
+			prev.CpuQuota == r.CpuQuota &&
+			prev.CpuPeriod == r.CpuPeriod &&
+			prev.CpuWeight == r.CpuWeight &&
+			prev.CpuRtRuntime == r.CpuRtRuntime &&
+			prev.CpuRtPeriod == r.CpuRtPeriod &&
+			reflect.DeepEqual(prev.CpuBurst, r.CpuBurst) &&
+			reflect.DeepEqual(prev.CPUIdle, r.CPUIdle)
+	case "cpuset":
+		return prev.CpusetCpus == r.CpusetCpus && prev.CpusetMems == r.CpusetMems
+	case "devices":
+		return prev.SkipDevices == r.SkipDevices &&
+			reflect.DeepEqual(prev.Devices, r.Devices) &&
+			reflect.DeepEqual(prev.DevicesAudit, r.DevicesAudit) &&
+			reflect.DeepEqual(prev.DevicesLink, r.DevicesLink)
+	case "memory":
+		return prev.Memory == r.Memory &&
+			prev.MemorySwap == r.MemorySwap &&
+			prev.MemoryReservation == r.MemoryReservation &&
+			prev.OomKillDisable == r.OomKillDisable &&
+			reflect.DeepEqual(prev.MemorySwappiness, r.MemorySwappiness)
+	case "pids":
+		return reflect.DeepEqual(prev.PidsLimit, r.PidsLimit)
+	case "cgroup":
+		// The core cgroup v2 interface files (cgroup.max.*).
+		return reflect.DeepEqual(prev.MaxDescendants, r.MaxDescendants) &&
+			reflect.DeepEqual(prev.MaxDepth, r.MaxDepth)
+	case "blkio", "io":
+		return prev.BlkioWeight == r.BlkioWeight &&
+			prev.BlkioLeafWeight == r.BlkioLeafWeight &&
+			reflect.DeepEqual(prev.BlkioWeightDevice, r.BlkioWeightDevice) &&
+			reflect.DeepEqual(prev.BlkioThrottleReadBpsDevice, r.BlkioThrottleReadBpsDevice) &&
+			reflect.DeepEqual(prev.BlkioThrottleWriteBpsDevice, r.BlkioThrottleWriteBpsDevice) &&
+			reflect.DeepEqual(prev.BlkioThrottleReadIOPSDevice, r.BlkioThrottleReadIOPSDevice) &&
+			reflect.DeepEqual(prev.BlkioThrottleWriteIOPSDevice, r.BlkioThrottleWriteIOPSDevice)
+	case "hugetlb":
+		return reflect.DeepEqual(prev.HugetlbLimit, r.HugetlbLimit)
+	case "net_cls":
+		return prev.NetClsClassid == r.NetClsClassid
+	case "net_prio":
+		return reflect.DeepEqual(prev.NetPrioIfpriomap, r.NetPrioIfpriomap)
+	case "network":
+		// The eBPF network accounting (cgroup v2 only).
+		return prev.NetworkAccounting == r.NetworkAccounting
+	case "rdma":
+		return reflect.DeepEqual(prev.Rdma, r.Rdma)
+	case "perf_event":
+		return prev.PerfEvents == r.PerfEvents
+	case "cpuacct", "name=systemd", "misc", "":
+		// Nothing to set.
+		return true
+	}
+	return false
+}
+
+// unifiedUnchanged reports whether the unified resources of the given
+// controller (the "CONTROLLER.*" keys) are the same in prev and res. A
+// key which is removed counts as a change, as the controller settings
+// have to be applied again.
+func unifiedUnchanged(controller string, prev, res map[string]string) bool {
+	contains := func(a, b map[string]string) bool {
+		for k, v := range a {
+			if c, _, _ := strings.Cut(k, "."); c != controller {
+				continue
+			}
+			if bv, ok := b[k]; !ok || bv != v {
+				return false
+			}
+		}
+		return true
+	}
+	return contains(prev, res) && contains(res, prev)
+}
@@ -0,0 +1,53 @@
+package fscommon
+
+import (
+	"testing"
+
+	"github.com/opencontainers/cgroups"
+)
+
+func TestUnchanged(t *testing.T) {
+	limit := int64(100)
+	otherLimit := int64(100)
+	prev := &cgroups.Resources{
+		PidsLimit:  &limit,
+		Memory:     1024,
+		CpusetCpus: "0-1",
+	}
+
+	if Unchanged("pids", nil, prev) {
+		t.Error("expected pids to be changed with no previous resources")
+	}
+	if !Unchanged("pids", prev, &cgroups.Resources{PidsLimit: &otherLimit}) {
+		t.Error("expected same pids limit to be unchanged")
+	}
+	if Unchanged("memory", prev, &cgroups.Resources{Memory: 2048}) {
+		t.Error("expected different memory limit to be changed")
+	}
+	if !Unchanged("cpuset", prev, &cgroups.Resources{CpusetCpus: "0-1"}) {
+		t.Error("expected same cpuset to be unchanged")
+	}
+	if Unchanged("freezer", prev, prev) {
+		t.Error("expected freezer never to be unchanged")
+	}
+	if Unchanged("unknown", prev, prev) {
+		t.Error("expected unknown controller to be changed")
+	}
+}
+
+func TestUnchangedUnified(t *testing.T) {
+	prev := &cgroups.Resources{Unified: map[string]string{"memory.high": "1000", "pids.max": "10"}}
+
+	if !Unchanged("memory", prev, &cgroups.Resources{Unified: map[string]string{"memory.high": "1000", "pids.max": "20"}}) {
+		t.Error("expected memory to be unchanged when only another controller's key is changed")
+	}
+	if Unchanged("memory", prev, &cgroups.Resources{Unified: map[string]string{"memory.high": "2000", "pids.max": "10"}}) {
+		t.Error("expected memory to be changed when its key is changed")
+	}
+	if Unchanged("memory", prev, &cgroups.Resources{Unified: map[string]string{"pids.max": "10"}}) {
+		t.Error("expected memory to be changed when its key is removed")
+	}
+	if Unchanged("cpu", prev, &cgroups.Resources{Unified: map[string]string{"memory.high": "1000", "pids.max": "10", "cpu.weight": "10"}}) {
+		t.Error("expected cpu to be changed when its key is added")
+	}
+}
@@ -0,0 +1,74 @@
+package fscommon
+
+import (
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/opencontainers/cgroups"
+)
+
+// AppliedFiles records the contents of cgroup files right after they were
+// modified, so that the later changes to them can be detected.
+type AppliedFiles map[File]string
+
+// Record reads and records the current contents of files.
+func (a AppliedFiles) Record(files []File) {
+	for _, f := range files {
+		data, err := cgroups.ReadFile(f.Dir, f.Name)
+		if err != nil {
+			delete(a, f)
+			continue
+		}
+		a[f] = data
+	}
+}
+
+// Verify returns the drift of the recorded files from their current
+// contents, ordered by the file path. A file which can't be read (for
+// example, as it was removed) is a drift too, with the error set.
+func (a AppliedFiles) Verify() ([]cgroups.Drift, error) {
+	files := make([]File, 0, len(a))
+	for f := range a {
+		files = append(files, f)
+	}
+	slices.SortFunc(files, func(x, y File) int {
+		if c := strings.Compare(x.Dir, y.Dir); c != 0 {
+			return c
+		}
+		return strings.Compare(x.Name, y.Name)
+	})
+
+	var drifts []cgroups.Drift
+	for _, f := range files {
+		data, err := cgroups.ReadFile(f.Dir, f.Name)
+		if want := a[f]; err != nil || data != want {
+			d := cgroups.Drift{
+				Path:     f.Dir,
+				File:     f.Name,
+				Expected: want,
+				Actual:   data,
+			}
+			if err != nil {
+				d.Err = err.Error()
+			}
+			drifts = append(drifts, d)
+		}
+	}
+	return drifts, nil
+}
+
+// Reconcile writes the recorded contents back to the drifted files.
+func (a AppliedFiles) Reconcile(drifts []cgroups.Drift) error {
+	var errs []error
+	for _, d := range drifts {
+		data, ok := a[File{Dir: d.Path, Name: d.File}]
+		if !ok {
+			continue
+		}
+		if err := restoreFile(d.Path, d.File, data); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,212 @@
+package fscommon
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/opencontainers/cgroups"
+)
+
+// perfEvents are the software events counted for a cgroup, with the
+// pointers to the fields of cgroups.PerfEventStats they are read into.
+var perfEvents = []struct {
+	config uint64
+	field  func(*cgroups.PerfEventStats) *uint64
+}{
+	{unix.PERF_COUNT_SW_TASK_CLOCK, func(s *cgroups.PerfEventStats) *uint64 { return &s.TaskClock }},
+	{unix.PERF_COUNT_SW_CONTEXT_SWITCHES, func(s *cgroups.PerfEventStats) *uint64 { return &s.ContextSwitches }},
+	{unix.PERF_COUNT_SW_CPU_MIGRATIONS, func(s *cgroups.PerfEventStats) *uint64 { return &s.CPUMigrations }},
+	{unix.PERF_COUNT_SW_PAGE_FAULTS, func(s *cgroups.PerfEventStats) *uint64 { return &s.PageFaults }},
+	{unix.PERF_COUNT_SW_PAGE_FAULTS_MAJ, func(s *cgroups.PerfEventStats) *uint64 { return &s.MajorFaults }},
+}
+
+// MaxPerfEventFds is the maximum number of perf event fds held by this
+// process to count the perf events of cgroups (see [SetPerfEvents]). As
+// counting the events of a cgroup takes an fd per event and online CPU
+// (that is, 5 fds per CPU), they quickly add up on large machines. If it
+// is 0 (the default), the limit is half of the RLIMIT_NOFILE soft limit.
+var MaxPerfEventFds int
+
+// perfCounters are the fds of the perf events of the cgroups, by cgroup
+// path, and then by event (in the order of perfEvents) and CPU, and their
+// total number. They are kept open for as long as the events are to be
+// counted, as the counts are lost once the fds are closed.
+var perfCounters = struct {
+	sync.Mutex
+	fds map[string][][]int
+	n   int
+}{fds: make(map[string][][]int)}
+
+// maxPerfEventFds returns the limit of the perf event fds (see
+// [MaxPerfEventFds]).
+func maxPerfEventFds() int {
+	if MaxPerfEventFds != 0 {
+		return MaxPerfEventFds
+	}
+	var rlim unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &rlim); err != nil || rlim.Cur > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int(rlim.Cur / 2)
+}
+
+// onlineCPUs returns the list of the online CPUs, as the cgroup perf
+// events can only be counted per CPU.
+func onlineCPUs() ([]int, error) {
+	data, err := os.ReadFile("/sys/devices/system/cpu/online")
+	if err != nil {
+		return nil, err
+	}
+	var cpus []int
+	for _, r := range strings.Split(strings.TrimSpace(string(data)), ",") {
+		first, last, isRange := strings.Cut(r, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("invalid online CPU list %q", data)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(last); err != nil || end < start {
+				return nil, fmt.Errorf("invalid online CPU list %q", data)
+			}
+		}
+		for cpu := start; cpu <= end; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+func countPerfFds(fds [][]int) int {
+	n := 0
+	for _, fds := range fds {
+		n += len(fds)
+	}
+	return n
+}
+
+func closePerfFds(fds [][]int) {
+	for _, fds := range fds {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+	}
+}
+
+// openPerfFds opens the perf events for the cgroup dirPath (either a cgroup
+// v2 one, or a cgroup v1 perf_event one) on the given CPUs.
+func openPerfFds(dirPath string, cpus []int) ([][]int, error) {
+	dirFd, err := unix.Open(dirPath, unix.O_DIRECTORY|unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: dirPath, Err: err}
+	}
+	defer unix.Close(dirFd)
+
+	fds := make([][]int, 0, len(perfEvents))
+	for _, ev := range perfEvents {
+		attr := unix.PerfEventAttr{
+			Type:   unix.PERF_TYPE_SOFTWARE,
+			Size:   uint32(unsafe.Sizeof(unix.PerfEventAttr{})),
+			Config: ev.config,
+		}
+		evFds := make([]int, 0, len(cpus))
+		for _, cpu := range cpus {
+			fd, err := unix.PerfEventOpen(&attr, dirFd, cpu, -1, unix.PERF_FLAG_PID_CGROUP|unix.PERF_FLAG_FD_CLOEXEC)
+			if err != nil {
+				closePerfFds(append(fds, evFds))
+				return nil, fmt.Errorf("perf_event_open (cgroup %s, cpu %d): %w", dirPath, cpu, err)
+			}
+			evFds = append(evFds, fd)
+		}
+		fds = append(fds, evFds)
+	}
+	return fds, nil
+}
+
+// SetPerfEvents starts or stops counting the software perf events of the
+// cgroup dirPath (see [cgroups.Resources.PerfEvents]). The counters are
+// held by this process, and are kept if they are already being counted.
+// They are closed, so the counting stops, when this process exits.
+//
+// The events are counted on the CPUs which are online when the counting
+// starts; the CPUs brought online later are not counted. It fails if the
+// counters would take more fds than [MaxPerfEventFds].
+func SetPerfEvents(dirPath string, enable bool) error {
+	perfCounters.Lock()
+	defer perfCounters.Unlock()
+
+	fds, ok := perfCounters.fds[dirPath]
+	if !enable {
+		if ok {
+			delete(perfCounters.fds, dirPath)
+			perfCounters.n -= countPerfFds(fds)
+			closePerfFds(fds)
+		}
+		return nil
+	}
+	if ok {
+		return nil
+	}
+	if dirPath == "" {
+		return errors.New("perf_event cgroup is not available")
+	}
+	cpus, err := onlineCPUs()
+	if err != nil {
+		return err
+	}
+	n := len(perfEvents) * len(cpus)
+	if limit := maxPerfEventFds(); perfCounters.n+n > limit {
+		return fmt.Errorf("unable to count the perf events of cgroup %s: %d more fds needed, while %d of at most %d are in use", dirPath, n, perfCounters.n, limit)
+	}
+	fds, err = openPerfFds(dirPath, cpus)
+	if err != nil {
+		return err
+	}
+	perfCounters.fds[dirPath] = fds
+	perfCounters.n += n
+	return nil
+}
+
+// PerfEventsEnabled reports whether the software perf events of the cgroup
+// dirPath are being counted by this process.
+func PerfEventsEnabled(dirPath string) bool {
+	perfCounters.Lock()
+	defer perfCounters.Unlock()
+	_, ok := perfCounters.fds[dirPath]
+	return ok
+}
+
+// GetPerfEventStats reads the software perf event counts of the cgroup
+// dirPath into stats, if they are being counted (see [SetPerfEvents]).
+func GetPerfEventStats(dirPath string, stats *cgroups.Stats) error {
+	perfCounters.Lock()
+	defer perfCounters.Unlock()
+
+	fds, ok := perfCounters.fds[dirPath]
+	if !ok {
+		return nil
+	}
+	var st cgroups.PerfEventStats
+	buf := make([]byte, 8)
+	for i, ev := range perfEvents {
+		var sum uint64
+		for _, fd := range fds[i] {
+			if _, err := unix.Read(fd, buf); err != nil {
+				return fmt.Errorf("unable to read perf event counter: %w", os.NewSyscallError("read", err))
+			}
+			sum += binary.NativeEndian.Uint64(buf)
+		}
+		*ev.field(&st) = sum
+	}
+	stats.PerfEventStats = st
+	return nil
+}
@@ -0,0 +1,106 @@
+package fscommon
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/opencontainers/cgroups"
+)
+
+func TestPerfEvents(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	var root string
+	for _, r := range []string{"/sys/fs/cgroup", "/sys/fs/cgroup/unified"} {
+		var st unix.Statfs_t
+		if err := unix.Statfs(r, &st); err == nil && st.Type == unix.CGROUP2_SUPER_MAGIC {
+			root = r
+			break
+		}
+	}
+	if root == "" {
+		t.Skip("cgroup v2 is not mounted")
+	}
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var orig string
+	for _, line := range strings.Split(string(data), "\n") {
+		if p, ok := strings.CutPrefix(line, "0::"); ok {
+			orig = filepath.Join(root, p)
+		}
+	}
+	if orig == "" {
+		t.Skip("unable to find the current cgroup v2 cgroup")
+	}
+	path, err := os.MkdirTemp(root, "fscommon-test-")
+	if err != nil {
+		t.Skipf("unable to create a cgroup: %v", err)
+	}
+	t.Cleanup(func() { _ = os.Remove(path) })
+
+	// The fds are limited.
+	MaxPerfEventFds = len(perfEvents) - 1
+	err = SetPerfEvents(path, true)
+	MaxPerfEventFds = 0
+	if err == nil || PerfEventsEnabled(path) {
+		t.Fatal("expected the perf events over the fd limit not to be enabled")
+	}
+
+	if err := SetPerfEvents(path, true); err != nil {
+		t.Skipf("unable to count perf events: %v", err)
+	}
+	defer SetPerfEvents(path, false) //nolint:errcheck
+	if !PerfEventsEnabled(path) {
+		t.Fatal("expected the perf events to be enabled")
+	}
+
+	// Run for a while in the cgroup.
+	pid := []byte(strconv.Itoa(os.Getpid()))
+	if err := os.WriteFile(filepath.Join(path, "cgroup.procs"), pid, 0o644); err != nil {
+		t.Skipf("unable to move the process into the cgroup: %v", err)
+	}
+	for start := time.Now(); time.Since(start) < 20*time.Millisecond; {
+	}
+	if err := os.WriteFile(filepath.Join(orig, "cgroup.procs"), pid, 0o644); err != nil {
+		t.Fatalf("unable to move the process back: %v", err)
+	}
+
+	st := cgroups.NewStats()
+	if err := GetPerfEventStats(path, st); err != nil {
+		t.Fatal(err)
+	}
+	if st.PerfEventStats.TaskClock < uint64(10*time.Millisecond) {
+		t.Errorf("expected task-clock of at least 10ms, got %+v", st.PerfEventStats)
+	}
+
+	// Enabling it again keeps the counts.
+	if err := SetPerfEvents(path, true); err != nil {
+		t.Fatal(err)
+	}
+	st2 := cgroups.NewStats()
+	if err := GetPerfEventStats(path, st2); err != nil {
+		t.Fatal(err)
+	}
+	if st2.PerfEventStats.TaskClock < st.PerfEventStats.TaskClock {
+		t.Errorf("expected the counts to be kept, got %+v after %+v", st2.PerfEventStats, st.PerfEventStats)
+	}
+
+	if err := SetPerfEvents(path, false); err != nil {
+		t.Fatal(err)
+	}
+	if PerfEventsEnabled(path) {
+		t.Fatal("expected the perf events to be disabled")
+	}
+	if perfCounters.n != 0 {
+		t.Errorf("expected no perf event fds to be held, got %d", perfCounters.n)
+	}
+}
@@ -109,6 +109,17 @@ func createCmdString(device string, limits cgroups.LinuxRdma) string {
 	return cmdString
 }
 
+// RdmaSave saves the contents of rdma.max to be restored on rollback,
+// if RDMA resources are about to be set.
+func RdmaSave(tx *Transaction, path string, r *cgroups.Resources) {
+	if len(r.Rdma) == 0 {
+		return
+	}
+	tx.SaveKeyedFile(path, "rdma.max", func(device string) string {
+		return device + " hca_handle=max hca_object=max"
+	})
+}
+
 // RdmaSet sets RDMA resources.
 func RdmaSet(path string, r *cgroups.Resources) error {
 	for device, limits := range r.Rdma {
@@ -0,0 +1,138 @@
+package fscommon
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/opencontainers/cgroups"
+)
+
+// Transaction records the state of cgroup files (and other resources)
+// before they are modified, so that it can be restored if a later
+// modification fails. The zero value is ready to use.
+type Transaction struct {
+	undo  []func() error
+	files []File
+}
+
+// File identifies a cgroup file.
+type File struct {
+	// Dir is the cgroup directory.
+	Dir string
+	// Name is the file name.
+	Name string
+}
+
+// Files returns the list of files modified by the transaction, i.e. all
+// the files saved by SaveFiles and SaveKeyedFile or marked by MarkModified.
+func (t *Transaction) Files() []File {
+	return t.files
+}
+
+// MarkModified adds files in dir to the list returned by Files, for the
+// files that are saved by other means than SaveFiles or SaveKeyedFile.
+func (t *Transaction) MarkModified(dir string, files ...string) {
+	for _, file := range files {
+		t.files = append(t.files, File{Dir: dir, Name: file})
+	}
+}
+
+// SaveFiles records the current contents of files in dir, to be written
+// back on Rollback. Files that can not be read (for example, because they
+// do not exist) are skipped, as there is nothing to restore.
+func (t *Transaction) SaveFiles(dir string, files ...string) {
+	if dir == "" {
+		return
+	}
+	t.MarkModified(dir, files...)
+	for _, file := range files {
+		data, err := cgroups.ReadFile(dir, file)
+		if err != nil {
+			logrus.Debugf("not saving %s/%s for rollback: %v", dir, file, err)
+			continue
+		}
+		t.OnRollback(func() error {
+			return restoreFile(dir, file, data)
+		})
+	}
+}
+
+// SaveKeyedFile is like SaveFiles, but for a file consisting of lines in
+// the "KEY VALUES..." format (such as io.max or rdma.max), to which new
+// keys can be added by writing to it. On Rollback, the keys which were
+// added after the file was saved are removed by writing a line returned by
+// reset for every such key, and then the original contents is written back.
+func (t *Transaction) SaveKeyedFile(dir, file string, reset func(key string) string) {
+	if dir == "" {
+		return
+	}
+	t.MarkModified(dir, file)
+	data, err := cgroups.ReadFile(dir, file)
+	if err != nil {
+		logrus.Debugf("not saving %s/%s for rollback: %v", dir, file, err)
+		return
+	}
+	t.OnRollback(func() error {
+		cur, err := cgroups.ReadFile(dir, file)
+		if err != nil {
+			return err
+		}
+		saved := lineKeys(data)
+		for key := range lineKeys(cur) {
+			if _, ok := saved[key]; ok {
+				continue
+			}
+			if err := cgroups.WriteFile(dir, file, reset(key)); err != nil {
+				return fmt.Errorf("unable to reset %q in %s: %w", key, file, err)
+			}
+		}
+		return restoreFile(dir, file, data)
+	})
+}
+
+// OnRollback registers fn to be called on Rollback.
+func (t *Transaction) OnRollback(fn func() error) {
+	t.undo = append(t.undo, fn)
+}
+
+// Rollback restores the saved state, in the reverse order of saving. It
+// tries to restore as much as possible, and returns all errors encountered.
+// Once Rollback is called, the saved state is discarded.
+func (t *Transaction) Rollback() error {
+	var errs []error
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		if err := t.undo[i](); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	t.undo = nil
+	return errors.Join(errs...)
+}
+
+// restoreFile writes the data previously read from a cgroup file back.
+func restoreFile(dir, file, data string) error {
+	data = strings.TrimSuffix(data, "\n")
+	if data == "" {
+		// An empty value (e.g. cpuset.cpus in cgroup v2) is shown as
+		// an empty line, and can be written back as such.
+		data = "\n"
+	}
+	if err := cgroups.WriteFileByLine(dir, file, data); err != nil {
+		return fmt.Errorf("unable to restore %s: %w", file, err)
+	}
+	return nil
+}
+
+// lineKeys returns the set of first fields of all lines in data.
+func lineKeys(data string) map[string]struct{} {
+	keys := make(map[string]struct{})
+	for line := range strings.SplitSeq(data, "\n") {
+		if key, _, _ := strings.Cut(strings.TrimSpace(line), " "); key != "" {
+			keys[key] = struct{}{}
+		}
+	}
+	return keys
+}
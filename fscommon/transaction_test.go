@@ -0,0 +1,94 @@
+package fscommon
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/cgroups"
+)
+
+func TestTransactionRollback(t *testing.T) {
+	dir := t.TempDir()
+	for file, data := range map[string]string{
+		"pids.max":    "max\n",
+		"cpuset.cpus": "\n",
+		"io.max":      "8:0 rbps=1024 wbps=max riops=max wiops=max\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tx Transaction
+	var order []string
+	tx.OnRollback(func() error {
+		order = append(order, "first")
+		return nil
+	})
+	tx.SaveFiles(dir, "pids.max", "cpuset.cpus", "no.such.file")
+	var resetKeys []string
+	tx.SaveKeyedFile(dir, "io.max", func(key string) string {
+		resetKeys = append(resetKeys, key)
+		return key + " rbps=max wbps=max riops=max wiops=max"
+	})
+	tx.OnRollback(func() error {
+		order = append(order, "last")
+		return nil
+	})
+
+	for file, data := range map[string]string{
+		"pids.max":    "100",
+		"cpuset.cpus": "0-1",
+		"io.max":      "8:0 rbps=2048 wbps=max riops=max wiops=max\n8:16 rbps=max wbps=max riops=10 wiops=max\n",
+	} {
+		if err := cgroups.WriteFile(dir, file, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if len(order) != 2 || order[0] != "last" || order[1] != "first" {
+		t.Errorf("expected rollback in reverse order, got %v", order)
+	}
+	if len(resetKeys) != 1 || resetKeys[0] != "8:16" {
+		t.Errorf("expected only 8:16 to be reset, got %v", resetKeys)
+	}
+	for file, want := range map[string]string{
+		"pids.max":    "max",
+		"cpuset.cpus": "\n",
+		"io.max":      "8:0 rbps=1024 wbps=max riops=max wiops=max",
+	} {
+		got, err := cgroups.ReadFile(dir, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%s: expected %q, got %q", file, want, got)
+		}
+	}
+
+	// Once rolled back, nothing is left to roll back.
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if len(order) != 2 {
+		t.Errorf("expected rollback to be done once, got %v", order)
+	}
+}
+
+func TestTransactionRollbackErrors(t *testing.T) {
+	var tx Transaction
+	errA, errB := errors.New("a"), errors.New("b")
+	tx.OnRollback(func() error { return errA })
+	tx.OnRollback(func() error { return nil })
+	tx.OnRollback(func() error { return errB })
+
+	err := tx.Rollback()
+	if !errors.Is(err, errA) || !errors.Is(err, errB) {
+		t.Fatalf("expected both errors to be returned, got %v", err)
+	}
+}
@@ -0,0 +1,680 @@
+// Package bpf is a minimal set of bpf(2) syscall wrappers, which are
+// roughly equivalent to the ones of github.com/cilium/ebpf, for the eBPF
+// programs attached to cgroups by the managers.
+package bpf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"unsafe"
+
+	"github.com/cilium/ebpf/asm"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// maxRetries is the maximum number of times a BPF_PROG_LOAD is retried
+// after being interrupted by a signal (EAGAIN).
+const maxRetries = 30
+
+func bpf(cmd uintptr, attr unsafe.Pointer, size uintptr) (uintptr, error) {
+	// Prevent the Go profiler from repeatedly interrupting the verifier.
+	if cmd == unix.BPF_PROG_LOAD || cmd == unix.BPF_PROG_RUN {
+		maskProfilerSignal()
+		defer unmaskProfilerSignal()
+	}
+	for retries := 0; ; retries++ {
+		r1, _, errno := unix.Syscall(unix.SYS_BPF, cmd, uintptr(attr), size)
+		runtime.KeepAlive(attr)
+		if errno == 0 {
+			return r1, nil
+		}
+
+		// As of ~4.20 the verifier can be interrupted by a signal,
+		// and returns EAGAIN in that case.
+		if errno == unix.EAGAIN && cmd == unix.BPF_PROG_LOAD {
+			if retries < maxRetries {
+				continue
+			}
+			return r1, fmt.Errorf("bpf: prog load keeps being interrupted by EAGAIN after %d retries: %w", maxRetries, errno)
+		}
+
+		return r1, os.NewSyscallError("bpf", errno)
+	}
+}
+
+func bpfFD(cmd uintptr, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, err := bpf(cmd, attr, size)
+	if err != nil {
+		return -1, err
+	}
+	if fd != 0 {
+		return int(fd), nil
+	}
+	// bpf(2) treats fd 0 as unset, so we need to dup it.
+	newFD, err := unix.FcntlInt(fd, unix.F_DUPFD_CLOEXEC, 1)
+	unix.Close(int(fd))
+	if err != nil {
+		return -1, os.NewSyscallError("dup", err)
+	}
+	return newFD, nil
+}
+
+// ProgLoad loads a program of the given progType and name, which does not
+// need any of the other bpf_attr fields to be set, and returns its fd.
+//
+// It is roughly equivalent to [github.com/cilium/ebpf/internal/sys.ProgLoad],
+// and the "retry with verifier log" is taken from [github.com/cilium/ebpf.NewProgram].
+func ProgLoad(progType uint32, name string, insns asm.Instructions, license string) (int, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, insns.Size()))
+	if err := insns.Marshal(buf, NativeEndian); err != nil {
+		return -1, err
+	}
+	insnsBytes := buf.Bytes()
+
+	licensePtr, err := unix.BytePtrFromString(license)
+	if err != nil {
+		return -1, err
+	}
+
+	// Subset of struct bpf_attr for BPF_PROG_LOAD. Fields past the ones we set
+	// are left zero; the kernel zero-fills any part of bpf_attr beyond the size
+	// we pass.
+	attr := struct {
+		progType uint32
+		insnCnt  uint32
+		insns    uint64 // pointer
+		license  uint64 // pointer
+		logLevel uint32
+		logSize  uint32
+		logBuf   uint64 // pointer
+		_        uint32 // kern_version
+		_        uint32 // prog_flags
+		progName [unix.BPF_OBJ_NAME_LEN]byte
+	}{
+		progType: progType,
+		insnCnt:  uint32(len(insnsBytes) / asm.InstructionSize),
+		insns:    uint64(uintptr(unsafe.Pointer(&insnsBytes[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(licensePtr))),
+	}
+	// The name is truncated, leaving room for the terminating NUL.
+	copy(attr.progName[:unix.BPF_OBJ_NAME_LEN-1], name)
+
+	fd, err := bpfFD(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	// attr holds the pointers as integers, so the GC can't see them; keep the
+	// referenced objects alive until the syscall returns.
+	runtime.KeepAlive(insnsBytes)
+	runtime.KeepAlive(licensePtr)
+	if err == nil {
+		return fd, nil
+	}
+	origErr := err
+
+	// The load failed. Retry with the verifier log enabled so we can include
+	// it in the error (the first attempt skips it, as it is the fast path).
+	const minLogSize = 64 * 1024
+	// If the log does not fit into the buffer, the kernel returns ENOSPC,
+	// in which case retry with a bigger buffer, up to maxLogSize.
+	// Note kernels < v5.2 rejected a log_size larger than UINT_MAX >> 8.
+	const maxLogSize = 16*1024*1024 - 1
+	attr.logLevel = 1
+	for logSize := minLogSize; ; logSize = min(logSize*8, maxLogSize) {
+		log := make([]byte, logSize)
+		attr.logSize = uint32(len(log))
+		attr.logBuf = uint64(uintptr(unsafe.Pointer(unsafe.SliceData(log))))
+
+		fd, err = bpfFD(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+		runtime.KeepAlive(insnsBytes)
+		runtime.KeepAlive(licensePtr)
+		runtime.KeepAlive(log)
+		if err == nil { // Totally unexpected.
+			logrus.Warnf("BPF_PROG_LOAD retry unexpectedly succeeded after failing with %v earlier", origErr)
+			return fd, nil
+		}
+		if errors.Is(err, unix.ENOSPC) && logSize < maxLogSize {
+			continue
+		}
+		if n := bytes.IndexByte(log, 0); n > 0 {
+			return -1, fmt.Errorf("%w: %s", err, bytes.TrimRight(log[:n], "\n"))
+		}
+		return -1, err
+	}
+}
+
+// ProgGetFdByID returns the fd for the BPF program with the given ID.
+//
+// It is roughly equivalent to [github.com/cilium/ebpf/internal/sys.ProgGetFdById].
+func ProgGetFdByID(id uint32) (int, error) {
+	// The kernel zero-fills the rest of bpf_attr beyond the size we pass.
+	attr := struct{ id uint32 }{id}
+	return bpfFD(unix.BPF_PROG_GET_FD_BY_ID, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+// ProgTestRun runs the program once with the given context (which must
+// be a multiple of 8 bytes in size), and returns its return value.
+//
+// It is roughly equivalent to [github.com/cilium/ebpf.Program.Run].
+func ProgTestRun(progFd int, ctx []byte) (uint32, error) {
+	attr := struct {
+		progFd      uint32
+		retval      uint32
+		dataSizeIn  uint32
+		dataSizeOut uint32
+		dataIn      uint64 // pointer
+		dataOut     uint64 // pointer
+		repeat      uint32
+		duration    uint32
+		ctxSizeIn   uint32
+		ctxSizeOut  uint32
+		ctxIn       uint64 // pointer
+		ctxOut      uint64 // pointer
+	}{
+		progFd:    uint32(progFd),
+		ctxSizeIn: uint32(len(ctx)),
+		ctxIn:     uint64(uintptr(unsafe.Pointer(unsafe.SliceData(ctx)))),
+	}
+	_, err := bpf(unix.BPF_PROG_RUN, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("bpf_prog_test_run failed: %w", err)
+	}
+	return attr.retval, nil
+}
+
+// MapCreate creates a map of the given mapType and returns its fd.
+//
+// It is roughly equivalent to [github.com/cilium/ebpf.NewMap].
+func MapCreate(mapType, keySize, valueSize, maxEntries uint32) (int, error) {
+	attr := struct {
+		mapType    uint32
+		keySize    uint32
+		valueSize  uint32
+		maxEntries uint32
+	}{
+		mapType:    mapType,
+		keySize:    keySize,
+		valueSize:  valueSize,
+		maxEntries: maxEntries,
+	}
+	return bpfFD(unix.BPF_MAP_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+// MapGetFdByID returns the fd for the BPF map with the given ID.
+func MapGetFdByID(id uint32) (int, error) {
+	// The kernel zero-fills the rest of bpf_attr beyond the size we pass.
+	attr := struct{ id uint32 }{id}
+	return bpfFD(unix.BPF_MAP_GET_FD_BY_ID, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+// MapLookupElem reads the value of the map element with the given key.
+// The sizes of key and value must be the ones the map was created with.
+//
+// It is roughly equivalent to [github.com/cilium/ebpf.Map.Lookup].
+func MapLookupElem(mapFd int, key, value []byte) error {
+	// See the comment about pinning in ProgQuery.
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+	pinner.Pin(&key[0])
+	pinner.Pin(&value[0])
+	attr := struct {
+		mapFd uint32
+		_     uint32
+		key   uint64 // pointer
+		value uint64 // pointer
+		flags uint64
+	}{
+		mapFd: uint32(mapFd),
+		key:   uint64(uintptr(unsafe.Pointer(&key[0]))),
+		value: uint64(uintptr(unsafe.Pointer(&value[0]))),
+	}
+	_, err := bpf(unix.BPF_MAP_LOOKUP_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+// ObjPin pins the BPF object to path, which must be in a bpffs.
+func ObjPin(fd int, path string) error {
+	// See the comment about pinning in ProgQuery.
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+	pathPtr, err := unix.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	pinner.Pin(pathPtr)
+	attr := struct {
+		pathname uint64 // pointer
+		bpfFd    uint32
+	}{
+		pathname: uint64(uintptr(unsafe.Pointer(pathPtr))),
+		bpfFd:    uint32(fd),
+	}
+	_, err = bpf(unix.BPF_OBJ_PIN, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return &os.PathError{Op: "bpf_obj_pin", Path: path, Err: errors.Unwrap(err)}
+	}
+	return nil
+}
+
+// ObjGet returns the fd of the BPF object pinned at path.
+func ObjGet(path string) (int, error) {
+	// See the comment about pinning in ProgQuery.
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+	pathPtr, err := unix.BytePtrFromString(path)
+	if err != nil {
+		return -1, err
+	}
+	pinner.Pin(pathPtr)
+	attr := struct {
+		pathname uint64 // pointer
+		bpfFd    uint32
+		flags    uint32
+	}{
+		pathname: uint64(uintptr(unsafe.Pointer(pathPtr))),
+	}
+	fd, err := bpfFD(unix.BPF_OBJ_GET, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return -1, &os.PathError{Op: "bpf_obj_get", Path: path, Err: errors.Unwrap(err)}
+	}
+	return fd, nil
+}
+
+// LinkCreate attaches progFd to cgroupFd with the given attachType through
+// a new BPF link, and returns the link fd. The program stays attached until
+// the link is released, i.e. all its fds are closed and it is not pinned.
+//
+// It is roughly equivalent to [github.com/cilium/ebpf/link.AttachCgroup].
+func LinkCreate(cgroupFd, progFd int, attachType uint32) (int, error) {
+	attr := struct {
+		progFd     uint32
+		targetFd   uint32
+		attachType uint32
+		flags      uint32
+	}{
+		progFd:     uint32(progFd),
+		targetFd:   uint32(cgroupFd),
+		attachType: attachType,
+	}
+	return bpfFD(unix.BPF_LINK_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+// LinkUpdate atomically replaces the program of the BPF link linkFd
+// with progFd.
+//
+// It is roughly equivalent to [github.com/cilium/ebpf/link.RawLink.Update].
+func LinkUpdate(linkFd, progFd int) error {
+	attr := struct {
+		linkFd    uint32
+		newProgFd uint32
+		flags     uint32
+		oldProgFd uint32
+	}{
+		linkFd:    uint32(linkFd),
+		newProgFd: uint32(progFd),
+	}
+	_, err := bpf(unix.BPF_LINK_UPDATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+// LinkDetach detaches the program of the BPF link linkFd from its target
+// (Linux 5.9 or later), which makes the link defunct, even if it is still
+// held or pinned.
+//
+// It is roughly equivalent to [github.com/cilium/ebpf/link.RawLink.Detach].
+func LinkDetach(linkFd int) error {
+	attr := struct{ linkFd uint32 }{uint32(linkFd)}
+	_, err := bpf(unix.BPF_LINK_DETACH, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+// LinkGetNextID returns the ID of the BPF link following the one with the
+// given ID (or the first one, if id is 0), or ENOENT if there is none.
+func LinkGetNextID(id uint32) (uint32, error) {
+	attr := struct {
+		startID uint32
+		nextID  uint32
+	}{startID: id}
+	_, err := bpf(unix.BPF_LINK_GET_NEXT_ID, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return attr.nextID, err
+}
+
+// LinkGetFdByID returns the fd for the BPF link with the given ID.
+func LinkGetFdByID(id uint32) (int, error) {
+	attr := struct{ id uint32 }{id}
+	return bpfFD(unix.BPF_LINK_GET_FD_BY_ID, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+// LinkInfo is a subset of struct bpf_link_info, for the cgroup links.
+type LinkInfo struct {
+	Type   uint32
+	ID     uint32
+	ProgID uint32
+	_      uint32
+	// CgroupID is the ID of the cgroup the link is attached to, or 0
+	// if the link is defunct.
+	CgroupID   uint64
+	AttachType uint32
+	_          uint32
+}
+
+// LinkGetInfo returns the information about the BPF link linkFd.
+//
+// It is roughly equivalent to [github.com/cilium/ebpf/link.RawLink.Info].
+func LinkGetInfo(linkFd int) (*LinkInfo, error) {
+	info := &LinkInfo{}
+	// See the comment about pinning in ProgQuery.
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+	pinner.Pin(info)
+	attr := struct {
+		bpfFd   uint32
+		infoLen uint32
+		info    uint64 // pointer
+	}{
+		bpfFd:   uint32(linkFd),
+		infoLen: uint32(unsafe.Sizeof(*info)),
+		info:    uint64(uintptr(unsafe.Pointer(info))),
+	}
+	if _, err := bpf(unix.BPF_OBJ_GET_INFO_BY_FD, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err != nil {
+		return nil, fmt.Errorf("bpf_obj_get_info_by_fd failed: %w", err)
+	}
+	return info, nil
+}
+
+// ProgInfo is a subset of struct bpf_prog_info.
+type ProgInfo struct {
+	Type            uint32
+	ID              uint32
+	Tag             [unix.BPF_TAG_SIZE]byte
+	jitedProgLen    uint32
+	xlatedProgLen   uint32
+	jitedProgInsns  uint64 // pointer
+	xlatedProgInsns uint64 // pointer
+	loadTime        uint64
+	createdByUID    uint32
+	nrMapIDs        uint32
+	mapIDs          uint64 // pointer
+	Name            [unix.BPF_OBJ_NAME_LEN]byte
+}
+
+// NameString returns the program name.
+func (i *ProgInfo) NameString() string {
+	return string(bytes.TrimRight(i.Name[:], "\x00"))
+}
+
+// ProgGetInfo returns the information about the BPF program, and its
+// instructions as translated by the kernel. The instructions are nil if the
+// kernel does not let us see them (see bpf_dump_raw_ok in the kernel).
+//
+// It is roughly equivalent to [github.com/cilium/ebpf.Program.Info].
+func ProgGetInfo(progFd int) (*ProgInfo, []byte, error) {
+	// See the comment about pinning in ProgQuery.
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+
+	getInfo := func(info *ProgInfo) error {
+		pinner.Pin(info)
+		attr := struct {
+			bpfFd   uint32
+			infoLen uint32
+			info    uint64 // pointer
+		}{
+			bpfFd:   uint32(progFd),
+			infoLen: uint32(unsafe.Sizeof(*info)),
+			info:    uint64(uintptr(unsafe.Pointer(info))),
+		}
+		_, err := bpf(unix.BPF_OBJ_GET_INFO_BY_FD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+		return err
+	}
+
+	info := &ProgInfo{}
+	if err := getInfo(info); err != nil {
+		return nil, nil, fmt.Errorf("bpf_obj_get_info_by_fd failed: %w", err)
+	}
+	if info.xlatedProgLen == 0 {
+		return info, nil, nil
+	}
+	// Now that we know the size, get the instructions.
+	insns := make([]byte, info.xlatedProgLen)
+	pinner.Pin(&insns[0])
+	info = &ProgInfo{
+		xlatedProgLen:   uint32(len(insns)),
+		xlatedProgInsns: uint64(uintptr(unsafe.Pointer(&insns[0]))),
+	}
+	if err := getInfo(info); err != nil {
+		return nil, nil, fmt.Errorf("bpf_obj_get_info_by_fd failed: %w", err)
+	}
+	return info, insns[:min(int(info.xlatedProgLen), len(insns))], nil
+}
+
+// ProgMapIDs returns the IDs of the maps used by the BPF program.
+func ProgMapIDs(progFd int) ([]uint32, error) {
+	// See the comment about pinning in ProgQuery.
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+
+	var ids []uint32
+	for {
+		info := &ProgInfo{nrMapIDs: uint32(len(ids))}
+		if len(ids) > 0 {
+			pinner.Pin(&ids[0])
+			info.mapIDs = uint64(uintptr(unsafe.Pointer(&ids[0])))
+		}
+		pinner.Pin(info)
+		attr := struct {
+			bpfFd   uint32
+			infoLen uint32
+			info    uint64 // pointer
+		}{
+			bpfFd:   uint32(progFd),
+			infoLen: uint32(unsafe.Sizeof(*info)),
+			info:    uint64(uintptr(unsafe.Pointer(info))),
+		}
+		if _, err := bpf(unix.BPF_OBJ_GET_INFO_BY_FD, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err != nil {
+			return nil, fmt.Errorf("bpf_obj_get_info_by_fd failed: %w", err)
+		}
+		// The kernel reports the actual number of maps, which
+		// is only filled in if the buffer is large enough.
+		if int(info.nrMapIDs) <= len(ids) {
+			return ids[:info.nrMapIDs], nil
+		}
+		ids = make([]uint32, info.nrMapIDs)
+	}
+}
+
+// ProgAttach attaches progFd to cgroupFd with the given attachType and flags.
+// If replaceFd is > 0, its fd is set in replaceBpfFd (for BPF_F_REPLACE
+// semantics).
+//
+// It is roughly equivalent to [github.com/cilium/ebpf/link.RawAttachProgram].
+func ProgAttach(cgroupFd, progFd int, attachType, attachFlags uint32, replaceFd int) error {
+	attr := struct {
+		targetFd     uint32
+		attachBpfFd  uint32
+		attachType   uint32
+		attachFlags  uint32
+		replaceBpfFd uint32
+	}{
+		targetFd:    uint32(cgroupFd),
+		attachBpfFd: uint32(progFd),
+		attachType:  attachType,
+		attachFlags: attachFlags,
+	}
+	if replaceFd > 0 {
+		attr.replaceBpfFd = uint32(replaceFd)
+	}
+	_, err := bpf(unix.BPF_PROG_ATTACH, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+// ProgDetach detaches progFd attached to cgroupFd with the given attachType.
+//
+// It is roughly equivalent to [github.com/cilium/ebpf/link.RawDetachProgram].
+func ProgDetach(cgroupFd, progFd int, attachType uint32) error {
+	// The kernel zero-fills the rest of bpf_attr beyond the size we pass.
+	attr := struct {
+		targetFd    uint32
+		attachBpfFd uint32
+		attachType  uint32
+	}{
+		targetFd:    uint32(cgroupFd),
+		attachBpfFd: uint32(progFd),
+		attachType:  attachType,
+	}
+	_, err := bpf(unix.BPF_PROG_DETACH, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+// ProgQuery returns the fds of the programs attached to the cgroup dirFd
+// with the given attachType (named by typeName in the errors and logs).
+func ProgQuery(dirFd int, attachType uint32, typeName string) (_ []int, retErr error) {
+	type bpfAttrQuery struct {
+		TargetFd    uint32
+		AttachType  uint32
+		QueryType   uint32
+		AttachFlags uint32
+		ProgIds     uint64 // __aligned_u64
+		ProgCnt     uint32
+		// Kernels v6.17+ have a bug: they write the Revision field no matter
+		// what size is provided to bpf(2). This was fixed in kernel v7.2
+		// (commit 21c4b99b27f3). None of the fields below are used here,
+		// but they must be declared to work around the kernel bug.
+		_               uint32 // padding
+		ProgAttachFlags uint64 // __aligned_u64
+		LinkIDs         uint64 // __aligned_u64
+		LinkAttachFlags uint64 // __aligned_u64
+		Revision        uint64
+	}
+
+	// query.ProgIds below holds the address of the progIds buffer as an
+	// integer, so it is invisible to the runtime: the GC does not see the
+	// buffer as reachable, and the stack copier would not rewrite the address
+	// if the buffer were stack-allocated. Pinning it takes care of both --
+	// pinner.Pin forces the buffer onto the heap (its argument escapes) and
+	// keeps it in place and alive until Unpin.
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+
+	// Currently you can only have 64 eBPF programs attached to a cgroup.
+	size := 64
+	retries := 0
+	for retries < 10 {
+		// Release the pin from a previous iteration, if any
+		// (Unpin on an empty pinner is a no-op).
+		pinner.Unpin()
+		progIds := make([]uint32, size)
+		pinner.Pin(&progIds[0])
+		query := bpfAttrQuery{
+			TargetFd:   uint32(dirFd),
+			AttachType: attachType,
+			ProgIds:    uint64(uintptr(unsafe.Pointer(&progIds[0]))),
+			ProgCnt:    uint32(len(progIds)),
+		}
+
+		// Fetch the list of program ids.
+		_, err := bpf(unix.BPF_PROG_QUERY, unsafe.Pointer(&query), unsafe.Sizeof(query))
+		size = int(query.ProgCnt)
+		if err != nil {
+			// On ENOSPC we get the correct number of programs.
+			if errors.Is(err, unix.ENOSPC) {
+				retries++
+				continue
+			}
+			return nil, fmt.Errorf("bpf_prog_query(BPF_%s) failed: %w", typeName, err)
+		}
+
+		// Convert the ids to program fds.
+		// On error we don't return the fds slice, so close the fds stored there.
+		progIds = progIds[:size]
+		fds := make([]int, 0, len(progIds))
+		defer func() {
+			if retErr != nil {
+				for _, fd := range fds {
+					unix.Close(fd)
+				}
+			}
+		}()
+
+		for _, progID := range progIds {
+			fd, err := ProgGetFdByID(progID)
+			if err != nil {
+				// We skip over programs that give us -EACCES or -EPERM. This
+				// is necessary because there may be BPF programs that have
+				// been attached (such as with --systemd-cgroup) which have an
+				// LSM label that blocks us from interacting with the program.
+				//
+				// Because additional BPF_CGROUP_DEVICE programs only can add
+				// restrictions, there's no real issue with just ignoring these
+				// programs (and stops runc from breaking on distributions with
+				// very strict SELinux policies). The programs of the other
+				// attach types we care about are our own, which we can access.
+				if errors.Is(err, os.ErrPermission) {
+					logrus.Debugf("ignoring existing %s program (prog_id=%v) which cannot be accessed by runc -- likely due to LSM policy: %v", typeName, progID, err)
+					continue
+				}
+				return nil, fmt.Errorf("cannot fetch program from id: %w", err)
+			}
+			fds = append(fds, fd)
+		}
+		return fds, nil
+	}
+
+	return nil, fmt.Errorf("could not get complete list of %s programs", typeName)
+}
+
+var (
+	haveProgReplaceBool bool
+	haveProgReplaceOnce sync.Once
+)
+
+// HaveProgReplace reports whether the kernel supports BPF_F_REPLACE.
+//
+// Loosely based on the BPF_F_REPLACE support check in
+// https://github.com/cilium/ebpf/blob/v0.6.0/link/syscalls.go.
+func HaveProgReplace() bool {
+	haveProgReplaceOnce.Do(func() {
+		progFd, err := ProgLoad(unix.BPF_PROG_TYPE_CGROUP_DEVICE, "", asm.Instructions{
+			asm.Mov.Imm(asm.R0, 0),
+			asm.Return(),
+		}, "MIT")
+		if err != nil {
+			logrus.Warnf("checking for BPF_F_REPLACE support: ProgLoad failed: %v", err)
+			return
+		}
+		defer unix.Close(progFd)
+
+		devnull, err := os.Open("/dev/null")
+		if err != nil {
+			logrus.Warnf("checking for BPF_F_REPLACE support: open dummy target fd: %v", err)
+			return
+		}
+		defer devnull.Close()
+
+		// We know that we have BPF_PROG_ATTACH since we can load
+		// BPF_CGROUP_DEVICE programs. If passing BPF_F_REPLACE gives us EINVAL
+		// we know that the feature isn't present.
+		//
+		// We rely on the target fd being checked after attachFlags in the
+		// kernel. Attempting to "replace" our BPF program with itself always
+		// fails, but we should get -EINVAL if BPF_F_REPLACE is not supported,
+		// and -EBADF (from the dummy target fd) if it is.
+		err = ProgAttach(int(devnull.Fd()), progFd, unix.BPF_CGROUP_DEVICE, unix.BPF_F_ALLOW_MULTI|unix.BPF_F_REPLACE, progFd)
+		if errors.Is(err, unix.EINVAL) {
+			// not supported
+			return
+		}
+		if !errors.Is(err, unix.EBADF) {
+			// If we see any new errors here, it's possible that there is a
+			// regression due to a kernel update and the above EINVAL
+			// checks are not working. So, be loud about it so someone notices
+			// and we can get the issue fixed quicker.
+			logrus.Warnf("checking for BPF_F_REPLACE: got unexpected (not EBADF or EINVAL) error: %v", err)
+		}
+		haveProgReplaceBool = true
+	})
+	return haveProgReplaceBool
+}
@@ -1,12 +1,12 @@
-package devices
+package bpf
 
 import (
 	"encoding/binary"
 )
 
-// nativeEndian is used as a workaround for cilium/ebpf/asm,
+// NativeEndian is used as a workaround for cilium/ebpf/asm,
 // which does not accept binary.NativeEndian.
-var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+var NativeEndian binary.ByteOrder = func() binary.ByteOrder {
 	buf := [2]byte{}
 	binary.NativeEndian.PutUint16(buf[:], 0xABCD)
 	switch buf {
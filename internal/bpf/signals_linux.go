@@ -1,4 +1,4 @@
-package devices
+package bpf
 
 // The code below is copied from
 // github.com/cilium/ebpf/internal/sys/signals.go@v0.22.0.
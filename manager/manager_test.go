@@ -1,10 +1,19 @@
 package manager
 
 import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
 	"testing"
+	"time"
+
+	systemdDbus "github.com/coreos/go-systemd/v22/dbus"
+	"github.com/sirupsen/logrus"
 
 	"github.com/opencontainers/cgroups"
 	"github.com/opencontainers/cgroups/systemd"
+	"github.com/opencontainers/cgroups/systemd/systemdtest"
 )
 
 // TestNilResources checks that a cgroup manager do not panic when
@@ -53,3 +62,122 @@ func testNilResources(t *testing.T, systemd bool) {
 	_, _ = mgr.OOMKillCount()
 	_ = mgr.Destroy()
 }
+
+func TestNewWithOptions(t *testing.T) {
+	srv, err := systemdtest.NewServer(systemdtest.Config{CgroupRoot: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = srv.Close() })
+	reachable := systemd.NewDbusConnManager(srv.Dial)
+	unreachable := systemd.NewDbusConnManager(func(context.Context) (*systemdDbus.Conn, error) {
+		return nil, errors.New("no bus")
+	})
+	block := make(chan struct{})
+	t.Cleanup(func() { close(block) })
+	hanging := systemd.NewDbusConnManager(func(context.Context) (*systemdDbus.Conn, error) {
+		<-block
+		return nil, errors.New("no bus")
+	})
+
+	paths := map[string]string{"": filepath.Join(t.TempDir(), "test")}
+	if !cgroups.IsCgroup2UnifiedMode() {
+		paths = map[string]string{"memory": paths[""], "pids": paths[""]}
+	}
+
+	testCases := []struct {
+		desc    string
+		systemd bool
+		opts    Options
+		backend Backend
+		reason  string
+		err     bool
+	}{
+		{
+			desc:    "not requested",
+			opts:    Options{Dbus: reachable},
+			backend: Cgroupfs,
+			reason:  "systemd is not requested",
+		},
+		{
+			desc:    "required",
+			systemd: true,
+			opts:    Options{Dbus: reachable},
+			backend: Systemd,
+			reason:  "systemd is requested and can be reached",
+		},
+		{
+			desc:    "required,unreachable",
+			systemd: true,
+			opts:    Options{Dbus: unreachable},
+			err:     true,
+		},
+		{
+			desc:    "fallback,unreachable",
+			systemd: true,
+			opts:    Options{Policy: FallbackToCgroupfs, Dbus: unreachable},
+			backend: Cgroupfs,
+			reason:  "systemd can't be reached (failed to connect to dbus: no bus), falling back to cgroupfs",
+		},
+		{
+			desc:    "fallback,hanging",
+			systemd: true,
+			opts:    Options{Policy: FallbackToCgroupfs, Dbus: hanging, ProbeTimeout: 10 * time.Millisecond},
+			backend: Cgroupfs,
+			reason:  "systemd can't be reached (context deadline exceeded), falling back to cgroupfs",
+		},
+		{
+			desc:    "prefer",
+			opts:    Options{Policy: PreferSystemd, Dbus: reachable},
+			backend: Systemd,
+			reason:  "systemd is preferred and can be reached",
+		},
+		{
+			desc:    "prefer,unreachable",
+			opts:    Options{Policy: PreferSystemd, Dbus: unreachable},
+			backend: Cgroupfs,
+			reason:  "systemd can't be reached (failed to connect to dbus: no bus), falling back to cgroupfs",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			cg := &cgroups.Cgroup{
+				Name:        "test",
+				ScopePrefix: "runc",
+				Parent:      "system.slice",
+				Systemd:     tc.systemd,
+				Resources:   &cgroups.Resources{},
+			}
+			tc.opts.Paths = paths
+			logger := logrus.New()
+			logger.Out = io.Discard
+			tc.opts.Logger = logger
+			m, sel, err := NewWithOptions(cg, tc.opts)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected error, got backend %s", sel.Backend)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sel.Backend != tc.backend || sel.Reason != tc.reason {
+				t.Errorf("expected backend %s (%s), got %s (%s)", tc.backend, tc.reason, sel.Backend, sel.Reason)
+			}
+			if cg.Systemd != (tc.backend == Systemd) {
+				t.Errorf("expected config.Systemd to be %v", tc.backend == Systemd)
+			}
+			switch m.(type) {
+			case *systemd.UnifiedManager, *systemd.LegacyManager:
+				if tc.backend != Systemd {
+					t.Errorf("unexpected manager %T", m)
+				}
+			default:
+				if tc.backend != Cgroupfs {
+					t.Errorf("unexpected manager %T", m)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/opencontainers/cgroups"
+	"github.com/opencontainers/cgroups/fs"
+	"github.com/opencontainers/cgroups/fs2"
+	"github.com/opencontainers/cgroups/systemd"
+)
+
+// DefaultProbeTimeout is the time to wait for systemd to reply when
+// checking if it can be reached, unless [Options.ProbeTimeout] is set.
+const DefaultProbeTimeout = 5 * time.Second
+
+// Policy is the policy of choosing between the systemd and the cgroupfs
+// managers (see [NewWithOptions]).
+type Policy int
+
+const (
+	// RequireSystemd uses the systemd manager if config.Systemd is set,
+	// failing if systemd can't be reached, and the cgroupfs manager
+	// otherwise. This is what [New] does.
+	RequireSystemd Policy = iota
+	// FallbackToCgroupfs is like RequireSystemd, except that it uses the
+	// cgroupfs manager (logging a warning) if systemd can't be reached.
+	FallbackToCgroupfs
+	// PreferSystemd uses the systemd manager whenever systemd can be
+	// reached, even if config.Systemd is not set, and the cgroupfs
+	// manager (logging a warning) otherwise. The config has to be usable
+	// by both (see [cgroups.Cgroup.Parent] and [cgroups.Cgroup.Path]).
+	PreferSystemd
+)
+
+// Backend is a kind of cgroup managers.
+type Backend string
+
+const (
+	// Systemd are the systemd managers.
+	Systemd Backend = "systemd"
+	// Cgroupfs are the managers writing to cgroupfs directly.
+	Cgroupfs Backend = "cgroupfs"
+)
+
+// Options are the options of [NewWithOptions].
+type Options struct {
+	// Policy is the policy of choosing the manager backend.
+	Policy Policy
+	// Paths are the known cgroup paths (see [NewWithPaths]).
+	Paths map[string]string
+	// Dbus, if set, is the D-Bus connection manager the systemd managers
+	// use. By default, the shared system one, or user one for rootless
+	// configs, is used (see [systemd.NewUnifiedManager]).
+	Dbus *systemd.DbusConnManager
+	// JobTimeout, if set, is the systemd job timeout of the systemd
+	// managers (see [systemd.UnifiedManager.SetJobTimeout]).
+	JobTimeout time.Duration
+	// ProbeTimeout, if set, is used instead of DefaultProbeTimeout.
+	ProbeTimeout time.Duration
+	// Logger, if set, is used to log the warnings, instead of the
+	// standard logrus logger.
+	Logger logrus.FieldLogger
+}
+
+// Selection describes the manager backend chosen by [NewWithOptions].
+type Selection struct {
+	Backend Backend
+	// Reason tells why the backend was chosen.
+	Reason string
+	// RootlessDelegated tells, for a rootless config, whether the cgroup
+	// of the current process is delegated to the current user (so that
+	// the cgroups can be created, and limits set, without systemd).
+	// It is always false on cgroup v1.
+	RootlessDelegated bool
+}
+
+// NewWithOptions returns the instance of a cgroup manager, like [New] and
+// [NewWithPaths] do, but chooses between the systemd and the cgroupfs
+// managers according to opts.Policy, checking that systemd can be reached
+// if needed. It sets config.Systemd according to the chosen backend, and
+// returns that together with the reason it was chosen.
+func NewWithOptions(config *cgroups.Cgroup, opts Options) (cgroups.Manager, Selection, error) {
+	var sel Selection
+	if config == nil {
+		return nil, sel, errors.New("cgroups/manager.NewWithOptions: config must not be nil")
+	}
+	log := opts.Logger
+	if log == nil {
+		log = logrus.StandardLogger()
+	}
+	if config.Rootless {
+		sel.RootlessDelegated = rootlessDelegated()
+	}
+
+	sel.Backend = Cgroupfs
+	sel.Reason = "systemd is not requested"
+	if config.Systemd || opts.Policy == PreferSystemd {
+		err := probeSystemd(config, &opts)
+		switch {
+		case err == nil:
+			sel.Backend = Systemd
+			sel.Reason = "systemd is requested and can be reached"
+			if !config.Systemd {
+				sel.Reason = "systemd is preferred and can be reached"
+			}
+		case opts.Policy == RequireSystemd:
+			return nil, sel, fmt.Errorf("cannot use systemd cgroups manager: %w", err)
+		default:
+			sel.Reason = "systemd can't be reached (" + err.Error() + "), falling back to cgroupfs"
+			log.WithError(err).Warn("systemd can't be reached, falling back to cgroupfs cgroups manager")
+		}
+	}
+	if config.Rootless && sel.Backend == Cgroupfs && !sel.RootlessDelegated {
+		sel.Reason += "; the cgroup is not delegated, so rootless cgroups can't be created"
+		log.Warn("rootless and the cgroup is not delegated, cgroups can't be created by cgroupfs cgroups manager")
+	}
+	config.Systemd = sel.Backend == Systemd
+
+	m, err := newManager(config, &opts)
+	if err != nil {
+		return nil, sel, err
+	}
+	return m, sel, nil
+}
+
+// probeSystemd checks that the systemd manager can be used for config, and
+// that systemd can be reached. Unless opts.Dbus is connected already, the
+// probe uses a connection of its own (see [systemd.DbusConnManager.Ping]),
+// so a hanging systemd does not hold up the shared connection managers.
+func probeSystemd(config *cgroups.Cgroup, opts *Options) error {
+	if config.Rootless && !cgroups.IsCgroup2UnifiedMode() {
+		return errors.New("rootless systemd cgroups manager is not supported on cgroup v1")
+	}
+	if opts.Dbus == nil {
+		if !systemd.IsRunningSystemd() {
+			return errors.New("systemd not running on this host")
+		}
+		if config.Rootless {
+			opts.Dbus = systemd.UserDbusConnManager("", -1)
+		} else {
+			opts.Dbus = systemd.SystemDbusConnManager()
+		}
+	}
+	timeout := opts.ProbeTimeout
+	if timeout <= 0 {
+		timeout = DefaultProbeTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return opts.Dbus.Ping(ctx)
+}
+
+// newManager returns the manager for config, as of [NewWithPaths], using
+// opts for the systemd managers (with opts.Dbus set).
+func newManager(config *cgroups.Cgroup, opts *Options) (cgroups.Manager, error) {
+	// Cgroup v2 aka unified hierarchy.
+	if cgroups.IsCgroup2UnifiedMode() {
+		path, err := getUnifiedPath(opts.Paths)
+		if err != nil {
+			return nil, fmt.Errorf("manager.NewWithOptions: inconsistent paths: %w", err)
+		}
+		if config.Systemd {
+			m, err := systemd.NewUnifiedManagerWithDbus(config, path, opts.Dbus)
+			if err != nil {
+				return nil, err
+			}
+			m.SetJobTimeout(opts.JobTimeout)
+			return m, nil
+		}
+		return fs2.NewManager(config, path)
+	}
+
+	// Cgroup v1.
+	if config.Systemd {
+		m, err := systemd.NewLegacyManagerWithDbus(config, opts.Paths, opts.Dbus)
+		if err != nil {
+			return nil, err
+		}
+		m.SetJobTimeout(opts.JobTimeout)
+		return m, nil
+	}
+	return fs.NewManager(config, opts.Paths)
+}
+
+// rootlessDelegated reports whether the cgroup of the current process is
+// delegated to the current user, that is, whether it can create cgroups
+// in it, which is only possible on cgroup v2.
+func rootlessDelegated() bool {
+	if !cgroups.IsCgroup2UnifiedMode() {
+		return false
+	}
+	own, err := cgroups.ParseCgroupFile("/proc/self/cgroup")
+	if err != nil {
+		return false
+	}
+	return unix.Access(filepath.Join(fs2.UnifiedMountpoint, own[""]), unix.W_OK) == nil
+}
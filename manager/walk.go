@@ -0,0 +1,21 @@
+package manager
+
+import (
+	"path/filepath"
+
+	"github.com/opencontainers/cgroups"
+	"github.com/opencontainers/cgroups/fs"
+	"github.com/opencontainers/cgroups/fs2"
+)
+
+// Walk returns the tree of cgroups rooted at path, which is either a cgroup
+// v2 cgroup, or a cgroup in a cgroup v1 hierarchy. If opts is not nil, the
+// statistics of every cgroup are also collected.
+//
+// See [cgroups.Walk] for details.
+func Walk(path string, opts *cgroups.StatsOptions) (*cgroups.Node, error) {
+	if cgroups.PathExists(filepath.Join(path, "cgroup.controllers")) {
+		return fs2.Walk(path, opts)
+	}
+	return fs.Walk(path, opts)
+}
@@ -192,6 +192,68 @@ type MiscStats struct {
 	Events uint64 `json:"events,omitzero"`
 }
 
+// CgroupStats are the statistics of the cgroup itself, as shown by
+// cgroup.stat (cgroup v2 only).
+type CgroupStats struct {
+	// Number of visible descendant cgroups.
+	NrDescendants uint64 `json:"nr_descendants,omitzero"`
+	// Number of dying descendant cgroups, i.e. the ones which were
+	// removed, but are still holding some resources.
+	NrDyingDescendants uint64 `json:"nr_dying_descendants,omitzero"`
+	// Number of live (including this one) and dying cgroups in the
+	// subtree, per controller (since kernel 6.11).
+	NrSubsys      map[string]uint64 `json:"nr_subsys,omitzero"`
+	NrDyingSubsys map[string]uint64 `json:"nr_dying_subsys,omitzero"`
+}
+
+// IPStats are the IP traffic statistics of a cgroup, either as counted by
+// systemd (see [IPPolicy.Accounting] and [Stats.IPStats]), or by the eBPF
+// programs attached to the cgroup by the cgroup v2 managers (see
+// [Resources.NetworkAccounting] and [Stats.NetworkStats]). Either way, the
+// bytes are the sizes of the IP packets (without the link layer headers).
+type IPStats struct {
+	IngressBytes   uint64 `json:"ingress_bytes,omitzero"`
+	IngressPackets uint64 `json:"ingress_packets,omitzero"`
+	EgressBytes    uint64 `json:"egress_bytes,omitzero"`
+	EgressPackets  uint64 `json:"egress_packets,omitzero"`
+}
+
+// PerfEventStats are the software perf event counts of a cgroup, since the
+// counting was enabled by the current process (see [Resources.PerfEvents]).
+// They are zero if the counting was enabled by another process.
+type PerfEventStats struct {
+	// TaskClock is the time the tasks of the cgroup were running, in ns.
+	TaskClock       uint64 `json:"task_clock,omitzero"`
+	ContextSwitches uint64 `json:"context_switches,omitzero"`
+	CPUMigrations   uint64 `json:"cpu_migrations,omitzero"`
+	PageFaults      uint64 `json:"page_faults,omitzero"`
+	MajorFaults     uint64 `json:"major_faults,omitzero"`
+}
+
+// UnitStats are the statistics of a cgroup which are only available from the
+// properties of its systemd unit (see [Unit]). The values which are not
+// available (for example, as the accounting is not enabled) are zero.
+type UnitStats struct {
+	// Unit is the name of the systemd unit.
+	Unit string `json:"unit,omitzero"`
+	// InvocationID identifies the current run of the unit, in hex, as in
+	// the _SYSTEMD_INVOCATION_ID field of the journal entries.
+	InvocationID string `json:"invocation_id,omitzero"`
+	// ActiveEnterTimestamp is the time the unit became active, in
+	// microseconds since the epoch.
+	ActiveEnterTimestamp uint64 `json:"active_enter_timestamp,omitzero"`
+
+	MemoryCurrent uint64 `json:"memory_current,omitzero"`
+	// SliceMemoryCurrent is the MemoryCurrent of the parent slice.
+	SliceMemoryCurrent uint64 `json:"slice_memory_current,omitzero"`
+	CPUUsageNSec       uint64 `json:"cpu_usage_nsec,omitzero"`
+	TasksCurrent       uint64 `json:"tasks_current,omitzero"`
+	IOReadBytes        uint64 `json:"io_read_bytes,omitzero"`
+	IOWriteBytes       uint64 `json:"io_write_bytes,omitzero"`
+	IPIngressBytes     uint64 `json:"ip_ingress_bytes,omitzero"`
+	IPEgressBytes      uint64 `json:"ip_egress_bytes,omitzero"`
+}
+
 type Stats struct {
 	CpuStats    CpuStats    `json:"cpu_stats,omitzero"`
 	CPUSetStats CPUSetStats `json:"cpuset_stats,omitzero"`
@@ -202,7 +264,14 @@ type Stats struct {
 	HugetlbStats map[string]HugetlbStats `json:"hugetlb_stats,omitzero"`
 	RdmaStats    RdmaStats               `json:"rdma_stats,omitzero"`
 	// the map is in the format "misc resource name: stats of the key"
-	MiscStats map[string]MiscStats `json:"misc_stats,omitzero"`
+	MiscStats   map[string]MiscStats `json:"misc_stats,omitzero"`
+	CgroupStats CgroupStats          `json:"cgroup_stats,omitzero"`
+	// IPStats are counted by systemd, and NetworkStats by the cgroup v2
+	// managers (see [IPStats]).
+	IPStats        IPStats        `json:"ip_stats,omitzero"`
+	NetworkStats   IPStats        `json:"network_stats,omitzero"`
+	PerfEventStats PerfEventStats `json:"perf_event_stats,omitzero"`
+	UnitStats      UnitStats      `json:"unit_stats,omitzero"`
 }
 
 func NewStats() *Stats {
@@ -224,11 +293,18 @@ const (
 	HugeTLB
 	RDMA
 	Misc
-	CPUSet // v1 only
+	CPUSet    // v1 only
+	Core      // v2 only, cgroup.stat
+	IP        // systemd only, IP accounting (not in AllControllers)
+	Network   // v2 only, eBPF network accounting
+	PerfEvent // software perf events, if enabled
+	Unit      // systemd only, unit properties (not in AllControllers)
 )
 
-// AllControllers is a bitmask of all available controllers.
-const AllControllers = CPU | Memory | Pids | IO | HugeTLB | RDMA | Misc | CPUSet
+// AllControllers is a bitmask of all available controllers. It does not
+// include IP and Unit, as their statistics are queried from systemd, so
+// they have to be asked for explicitly.
+const AllControllers = CPU | Memory | Pids | IO | HugeTLB | RDMA | Misc | CPUSet | Core | Network | PerfEvent
 
 // StatsOptions specifies which controllers to retrieve statistics for.
 type StatsOptions struct {
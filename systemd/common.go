@@ -24,12 +24,17 @@ const (
 	// v1: https://www.kernel.org/doc/html/latest/scheduler/sched-bwc.html and
 	// v2: https://www.kernel.org/doc/html/latest/admin-guide/cgroup-v2.html
 	defCPUQuotaPeriod = uint64(100000)
+
+	delegateControllersSupportedVersion = 236
+	delegateSubgroupSupportedVersion    = 254
+
+	// DefaultJobTimeout is the default time to wait for a systemd job
+	// (starting or stopping a unit) to complete. See the SetJobTimeout
+	// methods of the managers.
+	DefaultJobTimeout = 30 * time.Second
 )
 
 var (
-	versionOnce sync.Once
-	version     int
-
 	isRunningSystemdOnce sync.Once
 	isRunningSystemd     bool
 
@@ -98,13 +103,51 @@ func newProp(name string, units any) systemdDbus.Property {
 }
 
 func getUnitName(c *cgroups.Cgroup) string {
+	if c.UnitName != "" {
+		return c.UnitName
+	}
 	// by default, we create a scope unless the user explicitly asks for a slice.
 	if !strings.HasSuffix(c.Name, ".slice") {
-		return c.ScopePrefix + "-" + c.Name + ".scope"
+		// The names which are valid are kept as they have always been,
+		// and only the others are escaped, as well as the ones with a
+		// '\' (so that they can't be the same as an escaped name).
+		unitName := c.ScopePrefix + "-" + c.Name + ".scope"
+		if strings.ContainsRune(unitName, '\\') || ValidateUnitName(unitName) != nil {
+			unitName = escapeScopeName(c.ScopePrefix+"-"+c.Name) + ".scope"
+		}
+		return unitName
 	}
 	return c.Name
 }
 
+// unitParent returns the name of the parent slice of the unit of c, as
+// given by the config. For a slice, that is the slice it Wants, while the
+// slice it is in is implied by its name (see parentSlice).
+func unitParent(c *cgroups.Cgroup) string {
+	if c.Parent != "" {
+		return c.Parent
+	}
+	if c.Rootless {
+		return "user.slice"
+	}
+	return "system.slice"
+}
+
+// parentSlice returns the name of the slice the unit of c is in, which is
+// unitParent for the scopes, and implied by the name for the slices (as
+// "a.slice" for "a-b.slice").
+func parentSlice(c *cgroups.Cgroup) string {
+	unitName := getUnitName(c)
+	if !strings.HasSuffix(unitName, ".slice") {
+		return unitParent(c)
+	}
+	p, err := ExpandSlice(unitName)
+	if err != nil || path.Dir(p) == "/" {
+		return "-.slice"
+	}
+	return path.Base(path.Dir(p))
+}
+
 // This code should be in sync with getUnitName.
 func getUnitType(unitName string) string {
 	if strings.HasSuffix(unitName, ".slice") {
@@ -129,13 +172,77 @@ func isUnitExists(err error) bool {
 	return isDbusError(err, "org.freedesktop.systemd1.UnitExists")
 }
 
-func startUnit(cm *dbusConnManager, unitName string, properties []systemdDbus.Property, ignoreExist bool) error {
+// jobTimeout returns the job timeout to use, given the one configured for a
+// manager (which is zero if not configured).
+func jobTimeout(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return DefaultJobTimeout
+	}
+	return timeout
+}
+
+// checkUnitName checks that the name of the unit of c, and of its parent
+// slice, are valid, and that the unit is either a scope or a slice.
+func checkUnitName(c *cgroups.Cgroup) error {
+	unitName := getUnitName(c)
+	if err := ValidateUnitName(unitName); err != nil {
+		return err
+	}
+	if !strings.HasSuffix(unitName, ".scope") && !strings.HasSuffix(unitName, ".slice") {
+		return fmt.Errorf("invalid unit name %q: only scopes and slices are supported", unitName)
+	}
+	if c.Parent != "" {
+		if _, err := ExpandSlice(c.Parent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDelegate checks the delegation settings of c (see
+// [cgroups.Cgroup.DelegateSubgroup]), which are only valid for scopes.
+func checkDelegate(c *cgroups.Cgroup) error {
+	if c.DelegateSubgroup == "" && len(c.DelegateControllers) == 0 {
+		return nil
+	}
+	if unitName := getUnitName(c); getUnitType(unitName) != "Scope" {
+		return fmt.Errorf("unable to delegate %s: delegation is only supported for scopes", unitName)
+	}
+	if sub := c.DelegateSubgroup; sub != "" {
+		if sub == "." || sub == ".." || strings.ContainsRune(sub, '/') || strings.HasPrefix(sub, "cgroup.") {
+			return fmt.Errorf("invalid delegate subgroup %q", sub)
+		}
+	}
+	return nil
+}
+
+// delegateProperties returns the unit properties delegating the cgroup of
+// a scope, according to c.
+func delegateProperties(cm *DbusConnManager, c *cgroups.Cgroup) ([]systemdDbus.Property, error) {
+	// Assume scopes always support delegation (supported since systemd v218).
+	props := []systemdDbus.Property{newProp("Delegate", true)}
+	if len(c.DelegateControllers) > 0 {
+		if sdVer := systemdVersion(cm); sdVer < delegateControllersSupportedVersion {
+			return nil, fmt.Errorf("systemd v%d is too old to support DelegateControllers, v%d is required", sdVer, delegateControllersSupportedVersion)
+		}
+		props = append(props, newProp("DelegateControllers", c.DelegateControllers))
+	}
+	if c.DelegateSubgroup != "" {
+		if sdVer := systemdVersion(cm); sdVer < delegateSubgroupSupportedVersion {
+			return nil, fmt.Errorf("systemd v%d is too old to support DelegateSubgroup, v%d is required", sdVer, delegateSubgroupSupportedVersion)
+		}
+		props = append(props, newProp("DelegateSubgroup", c.DelegateSubgroup))
+	}
+	return props, nil
+}
+
+func startUnit(ctx context.Context, cm *DbusConnManager, unitName string, properties []systemdDbus.Property, ignoreExist bool, jobTimeout time.Duration) error {
 	statusChan := make(chan string, 1)
 	retry := true
 
 retry:
-	err := cm.retryOnDisconnect(func(c *systemdDbus.Conn) error {
-		_, err := c.StartTransientUnitContext(context.TODO(), unitName, "replace", properties, statusChan)
+	err := cm.retryOnDisconnect(ctx, func(c *systemdDbus.Conn) error {
+		_, err := c.StartTransientUnitContext(ctx, unitName, "replace", properties, statusChan)
 		return err
 	})
 	if err != nil {
@@ -152,7 +259,7 @@ retry:
 			// In case a unit with the same name exists, this may
 			// be a leftover failed unit. Reset it, so systemd can
 			// remove it, and retry once.
-			err = resetFailedUnit(cm, unitName)
+			err = resetFailedUnit(ctx, cm, unitName)
 			if err != nil {
 				logrus.Warnf("unable to reset failed unit: %v", err)
 			}
@@ -162,7 +269,7 @@ retry:
 		return err
 	}
 
-	timeout := time.NewTimer(30 * time.Second)
+	timeout := time.NewTimer(jobTimeout)
 	defer timeout.Stop()
 
 	select {
@@ -170,25 +277,28 @@ retry:
 		close(statusChan)
 		// Please refer to https://pkg.go.dev/github.com/coreos/go-systemd/v22/dbus#Conn.StartUnit
 		if s != "done" {
-			_ = resetFailedUnit(cm, unitName)
+			_ = resetFailedUnit(ctx, cm, unitName)
 			return fmt.Errorf("error creating systemd unit `%s`: got `%s`", unitName, s)
 		}
 	case <-timeout.C:
-		_ = resetFailedUnit(cm, unitName)
+		_ = resetFailedUnit(ctx, cm, unitName)
 		return errors.New("Timeout waiting for systemd to create " + unitName)
+	case <-ctx.Done():
+		// The job is not cancelled, so the unit may still be created.
+		return fmt.Errorf("waiting for systemd to create %s: %w", unitName, ctx.Err())
 	}
 
 	return nil
 }
 
-func stopUnit(cm *dbusConnManager, unitName string) error {
+func stopUnit(ctx context.Context, cm *DbusConnManager, unitName string, jobTimeout time.Duration) error {
 	statusChan := make(chan string, 1)
-	err := cm.retryOnDisconnect(func(c *systemdDbus.Conn) error {
-		_, err := c.StopUnitContext(context.TODO(), unitName, "replace", statusChan)
+	err := cm.retryOnDisconnect(ctx, func(c *systemdDbus.Conn) error {
+		_, err := c.StopUnitContext(ctx, unitName, "replace", statusChan)
 		return err
 	})
 	if err == nil {
-		timeout := time.NewTimer(30 * time.Second)
+		timeout := time.NewTimer(jobTimeout)
 		defer timeout.Stop()
 
 		select {
@@ -200,53 +310,67 @@ func stopUnit(cm *dbusConnManager, unitName string) error {
 			}
 		case <-timeout.C:
 			return errors.New("Timed out while waiting for systemd to remove " + unitName)
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for systemd to remove %s: %w", unitName, ctx.Err())
 		}
+	} else if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
 	}
 
 	// In case of a failed unit, let systemd remove it.
-	_ = resetFailedUnit(cm, unitName)
+	_ = resetFailedUnit(ctx, cm, unitName)
 
 	return nil
 }
 
-func addPid(cm *dbusConnManager, unitName, subcgroup string, pid int) error {
+// absSubcgroup returns the sub cgroup path subcgroup (which is either empty,
+// or relative to the unit cgroup) as an absolute one, as systemd expects.
+func absSubcgroup(subcgroup string) (string, error) {
 	absSubcgroup := subcgroup
 	if !path.IsAbs(absSubcgroup) {
 		absSubcgroup = "/" + subcgroup
 	}
 	if absSubcgroup != path.Clean(absSubcgroup) {
-		return fmt.Errorf("bad sub cgroup path: %s", subcgroup)
+		return "", fmt.Errorf("bad sub cgroup path: %s", subcgroup)
+	}
+	return absSubcgroup, nil
+}
+
+func addPid(ctx context.Context, cm *DbusConnManager, unitName, subcgroup string, pid int) error {
+	absSubcgroup, err := absSubcgroup(subcgroup)
+	if err != nil {
+		return err
 	}
 
-	return cm.retryOnDisconnect(func(c *systemdDbus.Conn) error {
-		return c.AttachProcessesToUnit(context.TODO(), unitName, absSubcgroup, []uint32{uint32(pid)})
+	return cm.retryOnDisconnect(ctx, func(c *systemdDbus.Conn) error {
+		return c.AttachProcessesToUnit(ctx, unitName, absSubcgroup, []uint32{uint32(pid)})
 	})
 }
 
-func resetFailedUnit(cm *dbusConnManager, name string) error {
-	return cm.retryOnDisconnect(func(c *systemdDbus.Conn) error {
-		return c.ResetFailedUnitContext(context.TODO(), name)
+func resetFailedUnit(ctx context.Context, cm *DbusConnManager, name string) error {
+	return cm.retryOnDisconnect(ctx, func(c *systemdDbus.Conn) error {
+		return c.ResetFailedUnitContext(ctx, name)
 	})
 }
 
-func getUnitTypeProperty(cm *dbusConnManager, unitName string, unitType string, propertyName string) (*systemdDbus.Property, error) {
+func getUnitTypeProperty(ctx context.Context, cm *DbusConnManager, unitName string, unitType string, propertyName string) (*systemdDbus.Property, error) {
 	var prop *systemdDbus.Property
-	err := cm.retryOnDisconnect(func(c *systemdDbus.Conn) (Err error) {
-		prop, Err = c.GetUnitTypePropertyContext(context.TODO(), unitName, unitType, propertyName)
+	err := cm.retryOnDisconnect(ctx, func(c *systemdDbus.Conn) (Err error) {
+		prop, Err = c.GetUnitTypePropertyContext(ctx, unitName, unitType, propertyName)
 		return Err
 	})
 	return prop, err
 }
 
-func setUnitProperties(cm *dbusConnManager, name string, properties ...systemdDbus.Property) error {
-	return cm.retryOnDisconnect(func(c *systemdDbus.Conn) error {
-		return c.SetUnitPropertiesContext(context.TODO(), name, true, properties...)
+func setUnitProperties(ctx context.Context, cm *DbusConnManager, name string, properties ...systemdDbus.Property) error {
+	return cm.retryOnDisconnect(ctx, func(c *systemdDbus.Conn) error {
+		return c.SetUnitPropertiesContext(ctx, name, true, properties...)
 	})
 }
 
-func getManagerProperty(cm *dbusConnManager, name string) (string, error) {
+func getManagerProperty(ctx context.Context, cm *DbusConnManager, name string) (string, error) {
 	str := ""
-	err := cm.retryOnDisconnect(func(c *systemdDbus.Conn) error {
+	err := cm.retryOnDisconnect(ctx, func(c *systemdDbus.Conn) error {
 		var err error
 		str, err = c.GetManagerProperty(name)
 		return err
@@ -257,12 +381,15 @@ func getManagerProperty(cm *dbusConnManager, name string) (string, error) {
 	return strconv.Unquote(str)
 }
 
-func systemdVersion(cm *dbusConnManager) int {
-	versionOnce.Do(func() {
-		version = -1
-		verStr, err := getManagerProperty(cm, "Version")
+// systemdVersion returns the version of the systemd instance cm is
+// connected to, or -1 if it can't be determined. It is cached per cm, so
+// it is not bound to the context of any operation.
+func systemdVersion(cm *DbusConnManager) int {
+	cm.versionOnce.Do(func() {
+		cm.version = -1
+		verStr, err := getManagerProperty(context.TODO(), cm, "Version")
 		if err == nil {
-			version, err = systemdVersionAtoi(verStr)
+			cm.version, err = systemdVersionAtoi(verStr)
 		}
 
 		if err != nil {
@@ -270,7 +397,7 @@ func systemdVersion(cm *dbusConnManager) int {
 		}
 	})
 
-	return version
+	return cm.version
 }
 
 // systemdVersionAtoi extracts a numeric systemd version from the argument.
@@ -297,7 +424,7 @@ func systemdVersionAtoi(str string) (int, error) {
 
 // addCPUQuota adds CPUQuotaPeriodUSec and CPUQuotaPerSecUSec to the properties. The passed quota may be modified
 // along with round-up during calculation in order to write the same value to cgroupfs later.
-func addCPUQuota(cm *dbusConnManager, properties *[]systemdDbus.Property, quota *int64, period uint64) {
+func addCPUQuota(cm *DbusConnManager, properties *[]systemdDbus.Property, quota *int64, period uint64) {
 	if period != 0 {
 		// systemd only supports CPUQuotaPeriodUSec since v242
 		sdVer := systemdVersion(cm)
@@ -333,7 +460,7 @@ func addCPUQuota(cm *dbusConnManager, properties *[]systemdDbus.Property, quota
 	}
 }
 
-func addCpuset(cm *dbusConnManager, props *[]systemdDbus.Property, cpus, mems string) error {
+func addCpuset(cm *DbusConnManager, props *[]systemdDbus.Property, cpus, mems string) error {
 	if cpus == "" && mems == "" {
 		return nil
 	}
@@ -369,7 +496,7 @@ func addCpuset(cm *dbusConnManager, props *[]systemdDbus.Property, cpus, mems st
 
 // generateDeviceProperties takes the configured device rules and generates a
 // corresponding set of systemd properties to configure the devices correctly.
-func generateDeviceProperties(r *cgroups.Resources, cm *dbusConnManager) ([]systemdDbus.Property, error) {
+func generateDeviceProperties(r *cgroups.Resources, cm *DbusConnManager) ([]systemdDbus.Property, error) {
 	if GenerateDeviceProps == nil {
 		if len(r.Devices) > 0 {
 			return nil, cgroups.ErrDevicesUnsupported
@@ -13,71 +13,205 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-var (
-	dbusC        *systemdDbus.Conn
-	dbusMu       sync.RWMutex
-	dbusInited   bool
-	dbusRootless bool
-)
+// DialFunc establishes a new D-Bus connection to a systemd instance. The
+// connection attempt is to be aborted once ctx is done, and the connection
+// may be closed then (so the connections made by [DbusConnManager] to be
+// kept are dialed with a context which is never done).
+type DialFunc func(ctx context.Context) (*systemdDbus.Conn, error)
+
+// DbusConnManager manages a D-Bus connection to a systemd instance, which
+// can be shared by any number of cgroup managers. The connection is
+// established lazily, and re-established if it gets closed (for example,
+// when dbus is restarted).
+type DbusConnManager struct {
+	mu   sync.RWMutex
+	conn *systemdDbus.Conn
+	// dialing, if not nil, is closed once the connection attempt in
+	// progress is done. It is made without holding mu, so that the
+	// others can wait for it until their contexts are done.
+	dialing chan struct{}
+	dial    DialFunc
+	// hint is added to the connection errors.
+	hint string
+
+	versionOnce sync.Once
+	version     int
+
+	watchers unitWatchers
+}
 
-type dbusConnManager struct{}
+// NewDbusConnManager returns a connection manager which uses dial to
+// connect to systemd, and to reconnect after the connection is closed.
+func NewDbusConnManager(dial DialFunc) *DbusConnManager {
+	return &DbusConnManager{dial: dial}
+}
+
+// NewDbusConnManagerWithConn returns a connection manager which uses the
+// existing connection conn, until it is closed. After that, it uses dial
+// to reconnect, unless dial is nil, in which case the operations fail.
+func NewDbusConnManagerWithConn(conn *systemdDbus.Conn, dial DialFunc) *DbusConnManager {
+	return &DbusConnManager{conn: conn, dial: dial}
+}
 
-// newDbusConnManager initializes systemd dbus connection manager.
-func newDbusConnManager(rootless bool) *dbusConnManager {
-	dbusMu.Lock()
-	defer dbusMu.Unlock()
-	if dbusInited && rootless != dbusRootless {
-		panic("can't have both root and rootless dbus")
+// dbusConnManagers are the shared connection managers, by bus.
+var dbusConnManagers = struct {
+	sync.Mutex
+	m map[string]*DbusConnManager
+}{m: make(map[string]*DbusConnManager)}
+
+// sharedDbusConnManager returns the shared connection manager for the bus
+// key, creating it with newCM if needed.
+func sharedDbusConnManager(key string, newCM func() *DbusConnManager) *DbusConnManager {
+	dbusConnManagers.Lock()
+	defer dbusConnManagers.Unlock()
+	cm, ok := dbusConnManagers.m[key]
+	if !ok {
+		cm = newCM()
+		dbusConnManagers.m[key] = cm
 	}
-	dbusInited = true
-	dbusRootless = rootless
-	return &dbusConnManager{}
+	return cm
 }
 
-// getConnection lazily initializes and returns systemd dbus connection.
-func (d *dbusConnManager) getConnection() (*systemdDbus.Conn, error) {
-	// In the case where dbusC != nil
-	// Use the read lock the first time to ensure
-	// that Conn can be acquired at the same time.
-	dbusMu.RLock()
-	if conn := dbusC; conn != nil {
-		dbusMu.RUnlock()
-		return conn, nil
+// SystemDbusConnManager returns the connection manager for the system
+// instance of systemd, which is shared by all its users in this process.
+func SystemDbusConnManager() *DbusConnManager {
+	return sharedDbusConnManager("system", func() *DbusConnManager {
+		return NewDbusConnManager(systemdDbus.NewWithContext)
+	})
+}
+
+// UserDbusConnManager returns the connection manager for the user instance
+// of systemd listening at the D-Bus address, authenticating as uid, which
+// is shared by all its users in this process. If address is empty, or uid
+// is negative, they are detected on every connection attempt (see
+// [DetectUserDbusSessionBusAddress] and [DetectUID]).
+func UserDbusConnManager(address string, uid int) *DbusConnManager {
+	if uid < 0 {
+		uid = -1
 	}
-	dbusMu.RUnlock()
-
-	// In the case where dbusC == nil
-	// Use write lock to ensure that only one
-	// will be created
-	dbusMu.Lock()
-	defer dbusMu.Unlock()
-	if conn := dbusC; conn != nil {
-		return conn, nil
+	key := fmt.Sprintf("user:%d:%s", uid, address)
+	return sharedDbusConnManager(key, func() *DbusConnManager {
+		cm := NewDbusConnManager(func(ctx context.Context) (*systemdDbus.Conn, error) {
+			return newUserSystemdDbus(ctx, address, uid)
+		})
+		// When dbus-user-session is not installed, connecting to the user dbus
+		// may fail with a cryptic error "read unix @->/run/systemd/private: read: connection reset by peer: unknown."
+		// https://github.com/moby/moby/issues/42793
+		cm.hint = " (hint: for rootless containers, maybe you need to install dbus-user-session package, see https://github.com/opencontainers/runc/blob/master/docs/cgroup-v2.md)"
+		return cm
+	})
+}
+
+// defaultDbusConnManager returns the shared connection manager for the
+// system instance of systemd, or the user one (detected from the
+// environment) if rootless is true.
+func defaultDbusConnManager(rootless bool) *DbusConnManager {
+	if rootless {
+		return UserDbusConnManager("", -1)
 	}
+	return SystemDbusConnManager()
+}
 
-	conn, err := d.newConnection()
-	if err != nil {
-		// When dbus-user-session is not installed, we can't detect whether we should try to connect to user dbus or system dbus, so d.dbusRootless is set to false.
-		// This may fail with a cryptic error "read unix @->/run/systemd/private: read: connection reset by peer: unknown."
-		// https://github.com/moby/moby/issues/42793
-		return nil, fmt.Errorf("failed to connect to dbus (hint: for rootless containers, maybe you need to install dbus-user-session package, see https://github.com/opencontainers/runc/blob/master/docs/cgroup-v2.md): %w", err)
+// Ping checks that systemd can be reached using d. Unless d is connected
+// already, it uses a connection of its own, which is closed once ctx is
+// done, so that a connection attempt that hangs neither outlives ctx nor
+// holds up the other users of d. It returns when ctx is done, even if the
+// dial function of d does not honour ctx (see [DialFunc]).
+func (d *DbusConnManager) Ping(ctx context.Context) error {
+	d.mu.RLock()
+	conn := d.conn
+	d.mu.RUnlock()
+	if conn == nil && d.dial == nil {
+		return errors.New("dbus connection is closed, and can't be re-established (no dial function)")
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		c := conn
+		if c == nil {
+			var err error
+			c, err = d.dial(ctx)
+			if err != nil {
+				errCh <- fmt.Errorf("failed to connect to dbus%s: %w", d.hint, err)
+				return
+			}
+			defer c.Close()
+		}
+		_, err := c.GetManagerProperty("Version")
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	dbusC = conn
-	return conn, nil
 }
 
-func (d *dbusConnManager) newConnection() (*systemdDbus.Conn, error) {
-	newDbusConn := func() (*systemdDbus.Conn, error) {
-		if dbusRootless {
-			return newUserSystemdDbus()
+// getConnection lazily initializes and returns systemd dbus connection.
+// If another connection attempt is in progress, it waits for it to be
+// done, or for ctx to be done.
+func (d *DbusConnManager) getConnection(ctx context.Context) (*systemdDbus.Conn, error) {
+	for {
+		// In the case where d.conn != nil
+		// Use the read lock the first time to ensure
+		// that Conn can be acquired at the same time.
+		d.mu.RLock()
+		if conn := d.conn; conn != nil {
+			d.mu.RUnlock()
+			return conn, nil
+		}
+		d.mu.RUnlock()
+
+		// In the case where d.conn == nil
+		// Use write lock to ensure that only one
+		// will be created
+		d.mu.Lock()
+		if conn := d.conn; conn != nil {
+			d.mu.Unlock()
+			return conn, nil
+		}
+		if d.dial == nil {
+			d.mu.Unlock()
+			return nil, errors.New("dbus connection is closed, and can't be re-established (no dial function)")
+		}
+		if dialing := d.dialing; dialing != nil {
+			d.mu.Unlock()
+			select {
+			case <-dialing:
+				// Use the new connection, or try again.
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
 		}
-		return systemdDbus.NewWithContext(context.TODO())
+		dialing := make(chan struct{})
+		d.dialing = dialing
+		d.mu.Unlock()
+
+		conn, err := d.newConnection(ctx)
+
+		d.mu.Lock()
+		if err == nil {
+			d.conn = conn
+		}
+		d.dialing = nil
+		d.mu.Unlock()
+		close(dialing)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to dbus%s: %w", d.hint, err)
+		}
+		return conn, nil
 	}
+}
 
+func (d *DbusConnManager) newConnection(ctx context.Context) (*systemdDbus.Conn, error) {
+	// The connection outlives the operation it is established for.
+	dialCtx := context.WithoutCancel(ctx)
 	var err error
 	for retry := range 7 {
 		var conn *systemdDbus.Conn
-		conn, err = newDbusConn()
+		conn, err = d.dial(dialCtx)
 		if !errors.Is(err, unix.EAGAIN) {
 			return conn, err
 		}
@@ -85,28 +219,38 @@ func (d *dbusConnManager) newConnection() (*systemdDbus.Conn, error) {
 		// At most we would expect 15 seconds of delay with 7 attempts.
 		delay := 100 * time.Millisecond << retry
 		delay += time.Duration(rand.Int64N(1 + (delay.Milliseconds() >> 3)))
-		time.Sleep(delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
 	}
 	return nil, fmt.Errorf("dbus connection failed after several retries: %w", err)
 }
 
 // resetConnection resets the connection to its initial state
 // (so it can be reconnected if necessary).
-func (d *dbusConnManager) resetConnection(conn *systemdDbus.Conn) {
-	dbusMu.Lock()
-	defer dbusMu.Unlock()
-	if dbusC != nil && dbusC == conn {
-		dbusC.Close()
-		dbusC = nil
+func (d *DbusConnManager) resetConnection(conn *systemdDbus.Conn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conn != nil && d.conn == conn {
+		d.conn.Close()
+		d.conn = nil
 	}
 }
 
 // retryOnDisconnect calls op, and if the error it returns is about closed dbus
 // connection, the connection is re-established and the op is retried. This helps
 // with the situation when dbus is restarted and we have a stale connection.
-func (d *dbusConnManager) retryOnDisconnect(op func(*systemdDbus.Conn) error) error {
+// The retries stop once ctx is done.
+func (d *DbusConnManager) retryOnDisconnect(ctx context.Context, op func(*systemdDbus.Conn) error) error {
 	for {
-		conn, err := d.getConnection()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		conn, err := d.getConnection(ctx)
 		if err != nil {
 			return err
 		}
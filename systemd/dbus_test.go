@@ -2,11 +2,67 @@ package systemd
 
 import (
 	"context"
+	"errors"
 	"os"
 	"sync"
 	"testing"
+
+	systemdDbus "github.com/coreos/go-systemd/v22/dbus"
 )
 
+func TestDbusConnManagers(t *testing.T) {
+	sys := SystemDbusConnManager()
+	if SystemDbusConnManager() != sys {
+		t.Error("system connection manager is not shared")
+	}
+	user := UserDbusConnManager("unix:path=/run/user/1000/bus", 1000)
+	if user == sys {
+		t.Error("user and system connection managers are the same")
+	}
+	if UserDbusConnManager("unix:path=/run/user/1000/bus", 1000) != user {
+		t.Error("user connection manager is not shared")
+	}
+	if UserDbusConnManager("unix:path=/run/user/1001/bus", 1001) == user {
+		t.Error("connection managers of different users are the same")
+	}
+	if defaultDbusConnManager(false) != sys {
+		t.Error("default connection manager is not the system one")
+	}
+	if defaultDbusConnManager(true) != UserDbusConnManager("", -1) {
+		t.Error("default rootless connection manager is not the user one")
+	}
+}
+
+func TestDbusConnManagerDial(t *testing.T) {
+	errDial := errors.New("dial failed")
+	dials := 0
+	cm := NewDbusConnManager(func(context.Context) (*systemdDbus.Conn, error) {
+		dials++
+		return nil, errDial
+	})
+	for i := 1; i <= 2; i++ {
+		err := cm.retryOnDisconnect(context.Background(), func(*systemdDbus.Conn) error {
+			t.Fatal("op called without a connection")
+			return nil
+		})
+		if !errors.Is(err, errDial) {
+			t.Fatalf("expected %v, got %v", errDial, err)
+		}
+		// Failed connection attempts are not cached.
+		if dials != i {
+			t.Fatalf("expected %d dials, got %d", i, dials)
+		}
+	}
+
+	cm = NewDbusConnManagerWithConn(nil, nil)
+	if _, err := cm.getConnection(context.Background()); err == nil {
+		t.Fatal("expected an error without a connection and a dial function")
+	}
+	if _, err := NewUnifiedManagerWithDbus(nil, "", nil); err == nil {
+		t.Fatal("expected an error for a nil connection manager")
+	}
+}
+
 func TestParallelConnection(t *testing.T) {
 	if !IsRunningSystemd() {
 		t.Skip("Test requires systemd.")
@@ -15,9 +71,9 @@ func TestParallelConnection(t *testing.T) {
 		t.Skip("skipping unsafe test (can kill your desktop session); " +
 			"set CGROUPS_ALLOW_UNSAFE_TESTS=true to enable")
 	}
-	var dms []*dbusConnManager
+	var dms []*DbusConnManager
 	for range 600 {
-		dms = append(dms, newDbusConnManager(os.Geteuid() != 0))
+		dms = append(dms, defaultDbusConnManager(os.Geteuid() != 0))
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -30,13 +86,13 @@ func TestParallelConnection(t *testing.T) {
 	)
 	for _, dm := range dms {
 		doneWg.Add(1)
-		go func(dm *dbusConnManager) {
+		go func(dm *DbusConnManager) {
 			defer doneWg.Done()
 			select {
 			case <-ctx.Done():
 				return
 			case <-startCh:
-				_, err := dm.newConnection()
+				_, err := dm.newConnection(context.Background())
 				if err != nil {
 					// Only bother trying to send the first error.
 					select {
@@ -1,6 +1,7 @@
 package systemd
 
 import (
+	"context"
 	"reflect"
 
 	dbus "github.com/godbus/dbus/v5"
@@ -17,7 +18,7 @@ import (
 // (unlike our fs driver, they will happily write deny-all rules to running
 // containers). So we have to freeze the container to avoid the container get
 // an occasional "permission denied" error.
-func (m *LegacyManager) freezeBeforeSet(unitName string, r *cgroups.Resources) (needsFreeze, needsThaw bool, err error) {
+func (m *LegacyManager) freezeBeforeSet(ctx context.Context, unitName string, r *cgroups.Resources) (needsFreeze, needsThaw bool, err error) {
 	// Special case for SkipDevices, as used by Kubernetes to create pod
 	// cgroups with allow-all device policy).
 	if r.SkipDevices {
@@ -39,9 +40,9 @@ func (m *LegacyManager) freezeBeforeSet(unitName string, r *cgroups.Resources) (
 
 		unitType := getUnitType(unitName)
 
-		devPolicy, e := getUnitTypeProperty(m.dbus, unitName, unitType, "DevicePolicy")
+		devPolicy, e := getUnitTypeProperty(ctx, m.dbus, unitName, unitType, "DevicePolicy")
 		if e == nil && devPolicy.Value == dbus.MakeVariant("auto") {
-			devAllow, e := getUnitTypeProperty(m.dbus, unitName, unitType, "DeviceAllow")
+			devAllow, e := getUnitTypeProperty(ctx, m.dbus, unitName, unitType, "DeviceAllow")
 			if e == nil {
 				if rv := reflect.ValueOf(devAllow.Value.Value()); rv.Kind() == reflect.Slice && rv.Len() == 0 {
 					needsFreeze = false
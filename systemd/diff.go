@@ -0,0 +1,37 @@
+package systemd
+
+import (
+	"reflect"
+
+	systemdDbus "github.com/coreos/go-systemd/v22/dbus"
+	dbus "github.com/godbus/dbus/v5"
+)
+
+// changedProperties returns the properties from props which differ from
+// those in prev (the properties applied by the previous Set). If prev is
+// nil, props is returned as is.
+//
+// Properties are compared by name, with all the values of a property which
+// is set more than once (such as DeviceAllow) compared together.
+func changedProperties(prev, props []systemdDbus.Property) []systemdDbus.Property {
+	if prev == nil {
+		return props
+	}
+	prevValues := propertyValues(prev)
+	values := propertyValues(props)
+	var changed []systemdDbus.Property
+	for _, p := range props {
+		if !reflect.DeepEqual(values[p.Name], prevValues[p.Name]) {
+			changed = append(changed, p)
+		}
+	}
+	return changed
+}
+
+func propertyValues(props []systemdDbus.Property) map[string][]dbus.Variant {
+	values := make(map[string][]dbus.Variant, len(props))
+	for _, p := range props {
+		values[p.Name] = append(values[p.Name], p.Value)
+	}
+	return values
+}
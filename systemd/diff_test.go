@@ -0,0 +1,35 @@
+package systemd
+
+import (
+	"reflect"
+	"testing"
+
+	systemdDbus "github.com/coreos/go-systemd/v22/dbus"
+)
+
+func TestChangedProperties(t *testing.T) {
+	prev := []systemdDbus.Property{
+		newProp("MemoryMax", uint64(1024)),
+		newProp("TasksMax", uint64(10)),
+		newProp("DeviceAllow", []deviceAllowEntry{}),
+		newProp("DeviceAllow", []deviceAllowEntry{{Path: "/dev/null", Perms: "rwm"}}),
+	}
+
+	if got := changedProperties(nil, prev); !reflect.DeepEqual(got, prev) {
+		t.Errorf("expected all properties without previous ones, got %+v", got)
+	}
+	if got := changedProperties(prev, prev); len(got) != 0 {
+		t.Errorf("expected no changed properties, got %+v", got)
+	}
+
+	props := []systemdDbus.Property{
+		newProp("MemoryMax", uint64(2048)),
+		newProp("TasksMax", uint64(10)),
+		newProp("DeviceAllow", []deviceAllowEntry{}),
+		newProp("DeviceAllow", []deviceAllowEntry{{Path: "/dev/zero", Perms: "rwm"}}),
+	}
+	want := []systemdDbus.Property{props[0], props[2], props[3]}
+	if got := changedProperties(prev, props); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+}
@@ -0,0 +1,222 @@
+package systemd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	systemdDbus "github.com/coreos/go-systemd/v22/dbus"
+	dbus "github.com/godbus/dbus/v5"
+
+	"github.com/opencontainers/cgroups"
+)
+
+var (
+	_ cgroups.Verifier = &LegacyManager{}
+	_ cgroups.Verifier = &UnifiedManager{}
+)
+
+// Verify returns the unit properties and the cgroup files set by Set
+// whose values were changed since (for example, by systemctl set-property).
+func (m *LegacyManager) Verify() ([]cgroups.Drift, error) {
+	return m.VerifyContext(context.Background())
+}
+
+// VerifyContext is like Verify, but the D-Bus calls to systemd are aborted
+// once ctx is done.
+func (m *LegacyManager) VerifyContext(ctx context.Context) ([]cgroups.Drift, error) {
+	m.setMu.Lock()
+	defer m.setMu.Unlock()
+	return m.verify(ctx)
+}
+
+func (m *LegacyManager) verify(ctx context.Context) ([]cgroups.Drift, error) {
+	drifts, err := verifyUnitProperties(ctx, m.dbus, getUnitName(m.cgroups), m.appliedProps)
+	if err != nil {
+		return nil, err
+	}
+	fsDrifts, err := m.expected.Verify()
+	if err != nil {
+		return nil, err
+	}
+	return append(drifts, fsDrifts...), nil
+}
+
+// Reconcile is like Verify, but it also re-applies the drifted unit
+// properties and cgroup files.
+func (m *LegacyManager) Reconcile() ([]cgroups.Drift, error) {
+	return m.ReconcileContext(context.Background())
+}
+
+// ReconcileContext is like Reconcile, but the D-Bus calls to systemd are
+// aborted once ctx is done.
+func (m *LegacyManager) ReconcileContext(ctx context.Context) ([]cgroups.Drift, error) {
+	m.setMu.Lock()
+	defer m.setMu.Unlock()
+	drifts, err := m.verify(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return drifts, errors.Join(
+		reconcileUnitProperties(ctx, m.dbus, getUnitName(m.cgroups), m.appliedProps, drifts),
+		m.expected.Reconcile(drifts),
+	)
+}
+
+// Verify returns the unit properties and the cgroup files set by Set
+// whose values were changed since (for example, by systemctl set-property).
+func (m *UnifiedManager) Verify() ([]cgroups.Drift, error) {
+	return m.VerifyContext(context.Background())
+}
+
+// VerifyContext is like Verify, but the D-Bus calls to systemd are aborted
+// once ctx is done.
+func (m *UnifiedManager) VerifyContext(ctx context.Context) ([]cgroups.Drift, error) {
+	m.setMu.Lock()
+	defer m.setMu.Unlock()
+	drifts, err := verifyUnitProperties(ctx, m.dbus, getUnitName(m.cgroups), m.appliedProps)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := m.fsMgr.(cgroups.Verifier); ok {
+		fsDrifts, err := v.Verify()
+		if err != nil {
+			return nil, err
+		}
+		drifts = append(drifts, fsDrifts...)
+	}
+	return drifts, nil
+}
+
+// Reconcile is like Verify, but it also re-applies the drifted unit
+// properties and cgroup files.
+func (m *UnifiedManager) Reconcile() ([]cgroups.Drift, error) {
+	return m.ReconcileContext(context.Background())
+}
+
+// ReconcileContext is like Reconcile, but the D-Bus calls to systemd are
+// aborted once ctx is done.
+func (m *UnifiedManager) ReconcileContext(ctx context.Context) ([]cgroups.Drift, error) {
+	m.setMu.Lock()
+	defer m.setMu.Unlock()
+	unitName := getUnitName(m.cgroups)
+	drifts, err := verifyUnitProperties(ctx, m.dbus, unitName, m.appliedProps)
+	if err != nil {
+		return nil, err
+	}
+	err = reconcileUnitProperties(ctx, m.dbus, unitName, m.appliedProps, drifts)
+	if v, ok := m.fsMgr.(cgroups.Verifier); ok {
+		fsDrifts, fsErr := v.Reconcile()
+		drifts = append(drifts, fsDrifts...)
+		err = errors.Join(err, fsErr)
+	}
+	return drifts, err
+}
+
+// verifyUnitProperties compares the applied unit properties with their
+// current values, which are all read at once, and returns the ones that
+// differ.
+func verifyUnitProperties(ctx context.Context, cm *DbusConnManager, unitName string, applied []systemdDbus.Property) ([]cgroups.Drift, error) {
+	if len(applied) == 0 {
+		return nil, nil
+	}
+	current, err := getUnitProperties(ctx, cm, unitName, getUnitType(unitName))
+	if err != nil {
+		return nil, err
+	}
+	var drifts []cgroups.Drift
+	values := propertyValues(applied)
+	for _, name := range propertyNames(applied) {
+		cur, ok := current[name]
+		if !ok {
+			return nil, fmt.Errorf("unable to get unit %s property %s: no such property", unitName, name)
+		}
+		if d, ok := propertyDrift(name, values[name], dbus.MakeVariant(cur)); ok {
+			d.Unit = unitName
+			drifts = append(drifts, d)
+		}
+	}
+	return drifts, nil
+}
+
+// reconcileUnitProperties sets the drifted unit properties to their
+// applied values.
+func reconcileUnitProperties(ctx context.Context, cm *DbusConnManager, unitName string, applied []systemdDbus.Property, drifts []cgroups.Drift) error {
+	drifted := make(map[string]struct{})
+	for _, d := range drifts {
+		if d.Property != "" {
+			drifted[d.Property] = struct{}{}
+		}
+	}
+	var props []systemdDbus.Property
+	for _, name := range propertyNames(applied) {
+		if _, ok := drifted[name]; !ok {
+			continue
+		}
+		if reset, ok := listPropertyReset(name); ok {
+			// Setting a list property appends to the list,
+			// unless it is empty, so reset it first.
+			props = append(props, reset)
+		}
+	}
+	for _, p := range applied {
+		if _, ok := drifted[p.Name]; ok {
+			props = append(props, p)
+		}
+	}
+	if len(drifted) == 0 {
+		return nil
+	}
+	return setUnitProperties(ctx, cm, unitName, props...)
+}
+
+// propertyNames returns the unique property names in props, in order.
+func propertyNames(props []systemdDbus.Property) []string {
+	var names []string
+	seen := make(map[string]struct{})
+	for _, p := range props {
+		if _, ok := seen[p.Name]; !ok {
+			seen[p.Name] = struct{}{}
+			names = append(names, p.Name)
+		}
+	}
+	return names
+}
+
+// propertyDrift compares the effective value of a property set to the
+// given values (in order) with its current value, and returns the drift
+// if they differ.
+func propertyDrift(name string, values []dbus.Variant, cur dbus.Variant) (cgroups.Drift, bool) {
+	if len(values) == 0 {
+		return cgroups.Drift{}, false
+	}
+	want := values[len(values)-1].Value()
+	if _, ok := listPropertyReset(name); ok {
+		// Every non-empty value is appended to the list.
+		list := reflect.MakeSlice(reflect.TypeOf(want), 0, 0)
+		for _, v := range values {
+			rv := reflect.ValueOf(v.Value())
+			if rv.Len() == 0 {
+				list = list.Slice(0, 0)
+				continue
+			}
+			list = reflect.AppendSlice(list, rv)
+		}
+		want = list.Interface()
+	}
+	// The value received from D-Bus may have a different Go type
+	// (e.g. []any instead of a struct), so convert it to the one set.
+	got := cur.Value()
+	if conv := reflect.New(reflect.TypeOf(want)); dbus.Store([]any{got}, conv.Interface()) == nil {
+		got = conv.Elem().Interface()
+	}
+	if reflect.DeepEqual(want, got) {
+		return cgroups.Drift{}, false
+	}
+	return cgroups.Drift{
+		Property: name,
+		Expected: dbus.MakeVariant(want).String(),
+		Actual:   dbus.MakeVariant(got).String(),
+	}, true
+}
@@ -0,0 +1,54 @@
+package systemd
+
+import (
+	"testing"
+
+	dbus "github.com/godbus/dbus/v5"
+)
+
+func TestPropertyDrift(t *testing.T) {
+	devices := []dbus.Variant{
+		dbus.MakeVariant([]deviceAllowEntry{}),
+		dbus.MakeVariant([]deviceAllowEntry{{Path: "/dev/null", Perms: "rwm"}}),
+		dbus.MakeVariant([]deviceAllowEntry{{Path: "char-pts", Perms: "rwm"}}),
+	}
+	testCases := []struct {
+		name   string
+		values []dbus.Variant
+		cur    any
+		drift  bool
+	}{
+		{
+			name:   "MemoryMax",
+			values: []dbus.Variant{dbus.MakeVariant(uint64(1024))},
+			cur:    uint64(1024),
+		},
+		{
+			name:   "MemoryMax",
+			values: []dbus.Variant{dbus.MakeVariant(uint64(1024))},
+			cur:    uint64(2048),
+			drift:  true,
+		},
+		{
+			// As received from D-Bus, without the struct type.
+			name:   "DeviceAllow",
+			values: devices,
+			cur:    [][]any{{"/dev/null", "rwm"}, {"char-pts", "rwm"}},
+		},
+		{
+			name:   "DeviceAllow",
+			values: devices,
+			cur:    [][]any{{"/dev/null", "rwm"}},
+			drift:  true,
+		},
+	}
+	for _, tc := range testCases {
+		d, drift := propertyDrift(tc.name, tc.values, dbus.MakeVariant(tc.cur))
+		if drift != tc.drift {
+			t.Errorf("%s: expected drift %v, got %v (%+v)", tc.name, tc.drift, drift, d)
+		}
+		if drift && d.Property != tc.name {
+			t.Errorf("expected drift of %s, got %+v", tc.name, d)
+		}
+	}
+}
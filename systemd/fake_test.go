@@ -0,0 +1,964 @@
+package systemd
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	systemdDbus "github.com/coreos/go-systemd/v22/dbus"
+	"github.com/opencontainers/cgroups"
+	"github.com/opencontainers/cgroups/fs2"
+	"github.com/opencontainers/cgroups/systemd/systemdtest"
+)
+
+// newFakeSystemd starts a fake systemd creating the unit cgroups in root,
+// and returns it together with a connection manager connected to it.
+func newFakeSystemd(t *testing.T, root string) (*systemdtest.Server, *DbusConnManager) {
+	t.Helper()
+	srv, err := systemdtest.NewServer(systemdtest.Config{CgroupRoot: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = srv.Close() })
+	return srv, NewDbusConnManager(srv.Dial)
+}
+
+func TestFakeSystemdUnits(t *testing.T) {
+	root := t.TempDir()
+	srv, cm := newFakeSystemd(t, root)
+
+	if v := systemdVersion(cm); v != systemdtest.DefaultVersion {
+		t.Errorf("expected systemd version %d, got %d", systemdtest.DefaultVersion, v)
+	}
+
+	if err := startUnit(context.Background(), cm, "test-a.slice", nil, false, DefaultJobTimeout); err != nil {
+		t.Fatal(err)
+	}
+	props := []systemdDbus.Property{
+		systemdDbus.PropSlice("test-a.slice"),
+		newProp("PIDs", []uint32{uint32(os.Getpid())}),
+	}
+	if err := startUnit(context.Background(), cm, "test-fake.scope", props, false, DefaultJobTimeout); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(root, "test.slice", "test-a.slice", "test-fake.scope")
+	procs, err := os.ReadFile(filepath.Join(dir, "cgroup.procs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(procs)); got != strconv.Itoa(os.Getpid()) {
+		t.Errorf("expected cgroup.procs to contain %d, got %q", os.Getpid(), got)
+	}
+
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := addPid(context.Background(), cm, "test-fake.scope", "sub", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sub", "cgroup.procs")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := setUnitProperties(context.Background(), cm, "test-fake.scope", newProp("TasksMax", uint64(10))); err != nil {
+		t.Fatal(err)
+	}
+	prop, err := getUnitTypeProperty(context.Background(), cm, "test-fake.scope", "Scope", "TasksMax")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := prop.Value.Value().(uint64); !ok || v != 10 {
+		t.Errorf("expected TasksMax=10, got %v", prop.Value)
+	}
+
+	// A running unit can't be started again.
+	if err := startUnit(context.Background(), cm, "test-fake.scope", props, false, DefaultJobTimeout); !isUnitExists(err) {
+		t.Fatalf("expected a UnitExists error, got %v", err)
+	}
+	// A failed one is reset, and started again.
+	if err := srv.Fail("test-fake.scope", "oom-kill"); err != nil {
+		t.Fatal(err)
+	}
+	if err := startUnit(context.Background(), cm, "test-fake.scope", props, false, DefaultJobTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := srv.Unit("test-fake.scope"); u.ActiveState != "active" {
+		t.Errorf("expected the unit to be active, got %q", u.ActiveState)
+	}
+
+	for _, name := range []string{"test-fake.scope", "test-a.slice"} {
+		if err := stopUnit(context.Background(), cm, name, DefaultJobTimeout); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if units := srv.Units(); len(units) != 0 {
+		t.Errorf("expected no units, got %v", units)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed, got %v", dir, err)
+	}
+}
+
+// waitDisconnected waits for the client side of conn to notice that it has
+// been disconnected.
+func waitDisconnected(t *testing.T, conn *systemdDbus.Conn) {
+	t.Helper()
+	for range 100 {
+		if !conn.Connected() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for the dbus connection to be closed")
+}
+
+func TestFakeSystemdReconnect(t *testing.T) {
+	srv, _ := newFakeSystemd(t, t.TempDir())
+	dials := 0
+	cm := NewDbusConnManager(func(ctx context.Context) (*systemdDbus.Conn, error) {
+		dials++
+		return srv.Dial(ctx)
+	})
+
+	if err := startUnit(context.Background(), cm, "test-fake.slice", nil, false, DefaultJobTimeout); err != nil {
+		t.Fatal(err)
+	}
+	// Much like a dbus restart.
+	conn, err := cm.getConnection(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Disconnect()
+	waitDisconnected(t, conn)
+	if err := setUnitProperties(context.Background(), cm, "test-fake.slice", newProp("TasksMax", uint64(10))); err != nil {
+		t.Fatal(err)
+	}
+	if dials != 2 {
+		t.Errorf("expected 2 dials, got %d", dials)
+	}
+
+	// Without a dial function, the connection can't be re-established.
+	conn, err = srv.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm = NewDbusConnManagerWithConn(conn, nil)
+	if err := resetFailedUnit(context.Background(), cm, "test-fake.slice"); err != nil {
+		t.Fatal(err)
+	}
+	srv.Disconnect()
+	waitDisconnected(t, conn)
+	if err := resetFailedUnit(context.Background(), cm, "test-fake.slice"); err == nil {
+		t.Fatal("expected an error without a dial function")
+	}
+}
+
+func TestFakeSystemdSlowDial(t *testing.T) {
+	srv, _ := newFakeSystemd(t, t.TempDir())
+	dialing, release := make(chan struct{}), make(chan struct{})
+	cm := NewDbusConnManager(func(ctx context.Context) (*systemdDbus.Conn, error) {
+		close(dialing)
+		<-release
+		return srv.Dial(ctx)
+	})
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := cm.getConnection(context.Background())
+		errCh <- err
+	}()
+	<-dialing
+	// The others wait for the connection attempt in progress, but only
+	// until their contexts are done.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := cm.getConnection(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a deadline exceeded error, got %v", err)
+	}
+	close(release)
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	// The connection is established, so there is no dial anymore.
+	if err := startUnit(context.Background(), cm, "test-fake.slice", nil, false, DefaultJobTimeout); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFakeSystemdSetNotBlocking(t *testing.T) {
+	srv, _ := newFakeSystemd(t, t.TempDir())
+	dialing, release := make(chan struct{}), make(chan struct{})
+	cm := NewDbusConnManager(func(ctx context.Context) (*systemdDbus.Conn, error) {
+		close(dialing)
+		<-release
+		return srv.Dial(ctx)
+	})
+	config := &cgroups.Cgroup{Name: "fake", ScopePrefix: "test", Resources: &cgroups.Resources{}}
+	paths := map[string]string{"memory": filepath.Join(t.TempDir(), "memory")}
+	m, err := NewLegacyManagerWithDbus(config, paths, cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- m.Set(&cgroups.Resources{SkipDevices: true, Memory: 1 << 30})
+	}()
+	<-dialing
+	// While Set waits for systemd, the others are not blocked.
+	if p := m.Path("memory"); p != paths["memory"] {
+		t.Errorf("expected path %q, got %q", paths["memory"], p)
+	}
+	if _, err := m.Stats(&cgroups.StatsOptions{Controllers: cgroups.Pids}); err != nil {
+		t.Error(err)
+	}
+	close(release)
+	// The unit does not exist, so Set fails once systemd is reached.
+	if err := <-errCh; err == nil {
+		t.Error("expected Set of a missing unit to fail")
+	}
+}
+
+func TestFakeSystemdStatsContext(t *testing.T) {
+	srv, _ := newFakeSystemd(t, t.TempDir())
+	dialing, release := make(chan struct{}), make(chan struct{})
+	cm := NewDbusConnManager(func(ctx context.Context) (*systemdDbus.Conn, error) {
+		close(dialing)
+		<-release
+		return srv.Dial(ctx)
+	})
+	defer close(release)
+	config := &cgroups.Cgroup{Name: "fake", ScopePrefix: "test", Resources: &cgroups.Resources{}}
+	m, err := NewLegacyManagerWithDbus(config, map[string]string{}, cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Hang systemd, by holding the connection attempt.
+	go func() { _, _ = m.UnitExists(context.Background()) }()
+	<-dialing
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := m.StatsContext(ctx, &cgroups.StatsOptions{Controllers: cgroups.Unit}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("StatsContext: expected a deadline exceeded error, got %v", err)
+	}
+	if _, _, err := m.ManagedOOMContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ManagedOOMContext: expected a deadline exceeded error, got %v", err)
+	}
+}
+
+func TestFakeSystemdPing(t *testing.T) {
+	srv, _ := newFakeSystemd(t, t.TempDir())
+	hang := true
+	dialed := make(chan struct{})
+	cm := NewDbusConnManager(func(ctx context.Context) (*systemdDbus.Conn, error) {
+		if hang {
+			hang = false
+			defer close(dialed)
+			// Like the real dial functions, it honours ctx.
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return srv.Dial(ctx)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := cm.Ping(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a deadline exceeded error, got %v", err)
+	}
+	// The connection attempt is over once ctx is done, and it is not
+	// the one of cm, so the users of cm are not held up.
+	<-dialed
+	if err := startUnit(context.Background(), cm, "test-fake.slice", nil, false, DefaultJobTimeout); err != nil {
+		t.Fatal(err)
+	}
+	// Once connected, the connection of cm is used.
+	if err := cm.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFakeSystemdUnifiedManager(t *testing.T) {
+	// The cgroups are created by the fake systemd in a temporary
+	// directory, which the unified manager configures as a fake cgroupfs.
+	cgroups.TestMode = true
+	defer func() { cgroups.TestMode = false }()
+	root := t.TempDir()
+	srv, cm := newFakeSystemd(t, root)
+
+	config := &cgroups.Cgroup{
+		Name:        "fake",
+		ScopePrefix: "test",
+		Resources:   &cgroups.Resources{},
+	}
+	path := filepath.Join(root, "system.slice", "test-fake.scope")
+	m, err := NewUnifiedManagerWithDbus(config, path, cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Apply would create the cgroup path below /sys/fs/cgroup (see
+	// TestFakeSystemdUnifiedManagerApply), so start the unit directly.
+	props := []systemdDbus.Property{systemdDbus.PropSlice("system.slice")}
+	if err := startUnit(context.Background(), cm, getUnitName(config), props, true, DefaultJobTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Exists() {
+		t.Fatal("expected the cgroup to exist")
+	}
+	if err := os.WriteFile(filepath.Join(path, "cgroup.controllers"), []byte("cpu memory pids\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	limit := int64(10)
+	if err := m.Set(&cgroups.Resources{CpuWeight: 200, PidsLimit: &limit}); err != nil {
+		t.Fatal(err)
+	}
+	u, ok := srv.Unit("test-fake.scope")
+	if !ok {
+		t.Fatal("expected the unit to exist")
+	}
+	if v, ok := u.Properties["CPUWeight"].Value().(uint64); !ok || v != 200 {
+		t.Errorf("expected CPUWeight=200, got %v", u.Properties["CPUWeight"])
+	}
+	if v, ok := u.Properties["TasksMax"].Value().(uint64); !ok || v != 10 {
+		t.Errorf("expected TasksMax=10, got %v", u.Properties["TasksMax"])
+	}
+	for file, exp := range map[string]string{"cpu.weight": "200", "pids.max": "10"} {
+		if v, err := os.ReadFile(filepath.Join(path, file)); err != nil || strings.TrimSpace(string(v)) != exp {
+			t.Errorf("expected %s to be %q, got %q (%v)", file, exp, v, err)
+		}
+	}
+	if err := m.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := srv.Unit("test-fake.scope"); ok {
+		t.Error("expected the unit to be stopped")
+	}
+}
+
+// TestFakeSystemdUnifiedManagerApply is like TestFakeSystemdUnifiedManager,
+// but also creates the cgroup with Apply, which only works on cgroupfs.
+func TestFakeSystemdUnifiedManagerApply(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root.")
+	}
+	if !cgroups.IsCgroup2UnifiedMode() {
+		t.Skip("Test requires cgroup v2.")
+	}
+	// The cgroups are created by the fake systemd in a cgroup v2 cgroup,
+	// so the unified manager can configure them.
+	root, err := os.MkdirTemp(fs2.UnifiedMountpoint, "systemdtest-")
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { _ = cgroups.RemovePath(root) })
+	srv, cm := newFakeSystemd(t, root)
+
+	config := &cgroups.Cgroup{
+		Name:        "fake",
+		ScopePrefix: "test",
+		Resources:   &cgroups.Resources{},
+	}
+	path := filepath.Join(root, "system.slice", "test-fake.scope")
+	m, err := NewUnifiedManagerWithDbus(config, path, cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Apply(-1); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Exists() {
+		t.Fatal("expected the cgroup to exist")
+	}
+	if err := m.Set(&cgroups.Resources{CpuWeight: 200}); err != nil {
+		t.Fatal(err)
+	}
+	u, ok := srv.Unit("test-fake.scope")
+	if !ok {
+		t.Fatal("expected the unit to exist")
+	}
+	if v, ok := u.Properties["CPUWeight"].Value().(uint64); !ok || v != 200 {
+		t.Errorf("expected CPUWeight=200, got %v", u.Properties["CPUWeight"])
+	}
+	if err := m.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := srv.Unit("test-fake.scope"); ok {
+		t.Error("expected the unit to be stopped")
+	}
+	if m.Exists() {
+		t.Error("expected the cgroup to be removed")
+	}
+}
+
+func TestFakeSystemdLegacyManager(t *testing.T) {
+	cgroups.TestMode = true
+	defer func() { cgroups.TestMode = false }()
+	root := t.TempDir()
+	hierarchies := []string{"cpu", "freezer", "memory", "pids"}
+	srv, err := systemdtest.NewServer(systemdtest.Config{CgroupRoot: root, Hierarchies: hierarchies})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = srv.Close() })
+	cm := NewDbusConnManager(srv.Dial)
+
+	config := &cgroups.Cgroup{
+		Name:        "fake",
+		ScopePrefix: "test",
+		Resources:   &cgroups.Resources{},
+	}
+	paths := make(map[string]string)
+	for _, h := range hierarchies {
+		paths[h] = filepath.Join(root, h, "system.slice", "test-fake.scope")
+	}
+	m, err := NewLegacyManagerWithDbus(config, paths, cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Apply(-1); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range paths {
+		if _, err := os.Stat(p); err != nil {
+			t.Fatalf("expected the cgroup to exist: %v", err)
+		}
+	}
+	limit := int64(10)
+	if err := m.Set(&cgroups.Resources{CpuShares: 512, PidsLimit: &limit}); err != nil {
+		t.Fatal(err)
+	}
+	u, ok := srv.Unit("test-fake.scope")
+	if !ok {
+		t.Fatal("expected the unit to exist")
+	}
+	if v, ok := u.Properties["CPUShares"].Value().(uint64); !ok || v != 512 {
+		t.Errorf("expected CPUShares=512, got %v", u.Properties["CPUShares"])
+	}
+	for file, exp := range map[string]string{"cpu/cpu.shares": "512", "pids/pids.max": "10"} {
+		dir, name := filepath.Split(file)
+		p := filepath.Join(paths[filepath.Clean(dir)], name)
+		if v, err := os.ReadFile(p); err != nil || strings.TrimSpace(string(v)) != exp {
+			t.Errorf("expected %s to be %q, got %q (%v)", p, exp, v, err)
+		}
+	}
+	if err := m.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := srv.Unit("test-fake.scope"); ok {
+		t.Error("expected the unit to be stopped")
+	}
+}
+
+func TestFakeSystemdVerify(t *testing.T) {
+	_, cm := newFakeSystemd(t, t.TempDir())
+	ctx := context.Background()
+	config := &cgroups.Cgroup{Name: "fake", ScopePrefix: "test", Resources: &cgroups.Resources{}}
+	m, err := NewLegacyManagerWithDbus(config, map[string]string{}, cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Apply(-1); err != nil {
+		t.Fatal(err)
+	}
+	limit := int64(10)
+	if err := m.Set(&cgroups.Resources{SkipDevices: true, PidsLimit: &limit, CpuShares: 512}); err != nil {
+		t.Fatal(err)
+	}
+	if drifts, err := m.Verify(); err != nil || len(drifts) != 0 {
+		t.Fatalf("expected no drifts, got %v, %v", drifts, err)
+	}
+
+	unitName := getUnitName(config)
+	if err := setUnitProperties(ctx, cm, unitName, newProp("TasksMax", uint64(20))); err != nil {
+		t.Fatal(err)
+	}
+	drifts, err := m.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drifts) != 1 || drifts[0].Property != "TasksMax" || drifts[0].Unit != unitName {
+		t.Fatalf("expected a TasksMax drift, got %v", drifts)
+	}
+	if drifts, err := m.Verify(); err != nil || len(drifts) != 0 {
+		t.Errorf("expected no drifts after Reconcile, got %v, %v", drifts, err)
+	}
+}
+
+func TestFakeSystemdWatch(t *testing.T) {
+	srv, cm := newFakeSystemd(t, t.TempDir())
+	dir := t.TempDir()
+	config := &cgroups.Cgroup{
+		Name:        "fake",
+		ScopePrefix: "test",
+		Resources:   &cgroups.Resources{},
+	}
+	m, err := NewUnifiedManagerWithDbus(config, dir, cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := startUnit(context.Background(), cm, "test-fake.scope", nil, false, DefaultJobTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := m.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := func(want UnitEventType) UnitEvent {
+		t.Helper()
+		select {
+		case ev := <-events:
+			if ev.Type != want || ev.Unit != "test-fake.scope" {
+				t.Fatalf("expected a %s event, got %+v", want, ev)
+			}
+			return ev
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for a %s event", want)
+		}
+		return UnitEvent{}
+	}
+
+	next(UnitActive)
+	if !m.Exists() {
+		t.Fatal("expected the cgroup to exist")
+	}
+	if err := srv.Fail("test-fake.scope", "oom-kill"); err != nil {
+		t.Fatal(err)
+	}
+	if ev := next(UnitFailed); ev.Result != "oom-kill" {
+		t.Errorf("expected the oom-kill result, got %+v", ev)
+	}
+	if err := resetFailedUnit(context.Background(), cm, "test-fake.scope"); err != nil {
+		t.Fatal(err)
+	}
+	next(UnitRemoved)
+	if m.Exists() {
+		t.Error("expected the removed unit to not exist")
+	}
+
+	// The unit coming back, and being stopped by someone else.
+	if err := startUnit(context.Background(), cm, "test-fake.scope", nil, false, DefaultJobTimeout); err != nil {
+		t.Fatal(err)
+	}
+	next(UnitActive)
+	if err := srv.Stop("test-fake.scope"); err != nil {
+		t.Fatal(err)
+	}
+	next(UnitDeactivating)
+	next(UnitRemoved)
+
+	cancel()
+	for range events {
+	}
+	// Not watching anymore, so Exists only checks the cgroup.
+	if !m.Exists() {
+		t.Error("expected the cgroup to exist")
+	}
+	if ok, err := m.UnitExists(context.Background()); err != nil || ok {
+		t.Errorf("expected the unit to not exist, got %v, %v", ok, err)
+	}
+	if err := startUnit(context.Background(), cm, "test-fake.scope", nil, false, DefaultJobTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := m.UnitExists(context.Background()); err != nil || !ok {
+		t.Errorf("expected the unit to exist, got %v, %v", ok, err)
+	}
+}
+
+func TestFakeSystemdContext(t *testing.T) {
+	srv, cm := newFakeSystemd(t, t.TempDir())
+	config := &cgroups.Cgroup{
+		Name:        "fake",
+		ScopePrefix: "test",
+		Resources:   &cgroups.Resources{},
+	}
+	m, err := NewUnifiedManagerWithDbus(config, t.TempDir(), cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Jobs not completing in time.
+	srv.HoldJobs(true)
+	defer srv.HoldJobs(false)
+	m.SetJobTimeout(100 * time.Millisecond)
+	if err := m.Apply(-1); err == nil || !strings.Contains(err.Error(), "Timeout") {
+		t.Fatalf("expected a timeout error, got %v", err)
+	}
+	m.SetJobTimeout(time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := m.DestroyContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a deadline exceeded error, got %v", err)
+	}
+
+	// An already cancelled context.
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := m.ApplyContext(ctx, -1); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a canceled error from ApplyContext, got %v", err)
+	}
+	if err := m.SetContext(ctx, &cgroups.Resources{CpuWeight: 200}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a canceled error from SetContext, got %v", err)
+	}
+	if err := m.AddPidContext(ctx, "", os.Getpid()); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a canceled error from AddPidContext, got %v", err)
+	}
+	if err := m.FreezeContext(ctx, cgroups.Frozen); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a canceled error from FreezeContext, got %v", err)
+	}
+}
+
+func TestFakeSystemdDelegate(t *testing.T) {
+	root := t.TempDir()
+	_, cm := newFakeSystemd(t, root)
+
+	for _, c := range []*cgroups.Cgroup{
+		{Name: "fake", ScopePrefix: "test", DelegateSubgroup: "a/b"},
+		{Name: "fake", ScopePrefix: "test", DelegateSubgroup: ".."},
+		{Name: "test-fake.slice", DelegateControllers: []string{"memory"}},
+	} {
+		if _, err := NewUnifiedManagerWithDbus(c, t.TempDir(), cm); err == nil {
+			t.Errorf("expected an error for %+v", c)
+		}
+	}
+	c := &cgroups.Cgroup{Name: "fake", ScopePrefix: "test", DelegateSubgroup: "init", Resources: &cgroups.Resources{}}
+	if _, err := NewLegacyManagerWithDbus(c, map[string]string{}, cm); err == nil {
+		t.Error("expected an error for DelegateSubgroup on cgroup v1")
+	}
+
+	dir := filepath.Join(root, "system.slice", "test-fake.scope")
+	m, err := NewUnifiedManagerWithDbus(c, dir, cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := m.DelegateSubgroupPath(); p != filepath.Join(dir, "init") {
+		t.Errorf("expected the path of the delegated subgroup, got %s", p)
+	}
+	// The paths are the ones of the unit cgroup, so that a manager
+	// created from them (as by NewWithPaths) manages the same cgroup.
+	if p := m.Path(""); p != dir {
+		t.Errorf("expected the path of the unit cgroup, got %s", p)
+	}
+	m2, err := NewUnifiedManagerWithDbus(c, m.GetPaths()[""], cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := m2.Path(""); p != dir {
+		t.Errorf("expected the path of the unit cgroup after a round trip, got %s", p)
+	}
+	if p := m2.DelegateSubgroupPath(); p != filepath.Join(dir, "init") {
+		t.Errorf("expected the path of the delegated subgroup after a round trip, got %s", p)
+	}
+
+	delegate, err := delegateProperties(cm, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	props := append(delegate, newProp("PIDs", []uint32{uint32(os.Getpid())}))
+	if err := startUnit(context.Background(), cm, "test-fake.scope", props, false, DefaultJobTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "init", "cgroup.procs")); err != nil {
+		t.Fatalf("expected the process in the delegated subgroup: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "init", "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddPid("sub", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "init", "sub", "cgroup.procs")); err != nil {
+		t.Fatalf("expected the process in the sub cgroup of the delegated subgroup: %v", err)
+	}
+	if err := m.AddPid("../sub", 1); err == nil {
+		t.Error("expected an error for a sub cgroup outside of the delegated subgroup")
+	}
+
+	// DelegateSubgroup requires systemd v254.
+	srv, err := systemdtest.NewServer(systemdtest.Config{CgroupRoot: root, Version: delegateSubgroupSupportedVersion - 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	if _, err := delegateProperties(NewDbusConnManager(srv.Dial), c); err == nil {
+		t.Error("expected an error for DelegateSubgroup with systemd v253")
+	}
+}
+
+func TestFakeSystemdManagedOOM(t *testing.T) {
+	root := t.TempDir()
+	srv, cm := newFakeSystemd(t, root)
+
+	// The settings are checked, including against the systemd version.
+	versions := map[int]*DbusConnManager{systemdtest.DefaultVersion: cm}
+	for _, v := range []int{managedOOMSupportedVersion - 1, managedOOMSupportedVersion} {
+		srv, err := systemdtest.NewServer(systemdtest.Config{CgroupRoot: t.TempDir(), Version: v})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+		versions[v] = NewDbusConnManager(srv.Dial)
+	}
+	for _, tc := range []struct {
+		version int
+		oom     cgroups.ManagedOOM
+		valid   bool
+	}{
+		{systemdtest.DefaultVersion, cgroups.ManagedOOM{Swap: "stop"}, false},
+		{systemdtest.DefaultVersion, cgroups.ManagedOOM{MemoryPressureLimit: 1.5}, false},
+		{systemdtest.DefaultVersion, cgroups.ManagedOOM{Preference: "never"}, false},
+		{managedOOMSupportedVersion - 1, cgroups.ManagedOOM{Swap: cgroups.ManagedOOMKill}, false},
+		{managedOOMSupportedVersion, cgroups.ManagedOOM{Swap: cgroups.ManagedOOMKill}, true},
+		{managedOOMSupportedVersion, cgroups.ManagedOOM{Preference: cgroups.ManagedOOMPreferenceOmit}, false},
+		{managedOOMSupportedVersion, cgroups.ManagedOOM{MemoryPressureLimit: 0.5}, false},
+	} {
+		_, err := managedOOMProperties(versions[tc.version], &tc.oom)
+		if tc.valid && err != nil {
+			t.Errorf("%+v with systemd v%d: expected no error, got %v", tc.oom, tc.version, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%+v with systemd v%d: expected an error", tc.oom, tc.version)
+		}
+	}
+
+	if err := startUnit(context.Background(), cm, "test-a.slice", nil, false, DefaultJobTimeout); err != nil {
+		t.Fatal(err)
+	}
+	config := &cgroups.Cgroup{
+		Name:        "fake",
+		ScopePrefix: "test",
+		Parent:      "test-a.slice",
+		Resources:   &cgroups.Resources{},
+		ParentManagedOOM: &cgroups.ManagedOOM{
+			MemoryPressure:      cgroups.ManagedOOMKill,
+			MemoryPressureLimit: 0.6,
+		},
+	}
+	m, err := NewLegacyManagerWithDbus(config, map[string]string{"devices": filepath.Join(root, "devices")}, cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Apply(-1); err != nil {
+		t.Fatal(err)
+	}
+	err = m.Set(&cgroups.Resources{
+		SkipDevices: true,
+		ManagedOOM: &cgroups.ManagedOOM{
+			Swap:       cgroups.ManagedOOMKill,
+			Preference: cgroups.ManagedOOMPreferenceAvoid,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unit, parent, err := m.ManagedOOM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := (cgroups.ManagedOOM{Swap: cgroups.ManagedOOMKill, Preference: cgroups.ManagedOOMPreferenceAvoid}); *unit != exp {
+		t.Errorf("expected the unit settings %+v, got %+v", exp, *unit)
+	}
+	if *parent != *config.ParentManagedOOM {
+		t.Errorf("expected the parent slice settings %+v, got %+v", *config.ParentManagedOOM, *parent)
+	}
+
+	// The unit is stopped if the parent slice settings can't be set.
+	config = &cgroups.Cgroup{
+		Name:             "fake-nosuchparent",
+		ScopePrefix:      "test",
+		Parent:           "test-missing.slice",
+		Resources:        &cgroups.Resources{},
+		ParentManagedOOM: &cgroups.ManagedOOM{MemoryPressure: cgroups.ManagedOOMKill},
+	}
+	m, err = NewLegacyManagerWithDbus(config, map[string]string{"devices": filepath.Join(root, "devices")}, cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Apply(-1); err == nil {
+		t.Fatal("expected an error setting the settings of a missing parent slice")
+	}
+	if _, ok := srv.Unit(getUnitName(config)); ok {
+		t.Errorf("expected unit %s to be stopped", getUnitName(config))
+	}
+}
+
+func TestFakeSystemdUnitStats(t *testing.T) {
+	srv, cm := newFakeSystemd(t, t.TempDir())
+	ctx := context.Background()
+	if err := startUnit(ctx, cm, "test-a.slice", nil, false, DefaultJobTimeout); err != nil {
+		t.Fatal(err)
+	}
+	props := []systemdDbus.Property{systemdDbus.PropSlice("test-a.slice")}
+	if err := startUnit(ctx, cm, "test-fake.scope", props, false, DefaultJobTimeout); err != nil {
+		t.Fatal(err)
+	}
+	// The fake systemd does no accounting.
+	err := setUnitProperties(ctx, cm, "test-fake.scope",
+		newProp("MemoryCurrent", uint64(100)),
+		newProp("CPUUsageNSec", uint64(200)),
+		newProp("TasksCurrent", uint64(3)),
+		newProp("IOReadBytes", uint64(math.MaxUint64)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setUnitProperties(ctx, cm, "test-a.slice", newProp("MemoryCurrent", uint64(1000))); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &cgroups.Cgroup{
+		Name:        "fake",
+		ScopePrefix: "test",
+		Parent:      "test-a.slice",
+		Resources:   &cgroups.Resources{},
+	}
+	m, err := NewLegacyManagerWithDbus(config, map[string]string{}, cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Not queried unless asked for.
+	stats, err := m.Stats(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.UnitStats != (cgroups.UnitStats{}) {
+		t.Errorf("expected no unit stats, got %+v", stats.UnitStats)
+	}
+
+	stats, err = m.Stats(&cgroups.StatsOptions{Controllers: cgroups.Unit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := srv.Unit("test-fake.scope")
+	exp := cgroups.UnitStats{
+		Unit:                 "test-fake.scope",
+		InvocationID:         hex.EncodeToString(u.InvocationID),
+		ActiveEnterTimestamp: uint64(u.ActiveEnterTimestamp.UnixMicro()),
+		MemoryCurrent:        100,
+		SliceMemoryCurrent:   1000,
+		CPUUsageNSec:         200,
+		TasksCurrent:         3,
+	}
+	if stats.UnitStats != exp {
+		t.Errorf("expected unit stats %+v, got %+v", exp, stats.UnitStats)
+	}
+	if len(exp.InvocationID) != 32 {
+		t.Errorf("expected a 128-bit invocation ID, got %q", exp.InvocationID)
+	}
+
+	// The slice of a slice unit is implied by its name, rather than Parent.
+	if err := startUnit(ctx, cm, "test-a-b.slice", nil, false, DefaultJobTimeout); err != nil {
+		t.Fatal(err)
+	}
+	sm, err := NewLegacyManagerWithDbus(&cgroups.Cgroup{Name: "test-a-b.slice", Resources: &cgroups.Resources{}}, map[string]string{}, cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err = sm.Stats(&cgroups.StatsOptions{Controllers: cgroups.Unit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.UnitStats.SliceMemoryCurrent != 1000 {
+		t.Errorf("expected the memory of test-a.slice, got %d", stats.UnitStats.SliceMemoryCurrent)
+	}
+
+	// If systemd can't be queried, the other stats are returned anyway.
+	if err := srv.Stop("test-fake.scope"); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = m.Stats(&cgroups.StatsOptions{Controllers: cgroups.Unit})
+	if err == nil {
+		t.Fatal("expected an error querying a stopped unit")
+	}
+	if stats == nil {
+		t.Fatal("expected the stats along with the error")
+	}
+}
+
+func TestFakeSystemdSaveUnitProperties(t *testing.T) {
+	_, cm := newFakeSystemd(t, t.TempDir())
+	ctx := context.Background()
+	devs := []deviceAllowEntry{{Path: "/dev/null", Perms: "rwm"}}
+	props := []systemdDbus.Property{
+		newProp("TasksMax", uint64(10)),
+		newProp("DeviceAllow", devs),
+	}
+	if err := startUnit(ctx, cm, "test-fake.scope", props, false, DefaultJobTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := saveUnitProperties(ctx, cm, "test-fake.scope", []systemdDbus.Property{
+		newProp("TasksMax", uint64(20)),
+		newProp("DeviceAllow", []deviceAllowEntry{{Path: "/dev/zero", Perms: "r"}}),
+		newProp("TasksMax", uint64(30)),
+		newProp("NoSuchProperty", true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []systemdDbus.Property{
+		newProp("TasksMax", uint64(10)),
+		newProp("DeviceAllow", []deviceAllowEntry{}),
+		newProp("DeviceAllow", devs),
+	}
+	if len(saved) != len(exp) {
+		t.Fatalf("expected saved properties %v, got %v", exp, saved)
+	}
+	for i := range exp {
+		if saved[i].Name != exp[i].Name || saved[i].Value.Signature() != exp[i].Value.Signature() ||
+			!reflect.DeepEqual(saved[i].Value.Value(), exp[i].Value.Value()) {
+			t.Errorf("expected saved property %v, got %v", exp[i], saved[i])
+		}
+	}
+
+	// The saved properties can be set back.
+	if err := setUnitProperties(ctx, cm, "test-fake.scope", newProp("TasksMax", uint64(20))); err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreUnitProperties(ctx, cm, "test-fake.scope", saved); err != nil {
+		t.Fatal(err)
+	}
+	prop, err := getUnitTypeProperty(ctx, cm, "test-fake.scope", "Scope", "TasksMax")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := prop.Value.Value().(uint64); !ok || v != 10 {
+		t.Errorf("expected TasksMax=10, got %v", prop.Value)
+	}
+}
+
+func TestFakeSystemdIPStats(t *testing.T) {
+	_, cm := newFakeSystemd(t, t.TempDir())
+	config := &cgroups.Cgroup{
+		Name:        "fake",
+		ScopePrefix: "test",
+		Parent:      "system.slice",
+		Resources:   &cgroups.Resources{IP: &cgroups.IPPolicy{Accounting: true}},
+	}
+	m, err := NewLegacyManagerWithDbus(config, map[string]string{}, cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Not queried unless asked for.
+	if _, err := m.Stats(nil); err != nil {
+		t.Fatal(err)
+	}
+	// The unit does not exist, but the other stats are still returned.
+	stats, err := m.Stats(&cgroups.StatsOptions{Controllers: cgroups.AllControllers | cgroups.IP})
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	if stats == nil {
+		t.Fatal("expected partial stats, got nil")
+	}
+}
@@ -3,6 +3,7 @@ package systemd
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"os"
 	"os/exec"
 	"strings"
@@ -139,7 +140,7 @@ func TestFreezeBeforeSet(t *testing.T) {
 			defer m.Destroy() //nolint:errcheck
 
 			// Checks for a non-existent unit.
-			freeze, thaw, err := m.freezeBeforeSet(getUnitName(tc.cg), tc.cg.Resources)
+			freeze, thaw, err := m.freezeBeforeSet(context.Background(), getUnitName(tc.cg), tc.cg.Resources)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -173,7 +174,7 @@ func TestFreezeBeforeSet(t *testing.T) {
 					return // no more checks
 				}
 			}
-			freeze, thaw, err = m.freezeBeforeSet(getUnitName(tc.cg), tc.cg.Resources)
+			freeze, thaw, err = m.freezeBeforeSet(context.Background(), getUnitName(tc.cg), tc.cg.Resources)
 			if err != nil {
 				t.Error(err)
 				return // no more checks
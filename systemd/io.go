@@ -0,0 +1,205 @@
+package systemd
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	systemdDbus "github.com/coreos/go-systemd/v22/dbus"
+)
+
+// ioDeviceValue is an element of the per-device IO unit properties, such as
+// IODeviceWeight, IOReadBandwidthMax, or IODeviceLatencyTargetUSec.
+type ioDeviceValue struct {
+	Path  string
+	Value uint64
+}
+
+// ioDevicePath returns the path systemd refers to the block device with
+// the "MAJ:MIN" numbers dev by.
+func ioDevicePath(dev string) (string, error) {
+	major, minor, ok := strings.Cut(dev, ":")
+	if !ok {
+		return "", fmt.Errorf("invalid device %q", dev)
+	}
+	if _, err := strconv.ParseUint(major, 10, 32); err != nil {
+		return "", fmt.Errorf("invalid device %q: %w", dev, err)
+	}
+	if _, err := strconv.ParseUint(minor, 10, 32); err != nil {
+		return "", fmt.Errorf("invalid device %q: %w", dev, err)
+	}
+	return "/dev/block/" + dev, nil
+}
+
+// ioLines returns the non-empty lines of an io.* unified resource value,
+// which may have a line per device.
+func ioLines(v string) []string {
+	var lines []string
+	for line := range strings.SplitSeq(v, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// parseIOLimit parses a limit of an io.max or io.latency line, where "max"
+// means no limit.
+func parseIOLimit(v string) (uint64, error) {
+	if v == "max" {
+		return math.MaxUint64, nil
+	}
+	return strconv.ParseUint(v, 10, 64)
+}
+
+// parseIOWeight parses an io.weight or io.bfq.weight value, which consists
+// of "[default] WEIGHT" and "MAJ:MIN WEIGHT" lines, into the default weight
+// (0 if not set) and the device weights. It returns false if the value
+// can't be translated to unit properties, as it resets a device weight
+// ("MAJ:MIN default").
+func parseIOWeight(v string) (def uint64, devs []ioDeviceValue, ok bool, _ error) {
+	lines := ioLines(v)
+	if len(lines) == 0 {
+		return 0, nil, false, fmt.Errorf("invalid value %q", v)
+	}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 1 {
+			fields = []string{"default", fields[0]}
+		}
+		if len(fields) != 2 {
+			return 0, nil, false, fmt.Errorf("invalid line %q", line)
+		}
+		if fields[0] != "default" && fields[1] == "default" {
+			return 0, nil, false, nil
+		}
+		weight, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, nil, false, fmt.Errorf("invalid line %q: %w", line, err)
+		}
+		if weight == 0 {
+			return 0, nil, false, fmt.Errorf("invalid line %q: zero weight", line)
+		}
+		if fields[0] == "default" {
+			def = weight
+			continue
+		}
+		path, err := ioDevicePath(fields[0])
+		if err != nil {
+			return 0, nil, false, err
+		}
+		devs = append(devs, ioDeviceValue{Path: path, Value: weight})
+	}
+	return def, devs, true, nil
+}
+
+// ioWeightProps returns the unit properties for an io.weight value, or
+// nil if it can't be translated (see parseIOWeight).
+func ioWeightProps(v string) ([]systemdDbus.Property, error) {
+	def, devs, ok, err := parseIOWeight(v)
+	if err != nil || !ok {
+		return nil, err
+	}
+	var props []systemdDbus.Property
+	if def != 0 {
+		props = append(props, newProp("IOWeight", def))
+	}
+	if len(devs) > 0 {
+		props = append(props, newProp("IODeviceWeight", devs))
+	}
+	return props, nil
+}
+
+// bfqToIOWeight converts an io.bfq.weight value to the IOWeight one.
+// systemd sets io.bfq.weight by scaling IOWeight from [1, 100, 10000] (the
+// minimum, default and maximum) to [1, 100, 1000], so this scales it back.
+func bfqToIOWeight(weight uint64) uint64 {
+	if weight <= 100 {
+		return weight
+	}
+	return 100 + (weight-100)*(10000-100)/(1000-100)
+}
+
+// ioBFQWeightProps returns the unit properties for an io.bfq.weight value,
+// or nil if it can't be translated. Only the default weight can be, as
+// systemd does not set io.bfq.weight for the device weights.
+func ioBFQWeightProps(v string) ([]systemdDbus.Property, error) {
+	def, devs, ok, err := parseIOWeight(v)
+	if err != nil || !ok || def == 0 || len(devs) > 0 {
+		return nil, err
+	}
+	return []systemdDbus.Property{newProp("IOWeight", bfqToIOWeight(def))}, nil
+}
+
+// ioMaxProps returns the unit properties for an io.max value, which
+// consists of "MAJ:MIN [rbps=N] [wbps=N] [riops=N] [wiops=N]" lines.
+func ioMaxProps(v string) ([]systemdDbus.Property, error) {
+	keys := []struct{ key, prop string }{
+		{"rbps", "IOReadBandwidthMax"},
+		{"wbps", "IOWriteBandwidthMax"},
+		{"riops", "IOReadIOPSMax"},
+		{"wiops", "IOWriteIOPSMax"},
+	}
+	limits := make(map[string][]ioDeviceValue)
+	lines := ioLines(v)
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("invalid value %q", v)
+	}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		path, err := ioDevicePath(fields[0])
+		if err != nil {
+			return nil, err
+		}
+	fields:
+		for _, f := range fields[1:] {
+			key, val, _ := strings.Cut(f, "=")
+			for _, k := range keys {
+				if k.key != key {
+					continue
+				}
+				limit, err := parseIOLimit(val)
+				if err != nil {
+					return nil, fmt.Errorf("invalid line %q: %w", line, err)
+				}
+				limits[k.prop] = append(limits[k.prop], ioDeviceValue{Path: path, Value: limit})
+				continue fields
+			}
+			return nil, fmt.Errorf("invalid line %q: unknown key %q", line, key)
+		}
+	}
+	var props []systemdDbus.Property
+	for _, k := range keys {
+		if l, ok := limits[k.prop]; ok {
+			props = append(props, newProp(k.prop, l))
+		}
+	}
+	return props, nil
+}
+
+// ioLatencyProps returns the unit properties for an io.latency value,
+// which consists of "MAJ:MIN target=USEC" lines.
+func ioLatencyProps(v string) ([]systemdDbus.Property, error) {
+	var targets []ioDeviceValue
+	lines := ioLines(v)
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("invalid value %q", v)
+	}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], "target=") {
+			return nil, fmt.Errorf("invalid line %q", line)
+		}
+		path, err := ioDevicePath(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		target, err := parseIOLimit(strings.TrimPrefix(fields[1], "target="))
+		if err != nil {
+			return nil, fmt.Errorf("invalid line %q: %w", line, err)
+		}
+		targets = append(targets, ioDeviceValue{Path: path, Value: target})
+	}
+	return []systemdDbus.Property{newProp("IODeviceLatencyTargetUSec", targets)}, nil
+}
@@ -0,0 +1,123 @@
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+
+	systemdDbus "github.com/coreos/go-systemd/v22/dbus"
+	"golang.org/x/sys/unix"
+
+	"github.com/opencontainers/cgroups"
+)
+
+// ipAddressPrefix is an IPAddressAllow or IPAddressDeny list element.
+type ipAddressPrefix struct {
+	Family    int32
+	Address   []byte
+	PrefixLen uint32
+}
+
+// ipAddressNames are the symbolic names accepted by systemd in the
+// IPAddressAllow and IPAddressDeny lists, with the prefixes they mean.
+var ipAddressNames = map[string][]string{
+	"any":        {"0.0.0.0/0", "::/0"},
+	"localhost":  {"127.0.0.0/8", "::1/128"},
+	"link-local": {"169.254.0.0/16", "fe80::/64"},
+	"multicast":  {"224.0.0.0/4", "ff00::/8"},
+}
+
+// parseIPAddressPrefixes converts IP addresses, prefixes and symbolic
+// names to the IPAddressAllow or IPAddressDeny list.
+func parseIPAddressPrefixes(addrs []string) ([]ipAddressPrefix, error) {
+	list := []ipAddressPrefix{}
+	for _, a := range addrs {
+		strs, ok := ipAddressNames[a]
+		if !ok {
+			strs = []string{a}
+		}
+		for _, str := range strs {
+			prefix, err := netip.ParsePrefix(str)
+			if err != nil {
+				addr, err := netip.ParseAddr(str)
+				if err != nil {
+					return nil, fmt.Errorf("invalid IP address or prefix %q", a)
+				}
+				prefix = netip.PrefixFrom(addr, addr.BitLen())
+			}
+			prefix = prefix.Masked()
+			family := int32(unix.AF_INET)
+			if prefix.Addr().Is6() {
+				family = unix.AF_INET6
+			}
+			list = append(list, ipAddressPrefix{
+				Family:    family,
+				Address:   prefix.Addr().AsSlice(),
+				PrefixLen: uint32(prefix.Bits()),
+			})
+		}
+	}
+	return list, nil
+}
+
+// addIPPolicy adds the unit properties for the IP policy p, if set.
+func addIPPolicy(props *[]systemdDbus.Property, p *cgroups.IPPolicy) error {
+	if p == nil {
+		return nil
+	}
+	*props = append(*props, newProp("IPAccounting", p.Accounting))
+	for _, l := range []struct {
+		name  string
+		addrs []string
+	}{
+		{"IPAddressAllow", p.AddressAllow},
+		{"IPAddressDeny", p.AddressDeny},
+	} {
+		list, err := parseIPAddressPrefixes(l.addrs)
+		if err != nil {
+			return fmt.Errorf("%s: %w", l.name, err)
+		}
+		// Setting a list property appends to it, unless the
+		// value is empty, so reset it first.
+		reset, _ := listPropertyReset(l.name)
+		*props = append(*props, reset)
+		if len(list) > 0 {
+			*props = append(*props, newProp(l.name, list))
+		}
+	}
+	for _, l := range []struct {
+		name  string
+		paths []string
+	}{
+		{"IPIngressFilterPath", p.IngressFilterPath},
+		{"IPEgressFilterPath", p.EgressFilterPath},
+	} {
+		reset, _ := listPropertyReset(l.name)
+		*props = append(*props, reset)
+		if len(l.paths) > 0 {
+			*props = append(*props, newProp(l.name, l.paths))
+		}
+	}
+	return nil
+}
+
+// wantIPStats reports whether the IP statistics are to be collected for c
+// (which requires the IP accounting to be enabled) with the controllers.
+func wantIPStats(c *cgroups.Cgroup, controllers cgroups.Controller) bool {
+	return controllers&cgroups.IP != 0 && c.Resources != nil && c.IP != nil && c.IP.Accounting
+}
+
+// getIPStats reads the IP statistics from the unit properties, which are
+// all read at once.
+func getIPStats(ctx context.Context, cm *DbusConnManager, unitName string) (cgroups.IPStats, error) {
+	var st cgroups.IPStats
+	props, err := getUnitProperties(ctx, cm, unitName, getUnitType(unitName))
+	if err != nil {
+		return st, err
+	}
+	st.IngressBytes = unitCounter(props["IPIngressBytes"])
+	st.IngressPackets = unitCounter(props["IPIngressPackets"])
+	st.EgressBytes = unitCounter(props["IPEgressBytes"])
+	st.EgressPackets = unitCounter(props["IPEgressPackets"])
+	return st, nil
+}
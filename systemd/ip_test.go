@@ -0,0 +1,71 @@
+package systemd
+
+import (
+	"reflect"
+	"testing"
+
+	systemdDbus "github.com/coreos/go-systemd/v22/dbus"
+	dbus "github.com/godbus/dbus/v5"
+
+	"github.com/opencontainers/cgroups"
+)
+
+func TestParseIPAddressPrefixes(t *testing.T) {
+	list, err := parseIPAddressPrefixes([]string{"10.1.2.3/8", "::1", "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ipAddressPrefix{
+		{Family: 2, Address: []byte{10, 0, 0, 0}, PrefixLen: 8},
+		{Family: 10, Address: append(make([]byte, 15), 1), PrefixLen: 128},
+		{Family: 2, Address: []byte{127, 0, 0, 0}, PrefixLen: 8},
+		{Family: 10, Address: append(make([]byte, 15), 1), PrefixLen: 128},
+	}
+	if !reflect.DeepEqual(list, expected) {
+		t.Errorf("expected %v, got %v", expected, list)
+	}
+
+	if _, err := parseIPAddressPrefixes([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("expected an error for an invalid prefix")
+	}
+}
+
+func TestAddIPPolicy(t *testing.T) {
+	var props []systemdDbus.Property
+	err := addIPPolicy(&props, &cgroups.IPPolicy{
+		Accounting:       true,
+		AddressDeny:      []string{"any"},
+		EgressFilterPath: []string{"/sys/fs/bpf/egress"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, p := range props {
+		names = append(names, p.Name)
+	}
+	// The lists are reset before being set.
+	expected := []string{
+		"IPAccounting",
+		"IPAddressAllow",
+		"IPAddressDeny", "IPAddressDeny",
+		"IPIngressFilterPath",
+		"IPEgressFilterPath", "IPEgressFilterPath",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected properties %v, got %v", expected, names)
+	}
+
+	// The current value, as received from D-Bus, matches the set one.
+	values := propertyValues(props)
+	cur := dbus.MakeVariant([][]any{
+		{int32(2), []byte{0, 0, 0, 0}, uint32(0)},
+		{int32(10), make([]byte, 16), uint32(0)},
+	})
+	if d, drift := propertyDrift("IPAddressDeny", values["IPAddressDeny"], cur); drift {
+		t.Errorf("unexpected drift: %+v", d)
+	}
+	if d, drift := propertyDrift("IPAddressAllow", values["IPAddressAllow"], dbus.MakeVariant([][]any{})); drift {
+		t.Errorf("unexpected drift: %+v", d)
+	}
+}
@@ -0,0 +1,143 @@
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	systemdDbus "github.com/coreos/go-systemd/v22/dbus"
+	"github.com/sirupsen/logrus"
+
+	"github.com/opencontainers/cgroups"
+)
+
+const (
+	managedOOMSupportedVersion = 247
+	// ManagedOOMMemoryPressureLimit (which replaced the percent one) and
+	// ManagedOOMPreference are supported since systemd v248.
+	managedOOMLimitSupportedVersion = 248
+)
+
+// managedOOMProperties returns the unit properties for the systemd-oomd
+// settings o, checking them, and the systemd version.
+func managedOOMProperties(cm *DbusConnManager, o *cgroups.ManagedOOM) ([]systemdDbus.Property, error) {
+	if o == nil {
+		return nil, nil
+	}
+	var props []systemdDbus.Property
+	// need checks that systemd supports the property name, since
+	// minVer.
+	need := func(name string, minVer int) error {
+		if sdVer := systemdVersion(cm); sdVer < minVer {
+			return fmt.Errorf("systemd v%d is too old to support %s, v%d is required", sdVer, name, minVer)
+		}
+		return nil
+	}
+
+	for _, mode := range []struct {
+		name string
+		mode cgroups.ManagedOOMMode
+	}{
+		{"ManagedOOMSwap", o.Swap},
+		{"ManagedOOMMemoryPressure", o.MemoryPressure},
+	} {
+		switch mode.mode {
+		case "":
+			continue
+		case cgroups.ManagedOOMAuto, cgroups.ManagedOOMKill:
+		default:
+			return nil, fmt.Errorf("invalid %s value: %q", mode.name, mode.mode)
+		}
+		if err := need(mode.name, managedOOMSupportedVersion); err != nil {
+			return nil, err
+		}
+		props = append(props, newProp(mode.name, string(mode.mode)))
+	}
+
+	if limit := o.MemoryPressureLimit; limit != 0 {
+		if math.IsNaN(limit) || limit < 0 || limit > 1 {
+			return nil, fmt.Errorf("invalid ManagedOOMMemoryPressureLimit value: %v (must be between 0 and 1)", limit)
+		}
+		if err := need("ManagedOOMMemoryPressureLimit", managedOOMLimitSupportedVersion); err != nil {
+			return nil, err
+		}
+		// systemd scales the limit to the uint32 range.
+		props = append(props,
+			newProp("ManagedOOMMemoryPressureLimit", uint32(math.Round(limit*math.MaxUint32))))
+	}
+
+	switch o.Preference {
+	case "":
+	case cgroups.ManagedOOMPreferenceNone, cgroups.ManagedOOMPreferenceAvoid, cgroups.ManagedOOMPreferenceOmit:
+		if err := need("ManagedOOMPreference", managedOOMLimitSupportedVersion); err != nil {
+			return nil, err
+		}
+		props = append(props, newProp("ManagedOOMPreference", string(o.Preference)))
+	default:
+		return nil, fmt.Errorf("invalid ManagedOOMPreference value: %q", o.Preference)
+	}
+
+	return props, nil
+}
+
+// getManagedOOM returns the systemd-oomd settings of the unit unitName, as
+// currently set in systemd. The ones not supported by systemd are not set.
+func getManagedOOM(ctx context.Context, cm *DbusConnManager, unitName string) (*cgroups.ManagedOOM, error) {
+	props, err := getUnitProperties(ctx, cm, unitName, getUnitType(unitName))
+	if err != nil {
+		return nil, err
+	}
+	o := &cgroups.ManagedOOM{}
+	if v, ok := props["ManagedOOMSwap"].(string); ok {
+		o.Swap = cgroups.ManagedOOMMode(v)
+	}
+	if v, ok := props["ManagedOOMMemoryPressure"].(string); ok {
+		o.MemoryPressure = cgroups.ManagedOOMMode(v)
+	}
+	if v, ok := props["ManagedOOMMemoryPressureLimit"].(uint32); ok {
+		// Round to the precision systemd uses.
+		o.MemoryPressureLimit = math.Round(float64(v)/math.MaxUint32*10000) / 10000
+	}
+	if v, ok := props["ManagedOOMPreference"].(string); ok {
+		o.Preference = cgroups.ManagedOOMPreference(v)
+	}
+	return o, nil
+}
+
+// setParentManagedOOM sets the systemd-oomd settings props of the parent
+// slice of the unit of c (see [cgroups.Cgroup.ParentManagedOOM]), once the
+// unit is started. If that fails, the unit is stopped, unless it existed
+// before, so that Apply does not leave it running.
+func setParentManagedOOM(ctx context.Context, cm *DbusConnManager, c *cgroups.Cgroup, props []systemdDbus.Property, existed bool, timeout time.Duration) error {
+	if len(props) == 0 {
+		return nil
+	}
+	slice := parentSlice(c)
+	err := setUnitProperties(ctx, cm, slice, props...)
+	if err == nil {
+		return nil
+	}
+	err = fmt.Errorf("unable to set systemd-oomd settings of %s: %w", slice, err)
+	if !existed {
+		unitName := getUnitName(c)
+		if stopErr := stopUnit(context.WithoutCancel(ctx), cm, unitName, timeout); stopErr != nil {
+			logrus.Warnf("unable to stop unit %s: %v", unitName, stopErr)
+		}
+	}
+	return err
+}
+
+// managedOOM returns the systemd-oomd settings of the unit of c and of its
+// parent slice (see [UnifiedManager.ManagedOOM]).
+func managedOOM(ctx context.Context, cm *DbusConnManager, c *cgroups.Cgroup) (unit, parent *cgroups.ManagedOOM, err error) {
+	unit, err = getManagedOOM(ctx, cm, getUnitName(c))
+	if err != nil {
+		return nil, nil, err
+	}
+	parent, err = getManagedOOM(ctx, cm, parentSlice(c))
+	if err != nil {
+		return nil, nil, err
+	}
+	return unit, parent, nil
+}
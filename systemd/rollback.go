@@ -0,0 +1,112 @@
+package systemd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	systemdDbus "github.com/coreos/go-systemd/v22/dbus"
+	dbus "github.com/godbus/dbus/v5"
+	"github.com/sirupsen/logrus"
+
+	"github.com/opencontainers/cgroups"
+)
+
+// saveUnitProperties returns the current values of the unit properties
+// that are about to be changed to props, so they can be restored later
+// by restoreUnitProperties. They are all read at once, and the ones that
+// can not be read are skipped. It fails if the unit properties can not be
+// read at all (for example, as ctx is done), in which case nothing is to
+// be changed.
+func saveUnitProperties(ctx context.Context, cm *DbusConnManager, unitName string, props []systemdDbus.Property) ([]systemdDbus.Property, error) {
+	current, err := getUnitProperties(ctx, cm, unitName, getUnitType(unitName))
+	if err != nil {
+		return nil, fmt.Errorf("unable to save unit %s properties for rollback: %w", unitName, err)
+	}
+	seen := make(map[string]struct{}, len(props))
+	saved := make([]systemdDbus.Property, 0, len(props))
+	for _, p := range props {
+		if _, ok := seen[p.Name]; ok {
+			continue
+		}
+		seen[p.Name] = struct{}{}
+		prop, err := savedProperty(p, current)
+		if err != nil {
+			logrus.Debugf("not saving unit %s property %s for rollback: %v", unitName, p.Name, err)
+			continue
+		}
+		if reset, ok := listPropertyReset(p.Name); ok {
+			// Setting a list property appends to the list,
+			// unless it is empty, so reset it first.
+			saved = append(saved, reset)
+		}
+		saved = append(saved, prop)
+	}
+	return saved, nil
+}
+
+// savedProperty returns the property p with its current value, as read
+// from the unit properties current. As the D-Bus structures are read as
+// slices, the value is converted to the Go type of the value of p, so
+// that it has the same D-Bus signature.
+func savedProperty(p systemdDbus.Property, current map[string]any) (systemdDbus.Property, error) {
+	v, ok := current[p.Name]
+	if !ok {
+		return systemdDbus.Property{}, errors.New("no such property")
+	}
+	val := reflect.New(reflect.TypeOf(p.Value.Value()))
+	if err := dbus.Store([]any{v}, val.Interface()); err != nil {
+		return systemdDbus.Property{}, err
+	}
+	return newProp(p.Name, val.Elem().Interface()), nil
+}
+
+// deviceAllowEntry is a DeviceAllow list element.
+type deviceAllowEntry struct {
+	Path  string
+	Perms string
+}
+
+// listPropertyReset returns the property which empties the list property
+// name, or false if name is not a list property (i.e. the one that is
+// appended to when it is set to a non-empty value).
+func listPropertyReset(name string) (systemdDbus.Property, bool) {
+	switch name {
+	case "DeviceAllow":
+		return newProp(name, []deviceAllowEntry{}), true
+	case "IPAddressAllow", "IPAddressDeny":
+		return newProp(name, []ipAddressPrefix{}), true
+	case "IPIngressFilterPath", "IPEgressFilterPath":
+		return newProp(name, []string{}), true
+	}
+	return systemdDbus.Property{}, false
+}
+
+// restoreUnitProperties sets the unit properties previously saved by
+// saveUnitProperties.
+func restoreUnitProperties(ctx context.Context, cm *DbusConnManager, unitName string, saved []systemdDbus.Property) error {
+	if len(saved) == 0 {
+		return nil
+	}
+	if err := setUnitProperties(ctx, cm, unitName, saved...); err != nil {
+		return fmt.Errorf("unable to restore unit properties: %w", err)
+	}
+	return nil
+}
+
+// setFailed returns a [cgroups.SetError] for the failed step, after
+// restoring the saved unit properties. If err is already a SetError
+// (returned by a cgroupfs manager), the rollback error is added to it.
+//
+// The properties are restored even if ctx is cancelled (which may well
+// be the reason of the failure).
+func setFailed(ctx context.Context, cm *DbusConnManager, unitName, step string, err error, saved []systemdDbus.Property) error {
+	rbErr := restoreUnitProperties(context.WithoutCancel(ctx), cm, unitName, saved)
+	var setErr *cgroups.SetError
+	if errors.As(err, &setErr) {
+		setErr.RollbackErr = errors.Join(setErr.RollbackErr, rbErr)
+		return setErr
+	}
+	return &cgroups.SetError{Step: step, Err: err, RollbackErr: rbErr}
+}
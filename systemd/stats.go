@@ -0,0 +1,84 @@
+package systemd
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math"
+
+	systemdDbus "github.com/coreos/go-systemd/v22/dbus"
+
+	"github.com/opencontainers/cgroups"
+)
+
+// getUnitStats reads the statistics of the cgroup c from the properties of
+// its unit, and of the slice it is in (see parentSlice).
+func getUnitStats(ctx context.Context, cm *DbusConnManager, c *cgroups.Cgroup) (cgroups.UnitStats, error) {
+	st := cgroups.UnitStats{Unit: getUnitName(c)}
+
+	unitProps, err := getUnitProperties(ctx, cm, st.Unit, "")
+	if err != nil {
+		return st, err
+	}
+	if id, ok := unitProps["InvocationID"].([]byte); ok {
+		st.InvocationID = hex.EncodeToString(id)
+	}
+	if ts, ok := unitProps["ActiveEnterTimestamp"].(uint64); ok {
+		st.ActiveEnterTimestamp = ts
+	}
+
+	props, err := getUnitProperties(ctx, cm, st.Unit, getUnitType(st.Unit))
+	if err != nil {
+		return st, err
+	}
+	for name, val := range map[string]*uint64{
+		"MemoryCurrent":  &st.MemoryCurrent,
+		"CPUUsageNSec":   &st.CPUUsageNSec,
+		"TasksCurrent":   &st.TasksCurrent,
+		"IOReadBytes":    &st.IOReadBytes,
+		"IOWriteBytes":   &st.IOWriteBytes,
+		"IPIngressBytes": &st.IPIngressBytes,
+		"IPEgressBytes":  &st.IPEgressBytes,
+	} {
+		*val = unitCounter(props[name])
+	}
+
+	slice := parentSlice(c)
+	sliceProps, err := getUnitProperties(ctx, cm, slice, "Slice")
+	if err != nil {
+		return st, err
+	}
+	st.SliceMemoryCurrent = unitCounter(sliceProps["MemoryCurrent"])
+
+	return st, nil
+}
+
+// getUnitProperties returns the properties of the unit unitName of the
+// unitType interface, or of the Unit one, if unitType is empty.
+func getUnitProperties(ctx context.Context, cm *DbusConnManager, unitName, unitType string) (map[string]any, error) {
+	var props map[string]any
+	err := cm.retryOnDisconnect(ctx, func(c *systemdDbus.Conn) (err error) {
+		if unitType == "" {
+			props, err = c.GetUnitPropertiesContext(ctx, unitName)
+		} else {
+			props, err = c.GetUnitTypePropertiesContext(ctx, unitName, unitType)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get unit %s properties: %w", unitName, err)
+	}
+	return props, nil
+}
+
+// unitCounter returns the value of a unit accounting property, or 0 if it
+// is not available.
+func unitCounter(v any) uint64 {
+	n, ok := v.(uint64)
+	// UINT64_MAX means the value is not available
+	// (for example, the accounting is not enabled).
+	if !ok || n == math.MaxUint64 {
+		return 0
+	}
+	return n
+}
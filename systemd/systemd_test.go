@@ -1,14 +1,17 @@
 package systemd
 
 import (
+	"math"
 	"os"
 	"os/exec"
 	"reflect"
+	"slices"
 	"strconv"
 	"testing"
 
 	systemdDbus "github.com/coreos/go-systemd/v22/dbus"
 	"github.com/opencontainers/cgroups"
+	"github.com/opencontainers/cgroups/systemd/systemdtest"
 )
 
 func newManager(t *testing.T, config *cgroups.Cgroup) (m cgroups.Manager) {
@@ -75,6 +78,23 @@ func TestValidUnitTypes(t *testing.T) {
 	}
 }
 
+func TestParentSlice(t *testing.T) {
+	for _, tc := range []struct {
+		cg     cgroups.Cgroup
+		parent string
+	}{
+		{cgroups.Cgroup{ScopePrefix: "runc", Name: "ctr"}, "system.slice"},
+		{cgroups.Cgroup{ScopePrefix: "runc", Name: "ctr", Parent: "a-b.slice"}, "a-b.slice"},
+		{cgroups.Cgroup{Name: "a.slice"}, "-.slice"},
+		{cgroups.Cgroup{Name: "a-b.slice", Parent: "system.slice"}, "a.slice"},
+		{cgroups.Cgroup{Name: "a-b-c.slice"}, "a-b.slice"},
+	} {
+		if got := parentSlice(&tc.cg); got != tc.parent {
+			t.Errorf("parentSlice(%+v): expected %q, got %q", tc.cg, tc.parent, got)
+		}
+	}
+}
+
 func TestUnitExistsIgnored(t *testing.T) {
 	if !IsRunningSystemd() {
 		t.Skip("Test requires systemd.")
@@ -107,7 +127,7 @@ func TestUnifiedResToSystemdProps(t *testing.T) {
 		t.Skip("cgroup v2 is required")
 	}
 
-	cm := newDbusConnManager(os.Geteuid() != 0)
+	cm := defaultDbusConnManager(os.Geteuid() != 0)
 
 	testCases := []struct {
 		name     string
@@ -172,7 +192,219 @@ func TestUnifiedResToSystemdProps(t *testing.T) {
 			if tc.minVer != 0 && systemdVersion(cm) < tc.minVer {
 				t.Skipf("requires systemd >= %d", tc.minVer)
 			}
-			props, err := unifiedResToSystemdProps(cm, tc.res)
+			props, _, err := unifiedResToSystemdProps(cm, tc.res)
+			if err != nil && !tc.expError {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			if err == nil && tc.expError {
+				t.Fatal("expected error, got nil")
+			}
+			if !reflect.DeepEqual(tc.expProps, props) {
+				t.Errorf("wrong properties (exp %+v, got %+v)", tc.expProps, props)
+			}
+		})
+	}
+}
+
+func TestUnifiedResToSystemdPropsVersions(t *testing.T) {
+	// The fake systemd connection managers, by systemd version.
+	cms := make(map[int]*DbusConnManager)
+	fakeSystemd := func(version int) *DbusConnManager {
+		if cms[version] == nil {
+			srv, err := systemdtest.NewServer(systemdtest.Config{CgroupRoot: t.TempDir(), Version: version})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { _ = srv.Close() })
+			cms[version] = NewDbusConnManager(srv.Dial)
+		}
+		return cms[version]
+	}
+
+	dev := func(path string, value uint64) []ioDeviceValue {
+		return []ioDeviceValue{{Path: path, Value: value}}
+	}
+
+	testCases := []struct {
+		name            string
+		version         int
+		res             map[string]string
+		expError        bool
+		expProps        []systemdDbus.Property
+		expUntranslated []string
+	}{
+		{
+			name: "io.weight",
+			res: map[string]string{
+				"io.weight": "default 200\n8:16 300",
+			},
+			expProps: []systemdDbus.Property{
+				newProp("IOWeight", uint64(200)),
+				newProp("IODeviceWeight", dev("/dev/block/8:16", 300)),
+			},
+		},
+		{
+			name: "io.weight without default",
+			res: map[string]string{
+				"io.weight": "50",
+			},
+			expProps: []systemdDbus.Property{
+				newProp("IOWeight", uint64(50)),
+			},
+		},
+		{
+			name: "io.weight device reset",
+			res: map[string]string{
+				"io.weight": "8:16 default",
+			},
+			expUntranslated: []string{"io.weight"},
+		},
+		{
+			name:    "io.weight too old systemd",
+			version: 229,
+			res: map[string]string{
+				"io.weight": "50",
+			},
+			expUntranslated: []string{"io.weight"},
+		},
+		{
+			name: "io.bfq.weight",
+			res: map[string]string{
+				"io.bfq.weight": "200",
+			},
+			expProps: []systemdDbus.Property{
+				newProp("IOWeight", uint64(1200)),
+			},
+		},
+		{
+			name:    "io.bfq.weight too old systemd",
+			version: 242,
+			res: map[string]string{
+				"io.bfq.weight": "200",
+			},
+			expUntranslated: []string{"io.bfq.weight"},
+		},
+		{
+			name: "io.bfq.weight and io.weight",
+			res: map[string]string{
+				"io.bfq.weight": "200",
+				"io.weight":     "300",
+			},
+			expProps: []systemdDbus.Property{
+				newProp("IOWeight", uint64(300)),
+			},
+			expUntranslated: []string{"io.bfq.weight"},
+		},
+		{
+			name: "io.max",
+			res: map[string]string{
+				"io.max": "8:16 rbps=1048576 wiops=max",
+			},
+			expProps: []systemdDbus.Property{
+				newProp("IOReadBandwidthMax", dev("/dev/block/8:16", 1048576)),
+				newProp("IOWriteIOPSMax", dev("/dev/block/8:16", math.MaxUint64)),
+			},
+		},
+		{
+			name: "io.max invalid key",
+			res: map[string]string{
+				"io.max": "8:16 bps=1",
+			},
+			expError: true,
+		},
+		{
+			name: "io.latency",
+			res: map[string]string{
+				"io.latency": "8:16 target=75",
+			},
+			expProps: []systemdDbus.Property{
+				newProp("IODeviceLatencyTargetUSec", dev("/dev/block/8:16", 75)),
+			},
+		},
+		{
+			name:    "io.latency too old systemd",
+			version: 239,
+			res: map[string]string{
+				"io.latency": "8:16 target=75",
+			},
+			expUntranslated: []string{"io.latency"},
+		},
+		{
+			name: "memory.zswap.max",
+			res: map[string]string{
+				"memory.zswap.max": "max",
+			},
+			expProps: []systemdDbus.Property{
+				newProp("MemoryZSwapMax", uint64(math.MaxUint64)),
+			},
+		},
+		{
+			name:    "memory.zswap.max too old systemd",
+			version: memoryZSwapSupportedVersion - 1,
+			res: map[string]string{
+				"memory.zswap.max": "0",
+			},
+			expUntranslated: []string{"memory.zswap.max"},
+		},
+		{
+			name:    "memory.oom.group too old systemd",
+			version: oomPolicySupportedVersion - 1,
+			res: map[string]string{
+				"memory.oom.group": "1",
+			},
+			expUntranslated: []string{"memory.oom.group"},
+		},
+		{
+			name: "memory.oom.group only set by Apply",
+			res: map[string]string{
+				"memory.oom.group": "1",
+			},
+			expUntranslated: []string{"memory.oom.group"},
+		},
+		{
+			name: "cpu.weight.nice",
+			res: map[string]string{
+				"cpu.weight.nice": "-20",
+			},
+			expProps: []systemdDbus.Property{
+				newProp("CPUWeight", uint64(8668)),
+			},
+		},
+		{
+			name: "cpu.weight.nice out of range",
+			res: map[string]string{
+				"cpu.weight.nice": "20",
+			},
+			expError: true,
+		},
+		{
+			name: "cpu.weight.nice and cpu.weight",
+			res: map[string]string{
+				"cpu.weight.nice": "19",
+				"cpu.weight":      "1000",
+			},
+			expProps: []systemdDbus.Property{
+				newProp("CPUWeight", uint64(1000)),
+			},
+			expUntranslated: []string{"cpu.weight.nice"},
+		},
+		{
+			name: "untranslated keys",
+			res: map[string]string{
+				"cpuset.cpus.partition": "root",
+				"hugetlb.2MB.max":       "0",
+			},
+			expUntranslated: []string{"cpuset.cpus.partition", "hugetlb.2MB.max"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			version := tc.version
+			if version == 0 {
+				version = systemdtest.DefaultVersion
+			}
+			props, untranslated, err := unifiedResToSystemdProps(fakeSystemd(version), tc.res)
 			if err != nil && !tc.expError {
 				t.Fatalf("expected no error, got: %v", err)
 			}
@@ -182,16 +414,46 @@ func TestUnifiedResToSystemdProps(t *testing.T) {
 			if !reflect.DeepEqual(tc.expProps, props) {
 				t.Errorf("wrong properties (exp %+v, got %+v)", tc.expProps, props)
 			}
+			if !reflect.DeepEqual(tc.expUntranslated, untranslated) {
+				t.Errorf("wrong untranslated keys (exp %v, got %v)", tc.expUntranslated, untranslated)
+			}
 		})
 	}
 }
 
+func TestUntranslatedUnifiedKeysOOMGroup(t *testing.T) {
+	srv, err := systemdtest.NewServer(systemdtest.Config{CgroupRoot: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	config := &cgroups.Cgroup{
+		Name:        "fake",
+		ScopePrefix: "test",
+		Resources:   &cgroups.Resources{Unified: map[string]string{"memory.oom.group": "1"}},
+	}
+	m, err := NewUnifiedManagerWithDbus(config, t.TempDir(), NewDbusConnManager(srv.Dial))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the value set by Apply is translated.
+	for v, exp := range map[string][]string{"1": nil, "0": {"memory.oom.group"}} {
+		untranslated, err := m.UntranslatedUnifiedKeys(map[string]string{"memory.oom.group": v})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(exp, untranslated) {
+			t.Errorf("memory.oom.group=%s: expected untranslated keys %v, got %v", v, exp, untranslated)
+		}
+	}
+}
+
 func TestAddCPUQuota(t *testing.T) {
 	if !IsRunningSystemd() {
 		t.Skip("Test requires systemd.")
 	}
 
-	cm := newDbusConnManager(os.Geteuid() != 0)
+	cm := defaultDbusConnManager(os.Geteuid() != 0)
 
 	testCases := []struct {
 		name                       string
@@ -292,7 +554,7 @@ func TestOOMPolicyApply(t *testing.T) {
 		t.Skip("Test requires root.")
 	}
 
-	cm := newDbusConnManager(false)
+	cm := defaultDbusConnManager(false)
 	if systemdVersion(cm) < oomPolicySupportedVersion {
 		t.Skipf("Test requires systemd >= %d (OOMPolicy on scopes)", oomPolicySupportedVersion)
 	}
@@ -0,0 +1,308 @@
+// Package systemdtest provides a fake systemd, serving a minimal subset of
+// the org.freedesktop.systemd1 D-Bus API on a private socket, for testing
+// the systemd cgroup managers without systemd.
+//
+// The fake systemd keeps track of the transient units started through it,
+// creating and removing their cgroup directories under a (fake or real)
+// cgroupfs root, and moving processes into them. The unit properties are
+// only stored, not translated into cgroup settings.
+package systemdtest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	systemdDbus "github.com/coreos/go-systemd/v22/dbus"
+	dbus "github.com/godbus/dbus/v5"
+)
+
+// DefaultVersion is the systemd version reported by default.
+const DefaultVersion = 257
+
+// Config is the configuration of a fake systemd.
+type Config struct {
+	// CgroupRoot is the directory the unit cgroups are created in, such
+	// as a temporary directory, or a cgroup created for the test.
+	CgroupRoot string
+	// Hierarchies are the names of the cgroup v1 hierarchies, which are
+	// the subdirectories of CgroupRoot the unit cgroups are created in
+	// (for example, "memory" and "pids"). If empty, the unit cgroups are
+	// created in CgroupRoot itself, as on cgroup v2.
+	Hierarchies []string
+	// Version is the systemd version reported. If 0, DefaultVersion is
+	// used.
+	Version int
+}
+
+// Server is a fake systemd, listening on a private D-Bus socket.
+type Server struct {
+	config  Config
+	dir     string
+	address string
+	ln      net.Listener
+	guid    string
+	wg      sync.WaitGroup
+
+	mu sync.Mutex
+	// conns are the client connections, and whether they have asked
+	// for the signals (using AddMatch or Subscribe).
+	conns  map[*dbus.Conn]bool
+	units  map[string]*unit
+	lastID uint32
+	closed bool
+	// holdJobs is set by HoldJobs, and heldJobs complete the jobs
+	// held meanwhile.
+	holdJobs bool
+	heldJobs []func()
+}
+
+// NewServer starts a fake systemd with the given configuration. The caller
+// must call Close when done with it.
+func NewServer(config Config) (*Server, error) {
+	if config.CgroupRoot == "" {
+		return nil, errors.New("systemdtest: CgroupRoot is not set")
+	}
+	if config.Version == 0 {
+		config.Version = DefaultVersion
+	}
+	guid := make([]byte, 16)
+	if _, err := rand.Read(guid); err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp("", "systemdtest-")
+	if err != nil {
+		return nil, err
+	}
+	sock := filepath.Join(dir, "private")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+	s := &Server{
+		config:  config,
+		dir:     dir,
+		address: "unix:path=" + sock,
+		ln:      ln,
+		guid:    hex.EncodeToString(guid),
+		conns:   make(map[*dbus.Conn]bool),
+		units:   make(map[string]*unit),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Address returns the D-Bus address of the fake systemd.
+func (s *Server) Address() string {
+	return s.address
+}
+
+// Dial connects to the fake systemd. It can be used as a dial function of
+// a systemd D-Bus connection manager.
+func (s *Server) Dial(ctx context.Context) (*systemdDbus.Conn, error) {
+	return systemdDbus.NewConnection(func() (*dbus.Conn, error) {
+		conn, err := dbus.Dial(s.address, dbus.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		// As with the private systemd socket, there is no Hello.
+		methods := []dbus.Auth{dbus.AuthExternal(strconv.Itoa(os.Getuid()))}
+		if err := conn.Auth(methods); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	})
+}
+
+// Disconnect closes all the connections to the fake systemd, as happens
+// when systemd is restarted or reexecuted. The units are kept.
+func (s *Server) Disconnect() {
+	s.mu.Lock()
+	conns := s.conns
+	s.conns = make(map[*dbus.Conn]bool)
+	s.mu.Unlock()
+	for conn := range conns {
+		conn.Close()
+	}
+}
+
+// Close stops the fake systemd, closing all the connections to it. The
+// cgroups of the units still running are left in place.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	err := s.ln.Close()
+	s.Disconnect()
+	s.wg.Wait()
+	_ = os.RemoveAll(s.dir)
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if err := s.accept(c); err != nil {
+				c.Close()
+			}
+		}()
+	}
+}
+
+// accept authenticates a new client connection, and starts serving the
+// systemd API on it.
+func (s *Server) accept(c net.Conn) error {
+	_ = c.SetDeadline(time.Now().Add(10 * time.Second))
+	rd, err := serverAuth(c, s.guid)
+	if err != nil {
+		return err
+	}
+	_ = c.SetDeadline(time.Time{})
+
+	conn, err := dbus.NewConn(&serverTransport{
+		Reader:    rd,
+		conn:      c,
+		handshake: bytes.NewReader([]byte("REJECTED EXTERNAL\r\nOK " + s.guid + "\r\n")),
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.export(conn); err != nil {
+		conn.Close()
+		return err
+	}
+	// See serverTransport.
+	if err := conn.Auth([]dbus.Auth{dbus.AuthExternal("0")}); err != nil {
+		conn.Close()
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		conn.Close()
+		return nil
+	}
+	if _, ok := s.conns[conn]; !ok {
+		s.conns[conn] = false
+	}
+	return nil
+}
+
+// serverAuth performs the server side of the D-Bus authentication on the
+// connection c, accepting any client using the EXTERNAL mechanism. It
+// returns the reader to read the messages from c with.
+func serverAuth(c net.Conn, guid string) (io.Reader, error) {
+	rd := bufio.NewReader(c)
+	if b, err := rd.ReadByte(); err != nil || b != 0 {
+		return nil, errors.New("systemdtest: no null byte")
+	}
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		fields := bytes.Fields([]byte(line))
+		if len(fields) == 0 {
+			return nil, errors.New("systemdtest: authentication protocol error")
+		}
+		var reply string
+		switch string(fields[0]) {
+		case "AUTH":
+			if len(fields) > 1 && string(fields[1]) == "EXTERNAL" {
+				reply = "OK " + guid
+			} else {
+				reply = "REJECTED EXTERNAL"
+			}
+		case "BEGIN":
+			return rd, nil
+		default:
+			// Including NEGOTIATE_UNIX_FD, as fds are not passed.
+			reply = "ERROR"
+		}
+		if _, err := c.Write([]byte(reply + "\r\n")); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// serverTransport is the transport of a server-side *dbus.Conn. As godbus
+// only implements the client side of the authentication, the client side
+// is run on the server-side connection too, in order to start it, with its
+// handshake answered locally, rather than sent to the client (which is
+// authenticated by serverAuth).
+type serverTransport struct {
+	io.Reader
+	conn      net.Conn
+	handshake *bytes.Reader
+	begun     bool
+}
+
+func (t *serverTransport) Read(p []byte) (int, error) {
+	if t.handshake.Len() > 0 {
+		return t.handshake.Read(p)
+	}
+	return t.Reader.Read(p)
+}
+
+func (t *serverTransport) Write(p []byte) (int, error) {
+	if !t.begun {
+		t.begun = bytes.Equal(p, []byte("BEGIN\r\n"))
+		return len(p), nil
+	}
+	return t.conn.Write(p)
+}
+
+func (t *serverTransport) Close() error {
+	return t.conn.Close()
+}
+
+// subscribe makes conn receive the signals.
+func (s *Server) subscribe(conn *dbus.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.conns[conn] = true
+	}
+}
+
+// emit sends a signal to all the clients which asked for the signals,
+// forgetting the ones which are gone.
+func (s *Server) emit(path dbus.ObjectPath, name string, values ...any) {
+	s.mu.Lock()
+	conns := make([]*dbus.Conn, 0, len(s.conns))
+	for conn, subscribed := range s.conns {
+		if subscribed {
+			conns = append(conns, conn)
+		}
+	}
+	s.mu.Unlock()
+	for _, conn := range conns {
+		if err := conn.Emit(path, name, values...); err != nil {
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+			conn.Close()
+		}
+	}
+}
@@ -0,0 +1,567 @@
+package systemdtest
+
+import (
+	"crypto/rand"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	systemdDbus "github.com/coreos/go-systemd/v22/dbus"
+	dbus "github.com/godbus/dbus/v5"
+
+	"github.com/opencontainers/cgroups"
+)
+
+const (
+	managerPath  = dbus.ObjectPath("/org/freedesktop/systemd1")
+	unitPrefix   = "/org/freedesktop/systemd1/unit/"
+	jobPrefix    = "/org/freedesktop/systemd1/job/"
+	managerIface = "org.freedesktop.systemd1.Manager"
+	unitIface    = "org.freedesktop.systemd1.Unit"
+)
+
+// Unit is the state of a unit of the fake systemd.
+type Unit struct {
+	// Name is the name of the unit, such as "test.scope".
+	Name string
+	// ActiveState is either "active" or "failed".
+	ActiveState string
+	// Result is the result of the unit, such as "success", or the reason
+	// it has failed.
+	Result string
+	// ControlGroup is the cgroup of the unit, relative to the cgroupfs
+	// root (or the cgroup v1 hierarchy), such as "/system.slice/test.scope".
+	ControlGroup string
+	// Properties are the properties set when the unit was started, or
+	// later by SetUnitProperties.
+	Properties map[string]dbus.Variant
+	// InvocationID is the random ID of this run of the unit.
+	InvocationID []byte
+	// ActiveEnterTimestamp is the time the unit was started.
+	ActiveEnterTimestamp time.Time
+}
+
+type unit struct {
+	Unit
+	typ string
+}
+
+// Unit returns the state of the unit name, and whether it exists.
+func (s *Server) Unit(name string) (Unit, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.units[name]
+	if !ok {
+		return Unit{}, false
+	}
+	st := u.Unit
+	st.Properties = maps.Clone(u.Properties)
+	st.InvocationID = slices.Clone(u.InvocationID)
+	return st, true
+}
+
+// Units returns the names of the existing units, sorted.
+func (s *Server) Units() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Sorted(maps.Keys(s.units))
+}
+
+// Fail puts the existing unit name into the failed state, with the result
+// (such as "oom-kill"), in which it is kept until it is reset using
+// ResetFailedUnit.
+func (s *Server) Fail(name, result string) error {
+	s.mu.Lock()
+	u, ok := s.units[name]
+	if ok {
+		u.ActiveState = "failed"
+		u.Result = result
+	}
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unit %s does not exist", name)
+	}
+	s.stateChanged(name, "failed", "failed")
+	return nil
+}
+
+// Stop stops the existing unit name, as "systemctl stop" does.
+func (s *Server) Stop(name string) error {
+	if _, err := s.stopUnit(name, "replace"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// stateChanged notifies the clients about the new state of the unit name.
+func (s *Server) stateChanged(name, activeState, subState string) {
+	s.emit(unitPath(name), "org.freedesktop.DBus.Properties.PropertiesChanged", unitIface, map[string]dbus.Variant{
+		"ActiveState": dbus.MakeVariant(activeState),
+		"SubState":    dbus.MakeVariant(subState),
+	}, []string{})
+}
+
+// removed notifies the clients about the unit name being stopped and
+// garbage-collected.
+func (s *Server) removed(name string) {
+	s.stateChanged(name, "inactive", "dead")
+	s.emit(managerPath, managerIface+".UnitRemoved", name, unitPath(name))
+}
+
+func noSuchUnit(name string) *dbus.Error {
+	return dbus.NewError("org.freedesktop.systemd1.NoSuchUnit", []any{"Unit " + name + " not loaded."})
+}
+
+func unknownInterface(iface string) *dbus.Error {
+	err := dbus.MakeUnknownInterfaceError(iface)
+	return &err
+}
+
+func noObject(p dbus.ObjectPath) *dbus.Error {
+	err := dbus.MakeNoObjectError(p)
+	return &err
+}
+
+func invalidArgs(format string, a ...any) *dbus.Error {
+	return dbus.NewError("org.freedesktop.DBus.Error.InvalidArgs", []any{fmt.Sprintf(format, a...)})
+}
+
+func unitPath(name string) dbus.ObjectPath {
+	return dbus.ObjectPath(unitPrefix + systemdDbus.PathBusEscape(name))
+}
+
+// unitName is the reverse of unitPath.
+func unitName(p dbus.ObjectPath) (string, bool) {
+	escaped, ok := strings.CutPrefix(string(p), unitPrefix)
+	if !ok || escaped == "" {
+		return "", false
+	}
+	var name strings.Builder
+	for i := 0; i < len(escaped); i++ {
+		if escaped[i] == '_' && i+2 < len(escaped) {
+			if b, err := strconv.ParseUint(escaped[i+1:i+3], 16, 8); err == nil {
+				name.WriteByte(byte(b))
+				i += 2
+				continue
+			}
+		}
+		name.WriteByte(escaped[i])
+	}
+	return name.String(), true
+}
+
+// unitType returns the D-Bus interface name suffix of the unit type, such
+// as "Scope".
+func unitType(name string) (string, bool) {
+	i := strings.LastIndexByte(name, '.')
+	if i <= 0 {
+		return "", false
+	}
+	switch suffix := name[i+1:]; suffix {
+	case "scope", "slice", "service":
+		return strings.ToUpper(suffix[:1]) + suffix[1:], true
+	}
+	return "", false
+}
+
+// sliceCgroup returns the cgroup of the slice, such as "/a.slice/a-b.slice"
+// for "a-b.slice".
+func sliceCgroup(slice string) (string, error) {
+	name, ok := strings.CutSuffix(slice, ".slice")
+	if !ok || name == "" || strings.Contains(name, "/") {
+		return "", fmt.Errorf("invalid slice name %q", slice)
+	}
+	if name == "-" {
+		return "/", nil
+	}
+	cg, prefix := "/", ""
+	for c := range strings.SplitSeq(name, "-") {
+		if c == "" {
+			return "", fmt.Errorf("invalid slice name %q", slice)
+		}
+		cg = path.Join(cg, prefix+c+".slice")
+		prefix += c + "-"
+	}
+	return cg, nil
+}
+
+// unitCgroup returns the cgroup of the unit with the given properties.
+func unitCgroup(name string, props map[string]dbus.Variant) (string, error) {
+	if strings.HasSuffix(name, ".slice") {
+		return sliceCgroup(name)
+	}
+	slice := "system.slice"
+	if v, ok := props["Slice"]; ok {
+		if err := v.Store(&slice); err != nil {
+			return "", fmt.Errorf("invalid Slice: %w", err)
+		}
+	}
+	parent, err := sliceCgroup(slice)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(parent, name), nil
+}
+
+// cgroupDirs returns the directories of the cgroup cg in all hierarchies.
+func (s *Server) cgroupDirs(cg string) []string {
+	if len(s.config.Hierarchies) == 0 {
+		return []string{filepath.Join(s.config.CgroupRoot, cg)}
+	}
+	dirs := make([]string, 0, len(s.config.Hierarchies))
+	for _, h := range s.config.Hierarchies {
+		dirs = append(dirs, filepath.Join(s.config.CgroupRoot, h, cg))
+	}
+	return dirs
+}
+
+// attach moves the processes pids into the cgroup cg.
+func (s *Server) attach(cg string, pids []uint32) error {
+	for _, dir := range s.cgroupDirs(cg) {
+		for _, pid := range pids {
+			// Creating the file allows for a fake cgroupfs.
+			f, err := os.OpenFile(filepath.Join(dir, "cgroup.procs"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+			if err != nil {
+				return err
+			}
+			_, err = f.WriteString(strconv.FormatUint(uint64(pid), 10) + "\n")
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeCgroup removes the directories of the cgroup cg, if possible.
+func (s *Server) removeCgroup(cg string) {
+	if cg == "/" {
+		return
+	}
+	for _, dir := range s.cgroupDirs(cg) {
+		if err := cgroups.RemovePath(dir); err != nil {
+			// A fake cgroupfs contains regular files.
+			_ = os.RemoveAll(dir)
+		}
+	}
+}
+
+// HoldJobs makes the jobs (of starting and stopping units) not complete
+// until HoldJobs is called again with hold set to false, which completes
+// the held ones. The changes to the units are done regardless.
+func (s *Server) HoldJobs(hold bool) {
+	s.mu.Lock()
+	s.holdJobs = hold
+	var held []func()
+	if !hold {
+		held, s.heldJobs = s.heldJobs, nil
+	}
+	s.mu.Unlock()
+
+	for _, done := range held {
+		done()
+	}
+}
+
+// newJob runs a job for the unit name, completing it immediately with the
+// result (unless jobs are held), and returns the path of the job. The
+// JobRemoved signal is sent before the reply, as the clients are ready
+// for that.
+func (s *Server) newJob(name, result string) dbus.ObjectPath {
+	s.mu.Lock()
+	s.lastID++
+	id := s.lastID
+	s.mu.Unlock()
+
+	job := dbus.ObjectPath(jobPrefix + strconv.FormatUint(uint64(id), 10))
+	s.emit(managerPath, managerIface+".JobNew", id, job, name)
+	done := func() {
+		s.emit(managerPath, managerIface+".JobRemoved", id, job, name, result)
+	}
+	s.mu.Lock()
+	if s.holdJobs {
+		s.heldJobs = append(s.heldJobs, done)
+		done = nil
+	}
+	s.mu.Unlock()
+	if done != nil {
+		done()
+	}
+	return job
+}
+
+// export serves the systemd API on the client connection conn.
+func (s *Server) export(conn *dbus.Conn) error {
+	bus := map[string]any{
+		"Hello": func() (string, *dbus.Error) {
+			return ":1.1", nil
+		},
+		"AddMatch": func(string) *dbus.Error {
+			s.subscribe(conn)
+			return nil
+		},
+		"RemoveMatch": func(string) *dbus.Error {
+			return nil
+		},
+	}
+	if err := conn.ExportMethodTable(bus, "/org/freedesktop/DBus", "org.freedesktop.DBus"); err != nil {
+		return err
+	}
+	manager := map[string]any{
+		"StartTransientUnit":    s.startTransientUnit,
+		"StopUnit":              s.stopUnit,
+		"ResetFailedUnit":       s.resetFailedUnit,
+		"SetUnitProperties":     s.setUnitProperties,
+		"AttachProcessesToUnit": s.attachProcessesToUnit,
+		"GetUnit":               s.getUnit,
+		"Subscribe": func() *dbus.Error {
+			s.subscribe(conn)
+			return nil
+		},
+		"Unsubscribe": func() *dbus.Error {
+			return nil
+		},
+	}
+	if err := conn.ExportMethodTable(manager, managerPath, managerIface); err != nil {
+		return err
+	}
+	props := map[string]any{
+		"Get":    s.getProperty,
+		"GetAll": s.getAllProperties,
+	}
+	return conn.ExportSubtreeMethodTable(props, managerPath, "org.freedesktop.DBus.Properties")
+}
+
+func (s *Server) startTransientUnit(name, mode string, properties []systemdDbus.Property, _ []systemdDbus.PropertyCollection) (dbus.ObjectPath, *dbus.Error) {
+	typ, ok := unitType(name)
+	if !ok {
+		return "", invalidArgs("unit type of %s is not supported", name)
+	}
+	props := make(map[string]dbus.Variant, len(properties))
+	for _, p := range properties {
+		props[p.Name] = typedVariant(p.Value)
+	}
+	cg, err := unitCgroup(name, props)
+	if err != nil {
+		return "", invalidArgs("%v", err)
+	}
+
+	s.mu.Lock()
+	if _, ok := s.units[name]; ok {
+		s.mu.Unlock()
+		return "", dbus.NewError("org.freedesktop.systemd1.UnitExists", []any{"Unit " + name + " was already loaded or has a fragment file."})
+	}
+	u := &unit{
+		Unit: Unit{
+			Name:                 name,
+			ActiveState:          "active",
+			Result:               "success",
+			ControlGroup:         cg,
+			Properties:           props,
+			InvocationID:         make([]byte, 16),
+			ActiveEnterTimestamp: time.Now(),
+		},
+		typ: typ,
+	}
+	_, _ = rand.Read(u.InvocationID)
+	s.units[name] = u
+	s.mu.Unlock()
+
+	result := "done"
+	for _, dir := range s.cgroupDirs(cg) {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			result = "failed"
+		}
+	}
+	if v, ok := props["PIDs"]; ok && result == "done" {
+		// The processes are put in the delegated subgroup, if any.
+		pcg := cg
+		if v, ok := props["DelegateSubgroup"]; ok {
+			if sub, _ := v.Value().(string); sub != "" {
+				pcg = path.Join(cg, sub)
+			}
+		}
+		var pids []uint32
+		for _, dir := range s.cgroupDirs(pcg) {
+			if os.MkdirAll(dir, 0o755) != nil {
+				result = "failed"
+			}
+		}
+		if v.Store(&pids) != nil || s.attach(pcg, pids) != nil {
+			result = "failed"
+		}
+	}
+	activeState, subState := "active", "running"
+	if typ == "Slice" {
+		subState = "active"
+	}
+	if result != "done" {
+		s.mu.Lock()
+		u.ActiveState = "failed"
+		u.Result = "resources"
+		s.mu.Unlock()
+		activeState, subState = "failed", "failed"
+	}
+	s.emit(managerPath, managerIface+".UnitNew", name, unitPath(name))
+	s.stateChanged(name, activeState, subState)
+	return s.newJob(name, result), nil
+}
+
+func (s *Server) stopUnit(name, mode string) (dbus.ObjectPath, *dbus.Error) {
+	s.mu.Lock()
+	u, ok := s.units[name]
+	if ok {
+		delete(s.units, name)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return "", noSuchUnit(name)
+	}
+	s.stateChanged(name, "deactivating", "stop-sigterm")
+	s.removeCgroup(u.ControlGroup)
+	job := s.newJob(name, "done")
+	s.removed(name)
+	return job, nil
+}
+
+func (s *Server) resetFailedUnit(name string) *dbus.Error {
+	s.mu.Lock()
+	u, ok := s.units[name]
+	failed := ok && u.ActiveState == "failed"
+	if failed {
+		delete(s.units, name)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return noSuchUnit(name)
+	}
+	if failed {
+		s.removeCgroup(u.ControlGroup)
+		s.removed(name)
+	}
+	return nil
+}
+
+func (s *Server) setUnitProperties(name string, _ bool, properties []systemdDbus.Property) *dbus.Error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.units[name]
+	if !ok {
+		return noSuchUnit(name)
+	}
+	for _, p := range properties {
+		u.Properties[p.Name] = typedVariant(p.Value)
+	}
+	return nil
+}
+
+func (s *Server) attachProcessesToUnit(name, subcgroup string, pids []uint32) *dbus.Error {
+	s.mu.Lock()
+	u, ok := s.units[name]
+	var cg string
+	if ok {
+		cg = u.ControlGroup
+	}
+	s.mu.Unlock()
+	if !ok {
+		return noSuchUnit(name)
+	}
+	if !path.IsAbs(subcgroup) || path.Clean(subcgroup) != subcgroup {
+		return invalidArgs("invalid subcgroup %q", subcgroup)
+	}
+	if err := s.attach(path.Join(cg, subcgroup), pids); err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	return nil
+}
+
+func (s *Server) getUnit(name string) (dbus.ObjectPath, *dbus.Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.units[name]; !ok {
+		return "", noSuchUnit(name)
+	}
+	return unitPath(name), nil
+}
+
+// properties returns the properties of the object p on the interface
+// iface.
+func (s *Server) properties(p dbus.ObjectPath, iface string) (map[string]dbus.Variant, *dbus.Error) {
+	if p == managerPath {
+		if iface != managerIface {
+			return nil, unknownInterface(iface)
+		}
+		return map[string]dbus.Variant{
+			"Version": dbus.MakeVariant(strconv.Itoa(s.config.Version)),
+		}, nil
+	}
+	name, ok := unitName(p)
+	if !ok {
+		return nil, noObject(p)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.units[name]
+	if !ok {
+		// Much like systemd, which loads the unit to find out it does
+		// not exist.
+		if iface != unitIface {
+			return nil, noSuchUnit(name)
+		}
+		return map[string]dbus.Variant{
+			"Id":          dbus.MakeVariant(name),
+			"LoadState":   dbus.MakeVariant("not-found"),
+			"ActiveState": dbus.MakeVariant("inactive"),
+			"SubState":    dbus.MakeVariant("dead"),
+		}, nil
+	}
+	if iface != unitIface && iface != "org.freedesktop.systemd1."+u.typ {
+		return nil, unknownInterface(iface)
+	}
+	// The properties are not sorted by interface, so all of them are
+	// returned for every interface of the unit.
+	props := maps.Clone(u.Properties)
+	subState := "running"
+	if u.typ == "Slice" {
+		subState = "active"
+	} else {
+		props["Result"] = dbus.MakeVariant(u.Result)
+	}
+	if u.ActiveState == "failed" {
+		subState = "failed"
+	}
+	props["Id"] = dbus.MakeVariant(name)
+	props["LoadState"] = dbus.MakeVariant("loaded")
+	props["ActiveState"] = dbus.MakeVariant(u.ActiveState)
+	props["SubState"] = dbus.MakeVariant(subState)
+	props["ControlGroup"] = dbus.MakeVariant(u.ControlGroup)
+	props["InvocationID"] = dbus.MakeVariant(u.InvocationID)
+	props["ActiveEnterTimestamp"] = dbus.MakeVariant(uint64(u.ActiveEnterTimestamp.UnixMicro()))
+	return props, nil
+}
+
+func (s *Server) getProperty(msg dbus.Message, iface, name string) (dbus.Variant, *dbus.Error) {
+	p, _ := msg.Headers[dbus.FieldPath].Value().(dbus.ObjectPath)
+	props, err := s.properties(p, iface)
+	if err != nil {
+		return dbus.Variant{}, err
+	}
+	v, ok := props[name]
+	if !ok {
+		return dbus.Variant{}, dbus.NewError("org.freedesktop.DBus.Error.UnknownProperty", []any{"Unknown property " + name})
+	}
+	return v, nil
+}
+
+func (s *Server) getAllProperties(msg dbus.Message, iface string) (map[string]dbus.Variant, *dbus.Error) {
+	p, _ := msg.Headers[dbus.FieldPath].Value().(dbus.ObjectPath)
+	return s.properties(p, iface)
+}
@@ -0,0 +1,96 @@
+package systemdtest
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+
+	dbus "github.com/godbus/dbus/v5"
+)
+
+// basicTypes are the Go types of the basic D-Bus types, by signature.
+var basicTypes = map[byte]reflect.Type{
+	'y': reflect.TypeFor[byte](),
+	'b': reflect.TypeFor[bool](),
+	'n': reflect.TypeFor[int16](),
+	'q': reflect.TypeFor[uint16](),
+	'i': reflect.TypeFor[int32](),
+	'u': reflect.TypeFor[uint32](),
+	'x': reflect.TypeFor[int64](),
+	't': reflect.TypeFor[uint64](),
+	'd': reflect.TypeFor[float64](),
+	's': reflect.TypeFor[string](),
+	'o': reflect.TypeFor[dbus.ObjectPath](),
+	'g': reflect.TypeFor[dbus.Signature](),
+	'h': reflect.TypeFor[dbus.UnixFDIndex](),
+	'v': reflect.TypeFor[dbus.Variant](),
+}
+
+// sigType returns the Go type of the first complete type of the D-Bus
+// signature sig, and the rest of sig. The D-Bus structures are Go
+// structures, so that they are sent back with the same signature.
+func sigType(sig string) (reflect.Type, string, error) {
+	if sig == "" {
+		return nil, "", fmt.Errorf("incomplete signature")
+	}
+	if t, ok := basicTypes[sig[0]]; ok {
+		return t, sig[1:], nil
+	}
+	switch sig[0] {
+	case 'a':
+		if len(sig) > 1 && sig[1] == '{' {
+			k, rest, err := sigType(sig[2:])
+			if err != nil {
+				return nil, "", err
+			}
+			v, rest, err := sigType(rest)
+			if err != nil {
+				return nil, "", err
+			}
+			if rest == "" || rest[0] != '}' {
+				return nil, "", fmt.Errorf("unterminated dict entry")
+			}
+			return reflect.MapOf(k, v), rest[1:], nil
+		}
+		elem, rest, err := sigType(sig[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		return reflect.SliceOf(elem), rest, nil
+	case '(':
+		var fields []reflect.StructField
+		rest := sig[1:]
+		for rest != "" && rest[0] != ')' {
+			var (
+				t   reflect.Type
+				err error
+			)
+			t, rest, err = sigType(rest)
+			if err != nil {
+				return nil, "", err
+			}
+			fields = append(fields, reflect.StructField{Name: "F" + strconv.Itoa(len(fields)), Type: t})
+		}
+		if rest == "" {
+			return nil, "", fmt.Errorf("unterminated struct")
+		}
+		return reflect.StructOf(fields), rest[1:], nil
+	}
+	return nil, "", fmt.Errorf("unsupported type %q", sig[0])
+}
+
+// typedVariant returns v with its value converted to the Go type of its
+// signature. The D-Bus structures in the variants received are decoded
+// as slices, which would be sent back with a different signature.
+func typedVariant(v dbus.Variant) dbus.Variant {
+	sig := v.Signature().String()
+	t, rest, err := sigType(sig)
+	if err != nil || rest != "" {
+		return v
+	}
+	val := reflect.New(t)
+	if err := dbus.Store([]any{v.Value()}, val.Interface()); err != nil {
+		return v
+	}
+	return dbus.MakeVariantWithSignature(val.Elem().Interface(), v.Signature())
+}
@@ -0,0 +1,178 @@
+package systemd
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// unitNameMax is the maximum length of a unit name.
+const unitNameMax = 255
+
+// unitTypes are the unit types known to systemd, by unit name suffix.
+var unitTypes = []string{
+	"service", "socket", "target", "device", "mount", "automount",
+	"swap", "timer", "path", "slice", "scope",
+}
+
+// validUnitChar reports whether c is allowed in a unit name (besides the
+// '@' of template and instance names).
+func validUnitChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == ':' || c == '-' || c == '_' || c == '.' || c == '\\'
+}
+
+// escapeUnitChars escapes s for use in a unit name: the characters which
+// are not valid in unit names, a leading '.', and those of extra, are
+// escaped as "\xNN", while '/' is replaced by slash (unless it is escaped).
+func escapeUnitChars(s string, slash byte, extra string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '/' && slash != 0:
+			b.WriteByte(slash)
+		case i == 0 && c == '.', c == '\\', !validUnitChar(c), strings.IndexByte(extra, c) >= 0:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// EscapeUnitName escapes s for use in a unit name, the same way as
+// systemd-escape(1) does: '/' becomes '-', and the characters which are
+// not valid in unit names (as well as '-', '\', and a leading '.') become
+// "\xNN". See [UnescapeUnitName] for the reverse.
+func EscapeUnitName(s string) string {
+	return escapeUnitChars(s, '-', "-")
+}
+
+// UnescapeUnitName reverses [EscapeUnitName] (like systemd-escape -u).
+func UnescapeUnitName(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '-':
+			b.WriteByte('/')
+		case '\\':
+			if i+3 >= len(s) || s[i+1] != 'x' {
+				return "", fmt.Errorf("invalid escape sequence in %q", s)
+			}
+			v, err := strconv.ParseUint(s[i+2:i+4], 16, 8)
+			if err != nil {
+				return "", fmt.Errorf("invalid escape sequence in %q", s)
+			}
+			b.WriteByte(byte(v))
+			i += 3
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+// escapeScopeName escapes name (the part of a scope unit name before the
+// suffix) for use in a unit name. Unlike [EscapeUnitName], the characters
+// which are valid in unit names (such as '-') are kept as is, while '/' and
+// '\' are escaped, as well as a leading '.'. It is only used for the names
+// which are not valid as they are, or have a '\' (see getUnitName).
+func escapeScopeName(name string) string {
+	return escapeUnitChars(name, 0, "")
+}
+
+// ValidateUnitName checks that name is a valid systemd unit name, such as
+// "foo.scope", or "foo-bar.slice", using the same rules as systemd.
+func ValidateUnitName(name string) error {
+	if len(name) > unitNameMax {
+		return fmt.Errorf("invalid unit name %q: longer than %d characters", name, unitNameMax)
+	}
+	dot := strings.LastIndexByte(name, '.')
+	if dot <= 0 {
+		return fmt.Errorf("invalid unit name %q: no unit type suffix", name)
+	}
+	prefix, typ := name[:dot], name[dot+1:]
+	if !slices.Contains(unitTypes, typ) {
+		return fmt.Errorf("invalid unit name %q: unknown unit type %q", name, typ)
+	}
+	if at := strings.IndexByte(prefix, '@'); at == 0 || at >= 0 && strings.IndexByte(prefix[at+1:], '@') >= 0 {
+		return fmt.Errorf("invalid unit name %q: invalid instance", name)
+	}
+	for i := 0; i < len(prefix); i++ {
+		if c := prefix[i]; c != '@' && !validUnitChar(c) {
+			return fmt.Errorf("invalid unit name %q: invalid character %q", name, c)
+		}
+	}
+	if typ == "slice" {
+		if strings.IndexByte(prefix, '@') >= 0 {
+			return fmt.Errorf("invalid slice name %q: slices can't be instantiated", name)
+		}
+		if _, err := ExpandSlice(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnitNameToCgroupPath returns the path of the cgroup of the unit unitName
+// relative to the cgroupfs root (or a cgroup v1 hierarchy root), such as
+// "/system.slice/foo.scope". The slice is the parent slice of the unit,
+// which for slices is implied by their name (so it has to be empty, or
+// match that).
+func UnitNameToCgroupPath(unitName, slice string) (string, error) {
+	if err := ValidateUnitName(unitName); err != nil {
+		return "", err
+	}
+	if strings.HasSuffix(unitName, ".slice") {
+		p, err := ExpandSlice(unitName)
+		if err != nil {
+			return "", err
+		}
+		if slice != "" {
+			if parent, err := ExpandSlice(slice); err != nil || parent != path.Dir(p) {
+				return "", fmt.Errorf("slice %s is not the parent of %s", slice, unitName)
+			}
+		}
+		return p, nil
+	}
+	if slice == "" {
+		return "", fmt.Errorf("no parent slice of unit %s", unitName)
+	}
+	parent, err := ExpandSlice(slice)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(parent, unitName), nil
+}
+
+// CgroupPathToUnit is the reverse of [UnitNameToCgroupPath]: it returns the
+// name of the unit of the cgroup path p, and of its parent slice. It fails
+// if p is not the path of a unit cgroup.
+func CgroupPathToUnit(p string) (unitName, slice string, _ error) {
+	p = path.Clean("/" + p)
+	dir, unitName := path.Split(p)
+	if unitName == "" {
+		return "", "", fmt.Errorf("cgroup path %s is not of a unit", p)
+	}
+	if err := ValidateUnitName(unitName); err != nil {
+		return "", "", err
+	}
+	dir = path.Clean(dir)
+	slice = "-.slice"
+	if dir != "/" {
+		slice = path.Base(dir)
+	}
+	// Only the slices are nested (in the slices they are named after).
+	if exp, err := ExpandSlice(slice); err != nil || exp != dir {
+		return "", "", fmt.Errorf("cgroup path %s is not of a unit", p)
+	}
+	if strings.HasSuffix(unitName, ".slice") {
+		if exp, _ := ExpandSlice(unitName); exp != p {
+			return "", "", fmt.Errorf("cgroup path %s is not of a unit", p)
+		}
+	}
+	return unitName, slice, nil
+}
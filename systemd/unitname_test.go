@@ -0,0 +1,196 @@
+package systemd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/cgroups"
+)
+
+func TestEscapeUnitName(t *testing.T) {
+	// The expected values are from systemd-escape(1).
+	testCases := []struct {
+		in, out string
+	}{
+		{"foo", "foo"},
+		{"foo/bar", "foo-bar"},
+		{"/foo/bar/", "-foo-bar-"},
+		{"foo-bar", `foo\x2dbar`},
+		{`foo\bar`, `foo\x5cbar`},
+		{".foo.bar", `\x2efoo.bar`},
+		{"foo bar:baz_1", `foo\x20bar:baz_1`},
+		{"zürich", `z\xc3\xbcrich`},
+		{"a@b", `a\x40b`},
+		{"", ""},
+	}
+	for _, tc := range testCases {
+		if got := EscapeUnitName(tc.in); got != tc.out {
+			t.Errorf("EscapeUnitName(%q): expected %q, got %q", tc.in, tc.out, got)
+		}
+		got, err := UnescapeUnitName(tc.out)
+		if err != nil {
+			t.Errorf("UnescapeUnitName(%q): %v", tc.out, err)
+		} else if got != tc.in {
+			t.Errorf("UnescapeUnitName(%q): expected %q, got %q", tc.out, tc.in, got)
+		}
+	}
+
+	for _, in := range []string{`foo\`, `foo\x`, `foo\x2`, `foo\y20`, `foo\xzz`} {
+		if _, err := UnescapeUnitName(in); err == nil {
+			t.Errorf("UnescapeUnitName(%q): expected error, got nil", in)
+		}
+	}
+}
+
+func TestValidateUnitName(t *testing.T) {
+	valid := []string{
+		"foo.scope",
+		"foo-bar.slice",
+		"-.slice",
+		`foo\x2fbar.scope`,
+		"foo@bar.service",
+		"foo@.service",
+		"a:b_c.d.mount",
+		strings.Repeat("a", 249) + ".scope",
+	}
+	for _, name := range valid {
+		if err := ValidateUnitName(name); err != nil {
+			t.Errorf("%q: expected valid, got %v", name, err)
+		}
+	}
+	invalid := []string{
+		"",
+		"foo",
+		".scope",
+		"foo.bar",
+		"foo/bar.scope",
+		"foo bar.scope",
+		"zürich.scope",
+		"@foo.service",
+		"a@b@c.service",
+		"foo@bar.slice",
+		"-foo.slice",
+		"foo-.slice",
+		"foo--bar.slice",
+		strings.Repeat("a", 250) + ".scope",
+	}
+	for _, name := range invalid {
+		if err := ValidateUnitName(name); err == nil {
+			t.Errorf("%q: expected error, got nil", name)
+		}
+	}
+}
+
+func TestGetUnitNameEscape(t *testing.T) {
+	testCases := []struct {
+		cg   cgroups.Cgroup
+		unit string
+	}{
+		{cgroups.Cgroup{ScopePrefix: "runc", Name: "abc-123"}, "runc-abc-123.scope"},
+		{cgroups.Cgroup{ScopePrefix: "runc", Name: "a/b"}, `runc-a\x2fb.scope`},
+		// The valid names are kept as is.
+		{cgroups.Cgroup{ScopePrefix: "runc", Name: ".foo"}, "runc-.foo.scope"},
+		{cgroups.Cgroup{ScopePrefix: ".runc", Name: "foo"}, ".runc-foo.scope"},
+		// Unless they have a '\', so they don't collide with the escaped ones.
+		{cgroups.Cgroup{ScopePrefix: "runc", Name: `a\x2fb`}, `runc-a\x5cx2fb.scope`},
+		{cgroups.Cgroup{ScopePrefix: "runc", Name: `a\b`}, `runc-a\x5cb.scope`},
+		{cgroups.Cgroup{ScopePrefix: `r\unc`, Name: "a"}, `r\x5cunc-a.scope`},
+		// The others are escaped, including the '\' in them.
+		{cgroups.Cgroup{ScopePrefix: "runc", Name: "zürich"}, `runc-z\xc3\xbcrich.scope`},
+		{cgroups.Cgroup{ScopePrefix: "runc", Name: `a\b/c`}, `runc-a\x5cb\x2fc.scope`},
+		{cgroups.Cgroup{ScopePrefix: "runc", Name: ".a/b"}, `runc-.a\x2fb.scope`},
+		{cgroups.Cgroup{ScopePrefix: ".runc", Name: "a/b"}, `\x2erunc-a\x2fb.scope`},
+		{cgroups.Cgroup{Name: "system-foo.slice"}, "system-foo.slice"},
+		{cgroups.Cgroup{ScopePrefix: "runc", Name: "abc", UnitName: "custom.slice"}, "custom.slice"},
+	}
+	for _, tc := range testCases {
+		if got := getUnitName(&tc.cg); got != tc.unit {
+			t.Errorf("%+v: expected %q, got %q", tc.cg, tc.unit, got)
+		}
+		if err := checkUnitName(&tc.cg); err != nil {
+			t.Errorf("%+v: %v", tc.cg, err)
+		}
+	}
+
+	// The escaped names are not the same as any other.
+	for _, names := range [][2]string{{"a/b", `a\x2fb`}, {`a\b/c`, `a\x5cb\x2fc`}} {
+		a := getUnitName(&cgroups.Cgroup{ScopePrefix: "runc", Name: names[0]})
+		b := getUnitName(&cgroups.Cgroup{ScopePrefix: "runc", Name: names[1]})
+		if a == b {
+			t.Errorf("names %q and %q have the same unit name %q", names[0], names[1], a)
+		}
+	}
+
+	for _, cg := range []cgroups.Cgroup{
+		{UnitName: "foo.service"},
+		{UnitName: "foo/bar.scope"},
+		{UnitName: "foo"},
+		{Name: "foo--bar.slice"},
+		{ScopePrefix: "runc", Name: "foo", Parent: "foo/bar.slice"},
+		{ScopePrefix: "runc", Name: strings.Repeat("a", 250)},
+	} {
+		if err := checkUnitName(&cg); err == nil {
+			t.Errorf("%+v: expected error, got nil", cg)
+		}
+	}
+}
+
+func TestUnitNameToCgroupPath(t *testing.T) {
+	testCases := []struct {
+		unit, slice, path string
+	}{
+		{"foo.scope", "system.slice", "/system.slice/foo.scope"},
+		{"foo.scope", "-.slice", "/foo.scope"},
+		{"foo.scope", "a-b.slice", "/a.slice/a-b.slice/foo.scope"},
+		{`runc-a\x2fb.scope`, "user.slice", `/user.slice/runc-a\x2fb.scope`},
+		{"a-b-c.slice", "", "/a.slice/a-b.slice/a-b-c.slice"},
+		{"a-b-c.slice", "a-b.slice", "/a.slice/a-b.slice/a-b-c.slice"},
+		{"a.slice", "-.slice", "/a.slice"},
+	}
+	for _, tc := range testCases {
+		p, err := UnitNameToCgroupPath(tc.unit, tc.slice)
+		if err != nil {
+			t.Errorf("UnitNameToCgroupPath(%q, %q): %v", tc.unit, tc.slice, err)
+			continue
+		}
+		if p != tc.path {
+			t.Errorf("UnitNameToCgroupPath(%q, %q): expected %q, got %q", tc.unit, tc.slice, tc.path, p)
+		}
+		unit, slice, err := CgroupPathToUnit(p)
+		if err != nil {
+			t.Errorf("CgroupPathToUnit(%q): %v", p, err)
+			continue
+		}
+		if unit != tc.unit {
+			t.Errorf("CgroupPathToUnit(%q): expected unit %q, got %q", p, tc.unit, unit)
+		}
+		// The parent of a slice is implied by its name.
+		if tc.slice != "" && slice != tc.slice {
+			t.Errorf("CgroupPathToUnit(%q): expected slice %q, got %q", p, tc.slice, slice)
+		}
+	}
+
+	for _, tc := range []struct{ unit, slice string }{
+		{"foo.scope", ""},
+		{"foo.scope", "foo"},
+		{"foo", "system.slice"},
+		{"a-b.slice", "system.slice"},
+	} {
+		if _, err := UnitNameToCgroupPath(tc.unit, tc.slice); err == nil {
+			t.Errorf("UnitNameToCgroupPath(%q, %q): expected error, got nil", tc.unit, tc.slice)
+		}
+	}
+
+	for _, p := range []string{
+		"/",
+		"/foo/bar.scope",
+		"/system.slice/foo",
+		"/system.slice/a-b.slice",
+		"/a.slice/b.slice/foo.scope",
+		"/system.slice/foo.scope/bar.scope",
+	} {
+		if unit, slice, err := CgroupPathToUnit(p); err == nil {
+			t.Errorf("CgroupPathToUnit(%q): expected error, got %q, %q", p, unit, slice)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package systemd
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"os"
@@ -16,19 +17,26 @@ import (
 	"github.com/moby/sys/userns"
 )
 
-// newUserSystemdDbus creates a connection for systemd user-instance.
-func newUserSystemdDbus() (*systemdDbus.Conn, error) {
-	addr, err := DetectUserDbusSessionBusAddress()
-	if err != nil {
-		return nil, err
+// newUserSystemdDbus creates a connection for systemd user-instance
+// listening at addr, authenticating as uid. If addr is empty, or uid is
+// negative, they are detected. The connection is closed once ctx is done.
+func newUserSystemdDbus(ctx context.Context, addr string, uid int) (*systemdDbus.Conn, error) {
+	var err error
+	if addr == "" {
+		addr, err = DetectUserDbusSessionBusAddress()
+		if err != nil {
+			return nil, err
+		}
 	}
-	uid, err := DetectUID()
-	if err != nil {
-		return nil, err
+	if uid < 0 {
+		uid, err = DetectUID()
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return systemdDbus.NewConnection(func() (*dbus.Conn, error) {
-		conn, err := dbus.Dial(addr)
+		conn, err := dbus.Dial(addr, dbus.WithContext(ctx))
 		if err != nil {
 			return nil, fmt.Errorf("error while dialing %q: %w", addr, err)
 		}
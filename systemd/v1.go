@@ -1,34 +1,73 @@
 package systemd
 
 import (
+	"context"
 	"errors"
 	"math"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	systemdDbus "github.com/coreos/go-systemd/v22/dbus"
 	"github.com/sirupsen/logrus"
 
 	"github.com/opencontainers/cgroups"
 	"github.com/opencontainers/cgroups/fs"
+	"github.com/opencontainers/cgroups/fscommon"
 )
 
 type LegacyManager struct {
 	mu      sync.Mutex
 	cgroups *cgroups.Cgroup
 	paths   map[string]string
-	dbus    *dbusConnManager
+	dbus    *DbusConnManager
+	// setMu serializes Set, Verify and Reconcile, and guards the fields
+	// below, which only they use. It is held across the D-Bus calls, so
+	// the other methods (which use mu) are not blocked by them.
+	setMu sync.Mutex
+	// applied and appliedProps are the resources and the unit properties
+	// applied by the last successful Set, used for Resources.SkipUnchanged.
+	applied      *cgroups.Resources
+	appliedProps []systemdDbus.Property
+	// expected are the contents of the files written by Set,
+	// used by Verify and Reconcile.
+	expected fscommon.AppliedFiles
+	watch    unitWatch
+	// jobTimeout is the time to wait for systemd jobs (see
+	// SetJobTimeout), or zero for DefaultJobTimeout.
+	jobTimeout time.Duration
 }
 
+// NewLegacyManager creates a systemd cgroup v1 manager, which talks to
+// systemd using the shared system D-Bus connection (see
+// [SystemDbusConnManager]).
 func NewLegacyManager(cg *cgroups.Cgroup, paths map[string]string) (*LegacyManager, error) {
+	return NewLegacyManagerWithDbus(cg, paths, SystemDbusConnManager())
+}
+
+// NewLegacyManagerWithDbus is like [NewLegacyManager], but uses the D-Bus
+// connection manager cm to talk to systemd.
+func NewLegacyManagerWithDbus(cg *cgroups.Cgroup, paths map[string]string, cm *DbusConnManager) (*LegacyManager, error) {
+	if cm == nil {
+		return nil, errors.New("nil dbus connection manager")
+	}
 	if cg.Rootless {
 		return nil, errors.New("cannot use rootless systemd cgroups manager on cgroup v1")
 	}
 	if cg.Resources != nil && cg.Resources.Unified != nil {
 		return nil, cgroups.ErrV1NoUnified
 	}
+	if cg.DelegateSubgroup != "" {
+		return nil, errors.New("cannot use DelegateSubgroup with systemd cgroup v1 manager")
+	}
+	if err := checkUnitName(cg); err != nil {
+		return nil, err
+	}
+	if err := checkDelegate(cg); err != nil {
+		return nil, err
+	}
 	if paths == nil {
 		var err error
 		paths, err = initPaths(cg)
@@ -39,7 +78,7 @@ func NewLegacyManager(cg *cgroups.Cgroup, paths map[string]string) (*LegacyManag
 	return &LegacyManager{
 		cgroups: cg,
 		paths:   paths,
-		dbus:    newDbusConnManager(false),
+		dbus:    cm,
 	}, nil
 }
 
@@ -74,7 +113,7 @@ var legacySubsystems = []subsystem{
 	&fs.NameGroup{GroupName: "misc", GroupID: cgroups.Misc},
 }
 
-func genV1ResourcesProperties(r *cgroups.Resources, cm *dbusConnManager) ([]systemdDbus.Property, error) {
+func genV1ResourcesProperties(r *cgroups.Resources, cm *DbusConnManager) ([]systemdDbus.Property, error) {
 	var properties []systemdDbus.Property
 
 	deviceProperties, err := generateDeviceProperties(r, cm)
@@ -118,6 +157,18 @@ func genV1ResourcesProperties(r *cgroups.Resources, cm *dbusConnManager) ([]syst
 		return nil, err
 	}
 
+	// IP accounting and filtering also work in the hybrid mode,
+	// as long as the cgroup v2 hierarchy is mounted.
+	if err := addIPPolicy(&properties, r.IP); err != nil {
+		return nil, err
+	}
+
+	oomProps, err := managedOOMProperties(cm, r.ManagedOOM)
+	if err != nil {
+		return nil, err
+	}
+	properties = append(properties, oomProps...)
+
 	return properties, nil
 }
 
@@ -168,21 +219,30 @@ func initPaths(c *cgroups.Cgroup) (map[string]string, error) {
 	return paths, nil
 }
 
+// SetJobTimeout sets the time to wait for systemd to start or stop the unit
+// of the manager. Zero or a negative value means [DefaultJobTimeout]. It is
+// to be called before the manager is used.
+func (m *LegacyManager) SetJobTimeout(timeout time.Duration) {
+	m.jobTimeout = timeout
+}
+
 func (m *LegacyManager) Apply(pid int) error {
+	return m.ApplyContext(context.Background(), pid)
+}
+
+// ApplyContext is like Apply, but the D-Bus calls to systemd, and the wait
+// for the unit to be started, are aborted once ctx is done.
+func (m *LegacyManager) ApplyContext(ctx context.Context, pid int) error {
 	var (
 		c          = m.cgroups
 		unitName   = getUnitName(c)
-		slice      = "system.slice"
+		slice      = unitParent(c)
 		properties []systemdDbus.Property
 	)
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if c.Parent != "" {
-		slice = c.Parent
-	}
-
 	properties = append(properties, systemdDbus.PropDescription("libcontainer container "+c.Name))
 
 	if strings.HasSuffix(unitName, ".slice") {
@@ -191,8 +251,11 @@ func (m *LegacyManager) Apply(pid int) error {
 	} else {
 		// Otherwise it's a scope, which we put into a Slice=.
 		properties = append(properties, systemdDbus.PropSlice(slice))
-		// Assume scopes always support delegation (supported since systemd v218).
-		properties = append(properties, newProp("Delegate", true))
+		delegate, err := delegateProperties(m.dbus, c)
+		if err != nil {
+			return err
+		}
+		properties = append(properties, delegate...)
 	}
 
 	// only add pid if its valid, -1 is used w/ general slice creation.
@@ -215,7 +278,23 @@ func (m *LegacyManager) Apply(pid int) error {
 
 	properties = append(properties, c.SystemdProps...)
 
-	if err := startUnit(m.dbus, unitName, properties, pid == -1); err != nil {
+	parentProps, err := managedOOMProperties(m.dbus, c.ParentManagedOOM)
+	if err != nil {
+		return err
+	}
+	// Unless a pid is given, the unit may exist already (see startUnit),
+	// in which case it is not to be stopped if the parent slice settings
+	// can't be set.
+	existed := false
+	if len(parentProps) > 0 && pid == -1 {
+		existed, _ = unitExists(ctx, m.dbus, unitName)
+	}
+
+	if err := startUnit(ctx, m.dbus, unitName, properties, pid == -1, jobTimeout(m.jobTimeout)); err != nil {
+		return err
+	}
+
+	if err := setParentManagedOOM(ctx, m.dbus, c, parentProps, existed, jobTimeout(m.jobTimeout)); err != nil {
 		return err
 	}
 
@@ -230,10 +309,16 @@ func (m *LegacyManager) Apply(pid int) error {
 // The subcgroup argument is either empty, or a path relative to
 // a cgroup under under the manager's cgroup.
 func (m *LegacyManager) AddPid(subcgroup string, pid int) error {
+	return m.AddPidContext(context.Background(), subcgroup, pid)
+}
+
+// AddPidContext is like AddPid, but the D-Bus call to systemd is aborted
+// once ctx is done.
+func (m *LegacyManager) AddPidContext(ctx context.Context, subcgroup string, pid int) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if err := addPid(m.dbus, getUnitName(m.cgroups), subcgroup, pid); err != nil {
+	if err := addPid(ctx, m.dbus, getUnitName(m.cgroups), subcgroup, pid); err != nil {
 		return err
 	}
 
@@ -246,10 +331,18 @@ func (m *LegacyManager) AddPid(subcgroup string, pid int) error {
 }
 
 func (m *LegacyManager) Destroy() error {
+	return m.DestroyContext(context.Background())
+}
+
+// DestroyContext is like Destroy, but the D-Bus calls to systemd, and the
+// wait for the unit to be stopped, are aborted once ctx is done. The
+// cgroups are removed regardless.
+func (m *LegacyManager) DestroyContext(ctx context.Context) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	stopErr := stopUnit(m.dbus, getUnitName(m.cgroups))
+	stopErr := stopUnit(ctx, m.dbus, getUnitName(m.cgroups), jobTimeout(m.jobTimeout))
+	_ = fscommon.SetPerfEvents(m.paths["perf_event"], false)
 
 	// Both on success and on error, cleanup all the cgroups
 	// we are aware of, as some of them were created directly
@@ -305,6 +398,15 @@ func getSubsystemPath(slice, unit, subsystem string) (string, error) {
 }
 
 func (m *LegacyManager) Freeze(state cgroups.FreezerState) error {
+	return m.FreezeContext(context.Background(), state)
+}
+
+// FreezeContext is like Freeze, but fails if ctx is already done. The
+// freezer is set using cgroupfs, which can't be interrupted.
+func (m *LegacyManager) FreezeContext(ctx context.Context, state cgroups.FreezerState) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	err := m.doFreeze(state)
 	if err == nil {
 		m.cgroups.Resources.Freezer = state
@@ -344,17 +446,50 @@ func (m *LegacyManager) GetStats() (*cgroups.Stats, error) {
 	return m.Stats(nil)
 }
 
-// Stats returns cgroup statistics for the specified controllers.
+// Stats returns cgroup statistics for the specified controllers. If the
+// statistics can't be queried from systemd, the ones read from cgroupfs
+// are returned together with the error.
 func (m *LegacyManager) Stats(opts *cgroups.StatsOptions) (*cgroups.Stats, error) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	return m.StatsContext(context.Background(), opts)
+}
 
+// StatsContext is like Stats, but the D-Bus calls to systemd are aborted
+// once ctx is done.
+func (m *LegacyManager) StatsContext(ctx context.Context, opts *cgroups.StatsOptions) (*cgroups.Stats, error) {
 	// Default: query all controllers (same as original GetStats behavior)
 	controllers := cgroups.AllControllers
 	if opts != nil && opts.Controllers != 0 {
 		controllers = opts.Controllers
 	}
 
+	stats, err := m.fsStats(controllers)
+	if err != nil {
+		return nil, err
+	}
+
+	if wantIPStats(m.cgroups, controllers) {
+		stats.IPStats, err = getIPStats(ctx, m.dbus, getUnitName(m.cgroups))
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	if controllers&cgroups.Unit != 0 {
+		stats.UnitStats, err = getUnitStats(ctx, m.dbus, m.cgroups)
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	return stats, nil
+}
+
+// fsStats reads the statistics of the controllers from cgroupfs. Unlike
+// the ones queried from systemd, it is done holding m.mu.
+func (m *LegacyManager) fsStats(controllers cgroups.Controller) (*cgroups.Stats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	stats := cgroups.NewStats()
 	for _, sys := range legacySubsystems {
 		path := m.paths[sys.Name()]
@@ -371,31 +506,86 @@ func (m *LegacyManager) Stats(opts *cgroups.StatsOptions) (*cgroups.Stats, error
 			return nil, err
 		}
 	}
-
 	return stats, nil
 }
 
 func (m *LegacyManager) Set(r *cgroups.Resources) error {
+	return m.SetContext(context.Background(), r)
+}
+
+// SetContext is like Set, but the D-Bus calls to systemd are aborted once
+// ctx is done (in which case the changes made are rolled back, as usual).
+func (m *LegacyManager) SetContext(ctx context.Context, r *cgroups.Resources) error {
 	if r == nil {
 		return nil
 	}
+	m.setMu.Lock()
+	defer m.setMu.Unlock()
 	if r.Unified != nil {
 		return cgroups.ErrV1NoUnified
 	}
 	// Use a copy since CpuQuota in r may be modified.
 	rCopy := *r
 	r = &rCopy
-	properties, err := genV1ResourcesProperties(r, m.dbus)
+	allProperties, err := genV1ResourcesProperties(r, m.dbus)
 	if err != nil {
 		return err
 	}
+	properties := allProperties
+	if r.SkipUnchanged {
+		properties = changedProperties(m.appliedProps, allProperties)
+	}
 
 	unitName := getUnitName(m.cgroups)
-	needsFreeze, needsThaw, err := m.freezeBeforeSet(unitName, r)
+	saved, err := m.applyUnitProperties(ctx, unitName, r, properties)
 	if err != nil {
 		return err
 	}
 
+	var tx fscommon.Transaction
+	for _, sys := range legacySubsystems {
+		if r.SkipUnchanged && fscommon.Unchanged(sys.Name(), m.applied, r) {
+			continue
+		}
+		// Get the subsystem path, but don't error out for not found cgroups.
+		path, ok := m.paths[sys.Name()]
+		if !ok {
+			continue
+		}
+		fs.SaveState(&tx, sys.Name(), path, r)
+		if err := sys.Set(path, r); err != nil {
+			err = &cgroups.SetError{Step: sys.Name(), Err: err, RollbackErr: tx.Rollback()}
+			return setFailed(ctx, m.dbus, unitName, sys.Name(), err, saved)
+		}
+	}
+	m.applied = r.Clone()
+	m.appliedProps = allProperties
+	if m.expected == nil {
+		m.expected = make(fscommon.AppliedFiles)
+	}
+	m.expected.Record(tx.Files())
+
+	return nil
+}
+
+// applyUnitProperties sets the unit properties, freezing the cgroup
+// around it if needed (see freezeBeforeSet). It returns the previous
+// values of the properties, to be restored in case Set fails later.
+func (m *LegacyManager) applyUnitProperties(ctx context.Context, unitName string, r *cgroups.Resources, properties []systemdDbus.Property) ([]systemdDbus.Property, error) {
+	if len(properties) == 0 {
+		return nil, nil
+	}
+	// Save the current property values so that both the unit and
+	// the cgroupfs can be reverted if any of the steps below fails.
+	saved, err := saveUnitProperties(ctx, m.dbus, unitName, properties)
+	if err != nil {
+		return nil, err
+	}
+	needsFreeze, needsThaw, err := m.freezeBeforeSet(ctx, unitName, r)
+	if err != nil {
+		return nil, err
+	}
+
 	if needsFreeze {
 		if err := m.doFreeze(cgroups.Frozen); err != nil {
 			// If freezer cgroup isn't supported, we just warn about it.
@@ -407,32 +597,20 @@ func (m *LegacyManager) Set(r *cgroups.Resources) error {
 						logrus.Infof("thaw container after doFreeze failed: %v", thawErr)
 					}
 				}
-				return err
+				return nil, err
 			}
 		}
 	}
-	setErr := setUnitProperties(m.dbus, unitName, properties...)
+	setErr := setUnitProperties(ctx, m.dbus, unitName, properties...)
 	if needsThaw {
 		if err := m.doFreeze(cgroups.Thawed); err != nil {
 			logrus.Infof("thaw container after SetUnitProperties failed: %v", err)
 		}
 	}
 	if setErr != nil {
-		return setErr
-	}
-
-	for _, sys := range legacySubsystems {
-		// Get the subsystem path, but don't error out for not found cgroups.
-		path, ok := m.paths[sys.Name()]
-		if !ok {
-			continue
-		}
-		if err := sys.Set(path, r); err != nil {
-			return err
-		}
+		return nil, setFailed(ctx, m.dbus, unitName, "unit properties", setErr, saved)
 	}
-
-	return nil
+	return saved, nil
 }
 
 func (m *LegacyManager) GetPaths() map[string]string {
@@ -454,8 +632,31 @@ func (m *LegacyManager) GetFreezerState() (cgroups.FreezerState, error) {
 	return freezer.GetState(path)
 }
 
+// Exists reports whether the cgroup exists. If the unit is being watched
+// (see [LegacyManager.Watch]), it also has to be not removed. Otherwise, the
+// state of the unit is not checked (see [LegacyManager.UnitExists]).
 func (m *LegacyManager) Exists() bool {
-	return cgroups.PathExists(m.Path("devices"))
+	return !m.watch.removed() && cgroups.PathExists(m.Path("devices"))
+}
+
+// UnitExists is the same as [UnifiedManager.UnitExists].
+func (m *LegacyManager) UnitExists(ctx context.Context) (bool, error) {
+	return unitExists(ctx, m.dbus, getUnitName(m.cgroups))
+}
+
+// ManagedOOM is the same as [UnifiedManager.ManagedOOM].
+func (m *LegacyManager) ManagedOOM() (unit, parent *cgroups.ManagedOOM, err error) {
+	return m.ManagedOOMContext(context.Background())
+}
+
+// ManagedOOMContext is the same as [UnifiedManager.ManagedOOMContext].
+func (m *LegacyManager) ManagedOOMContext(ctx context.Context) (unit, parent *cgroups.ManagedOOM, err error) {
+	return managedOOM(ctx, m.dbus, m.cgroups)
+}
+
+// Watch is the same as [UnifiedManager.Watch].
+func (m *LegacyManager) Watch(ctx context.Context) (<-chan UnitEvent, error) {
+	return m.watch.watch(ctx, m.dbus, getUnitName(m.cgroups))
 }
 
 func (m *LegacyManager) OOMKillCount() (uint64, error) {
@@ -2,14 +2,18 @@ package systemd
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"math"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	systemdDbus "github.com/coreos/go-systemd/v22/dbus"
 	securejoin "github.com/cyphar/filepath-securejoin"
@@ -22,6 +26,11 @@ import (
 const (
 	cpuIdleSupportedVersion   = 252
 	oomPolicySupportedVersion = 253
+
+	ioSupportedVersion          = 230
+	ioLatencySupportedVersion   = 240
+	ioBFQWeightSupportedVersion = 243
+	memoryZSwapSupportedVersion = 253
 )
 
 type UnifiedManager struct {
@@ -29,17 +38,54 @@ type UnifiedManager struct {
 	cgroups *cgroups.Cgroup
 	// path is like "/sys/fs/cgroup/user.slice/user-1001.slice/session-1.scope"
 	path  string
-	dbus  *dbusConnManager
+	dbus  *DbusConnManager
 	fsMgr cgroups.Manager
+	// setMu is the same as in LegacyManager.
+	setMu sync.Mutex
+	// appliedProps are the unit properties applied by the last
+	// successful Set, used for Resources.SkipUnchanged.
+	appliedProps []systemdDbus.Property
+	watch        unitWatch
+	// jobTimeout is the time to wait for systemd jobs (see
+	// SetJobTimeout), or zero for DefaultJobTimeout.
+	jobTimeout time.Duration
 }
 
+// NewUnifiedManager creates a systemd cgroup v2 manager, which talks to
+// systemd using the shared system D-Bus connection, or the shared user one
+// if config.Rootless is set (see [SystemDbusConnManager] and
+// [UserDbusConnManager]).
 func NewUnifiedManager(config *cgroups.Cgroup, path string) (*UnifiedManager, error) {
+	return NewUnifiedManagerWithDbus(config, path, defaultDbusConnManager(config.Rootless))
+}
+
+// NewUnifiedManagerWithDbus is like [NewUnifiedManager], but uses the D-Bus
+// connection manager cm to talk to systemd. This allows to manage both
+// system and user (rootless) units, or units of several users, from the
+// same process.
+func NewUnifiedManagerWithDbus(config *cgroups.Cgroup, path string, cm *DbusConnManager) (*UnifiedManager, error) {
+	return NewUnifiedManagerWithDbusContext(context.Background(), config, path, cm)
+}
+
+// NewUnifiedManagerWithDbusContext is like [NewUnifiedManagerWithDbus], but
+// the D-Bus call to systemd made to find the cgroup path of a rootless unit
+// (when path is empty) is aborted once ctx is done.
+func NewUnifiedManagerWithDbusContext(ctx context.Context, config *cgroups.Cgroup, path string, cm *DbusConnManager) (*UnifiedManager, error) {
+	if cm == nil {
+		return nil, errors.New("nil dbus connection manager")
+	}
+	if err := checkUnitName(config); err != nil {
+		return nil, err
+	}
+	if err := checkDelegate(config); err != nil {
+		return nil, err
+	}
 	m := &UnifiedManager{
 		cgroups: config,
 		path:    path,
-		dbus:    newDbusConnManager(config.Rootless),
+		dbus:    cm,
 	}
-	if err := m.initPath(); err != nil {
+	if err := m.initPath(ctx); err != nil {
 		return nil, err
 	}
 
@@ -52,7 +98,7 @@ func NewUnifiedManager(config *cgroups.Cgroup, path string) (*UnifiedManager, er
 	return m, nil
 }
 
-func shouldSetCPUIdle(cm *dbusConnManager, v string) bool {
+func shouldSetCPUIdle(cm *DbusConnManager, v string) bool {
 	// The only valid values for cpu.idle are 0 and 1. As it is
 	// not possible to directly set cpu.idle to 0 via systemd,
 	// ignore 0. Ignore other values as we'll error out later
@@ -64,20 +110,35 @@ func shouldSetCPUIdle(cm *dbusConnManager, v string) bool {
 // key/value map (where key is cgroupfs file name) to systemd unit properties.
 // This is on a best-effort basis, so the properties that are not known
 // (to this function and/or systemd) are ignored (but logged with "debug"
-// log level).
+// log level), and their keys are returned as untranslated, in order.
 //
 // For the list of keys, see https://www.kernel.org/doc/Documentation/cgroup-v2.txt
 //
 // For the list of systemd unit properties, see systemd.resource-control(5).
-func unifiedResToSystemdProps(cm *dbusConnManager, res map[string]string) (props []systemdDbus.Property, _ error) {
+func unifiedResToSystemdProps(cm *DbusConnManager, res map[string]string) (props []systemdDbus.Property, untranslated []string, _ error) {
 	var err error
 
+	// skip reports k as untranslated, as it can't be set by systemd
+	// for the reason given.
+	skip := func(k, v, reason string) {
+		logrus.Debugf("unable to convert unified resource %q=%q to systemd unit property (%s); skipping (will still be applied to cgroupfs)", k, v, reason)
+		untranslated = append(untranslated, k)
+	}
+	// tooOld skips k if systemd is older than minVer.
+	tooOld := func(k, v string, minVer int) bool {
+		if sdVer := systemdVersion(cm); sdVer < minVer {
+			skip(k, v, fmt.Sprintf("systemd v%d is too old, v%d is required", sdVer, minVer))
+			return true
+		}
+		return false
+	}
+
 	for k, v := range res {
 		if strings.Contains(k, "/") {
-			return nil, fmt.Errorf("unified resource %q must be a file name (no slashes)", k)
+			return nil, nil, fmt.Errorf("unified resource %q must be a file name (no slashes)", k)
 		}
 		if strings.IndexByte(k, '.') <= 0 {
-			return nil, fmt.Errorf("unified resource %q must be in the form CONTROLLER.PARAMETER", k)
+			return nil, nil, fmt.Errorf("unified resource %q must be in the form CONTROLLER.PARAMETER", k)
 		}
 		// Kernel is quite forgiving to extra whitespace
 		// around the value, and so should we.
@@ -90,6 +151,8 @@ func unifiedResToSystemdProps(cm *dbusConnManager, res map[string]string) (props
 				// to set cpu.idle to 1.
 				props = append(props,
 					newProp("CPUWeight", uint64(0)))
+			} else if v == "1" {
+				tooOld(k, v, cpuIdleSupportedVersion)
 			}
 
 		case "cpu.max":
@@ -98,20 +161,20 @@ func unifiedResToSystemdProps(cm *dbusConnManager, res map[string]string) (props
 			period := defCPUQuotaPeriod
 			sv := strings.Fields(v)
 			if len(sv) < 1 || len(sv) > 2 {
-				return nil, fmt.Errorf("unified resource %q value invalid: %q", k, v)
+				return nil, nil, fmt.Errorf("unified resource %q value invalid: %q", k, v)
 			}
 			// quota
 			if sv[0] != "max" {
 				quota, err = strconv.ParseInt(sv[0], 10, 64)
 				if err != nil {
-					return nil, fmt.Errorf("unified resource %q period value conversion error: %w", k, err)
+					return nil, nil, fmt.Errorf("unified resource %q period value conversion error: %w", k, err)
 				}
 			}
 			// period
 			if len(sv) == 2 {
 				period, err = strconv.ParseUint(sv[1], 10, 64)
 				if err != nil {
-					return nil, fmt.Errorf("unified resource %q quota value conversion error: %w", k, err)
+					return nil, nil, fmt.Errorf("unified resource %q quota value conversion error: %w", k, err)
 				}
 			}
 			addCPUQuota(cm, &props, &quota, period)
@@ -121,60 +184,127 @@ func unifiedResToSystemdProps(cm *dbusConnManager, res map[string]string) (props
 				// Do not add duplicate CPUWeight property
 				// (see case "cpu.idle" above).
 				logrus.Warn("unable to apply both cpu.weight and cpu.idle to systemd, ignoring cpu.weight")
+				untranslated = append(untranslated, k)
 				continue
 			}
 			num, err := strconv.ParseUint(v, 10, 64)
 			if err != nil {
-				return nil, fmt.Errorf("unified resource %q value conversion error: %w", k, err)
+				return nil, nil, fmt.Errorf("unified resource %q value conversion error: %w", k, err)
 			}
 			props = append(props,
 				newProp("CPUWeight", num))
 
+		case "cpu.weight.nice":
+			if _, ok := res["cpu.weight"]; ok || shouldSetCPUIdle(cm, strings.TrimSpace(res["cpu.idle"])) {
+				// Do not add duplicate CPUWeight property
+				// (see cases "cpu.idle" and "cpu.weight" above).
+				logrus.Warn("unable to apply cpu.weight.nice together with cpu.weight or cpu.idle to systemd, ignoring cpu.weight.nice")
+				untranslated = append(untranslated, k)
+				continue
+			}
+			nice, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, nil, fmt.Errorf("unified resource %q value conversion error: %w", k, err)
+			}
+			weight, ok := niceToCPUWeight(nice)
+			if !ok {
+				return nil, nil, fmt.Errorf("unified resource %q value out of range: %d", k, nice)
+			}
+			props = append(props,
+				newProp("CPUWeight", weight))
+
 		case "cpuset.cpus", "cpuset.mems":
 			bits, err := RangeToBits(v)
 			if err != nil {
-				return nil, fmt.Errorf("unified resource %q=%q conversion error: %w", k, v, err)
+				return nil, nil, fmt.Errorf("unified resource %q=%q conversion error: %w", k, v, err)
 			}
 			m := map[string]string{
 				"cpuset.cpus": "AllowedCPUs",
 				"cpuset.mems": "AllowedMemoryNodes",
 			}
 			// systemd only supports these properties since v244
-			sdVer := systemdVersion(cm)
-			if sdVer >= 244 {
+			if !tooOld(k, v, 244) {
 				props = append(props,
 					newProp(m[k], bits))
-			} else {
-				logrus.Debugf("systemd v%d is too old to support %s"+
-					" (setting will still be applied to cgroupfs)",
-					sdVer, m[k])
 			}
 
-		case "memory.high", "memory.low", "memory.min", "memory.max", "memory.swap.max":
+		case "cpuset.cpus.partition":
+			// systemd has no property for it.
+			skip(k, v, "not supported by systemd")
+
+		case "io.bfq.weight":
+			if _, ok := res["io.weight"]; ok {
+				// Do not add duplicate IOWeight property
+				// (see case "io.weight" below).
+				logrus.Warn("unable to apply both io.weight and io.bfq.weight to systemd, ignoring io.bfq.weight")
+				untranslated = append(untranslated, k)
+				continue
+			}
+			ioProps, err := ioBFQWeightProps(v)
+			if err != nil {
+				return nil, nil, fmt.Errorf("unified resource %q=%q conversion error: %w", k, v, err)
+			}
+			if ioProps == nil {
+				skip(k, v, "only the default weight can be set by systemd")
+			} else if !tooOld(k, v, ioBFQWeightSupportedVersion) {
+				props = append(props, ioProps...)
+			}
+
+		case "io.latency", "io.max", "io.weight":
+			conv := map[string]struct {
+				props  func(string) ([]systemdDbus.Property, error)
+				minVer int
+			}{
+				"io.latency": {ioLatencyProps, ioLatencySupportedVersion},
+				"io.max":     {ioMaxProps, ioSupportedVersion},
+				"io.weight":  {ioWeightProps, ioSupportedVersion},
+			}[k]
+			ioProps, err := conv.props(v)
+			if err != nil {
+				return nil, nil, fmt.Errorf("unified resource %q=%q conversion error: %w", k, v, err)
+			}
+			if ioProps == nil {
+				skip(k, v, "device weight resets can't be set by systemd")
+			} else if !tooOld(k, v, conv.minVer) {
+				props = append(props, ioProps...)
+			}
+
+		case "memory.high", "memory.low", "memory.min", "memory.max", "memory.swap.max", "memory.zswap.max":
 			num := uint64(math.MaxUint64)
 			if v != "max" {
 				num, err = strconv.ParseUint(v, 10, 64)
 				if err != nil {
-					return nil, fmt.Errorf("unified resource %q value conversion error: %w", k, err)
+					return nil, nil, fmt.Errorf("unified resource %q value conversion error: %w", k, err)
 				}
 			}
+			if k == "memory.zswap.max" && tooOld(k, v, memoryZSwapSupportedVersion) {
+				continue
+			}
 			m := map[string]string{
-				"memory.high":     "MemoryHigh",
-				"memory.low":      "MemoryLow",
-				"memory.min":      "MemoryMin",
-				"memory.max":      "MemoryMax",
-				"memory.swap.max": "MemorySwapMax",
+				"memory.high":      "MemoryHigh",
+				"memory.low":       "MemoryLow",
+				"memory.min":       "MemoryMin",
+				"memory.max":       "MemoryMax",
+				"memory.swap.max":  "MemorySwapMax",
+				"memory.zswap.max": "MemoryZSwapMax",
 			}
 			props = append(props,
 				newProp(m[k], num))
 
+		case "memory.oom.group":
+			// It can only be set (as OOMPolicy) when the unit is
+			// started (see Apply, and UntranslatedUnifiedKeys).
+			if !tooOld(k, v, oomPolicySupportedVersion) {
+				skip(k, v, "OOMPolicy can only be set when the unit is started")
+			}
+
 		case "pids.max":
 			num := uint64(math.MaxUint64)
 			if v != "max" {
 				var err error
 				num, err = strconv.ParseUint(v, 10, 64)
 				if err != nil {
-					return nil, fmt.Errorf("unified resource %q value conversion error: %w", k, err)
+					return nil, nil, fmt.Errorf("unified resource %q value conversion error: %w", k, err)
 				}
 			}
 			if num == 0 {
@@ -183,21 +313,40 @@ func unifiedResToSystemdProps(cm *dbusConnManager, res map[string]string) (props
 			props = append(props,
 				newProp("TasksMax", num))
 
-		case "memory.oom.group":
-			// This was set before the unit started, so no need to
-			// warn about it here.
-
 		default:
 			// Ignore the unknown resource here -- will still be
 			// applied in Set which calls fs2.Set.
-			logrus.Debugf("don't know how to convert unified resource %q=%q to systemd unit property; skipping (will still be applied to cgroupfs)", k, v)
+			skip(k, v, "unknown resource")
 		}
 	}
 
-	return props, nil
+	slices.Sort(untranslated)
+	return props, untranslated, nil
 }
 
-func genV2ResourcesProperties(dirPath string, r *cgroups.Resources, cm *dbusConnManager) ([]systemdDbus.Property, error) {
+// niceToCPUWeight converts a cpu.weight.nice value to the cpu.weight one,
+// the same way the kernel does, returning false if nice is out of range.
+func niceToCPUWeight(nice int64) (uint64, bool) {
+	// The kernel's sched_prio_to_weight table, for nice -20 to 19.
+	prioToWeight := [...]uint64{
+		88761, 71755, 56483, 46273, 36291,
+		29154, 23254, 18705, 14949, 11916,
+		9548, 7620, 6100, 4904, 3906,
+		3121, 2501, 1991, 1586, 1277,
+		1024, 820, 655, 526, 423,
+		335, 272, 215, 172, 137,
+		110, 87, 70, 56, 45,
+		36, 29, 23, 18, 15,
+	}
+	if nice < -20 || nice > 19 {
+		return 0, false
+	}
+	// The default weight of 1024 is cpu.weight of 100, rounded.
+	weight := (prioToWeight[nice+20]*100 + 512) / 1024
+	return min(max(weight, 1), 10000), true
+}
+
+func genV2ResourcesProperties(dirPath string, r *cgroups.Resources, cm *DbusConnManager) ([]systemdDbus.Property, error) {
 	// We need this check before setting systemd properties, otherwise
 	// the container is OOM-killed and the systemd unit is removed
 	// before we get to fsMgr.Set().
@@ -273,11 +422,21 @@ func genV2ResourcesProperties(dirPath string, r *cgroups.Resources, cm *dbusConn
 		return nil, err
 	}
 
+	if err := addIPPolicy(&properties, r.IP); err != nil {
+		return nil, err
+	}
+
+	oomProps, err := managedOOMProperties(cm, r.ManagedOOM)
+	if err != nil {
+		return nil, err
+	}
+	properties = append(properties, oomProps...)
+
 	// ignore r.KernelMemory
 
 	// convert Resources.Unified map to systemd properties
 	if r.Unified != nil {
-		unifiedProps, err := unifiedResToSystemdProps(cm, r.Unified)
+		unifiedProps, _, err := unifiedResToSystemdProps(cm, r.Unified)
 		if err != nil {
 			return nil, err
 		}
@@ -287,20 +446,80 @@ func genV2ResourcesProperties(dirPath string, r *cgroups.Resources, cm *dbusConn
 	return properties, nil
 }
 
+// UntranslatedUnifiedKeys returns the keys of unified (as in
+// [cgroups.Resources.Unified]) which Set can't translate to systemd unit
+// properties, in order. These are only applied to cgroupfs, so systemd may
+// revert them later (for example, on daemon-reload).
+//
+// The memory.oom.group key is only translated if it is set to the same value
+// in the config of the manager, as it is then set (as OOMPolicy) by Apply.
+func (m *UnifiedManager) UntranslatedUnifiedKeys(unified map[string]string) ([]string, error) {
+	_, untranslated, err := unifiedResToSystemdProps(m.dbus, unified)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := unified["memory.oom.group"]; ok && m.appliesOOMPolicy(v) {
+		untranslated = slices.DeleteFunc(untranslated, func(k string) bool {
+			return k == "memory.oom.group"
+		})
+	}
+	return untranslated, nil
+}
+
+// appliesOOMPolicy reports whether Apply sets memory.oom.group to v through
+// systemd (see oomPolicyProperty).
+func (m *UnifiedManager) appliesOOMPolicy(v string) bool {
+	if m.cgroups.Resources == nil {
+		return false
+	}
+	if applied, ok := m.cgroups.Resources.Unified["memory.oom.group"]; !ok || applied != v {
+		return false
+	}
+	_, ok, err := oomPolicyProperty(m.dbus, v)
+	return err == nil && ok
+}
+
+// oomPolicyProperty returns the OOMPolicy unit property for the value v of
+// memory.oom.group, if systemd supports it, and it can be translated.
+func oomPolicyProperty(cm *DbusConnManager, v string) (systemdDbus.Property, bool, error) {
+	if systemdVersion(cm) < oomPolicySupportedVersion {
+		return systemdDbus.Property{}, false, nil
+	}
+	value, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return systemdDbus.Property{}, false, fmt.Errorf("unified resource %q value conversion error: %w", "memory.oom.group", err)
+	}
+	switch value {
+	case 0:
+		return newProp("OOMPolicy", "continue"), true, nil
+	case 1:
+		return newProp("OOMPolicy", "kill"), true, nil
+	}
+	logrus.Debugf("don't know how to convert memory.oom.group=%d; skipping (will still be applied to cgroupfs)", value)
+	return systemdDbus.Property{}, false, nil
+}
+
+// SetJobTimeout sets the time to wait for systemd to start or stop the unit
+// of the manager. Zero or a negative value means [DefaultJobTimeout]. It is
+// to be called before the manager is used.
+func (m *UnifiedManager) SetJobTimeout(timeout time.Duration) {
+	m.jobTimeout = timeout
+}
+
 func (m *UnifiedManager) Apply(pid int) error {
+	return m.ApplyContext(context.Background(), pid)
+}
+
+// ApplyContext is like Apply, but the D-Bus calls to systemd, and the wait
+// for the unit to be started, are aborted once ctx is done.
+func (m *UnifiedManager) ApplyContext(ctx context.Context, pid int) error {
 	var (
 		c          = m.cgroups
 		unitName   = getUnitName(c)
 		properties []systemdDbus.Property
 	)
 
-	slice := "system.slice"
-	if m.cgroups.Rootless {
-		slice = "user.slice"
-	}
-	if c.Parent != "" {
-		slice = c.Parent
-	}
+	slice := unitParent(c)
 
 	properties = append(properties, systemdDbus.PropDescription("libcontainer container "+c.Name))
 
@@ -310,8 +529,11 @@ func (m *UnifiedManager) Apply(pid int) error {
 	} else {
 		// Otherwise it's a scope, which we put into a Slice=.
 		properties = append(properties, systemdDbus.PropSlice(slice))
-		// Assume scopes always support delegation (supported since systemd v218).
-		properties = append(properties, newProp("Delegate", true))
+		delegate, err := delegateProperties(m.dbus, c)
+		if err != nil {
+			return err
+		}
+		properties = append(properties, delegate...)
 	}
 
 	// only add pid if its valid, -1 is used w/ general slice creation.
@@ -339,50 +561,67 @@ func (m *UnifiedManager) Apply(pid int) error {
 	// so we do this here in Apply() instead of Set()
 	if c.Resources != nil {
 		if v, ok := c.Resources.Unified["memory.oom.group"]; ok {
-			if systemdVersion(m.dbus) >= oomPolicySupportedVersion {
-				value, err := strconv.ParseUint(v, 10, 64)
-				if err != nil {
-					return fmt.Errorf("unified resource %q value conversion error: %w", "memory.oom.group", err)
-				}
-
-				switch value {
-				case 0:
-					properties = append(properties, newProp("OOMPolicy", "continue"))
-				case 1:
-					properties = append(properties, newProp("OOMPolicy", "kill"))
-				default:
-					logrus.Debugf("don't know how to convert memory.oom.group=%d; skipping (will still be applied to cgroupfs)", value)
-				}
+			prop, ok, err := oomPolicyProperty(m.dbus, v)
+			if err != nil {
+				return err
+			}
+			if ok {
+				properties = append(properties, prop)
 			}
 		}
 	}
 
-	if err := startUnit(m.dbus, unitName, properties, pid == -1); err != nil {
+	parentProps, err := managedOOMProperties(m.dbus, c.ParentManagedOOM)
+	if err != nil {
+		return err
+	}
+	// Unless a pid is given, the unit may exist already (see startUnit),
+	// in which case it is not to be stopped if the parent slice settings
+	// can't be set.
+	existed := false
+	if len(parentProps) > 0 && pid == -1 {
+		existed, _ = unitExists(ctx, m.dbus, unitName)
+	}
+
+	if err := startUnit(ctx, m.dbus, unitName, properties, pid == -1, jobTimeout(m.jobTimeout)); err != nil {
 		return fmt.Errorf("unable to start unit %q (properties %+v): %w", unitName, properties, err)
 	}
 
+	if err := setParentManagedOOM(ctx, m.dbus, c, parentProps, existed, jobTimeout(m.jobTimeout)); err != nil {
+		return err
+	}
+
 	if err := fs2.CreateCgroupPath(m.path, m.cgroups); err != nil {
 		return err
 	}
 
 	if c.OwnerUID != nil {
-		// The directory itself must be chowned.
-		err := os.Chown(m.path, *c.OwnerUID, -1)
-		if err != nil {
-			return err
-		}
-
 		filesToChown, err := cgroupFilesToChown()
 		if err != nil {
 			return err
 		}
 
-		for _, v := range filesToChown {
-			err := os.Chown(m.path+"/"+v, *c.OwnerUID, -1)
-			// Some files might not be present.
-			if err != nil && !errors.Is(err, os.ErrNotExist) {
+		dirs := []string{m.path}
+		if c.DelegateSubgroup != "" {
+			// Created by systemd, if there are processes to put in it.
+			if _, err := os.Stat(m.DelegateSubgroupPath()); err == nil {
+				dirs = append(dirs, m.DelegateSubgroupPath())
+			}
+		}
+		for _, dir := range dirs {
+			// The directory itself must be chowned.
+			err := os.Chown(dir, *c.OwnerUID, -1)
+			if err != nil {
 				return err
 			}
+
+			for _, v := range filesToChown {
+				err := os.Chown(dir+"/"+v, *c.OwnerUID, -1)
+				// Some files might not be present.
+				if err != nil && !errors.Is(err, os.ErrNotExist) {
+					return err
+				}
+			}
 		}
 	}
 
@@ -417,20 +656,56 @@ func cgroupFilesToChown() ([]string, error) {
 // The subcgroup argument is either empty, or a path relative to
 // a cgroup under under the manager's cgroup.
 func (m *UnifiedManager) AddPid(subcgroup string, pid int) error {
+	return m.AddPidContext(context.Background(), subcgroup, pid)
+}
+
+// AddPidContext is like AddPid, but the D-Bus call to systemd is aborted
+// once ctx is done.
+func (m *UnifiedManager) AddPidContext(ctx context.Context, subcgroup string, pid int) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	return addPid(m.dbus, getUnitName(m.cgroups), subcgroup, pid)
+	if sub := m.cgroups.DelegateSubgroup; sub != "" {
+		abs, err := absSubcgroup(subcgroup)
+		if err != nil {
+			return err
+		}
+		subcgroup = path.Join(sub, abs)
+	}
+	return addPid(ctx, m.dbus, getUnitName(m.cgroups), subcgroup, pid)
 }
 
 func (m *UnifiedManager) Destroy() error {
+	return m.DestroyContext(context.Background())
+}
+
+// DestroyContext is like Destroy, but the D-Bus calls to systemd, and the
+// wait for the unit to be stopped, are aborted once ctx is done.
+func (m *UnifiedManager) DestroyContext(ctx context.Context) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	// The device filter link is looked up by the ID of the unit cgroup,
+	// which is removed by systemd, so it is done before stopping the unit,
+	// while the link is only removed once it is stopped.
+	unlinkDevices := func() error { return nil }
+	if r := m.cgroups.Resources; r != nil && r.DevicesLink != nil && cgroups.DevicesUnlinkV2 != nil {
+		unlink, err := cgroups.DevicesUnlinkV2(m.path, r)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			logrus.Warnf("unable to find device filter link: %v", err)
+		}
+		if err == nil {
+			unlinkDevices = unlink
+		}
+	}
+
 	unitName := getUnitName(m.cgroups)
-	if err := stopUnit(m.dbus, unitName); err != nil {
+	if err := stopUnit(ctx, m.dbus, unitName, jobTimeout(m.jobTimeout)); err != nil {
 		return err
 	}
+	if err := unlinkDevices(); err != nil {
+		logrus.Warnf("unable to remove device filter link: %v", err)
+	}
 
 	// systemd 239 do not remove sub-cgroups.
 	err := m.fsMgr.Destroy()
@@ -446,9 +721,20 @@ func (m *UnifiedManager) Path(_ string) string {
 	return m.path
 }
 
+// DelegateSubgroupPath returns the path of the cgroup the processes are put
+// in, which is the delegated subgroup of the unit cgroup if DelegateSubgroup
+// is set (see [cgroups.Cgroup.DelegateSubgroup]), and the unit cgroup (see
+// Path) otherwise.
+func (m *UnifiedManager) DelegateSubgroupPath() string {
+	if sub := m.cgroups.DelegateSubgroup; sub != "" {
+		return filepath.Join(m.path, sub)
+	}
+	return m.path
+}
+
 // getSliceFull value is used in initPath.
 // The value is incompatible with systemdDbus.PropSlice.
-func (m *UnifiedManager) getSliceFull() (string, error) {
+func (m *UnifiedManager) getSliceFull(ctx context.Context) (string, error) {
 	c := m.cgroups
 	slice := "system.slice"
 	if c.Rootless {
@@ -464,7 +750,7 @@ func (m *UnifiedManager) getSliceFull() (string, error) {
 
 	if c.Rootless {
 		// managerCG is typically "/user.slice/user-${uid}.slice/user@${uid}.service".
-		managerCG, err := getManagerProperty(m.dbus, "ControlGroup")
+		managerCG, err := getManagerProperty(ctx, m.dbus, "ControlGroup")
 		if err != nil {
 			return "", err
 		}
@@ -476,12 +762,12 @@ func (m *UnifiedManager) getSliceFull() (string, error) {
 	return slice, nil
 }
 
-func (m *UnifiedManager) initPath() error {
+func (m *UnifiedManager) initPath(ctx context.Context) error {
 	if m.path != "" {
 		return nil
 	}
 
-	sliceFull, err := m.getSliceFull()
+	sliceFull, err := m.getSliceFull(ctx)
 	if err != nil {
 		return err
 	}
@@ -501,11 +787,20 @@ func (m *UnifiedManager) initPath() error {
 }
 
 func (m *UnifiedManager) Freeze(state cgroups.FreezerState) error {
+	return m.FreezeContext(context.Background(), state)
+}
+
+// FreezeContext is like Freeze, but fails if ctx is already done. The
+// freezer is set using cgroupfs, which can't be interrupted.
+func (m *UnifiedManager) FreezeContext(ctx context.Context, state cgroups.FreezerState) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	return m.fsMgr.Freeze(state)
 }
 
 func (m *UnifiedManager) GetPids() ([]int, error) {
-	return cgroups.GetPids(m.path)
+	return cgroups.GetPids(m.DelegateSubgroupPath())
 }
 
 func (m *UnifiedManager) GetAllPids() ([]int, error) {
@@ -513,31 +808,85 @@ func (m *UnifiedManager) GetAllPids() ([]int, error) {
 }
 
 func (m *UnifiedManager) GetStats() (*cgroups.Stats, error) {
-	return m.fsMgr.GetStats()
+	return m.Stats(nil)
 }
 
-// Stats returns cgroup statistics for the specified controllers.
+// Stats returns cgroup statistics for the specified controllers. If the
+// statistics can't be queried from systemd, the ones read from cgroupfs
+// are returned together with the error.
 func (m *UnifiedManager) Stats(opts *cgroups.StatsOptions) (*cgroups.Stats, error) {
-	return m.fsMgr.Stats(opts)
+	return m.StatsContext(context.Background(), opts)
+}
+
+// StatsContext is like Stats, but the D-Bus calls to systemd are aborted
+// once ctx is done.
+func (m *UnifiedManager) StatsContext(ctx context.Context, opts *cgroups.StatsOptions) (*cgroups.Stats, error) {
+	stats, err := m.fsMgr.Stats(opts)
+	if err != nil {
+		return nil, err
+	}
+	controllers := cgroups.AllControllers
+	if opts != nil && opts.Controllers != 0 {
+		controllers = opts.Controllers
+	}
+	if wantIPStats(m.cgroups, controllers) {
+		stats.IPStats, err = getIPStats(ctx, m.dbus, getUnitName(m.cgroups))
+		if err != nil {
+			return stats, err
+		}
+	}
+	if controllers&cgroups.Unit != 0 {
+		stats.UnitStats, err = getUnitStats(ctx, m.dbus, m.cgroups)
+		if err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
 }
 
 func (m *UnifiedManager) Set(r *cgroups.Resources) error {
+	return m.SetContext(context.Background(), r)
+}
+
+// SetContext is like Set, but the D-Bus calls to systemd are aborted once
+// ctx is done (in which case the changes made are rolled back, as usual).
+func (m *UnifiedManager) SetContext(ctx context.Context, r *cgroups.Resources) error {
 	if r == nil {
 		return nil
 	}
+	m.setMu.Lock()
+	defer m.setMu.Unlock()
 	// Use a copy since CpuQuota in r may be modified.
 	rCopy := *r
 	r = &rCopy
-	properties, err := genV2ResourcesProperties(m.fsMgr.Path(""), r, m.dbus)
+	allProperties, err := genV2ResourcesProperties(m.fsMgr.Path(""), r, m.dbus)
 	if err != nil {
 		return err
 	}
+	properties := allProperties
+	if r.SkipUnchanged {
+		properties = changedProperties(m.appliedProps, allProperties)
+	}
 
-	if err := setUnitProperties(m.dbus, getUnitName(m.cgroups), properties...); err != nil {
-		return fmt.Errorf("unable to set unit properties: %w", err)
+	// Save the current property values so that both the unit and
+	// the cgroupfs can be reverted if any of the steps below fails.
+	unitName := getUnitName(m.cgroups)
+	var saved []systemdDbus.Property
+	if len(properties) > 0 {
+		saved, err = saveUnitProperties(ctx, m.dbus, unitName, properties)
+		if err != nil {
+			return err
+		}
+		if err := setUnitProperties(ctx, m.dbus, unitName, properties...); err != nil {
+			return setFailed(ctx, m.dbus, unitName, "unit properties", err, saved)
+		}
 	}
 
-	return m.fsMgr.Set(r)
+	if err := m.fsMgr.Set(r); err != nil {
+		return setFailed(ctx, m.dbus, unitName, "cgroupfs", err, saved)
+	}
+	m.appliedProps = allProperties
+	return nil
 }
 
 func (m *UnifiedManager) GetPaths() map[string]string {
@@ -554,8 +903,41 @@ func (m *UnifiedManager) GetFreezerState() (cgroups.FreezerState, error) {
 	return m.fsMgr.GetFreezerState()
 }
 
+// Exists reports whether the cgroup exists. If the unit is being watched
+// (see [UnifiedManager.Watch]), it also has to be not removed. Otherwise, the
+// state of the unit is not checked (see [UnifiedManager.UnitExists]).
 func (m *UnifiedManager) Exists() bool {
-	return cgroups.PathExists(m.path)
+	return !m.watch.removed() && cgroups.PathExists(m.path)
+}
+
+// UnitExists reports whether the systemd unit of the manager exists, and
+// is not being removed, by querying its state from systemd (so, unlike
+// Exists, whether or not it is being watched).
+func (m *UnifiedManager) UnitExists(ctx context.Context) (bool, error) {
+	return unitExists(ctx, m.dbus, getUnitName(m.cgroups))
+}
+
+// ManagedOOM returns the systemd-oomd settings of the unit of the manager,
+// and of its parent slice, as currently set in systemd (see
+// [cgroups.Resources.ManagedOOM] and [cgroups.Cgroup.ParentManagedOOM]).
+func (m *UnifiedManager) ManagedOOM() (unit, parent *cgroups.ManagedOOM, err error) {
+	return m.ManagedOOMContext(context.Background())
+}
+
+// ManagedOOMContext is like ManagedOOM, but the D-Bus calls to systemd are
+// aborted once ctx is done.
+func (m *UnifiedManager) ManagedOOMContext(ctx context.Context) (unit, parent *cgroups.ManagedOOM, err error) {
+	return managedOOM(ctx, m.dbus, m.cgroups)
+}
+
+// Watch tracks the state of the systemd unit of the manager, using the
+// systemd D-Bus signals, until ctx is done, and the returned channel is
+// closed. The first event sent is the current state of the unit, followed
+// by the changes of it, such as the unit failing, or being stopped (by
+// systemd or by someone else). The intermediate states of the unit may be
+// skipped, if they are short-lived.
+func (m *UnifiedManager) Watch(ctx context.Context) (<-chan UnitEvent, error) {
+	return m.watch.watch(ctx, m.dbus, getUnitName(m.cgroups))
 }
 
 func (m *UnifiedManager) OOMKillCount() (uint64, error) {
@@ -0,0 +1,309 @@
+package systemd
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	systemdDbus "github.com/coreos/go-systemd/v22/dbus"
+	dbus "github.com/godbus/dbus/v5"
+	"github.com/sirupsen/logrus"
+)
+
+// UnitEventType is the type of a [UnitEvent].
+type UnitEventType int
+
+const (
+	// UnitActive means the unit is active (running).
+	UnitActive UnitEventType = iota + 1
+	// UnitDeactivating means the unit is being stopped.
+	UnitDeactivating
+	// UnitFailed means the unit has failed (see [UnitEvent.Result]).
+	UnitFailed
+	// UnitRemoved means the unit has been stopped, and removed (or is
+	// going to be, being inactive).
+	UnitRemoved
+)
+
+func (t UnitEventType) String() string {
+	switch t {
+	case UnitActive:
+		return "active"
+	case UnitDeactivating:
+		return "deactivating"
+	case UnitFailed:
+		return "failed"
+	case UnitRemoved:
+		return "removed"
+	}
+	return "unknown"
+}
+
+// UnitEvent is a change of the state of the systemd unit of a manager.
+type UnitEvent struct {
+	Type UnitEventType
+	// Unit is the name of the unit.
+	Unit string
+	// ActiveState and SubState are the states of the unit, as reported
+	// by systemd.
+	ActiveState string
+	SubState    string
+	// Result is the result of the unit (such as "oom-kill" or "timeout"),
+	// set for UnitFailed.
+	Result string
+}
+
+// unitWatchers are the watchers of the units, by unit name, which are fed
+// the unit property changes (or nil, meaning the state has to be queried)
+// from the systemd signals.
+type unitWatchers struct {
+	mu    sync.Mutex
+	units map[string]map[chan map[string]dbus.Variant]struct{}
+	// stop stops the signal dispatching, which runs while there are
+	// watchers.
+	stop chan struct{}
+}
+
+// watchUnit registers a watcher of the unit name, returning the channel
+// it is fed the property changes of the unit from, and a function to
+// unregister it.
+func (d *DbusConnManager) watchUnit(name string) (<-chan map[string]dbus.Variant, func(), error) {
+	if d.dial == nil {
+		return nil, nil, errors.New("unable to watch systemd units without a dbus dial function")
+	}
+	w := &d.watchers
+	ch := make(chan map[string]dbus.Variant, 32)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.units == nil {
+		w.units = make(map[string]map[chan map[string]dbus.Variant]struct{})
+	}
+	if w.units[name] == nil {
+		w.units[name] = make(map[chan map[string]dbus.Variant]struct{})
+	}
+	w.units[name][ch] = struct{}{}
+	if w.stop == nil {
+		w.stop = make(chan struct{})
+		go d.dispatchUnitSignals(w.stop)
+	}
+
+	return ch, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		delete(w.units[name], ch)
+		if len(w.units[name]) == 0 {
+			delete(w.units, name)
+		}
+		if len(w.units) == 0 && w.stop != nil {
+			close(w.stop)
+			w.stop = nil
+		}
+	}, nil
+}
+
+// notify feeds the watchers of the unit name (or all the units, if name
+// is empty) with the changed properties.
+func (w *unitWatchers) notify(name string, changed map[string]dbus.Variant) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for unit, chs := range w.units {
+		if name != "" && unit != name {
+			continue
+		}
+		for ch := range chs {
+			select {
+			case ch <- changed:
+			default:
+				// The watcher is behind, so make it query the state
+				// instead of the dropped change (there is room for
+				// that, as only the dispatcher sends).
+				select {
+				case <-ch:
+				default:
+				}
+				ch <- nil
+			}
+		}
+	}
+}
+
+// dispatchUnitSignals subscribes to the unit property changes, and feeds
+// the unit watchers with them, until stop is closed.
+//
+// It uses a connection of its own, as the subscriber of a connection can't
+// be changed safely while signals are received, and re-establishes it if
+// it gets closed.
+func (d *DbusConnManager) dispatchUnitSignals(stop <-chan struct{}) {
+	var (
+		conn    *systemdDbus.Conn
+		updates = make(chan *systemdDbus.PropertiesUpdate, 64)
+		errs    = make(chan error, 1)
+		checkCh = time.Tick(time.Second)
+	)
+	for {
+		if conn == nil || !conn.Connected() {
+			if conn != nil {
+				conn.Close()
+			}
+			var err error
+			conn, err = d.newConnection(context.Background())
+			if err == nil {
+				conn.SetPropertiesSubscriber(updates, errs)
+				if err = conn.Subscribe(); err != nil {
+					conn.Close()
+				}
+			}
+			if err != nil {
+				conn = nil
+				logrus.Debugf("unable to subscribe to systemd signals (will retry): %v", err)
+			} else {
+				// Some changes may have been missed.
+				d.watchers.notify("", nil)
+			}
+		}
+
+		select {
+		case <-stop:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		case u := <-updates:
+			d.watchers.notify(u.UnitName, u.Changed)
+		case <-errs:
+			// An update was dropped.
+			d.watchers.notify("", nil)
+		case <-checkCh:
+		}
+	}
+}
+
+// unitEvent returns the event corresponding to the unit properties (which
+// are queried if not known).
+func unitEvent(ctx context.Context, cm *DbusConnManager, unitName string, props map[string]dbus.Variant) (UnitEvent, error) {
+	ev := UnitEvent{Unit: unitName}
+	if v, ok := props["ActiveState"]; ok {
+		ev.ActiveState, _ = v.Value().(string)
+		if v, ok := props["SubState"]; ok {
+			ev.SubState, _ = v.Value().(string)
+		}
+	} else {
+		var all map[string]any
+		err := cm.retryOnDisconnect(ctx, func(c *systemdDbus.Conn) (err error) {
+			all, err = c.GetUnitPropertiesContext(ctx, unitName)
+			return err
+		})
+		if err != nil {
+			if isDbusError(err, "org.freedesktop.systemd1.NoSuchUnit") {
+				ev.Type = UnitRemoved
+				return ev, nil
+			}
+			return ev, err
+		}
+		ev.ActiveState, _ = all["ActiveState"].(string)
+		ev.SubState, _ = all["SubState"].(string)
+		if loadState, _ := all["LoadState"].(string); loadState == "not-found" {
+			ev.Type = UnitRemoved
+			return ev, nil
+		}
+	}
+
+	switch ev.ActiveState {
+	case "active", "reloading", "refreshing":
+		ev.Type = UnitActive
+	case "deactivating":
+		ev.Type = UnitDeactivating
+	case "failed":
+		ev.Type = UnitFailed
+		// Slices have no result.
+		if prop, err := getUnitTypeProperty(ctx, cm, unitName, getUnitType(unitName), "Result"); err == nil {
+			ev.Result, _ = prop.Value.Value().(string)
+		}
+	case "inactive":
+		// Transient units are garbage-collected once inactive.
+		ev.Type = UnitRemoved
+	}
+	return ev, nil
+}
+
+// unitExists reports whether the unit unitName exists, that is, whether it
+// is loaded and not inactive (see [UnitRemoved]), querying its state.
+func unitExists(ctx context.Context, cm *DbusConnManager, unitName string) (bool, error) {
+	if ctx == nil {
+		return false, errors.New("nil context")
+	}
+	ev, err := unitEvent(ctx, cm, unitName, nil)
+	if err != nil {
+		return false, err
+	}
+	return ev.Type != UnitRemoved, nil
+}
+
+// unitWatch tracks the state of the unit of a manager while it is being
+// watched.
+type unitWatch struct {
+	mu       sync.Mutex
+	watching int
+	last     UnitEventType
+}
+
+// watch starts watching the unit unitName (see [UnifiedManager.Watch]).
+func (w *unitWatch) watch(ctx context.Context, cm *DbusConnManager, unitName string) (<-chan UnitEvent, error) {
+	if ctx == nil {
+		return nil, errors.New("nil context")
+	}
+	changes, cancel, err := cm.watchUnit(unitName)
+	if err != nil {
+		return nil, err
+	}
+	w.mu.Lock()
+	w.watching++
+	w.mu.Unlock()
+
+	events := make(chan UnitEvent)
+	go func() {
+		defer func() {
+			cancel()
+			w.mu.Lock()
+			if w.watching--; w.watching == 0 {
+				w.last = 0
+			}
+			w.mu.Unlock()
+			close(events)
+		}()
+
+		var last UnitEventType
+		var props map[string]dbus.Variant
+		for {
+			ev, err := unitEvent(ctx, cm, unitName, props)
+			if err != nil {
+				logrus.Debugf("unable to get the state of unit %s: %v", unitName, err)
+			} else if ev.Type != 0 && ev.Type != last {
+				last = ev.Type
+				w.mu.Lock()
+				w.last = last
+				w.mu.Unlock()
+				select {
+				case events <- ev:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case props = <-changes:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// removed reports whether the unit is being watched, and has been removed.
+func (w *unitWatch) removed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.watching > 0 && w.last == UnitRemoved
+}
@@ -0,0 +1,178 @@
+package cgroups
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Node is a cgroup in a tree returned by [Walk].
+type Node struct {
+	// Path is the absolute cgroupfs path of the cgroup.
+	Path string `json:"path"`
+	// Type is the cgroup type, as shown by cgroup.type (such as "domain"
+	// or "threaded"). It is empty for cgroup v1, and for the root cgroup.
+	Type string `json:"type,omitzero"`
+	// Controllers are the controllers enabled for the cgroup. For cgroup
+	// v1, these are the controllers of the hierarchy the cgroup is in.
+	Controllers []string `json:"controllers,omitzero"`
+	// Pids are the processes in the cgroup (not including its children).
+	Pids []int `json:"pids,omitzero"`
+	// Stats are the cgroup statistics, only set if requested.
+	Stats *Stats `json:"stats,omitzero"`
+	// Unit is the name of the systemd unit the cgroup belongs to, if it
+	// can be derived from the path (i.e. the path, or one of its parents,
+	// ends with a unit name such as "foo.service" or "user.slice").
+	Unit string `json:"unit,omitzero"`
+	// Children are the child cgroups, sorted by name.
+	Children []*Node `json:"children,omitzero"`
+}
+
+// WalkOptions are the options for [Walk].
+type WalkOptions struct {
+	// Stats, if set, is used to get the statistics of every cgroup,
+	// given its path and enabled controllers. See fs.Walk and fs2.Walk.
+	Stats func(path string, controllers []string) (*Stats, error)
+}
+
+// Walk returns the tree of cgroups rooted at path, which is either a cgroup
+// v2 cgroup, or a cgroup in a cgroup v1 hierarchy. Cgroups removed during
+// the walk (other than path itself) are silently skipped.
+func Walk(path string, opts *WalkOptions) (*Node, error) {
+	if opts == nil {
+		opts = &WalkOptions{}
+	}
+	var v1Controllers []string
+	if _, err := ReadFile(path, "cgroup.controllers"); err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		if v1Controllers, err = hierarchyControllers(path); err != nil {
+			return nil, err
+		}
+	}
+	w := &walker{opts: opts, v1Controllers: v1Controllers}
+	return w.walk(path, unitFromPath(filepath.Dir(path)))
+}
+
+type walker struct {
+	opts *WalkOptions
+	// v1Controllers are the controllers of the cgroup v1 hierarchy
+	// being walked, or nil for cgroup v2.
+	v1Controllers []string
+}
+
+func (w *walker) walk(path, parentUnit string) (*Node, error) {
+	node := &Node{
+		Path: path,
+		Unit: parentUnit,
+	}
+	if unit := unitFromName(filepath.Base(path)); unit != "" {
+		node.Unit = unit
+	}
+	if err := w.fill(node); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		childPath := filepath.Join(path, e.Name())
+		child, err := w.walk(childPath, node.Unit)
+		if err != nil {
+			// A descendant cgroup can be removed while we walk,
+			// in which case the error is ignored.
+			if ignoreCgroupRemoved(err) || !PathExists(childPath) {
+				continue
+			}
+			return nil, err
+		}
+		node.Children = append(node.Children, child)
+	}
+	return node, nil
+}
+
+// fill sets the node fields read from the cgroup files.
+func (w *walker) fill(node *Node) error {
+	var err error
+	if w.v1Controllers != nil {
+		node.Controllers = w.v1Controllers
+	} else {
+		var data string
+		if data, err = ReadFile(node.Path, "cgroup.controllers"); err != nil {
+			return err
+		}
+		node.Controllers = strings.Fields(data)
+		// The root cgroup has no cgroup.type.
+		if data, err = ReadFile(node.Path, "cgroup.type"); err == nil {
+			node.Type = strings.TrimSpace(data)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if node.Pids, err = readProcsFile(node.Path); err != nil {
+		return err
+	}
+	if w.opts.Stats != nil {
+		if node.Stats, err = w.opts.Stats(node.Path, node.Controllers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hierarchyControllers returns the controllers of the cgroup v1 hierarchy
+// path is in.
+func hierarchyControllers(path string) ([]string, error) {
+	// The mountpoints are the resolved paths, while path may be
+	// a symlink, such as /sys/fs/cgroup/cpu -> cpu,cpuacct.
+	path, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+	mounts, err := GetCgroupMounts(true)
+	if err != nil {
+		return nil, err
+	}
+	var found *Mount
+	for i, m := range mounts {
+		if !strings.HasPrefix(path+"/", m.Mountpoint+"/") {
+			continue
+		}
+		if found == nil || len(m.Mountpoint) > len(found.Mountpoint) {
+			found = &mounts[i]
+		}
+	}
+	if found == nil {
+		return nil, NewNotFoundError(path)
+	}
+	return found.Subsystems, nil
+}
+
+// unitFromPath returns the name of the systemd unit the cgroup path
+// belongs to, i.e. the last path element which is a unit name.
+func unitFromPath(path string) string {
+	for path != "/" && path != "." {
+		if unit := unitFromName(filepath.Base(path)); unit != "" {
+			return unit
+		}
+		path = filepath.Dir(path)
+	}
+	return ""
+}
+
+// unitFromName returns name if it is a name of a unit that can have
+// a cgroup, or an empty string otherwise.
+func unitFromName(name string) string {
+	for _, suffix := range []string{".slice", ".scope", ".service", ".socket", ".mount", ".swap"} {
+		if strings.HasSuffix(name, suffix) && len(name) > len(suffix) {
+			return name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,110 @@
+package cgroups
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWalk(t *testing.T) {
+	TestMode = true
+	root := filepath.Join(t.TempDir(), "system.slice")
+	for dir, files := range map[string]map[string]string{
+		"": {
+			"cgroup.controllers": "cpu memory pids",
+			"cgroup.type":        "domain",
+			"cgroup.procs":       "",
+		},
+		"foo.service": {
+			"cgroup.controllers": "memory pids",
+			"cgroup.type":        "domain",
+			"cgroup.procs":       "1\n2\n",
+		},
+		"foo.service/sub": {
+			"cgroup.controllers": "",
+			"cgroup.type":        "domain threaded",
+			"cgroup.procs":       "3\n",
+		},
+		// Emulates a cgroup being removed during the walk.
+		"gone.scope": {},
+	} {
+		path := filepath.Join(root, dir)
+		if err := os.MkdirAll(path, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		for file, data := range files {
+			if err := os.WriteFile(filepath.Join(path, file), []byte(data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	var statted []string
+	opts := &WalkOptions{
+		Stats: func(path string, controllers []string) (*Stats, error) {
+			if filepath.Base(path) == "gone.scope" {
+				if err := os.Remove(path); err != nil {
+					t.Fatal(err)
+				}
+			}
+			statted = append(statted, path)
+			return NewStats(), nil
+		},
+	}
+
+	tree, err := Walk(root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Don't compare stats.
+	for _, n := range []*Node{tree, tree.Children[0], tree.Children[0].Children[0]} {
+		if n.Stats == nil {
+			t.Errorf("%s: no stats", n.Path)
+		}
+		n.Stats = nil
+	}
+	want := &Node{
+		Path:        root,
+		Type:        "domain",
+		Controllers: []string{"cpu", "memory", "pids"},
+		Unit:        "system.slice",
+		Children: []*Node{{
+			Path:        filepath.Join(root, "foo.service"),
+			Type:        "domain",
+			Controllers: []string{"memory", "pids"},
+			Pids:        []int{1, 2},
+			Unit:        "foo.service",
+			Children: []*Node{{
+				Path:        filepath.Join(root, "foo.service/sub"),
+				Type:        "domain threaded",
+				Controllers: []string{},
+				Pids:        []int{3},
+				Unit:        "foo.service",
+			}},
+		}},
+	}
+	if !reflect.DeepEqual(tree, want) {
+		t.Errorf("expected %+v, got %+v", want, tree)
+	}
+}
+
+func TestHierarchyControllersSymlink(t *testing.T) {
+	if IsCgroup2UnifiedMode() {
+		t.Skip("requires cgroup v1")
+	}
+	mnt, err := FindCgroupMountpoint("", "pids")
+	if err != nil {
+		t.Skip("requires the pids controller")
+	}
+	link := filepath.Join(t.TempDir(), "pids")
+	if err := os.Symlink(mnt, link); err != nil {
+		t.Fatal(err)
+	}
+	controllers, err := hierarchyControllers(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(controllers, []string{"pids"}) {
+		t.Errorf("expected [pids], got %v", controllers)
+	}
+}